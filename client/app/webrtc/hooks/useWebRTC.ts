@@ -96,6 +96,12 @@ export const useWebRTC = (
                     if (data.type === 'room_info') {
                         setUsers(data.data.users || []);
                     }
+                    else if (data.type === 'participant_joined') {
+                        setUsers(prev => [...prev.filter(u => u !== data.data.username), data.data.username]);
+                    }
+                    else if (data.type === 'participant_left') {
+                        setUsers(prev => prev.filter(u => u !== data.data.username));
+                    }
                     else if (data.type === 'error') {
                         setError(data.data);
                     }
@@ -7,6 +7,8 @@ export class SignalingClient {
     private connectionTimeout: NodeJS.Timeout | null = null;
     private connectionPromise: Promise<void> | null = null;
     private resolveConnection: (() => void) | null = null;
+    // room_info arrives once on joining; later joins and leaves update it.
+    private users: string[] = [];
 
     public onRoomInfo: (data: RoomInfo) => void = () => {};
     public onOffer: (data: RTCSessionDescriptionInit) => void = () => {};
@@ -76,8 +78,17 @@ export class SignalingClient {
 
                 switch (message.type) {
                     case 'room_info':
+                        this.users = message.data.users || [];
                         this.onRoomInfo(message.data);
                         break;
+                    case 'participant_joined':
+                        this.users = [...this.users.filter(u => u !== message.data.username), message.data.username];
+                        this.onRoomInfo({ users: this.users });
+                        break;
+                    case 'participant_left':
+                        this.users = this.users.filter(u => u !== message.data.username);
+                        this.onRoomInfo({ users: this.users });
+                        break;
                     case 'error':
                         this.onError(message.data);
                         break;
@@ -5,6 +5,8 @@ export interface RoomInfo {
 
 export type SignalingMessage =
     | { type: 'room_info'; data: RoomInfo }
+    | { type: 'participant_joined'; data: { username: string } }
+    | { type: 'participant_left'; data: { username: string } }
     | { type: 'error'; data: string }
     | { type: 'offer'; sdp: RTCSessionDescriptionInit }
     | { type: 'answer'; sdp: RTCSessionDescriptionInit }
@@ -0,0 +1,47 @@
+package audiomix
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrOpusUnavailable is returned by NewOpusCodec when the server was built
+// without the "opus" build tag.
+var ErrOpusUnavailable = errors.New("audiomix: built without opus support (build with -tags opus)")
+
+// Codec turns packets into mono PCM at SampleRate and back. Implementations
+// keep per-stream state, so every source and listener gets its own Codec.
+type Codec interface {
+	// Decode decodes one packet into pcm and returns the number of samples.
+	Decode(packet []byte, pcm []int16) (int, error)
+	// Encode encodes one frame of pcm into packet and returns its length.
+	Encode(pcm []int16, packet []byte) (int, error)
+}
+
+// CodecFactory creates the Codec of a new source or listener.
+type CodecFactory func() (Codec, error)
+
+// pcmCodec carries raw little-endian 16 bit samples. It has no use on the
+// wire but lets the mixer be driven with synthetic audio.
+type pcmCodec struct{}
+
+// NewPCMCodec returns a Codec for raw little-endian 16 bit samples.
+func NewPCMCodec() (Codec, error) {
+	return pcmCodec{}, nil
+}
+
+func (pcmCodec) Decode(packet []byte, pcm []int16) (int, error) {
+	n := min(len(packet)/2, len(pcm))
+	for i := 0; i < n; i++ {
+		pcm[i] = int16(binary.LittleEndian.Uint16(packet[2*i:]))
+	}
+	return n, nil
+}
+
+func (pcmCodec) Encode(pcm []int16, packet []byte) (int, error) {
+	n := min(len(pcm), len(packet)/2)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint16(packet[2*i:], uint16(pcm[i]))
+	}
+	return 2 * n, nil
+}
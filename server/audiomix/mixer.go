@@ -0,0 +1,202 @@
+// Package audiomix is a server-side audio mixer (MCU). It decodes the audio
+// of every source, and for every listener mixes all sources except the
+// listener's own into a single encoded stream.
+package audiomix
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// SampleRate is the rate of the mono PCM the mixer works with.
+	SampleRate = 48000
+	// FrameDuration is the length of one mixed frame.
+	FrameDuration = 20 * time.Millisecond
+	// FrameSamples is the number of samples in one mixed frame.
+	FrameSamples = SampleRate / 50
+
+	// A source is mixed once it has primeSamples buffered, which absorbs
+	// network jitter; anything beyond maxBufferedSamples is dropped so a
+	// source can never drift behind the others.
+	primeSamples       = 2 * FrameSamples
+	maxBufferedSamples = 6 * FrameSamples
+
+	maxDecodedSamples = 120 * SampleRate / 1000 // longest Opus packet
+	maxPacketSize     = 2 * FrameSamples        // an uncompressed frame
+)
+
+type source struct {
+	codec   Codec
+	pcm     []int16 // decoded, not yet mixed
+	scratch []int16
+	primed  bool
+	frame   []int16 // contribution to the current mix
+}
+
+type listener struct {
+	codec  Codec
+	frame  []int16
+	packet []byte
+}
+
+// Mixer mixes N sources into N-1 mixes, one per listener. All methods are
+// safe for concurrent use.
+type Mixer struct {
+	newCodec CodecFactory
+
+	mu        sync.Mutex
+	sources   map[string]*source
+	listeners map[string]*listener
+	sum       []int32
+}
+
+// NewMixer returns a Mixer creating a Codec per source and listener with newCodec.
+func NewMixer(newCodec CodecFactory) *Mixer {
+	return &Mixer{
+		newCodec:  newCodec,
+		sources:   make(map[string]*source),
+		listeners: make(map[string]*listener),
+		sum:       make([]int32, FrameSamples),
+	}
+}
+
+// AddListener starts producing a mix for id.
+func (m *Mixer) AddListener(id string) error {
+	codec, err := m.newCodec()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners[id] = &listener{
+		codec:  codec,
+		frame:  make([]int16, FrameSamples),
+		packet: make([]byte, maxPacketSize),
+	}
+	return nil
+}
+
+// RemoveListener stops producing a mix for id.
+func (m *Mixer) RemoveListener(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.listeners, id)
+	if len(m.listeners) == 0 {
+		// Nobody will consume what is buffered.
+		m.sources = make(map[string]*source)
+	}
+}
+
+// Listeners returns the number of listeners.
+func (m *Mixer) Listeners() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.listeners)
+}
+
+// Write decodes one packet of source id. Packets are ignored while the
+// mixer has no listeners, so idle rooms cost no decoding.
+func (m *Mixer) Write(id string, packet []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.listeners) == 0 {
+		return nil
+	}
+	s, ok := m.sources[id]
+	if !ok {
+		codec, err := m.newCodec()
+		if err != nil {
+			return err
+		}
+		s = &source{
+			codec:   codec,
+			scratch: make([]int16, maxDecodedSamples),
+			frame:   make([]int16, FrameSamples),
+		}
+		m.sources[id] = s
+	}
+
+	n, err := s.codec.Decode(packet, s.scratch)
+	if err != nil {
+		return err
+	}
+	s.pcm = append(s.pcm, s.scratch[:n]...)
+	if over := len(s.pcm) - maxBufferedSamples; over > 0 {
+		s.pcm = s.pcm[over:]
+	}
+	return nil
+}
+
+// RemoveSource drops the audio of id.
+func (m *Mixer) RemoveSource(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sources, id)
+}
+
+// Mix consumes one frame of every source and returns the encoded mix of
+// every listener, keyed by listener id. Call it once per FrameDuration.
+func (m *Mixer) Mix() (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.sum {
+		m.sum[i] = 0
+	}
+	for _, s := range m.sources {
+		s.take()
+		for i, v := range s.frame {
+			m.sum[i] += int32(v)
+		}
+	}
+
+	out := make(map[string][]byte, len(m.listeners))
+	for id, l := range m.listeners {
+		own := m.sources[id]
+		for i, v := range m.sum {
+			if own != nil {
+				v -= int32(own.frame[i])
+			}
+			l.frame[i] = clip(v)
+		}
+		n, err := l.codec.Encode(l.frame, l.packet)
+		if err != nil {
+			return nil, err
+		}
+		out[id] = append([]byte(nil), l.packet[:n]...)
+	}
+	return out, nil
+}
+
+// take moves the next frame into s.frame, padding with silence when the
+// source has not delivered enough audio.
+func (s *source) take() {
+	if !s.primed && len(s.pcm) >= primeSamples {
+		s.primed = true
+	}
+	if !s.primed {
+		clear(s.frame)
+		return
+	}
+
+	n := copy(s.frame, s.pcm)
+	clear(s.frame[n:])
+	s.pcm = s.pcm[n:]
+	if n < FrameSamples {
+		s.primed = false
+	}
+}
+
+func clip(v int32) int16 {
+	switch {
+	case v > math.MaxInt16:
+		return math.MaxInt16
+	case v < math.MinInt16:
+		return math.MinInt16
+	}
+	return int16(v)
+}
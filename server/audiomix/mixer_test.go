@@ -0,0 +1,119 @@
+package audiomix
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// tone returns one frame of a sine wave encoded with the PCM codec.
+func tone(freq float64, amplitude int16, frame int) []byte {
+	b := make([]byte, 2*FrameSamples)
+	for i := 0; i < FrameSamples; i++ {
+		t := float64(frame*FrameSamples+i) / SampleRate
+		v := int16(float64(amplitude) * math.Sin(2*math.Pi*freq*t))
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(v))
+	}
+	return b
+}
+
+func decode(t *testing.T, packet []byte) []int16 {
+	t.Helper()
+	if len(packet) != 2*FrameSamples {
+		t.Fatalf("mixed frame has %d bytes, want %d", len(packet), 2*FrameSamples)
+	}
+	pcm := make([]int16, FrameSamples)
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(packet[2*i:]))
+	}
+	return pcm
+}
+
+func TestMixExcludesOwnSource(t *testing.T) {
+	m := NewMixer(NewPCMCodec)
+	for _, id := range []string{"alice", "bob", "carol"} {
+		if err := m.AddListener(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	freqs := map[string]float64{"alice": 440, "bob": 660, "carol": 880}
+	// Prime every source before the first mix.
+	for frame := 0; frame < 2; frame++ {
+		for id, f := range freqs {
+			if err := m.Write(id, tone(f, 8000, frame)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	mixes, err := m.Mix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mixes) != 3 {
+		t.Fatalf("got %d mixes, want 3", len(mixes))
+	}
+
+	src := make(map[string][]int16)
+	for id, f := range freqs {
+		src[id] = decode(t, tone(f, 8000, 0))
+	}
+	for listener, packet := range mixes {
+		got := decode(t, packet)
+		for i := range got {
+			var want int16
+			for id := range freqs {
+				if id != listener {
+					want += src[id][i]
+				}
+			}
+			if got[i] != want {
+				t.Fatalf("%s sample %d = %d, want %d", listener, i, got[i], want)
+			}
+		}
+	}
+}
+
+func TestMixClipsAndPadsSilence(t *testing.T) {
+	m := NewMixer(NewPCMCodec)
+	if err := m.AddListener("listener"); err != nil {
+		t.Fatal(err)
+	}
+
+	for frame := 0; frame < 2; frame++ {
+		for _, id := range []string{"a", "b"} {
+			if err := m.Write(id, tone(100, math.MaxInt16, frame)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for frame := 0; frame < 3; frame++ {
+		mixes, err := m.Mix()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pcm := decode(t, mixes["listener"])
+		peak := 0
+		for _, v := range pcm {
+			peak = max(peak, int(math.Abs(float64(v))))
+		}
+		switch {
+		case frame < 2 && peak < math.MaxInt16:
+			t.Fatalf("frame %d: peak %d, want a clipped %d", frame, peak, math.MaxInt16)
+		case frame == 2 && peak != 0:
+			t.Fatalf("frame %d: peak %d, want silence after the sources ran dry", frame, peak)
+		}
+	}
+}
+
+func TestWriteWithoutListenersIsIgnored(t *testing.T) {
+	m := NewMixer(NewPCMCodec)
+	if err := m.Write("a", tone(440, 1000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sources) != 0 {
+		t.Fatalf("mixer decoded audio without listeners")
+	}
+}
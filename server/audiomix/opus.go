@@ -0,0 +1,33 @@
+//go:build opus
+
+package audiomix
+
+import "gopkg.in/hraban/opus.v2"
+
+// opusCodec wraps libopus through cgo. Building it needs the libopus
+// headers (and libopusfile unless -tags nolibopusfile is added too).
+type opusCodec struct {
+	dec *opus.Decoder
+	enc *opus.Encoder
+}
+
+// NewOpusCodec returns a mono Opus codec at SampleRate.
+func NewOpusCodec() (Codec, error) {
+	dec, err := opus.NewDecoder(SampleRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := opus.NewEncoder(SampleRate, 1, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	return &opusCodec{dec: dec, enc: enc}, nil
+}
+
+func (c *opusCodec) Decode(packet []byte, pcm []int16) (int, error) {
+	return c.dec.Decode(packet, pcm)
+}
+
+func (c *opusCodec) Encode(pcm []int16, packet []byte) (int, error) {
+	return c.enc.Encode(pcm, packet)
+}
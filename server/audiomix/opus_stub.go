@@ -0,0 +1,9 @@
+//go:build !opus
+
+package audiomix
+
+// NewOpusCodec reports ErrOpusUnavailable; build with -tags opus to link
+// libopus.
+func NewOpusCodec() (Codec, error) {
+	return nil, ErrOpusUnavailable
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// joinDraining fills a room with n members whose clients discard what they
+// receive, and returns the room.
+func joinDraining(b *testing.B, room string, n int, compress bool) *Room {
+	b.Helper()
+	upgrader.EnableCompression = compress
+	b.Cleanup(func() { upgrader.EnableCompression = false })
+	url := startServer(b)
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = compress
+	for i := 0; i < n; i++ {
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { conn.Close() })
+		if err := conn.WriteJSON(map[string]string{"room": room, "username": fmt.Sprintf("user-%d", i)}); err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		r := rooms[room]
+		mu.Unlock()
+		if r != nil {
+			r.mu.Lock()
+			joined := len(r.peers)
+			r.mu.Unlock()
+			if joined == n {
+				return r
+			}
+		}
+		if time.Now().After(deadline) {
+			b.Fatalf("room %s never filled up", room)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitWritten waits until the writers of every member of room have taken
+// what was queued for them.
+func waitWritten(room *Room) {
+	for _, p := range room.peers {
+		for p.backlog() > 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+// offer is the size of a typical SDP offer relayed to a room.
+var offer = `{"type":"offer","sdp":{"type":"offer","sdp":"` + strings.Repeat(`a=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\n`, 50) + `"}}`
+
+// BenchmarkBroadcast measures one broadcast to a whole room: every path
+// encodes the message once, however many members and compression settings
+// the room has. perPeer is the old way, encoding once per member.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		for _, n := range []int{2, 10, 100} {
+			name := fmt.Sprintf("peers=%d", n)
+			if compress {
+				name += "/deflate"
+			}
+			room := joinDraining(b, "broadcast-"+strings.ReplaceAll(name, "/", "-"), n, compress)
+
+			b.Run(name+"/participant_updated", func(b *testing.B) {
+				b.ReportAllocs()
+				room.mu.Lock()
+				defer room.mu.Unlock()
+				info := participants(room)[0]
+				for i := 0; i < b.N; i++ {
+					broadcastRoom(room, "participant_updated", info)
+					waitWritten(room)
+				}
+			})
+			b.Run(name+"/relay", func(b *testing.B) {
+				b.ReportAllocs()
+				msg := []byte(offer)
+				room.mu.Lock()
+				defer room.mu.Unlock()
+				for i := 0; i < b.N; i++ {
+					relayToRoom(room, nil, msg)
+					waitWritten(room)
+				}
+			})
+			b.Run(name+"/perPeer", func(b *testing.B) {
+				b.ReportAllocs()
+				room.mu.Lock()
+				defer room.mu.Unlock()
+				info := participants(room)[0]
+				for i := 0; i < b.N; i++ {
+					for _, p := range room.peers {
+						p.writeJSON(map[string]interface{}{"type": "participant_updated", "data": info})
+					}
+					waitWritten(room)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	initialBitrate = 1_000_000
+	minBitrate     = 100_000
+	maxBitrate     = 10_000_000
+
+	// audioReserve is budgeted for an audio track before its rate is known;
+	// audio is never paused.
+	audioReserve = 64_000
+
+	// upgradeHeadroom keeps a subscriber from flapping between two layers
+	// when the estimate hovers around a layer's bitrate.
+	upgradeHeadroom = 1.1
+
+	allocationInterval = time.Second
+)
+
+// configureCongestionControl enables transport-wide congestion control on
+// Peer.pc. Subscribers report arrival times of the packets the server sends
+// (TWCC) and a send-side GCC estimator turns them into peer.bwe.
+func configureCongestionControl(peer *Peer, m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	controller, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBitrate),
+			gcc.SendSideBWEMinBitrate(minBitrate),
+			gcc.SendSideBWEMaxBitrate(maxBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return err
+	}
+	controller.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		peer.bwe = estimator
+	})
+	i.Add(controller)
+
+	// Must be added after the controller so outgoing packets carry the
+	// TWCC sequence number by the time the estimator sees them.
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return err
+	}
+	// Also give publishers TWCC feedback for what they send us.
+	return webrtc.ConfigureTWCCSender(m, i)
+}
+
+// rateMeter measures a bitrate over one second windows.
+type rateMeter struct {
+	mu          sync.Mutex
+	bytes       int
+	windowStart time.Time
+	rate        int
+}
+
+func (r *rateMeter) add(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.windowStart.IsZero() {
+		r.windowStart = now
+	}
+	if elapsed := now.Sub(r.windowStart); elapsed >= time.Second {
+		r.rate = int(float64(r.bytes*8) / elapsed.Seconds())
+		r.bytes = 0
+		r.windowStart = now
+	}
+	r.bytes += n
+}
+
+// bitrate returns bits per second, 0 when unknown or the stream stalled.
+func (r *rateMeter) bitrate() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.windowStart) > 2*time.Second {
+		return 0
+	}
+	return r.rate
+}
+
+// sortedLayers returns the layers of t from the highest to the lowest
+// measured bitrate.
+func (t *publishedTrack) sortedLayers() []*trackLayer {
+	layers := make([]*trackLayer, 0, len(t.layers))
+	for _, l := range t.layers {
+		layers = append(layers, l)
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		bi, bj := layers[i].bitrate.bitrate(), layers[j].bitrate.bitrate()
+		if bi != bj {
+			return bi > bj
+		}
+		return layers[i].rid > layers[j].rid
+	})
+	return layers
+}
+
+// lowestLayer returns the cheapest layer of t. Caller must hold t.mu.
+func (t *publishedTrack) lowestLayer() *trackLayer {
+	layers := t.sortedLayers()
+	if len(layers) == 0 {
+		return nil
+	}
+	return layers[len(layers)-1]
+}
+
+// layerFor picks the best layer of t that fits into budget, or nil when
+// even the lowest one does not.
+func (t *publishedTrack) layerFor(budget int, current *trackLayer) *trackLayer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	currentRate := 0
+	if current != nil {
+		currentRate = current.bitrate.bitrate()
+	}
+	for _, l := range t.sortedLayers() {
+		need := l.bitrate.bitrate()
+		if l != current && need > currentRate {
+			need = int(float64(need) * upgradeHeadroom)
+		}
+		if need <= budget {
+			return l
+		}
+	}
+	return nil
+}
+
+type bandwidthTrackState struct {
+	TrackID  string `json:"trackId"`
+	Username string `json:"username"`
+	Kind     string `json:"kind"`
+	Layer    string `json:"layer"`
+	Paused   bool   `json:"paused"`
+}
+
+type bandwidthState struct {
+	Estimate int                   `json:"estimate"`
+	Tracks   []bandwidthTrackState `json:"tracks"`
+}
+
+// runBandwidthAllocator periodically fits each subscriber's video into its
+// bandwidth estimate.
+func runBandwidthAllocator() {
+	ticker := time.NewTicker(allocationInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, room := range snapshotRooms() {
+			room.mu.Lock()
+			for _, p := range room.peers {
+				if p.sfu && p.bwe != nil {
+					allocateBandwidth(p)
+					updateQuality(p)
+				}
+			}
+			for _, link := range room.cascadesOut {
+				if link.bwe != nil {
+					allocateBandwidth(link)
+				}
+			}
+			room.mu.Unlock()
+		}
+	}
+}
+
+// allocateBandwidth reserves the estimate for audio first, then hands the
+// rest to video in priority order: each video track gets the best layer
+// that still fits and is paused when none does. Caller must hold room.mu.
+func allocateBandwidth(peer *Peer) {
+	estimate := peer.bwe.GetTargetBitrate()
+	budget := estimate
+
+	video := make([]*downTrack, 0, len(peer.downTracks))
+	for _, dt := range peer.downTracks {
+		if dt.source.kind != webrtc.RTPCodecTypeVideo {
+			dt.source.mu.RLock()
+			for _, l := range dt.source.layers {
+				budget -= max(l.bitrate.bitrate(), audioReserve)
+			}
+			dt.source.mu.RUnlock()
+			continue
+		}
+		video = append(video, dt)
+	}
+	sort.Slice(video, func(i, j int) bool {
+		if video[i].source.priority != video[j].source.priority {
+			return video[i].source.priority > video[j].source.priority
+		}
+		return video[i].source.id < video[j].source.id
+	})
+
+	changed := false
+	for _, dt := range video {
+		dt.mu.Lock()
+		current, selected := dt.target, dt.selected
+		dt.mu.Unlock()
+
+		if !selected {
+			// Left out by last-N, not by bandwidth.
+			if dt.setLayer(nil) {
+				changed = true
+			}
+			continue
+		}
+		layer := dt.source.layerFor(budget, current)
+		if layer != nil {
+			budget -= layer.bitrate.bitrate()
+		}
+		if dt.setLayer(layer) {
+			changed = true
+			if layer == nil {
+				log.Printf("Paused track %s for %s (estimate %d bps)", dt.source.id, peer.username, estimate)
+			}
+		}
+	}
+
+	if !changed || peer.cascadeNode != "" {
+		return
+	}
+	if err := peer.writeJSON(map[string]interface{}{
+		"type": "bandwidth_state",
+		"data": peer.bandwidthState(),
+	}); err != nil {
+		log.Printf("Error sending bandwidth state to %s: %v", peer.username, err)
+	}
+}
+
+// bandwidthState describes what peer currently receives. Caller must hold
+// the room's mu.
+func (p *Peer) bandwidthState() bandwidthState {
+	state := bandwidthState{Tracks: make([]bandwidthTrackState, 0, len(p.downTracks))}
+	if p.bwe != nil {
+		state.Estimate = p.bwe.GetTargetBitrate()
+	}
+	for _, dt := range p.downTracks {
+		dt.mu.Lock()
+		ts := bandwidthTrackState{
+			TrackID:  dt.source.id,
+			Username: dt.source.owner.username,
+			Kind:     dt.source.kind.String(),
+			Paused:   dt.paused,
+		}
+		if dt.target != nil {
+			ts.Layer = dt.target.rid
+		}
+		dt.mu.Unlock()
+		state.Tracks = append(state.Tracks, ts)
+	}
+	sort.Slice(state.Tracks, func(i, j int) bool {
+		return state.Tracks[i].TrackID < state.Tracks[j].TrackID
+	})
+	return state
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v3"
+)
+
+// fixedEstimate is a bandwidth estimate the test sets.
+type fixedEstimate struct {
+	cc.BandwidthEstimator
+	bitrate int
+}
+
+func (e *fixedEstimate) GetTargetBitrate() int { return e.bitrate }
+
+// TestAllocateBandwidth fits the video of four publishers into a changing
+// estimate and checks the layer each one gets, and that bandwidth_state
+// is only sent when that changes.
+func TestAllocateBandwidth(t *testing.T) {
+	estimate := &fixedEstimate{}
+	sub := &Peer{username: "erin", downTracks: make(map[string]*downTrack), bwe: estimate}
+	sub.startWriting()
+
+	publish := func(owner string, kind webrtc.RTPCodecType, priority int, selected bool, rates map[string]int) {
+		track := &publishedTrack{
+			id:       owner + "-" + kind.String(),
+			kind:     kind,
+			owner:    &Peer{username: owner},
+			priority: priority,
+			layers:   make(map[string]*trackLayer),
+		}
+		for rid, rate := range rates {
+			l := &trackLayer{track: track, rid: rid}
+			l.bitrate.windowStart, l.bitrate.rate = time.Now(), rate
+			// Nobody is there to ask for keyframes.
+			l.keyframes.layer, l.keyframes.last = l, time.Now().Add(time.Hour)
+			track.layers[rid] = l
+		}
+		sub.downTracks[track.id] = &downTrack{source: track, subscriber: sub, selected: selected}
+	}
+	publish("alice", webrtc.RTPCodecTypeAudio, 0, true, map[string]int{"": 0}) // reserves audioReserve
+	publish("alice", webrtc.RTPCodecTypeVideo, 0, true, map[string]int{"h": 1_500_000, "m": 500_000, "l": 150_000})
+	publish("bob", webrtc.RTPCodecTypeVideo, 1, true, map[string]int{"h": 1_000_000, "l": 200_000})
+	publish("carol", webrtc.RTPCodecTypeVideo, 0, true, map[string]int{"": 300_000})
+	publish("dave", webrtc.RTPCodecTypeVideo, 0, false, map[string]int{"": 100_000}) // left out by last-N
+
+	for _, step := range []struct {
+		estimate int
+		layers   map[string]string // key: owner, absent when paused
+		sent     bool
+	}{
+		{5_000_000, map[string]string{"alice": "h", "bob": "h", "carol": ""}, true},
+		{5_000_000, map[string]string{"alice": "h", "bob": "h", "carol": ""}, false},
+		// bob's video has priority.
+		{1_500_000, map[string]string{"alice": "l", "bob": "h"}, true},
+		{300_000, map[string]string{"bob": "l"}, true},
+		{100_000, map[string]string{}, true},
+		{1_500_000, map[string]string{"alice": "l", "bob": "h"}, true},
+		// carol fits, but not with the headroom an upgrade needs.
+		{1_520_000, map[string]string{"alice": "l", "bob": "h"}, false},
+		{1_550_000, map[string]string{"alice": "l", "bob": "h", "carol": ""}, true},
+		// Staying on a layer needs no headroom.
+		{1_530_000, map[string]string{"alice": "l", "bob": "h", "carol": ""}, false},
+	} {
+		estimate.bitrate = step.estimate
+		allocateBandwidth(sub)
+
+		for _, dt := range sub.downTracks {
+			if dt.source.kind != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+			want, forwarded := step.layers[dt.source.owner.username]
+			dt.mu.Lock()
+			target, paused := dt.target, dt.paused
+			dt.mu.Unlock()
+			if paused == forwarded || forwarded && target.rid != want {
+				t.Errorf("at %d bps: %s gets %+v, want layer %q (forwarded %v)", step.estimate, dt.source.id, target, want, forwarded)
+			}
+		}
+
+		var states []bandwidthState
+		for len(sub.send) > 0 {
+			var m struct {
+				Type string         `json:"type"`
+				Data bandwidthState `json:"data"`
+			}
+			if err := json.Unmarshal((<-sub.send).data, &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Type == "bandwidth_state" {
+				states = append(states, m.Data)
+			}
+		}
+		if want := map[bool]int{true: 1}[step.sent]; len(states) != want {
+			t.Errorf("at %d bps: %d bandwidth_state sent, want %d", step.estimate, len(states), want)
+		}
+		if len(states) == 1 && (states[0].Estimate != step.estimate || len(states[0].Tracks) != len(sub.downTracks)) {
+			t.Errorf("at %d bps: bandwidth_state %+v", step.estimate, states[0])
+		}
+	}
+}
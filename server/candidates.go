@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// ICE candidates. Candidates participants trickle to each other or list in
+// their descriptions reveal their private and public addresses. The server
+// parses them to count them per session, to keep those the room does not
+// want from other participants (-ice-drop, relay-only rooms), and to log
+// them without the addresses (-redact-addresses).
+
+// iceCandidate is a parsed candidate attribute (RFC 8839).
+type iceCandidate struct {
+	Protocol       string // udp or tcp
+	Address        string // an IP address, or an mDNS name ending in .local
+	Port           string
+	Type           string // host, srflx, prflx or relay
+	RelatedAddress string
+	TCPType        string // active, passive or so, for tcp
+}
+
+// candidateFilterKeys are the words -ice-drop accepts.
+var candidateFilterKeys = []string{"host", "srflx", "prflx", "relay", "udp", "tcp", "ipv4", "ipv6", "mdns"}
+
+// iceDropList is -ice-drop, split.
+var iceDropList []string
+
+func checkICEFilter() {
+	iceDropList = splitList(strings.ToLower(*iceDrop))
+	for _, key := range iceDropList {
+		if !slices.Contains(candidateFilterKeys, key) {
+			log.Fatalf("Invalid -ice-drop %q: must be among %s", key, strings.Join(candidateFilterKeys, ", "))
+		}
+	}
+}
+
+// parseCandidate parses the value of a candidate attribute, with or without
+// its "candidate:" prefix.
+func parseCandidate(s string) (iceCandidate, error) {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimPrefix(s, "a="), "candidate:"))
+	if len(fields) < 8 || fields[6] != "typ" {
+		return iceCandidate{}, fmt.Errorf("invalid candidate %q", s)
+	}
+	c := iceCandidate{
+		Protocol: strings.ToLower(fields[2]),
+		Address:  fields[4],
+		Port:     fields[5],
+		Type:     fields[7],
+	}
+	switch c.Type {
+	case "host", "srflx", "prflx", "relay":
+	default:
+		return iceCandidate{}, fmt.Errorf("invalid candidate type %q", c.Type)
+	}
+	for i := 8; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "raddr":
+			c.RelatedAddress = fields[i+1]
+		case "tcptype":
+			c.TCPType = fields[i+1]
+		}
+	}
+	return c, nil
+}
+
+// family returns ipv4, ipv6 or mdns, or an empty string for other
+// hostnames.
+func (c iceCandidate) family() string {
+	if ip := net.ParseIP(c.Address); ip != nil {
+		if ip.To4() != nil {
+			return "ipv4"
+		}
+		return "ipv6"
+	}
+	if strings.HasSuffix(strings.ToLower(c.Address), ".local") {
+		return "mdns"
+	}
+	return ""
+}
+
+// dropCandidate reports whether c must not reach the other members of
+// room. Caller must hold room.mu.
+func dropCandidate(room *Room, c iceCandidate) bool {
+	if room.relayOnly && c.Type != "relay" {
+		return true
+	}
+	for _, key := range iceDropList {
+		if key == c.Type || key == c.Protocol || key == c.family() {
+			return true
+		}
+	}
+	return false
+}
+
+// filtersCandidates reports whether room drops any candidate. Caller must
+// hold room.mu.
+func filtersCandidates(room *Room) bool {
+	return room.relayOnly || len(iceDropList) > 0
+}
+
+// hideRelatedAddress returns the candidate attribute s with its related
+// address and port, which are the local address behind a reflexive or relay
+// candidate, replaced with "0.0.0.0 0" as for candidates gathered behind a
+// privacy policy (RFC 8839). It reports whether it changed anything.
+func hideRelatedAddress(s string) (string, bool) {
+	fields := strings.Fields(s)
+	changed := false
+	for i := 8; i+1 < len(fields); i += 2 {
+		switch {
+		case fields[i] == "raddr" && fields[i+1] != "0.0.0.0":
+			fields[i+1] = "0.0.0.0"
+		case fields[i] == "rport" && fields[i+1] != "0":
+			fields[i+1] = "0"
+		default:
+			continue
+		}
+		changed = true
+	}
+	if !changed {
+		return s, false
+	}
+	return strings.Join(fields, " "), true
+}
+
+// candidateStats counts the candidates a participant sent, to other
+// participants or to the SFU.
+type candidateStats struct {
+	Host    int `json:"host"`
+	Srflx   int `json:"srflx"`
+	Prflx   int `json:"prflx"`
+	Relay   int `json:"relay"`
+	UDP     int `json:"udp"`
+	TCP     int `json:"tcp"`
+	IPv4    int `json:"ipv4"`
+	IPv6    int `json:"ipv6"`
+	MDNS    int `json:"mdns"`
+	Dropped int `json:"dropped"` // kept from the other participants
+	Invalid int `json:"invalid"`
+}
+
+func (s *candidateStats) count(c iceCandidate) {
+	switch c.Type {
+	case "host":
+		s.Host++
+	case "srflx":
+		s.Srflx++
+	case "prflx":
+		s.Prflx++
+	case "relay":
+		s.Relay++
+	}
+	switch c.Protocol {
+	case "udp":
+		s.UDP++
+	case "tcp":
+		s.TCP++
+	}
+	switch c.family() {
+	case "ipv4":
+		s.IPv4++
+	case "ipv6":
+		s.IPv6++
+	case "mdns":
+		s.MDNS++
+	}
+}
+
+func (s candidateStats) String() string {
+	return fmt.Sprintf("%d host, %d srflx, %d prflx, %d relay (%d udp, %d tcp; %d ipv4, %d ipv6, %d mdns), %d dropped, %d invalid",
+		s.Host, s.Srflx, s.Prflx, s.Relay, s.UDP, s.TCP, s.IPv4, s.IPv6, s.MDNS, s.Dropped, s.Invalid)
+}
+
+// inspectCandidate counts and logs the candidate in m, which peer sent as
+// msg to relay to the room. It returns the message to relay, without the
+// related address in rooms that filter candidates, or false when the room
+// may not see the candidate. Caller must hold room.mu.
+func inspectCandidate(peer *Peer, msg []byte, m *signalMessage) ([]byte, bool) {
+	if m.ICE.Candidate == "" {
+		log.Printf("ICE from %s: %s (end of candidates)", peer.username, m.iceString())
+		return msg, true
+	}
+	c, err := parseCandidate(m.ICE.Candidate)
+	if err != nil {
+		peer.candidates.Invalid++
+		log.Printf("Invalid ICE candidate from %s: %s", peer.username, m.iceString())
+		// What cannot be parsed cannot be checked either.
+		return msg, !filtersCandidates(peer.joined)
+	}
+	peer.candidates.count(c)
+	if dropCandidate(peer.joined, c) {
+		peer.candidates.Dropped++
+		log.Printf("ICE from %s dropped: %s", peer.username, m.iceString())
+		return nil, false
+	}
+	log.Printf("ICE from %s: %s", peer.username, m.iceString())
+	if !filtersCandidates(peer.joined) {
+		return msg, true
+	}
+	hidden, changed := hideRelatedAddress(m.ICE.Candidate)
+	if !changed {
+		return msg, true
+	}
+	rewritten, err := replaceCandidate(msg, m, hidden)
+	if err != nil {
+		log.Printf("Error hiding the related address of ICE from %s: %v", peer.username, err)
+		return nil, false
+	}
+	return rewritten, true
+}
+
+// replaceCandidate returns msg, the message m was decoded from, with its
+// candidate attribute replaced by candidate, and updates m to match. Other
+// fields of the candidate are kept as they were sent.
+func replaceCandidate(msg []byte, m *signalMessage, candidate string) ([]byte, error) {
+	var fields, ice map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(fields["ice"], &ice); err != nil {
+		return nil, err
+	}
+	m.ICE.Candidate = candidate
+	var err error
+	if ice["candidate"], err = json.Marshal(candidate); err != nil {
+		return nil, err
+	}
+	if fields["ice"], err = json.Marshal(ice); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// filterSDPCandidates counts the candidates of d, which peer relays to the
+// room, and removes those the room may not see. It reports false when the
+// description is refused because it cannot be checked. Caller must hold
+// room.mu.
+func filterSDPCandidates(peer *Peer, d *description) bool {
+	if d.typ == "rollback" {
+		return true
+	}
+	if d.parsed == nil {
+		if filtersCandidates(peer.joined) {
+			log.Printf("SDP %s from %s refused, its candidates cannot be checked: %v", d.typ, peer.username, d.err)
+			sendError(peer, "sdp_rejected", "Description refused: it does not parse")
+			return false
+		}
+		return true
+	}
+
+	desc := d.parsed
+	dropped := false
+	for _, md := range desc.MediaDescriptions {
+		sectionDropped := false
+		md.Attributes = slices.DeleteFunc(md.Attributes, func(a sdp.Attribute) bool {
+			if a.Key != "candidate" {
+				return false
+			}
+			c, err := parseCandidate(a.Value)
+			if err != nil {
+				peer.candidates.Invalid++
+				if !filtersCandidates(peer.joined) {
+					return false
+				}
+				sectionDropped = true
+				return true
+			}
+			peer.candidates.count(c)
+			if dropCandidate(peer.joined, c) {
+				peer.candidates.Dropped++
+				sectionDropped = true
+				return true
+			}
+			return false
+		})
+		if filtersCandidates(peer.joined) {
+			for i, a := range md.Attributes {
+				if a.Key != "candidate" {
+					continue
+				}
+				if v, changed := hideRelatedAddress(a.Value); changed {
+					md.Attributes[i].Value = v
+					d.changed = true
+				}
+			}
+		}
+		if sectionDropped {
+			// The default address is one of the candidates; what is left
+			// is reached through ICE alone.
+			hideDefaultAddress(md)
+			dropped = true
+		}
+	}
+	if dropped {
+		if desc.ConnectionInformation != nil && desc.ConnectionInformation.Address != nil {
+			desc.ConnectionInformation.Address.Address = unspecifiedAddress(desc.ConnectionInformation.AddressType)
+		}
+		d.changed = true
+		log.Printf("Candidates dropped from SDP %s of %s", d.typ, peer.username)
+	}
+	return true
+}
+
+// hideDefaultAddress replaces the default candidate of a section with the
+// placeholder of a section whose candidates are trickled (RFC 8840).
+func hideDefaultAddress(md *sdp.MediaDescription) {
+	if md.MediaName.Port.Value != 0 {
+		md.MediaName.Port.Value = 9
+	}
+	if ci := md.ConnectionInformation; ci != nil && ci.Address != nil {
+		ci.Address.Address = unspecifiedAddress(ci.AddressType)
+	}
+	for i, a := range md.Attributes {
+		if a.Key == "rtcp" {
+			md.Attributes[i].Value = "9 IN IP4 0.0.0.0"
+		}
+	}
+}
+
+func unspecifiedAddress(addressType string) string {
+	if addressType == "IP6" {
+		return "::"
+	}
+	return "0.0.0.0"
+}
+
+// redactIP hides the host part of an IP address: the last byte of IPv4,
+// all but the first 48 bits of IPv6. Anything else, such as an mDNS name,
+// is returned as is.
+func redactIP(s string) string {
+	ip := net.ParseIP(strings.Trim(s, "[]"))
+	if ip == nil || ip.IsUnspecified() {
+		return s
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.x", v4[0], v4[1], v4[2])
+	}
+	return strings.TrimSuffix(ip.Mask(net.CIDRMask(48, 128)).String(), "::") + "::x"
+}
+
+// logAddr returns addr, an IP address with or without a port, as it may be
+// logged.
+func logAddr(addr string) string {
+	if !*redactAddresses {
+		return addr
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(redactIP(host), port)
+	}
+	return redactIP(addr)
+}
+
+// redactSDPLine returns a candidate or any other SDP line as it may be logged,
+// with the addresses in it redacted.
+func redactSDPLine(line string) string {
+	if !*redactAddresses {
+		return line
+	}
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		fields[i] = redactIP(f)
+	}
+	return strings.Join(fields, " ")
+}
+
+// redactSDP returns a description as it may be logged.
+func redactSDP(raw string) string {
+	if !*redactAddresses {
+		return raw
+	}
+	lines := strings.Split(raw, "\n")
+	for i, l := range lines {
+		lines[i] = redactSDPLine(strings.TrimSuffix(l, "\r"))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"server/store"
+)
+
+func TestParseCandidate(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		want    iceCandidate
+		family  string
+		invalid bool
+	}{
+		{
+			raw:    "candidate:3214951410 1 udp 2122260223 192.168.1.20 54321 typ host generation 0 ufrag Wm4b network-id 1",
+			want:   iceCandidate{Protocol: "udp", Address: "192.168.1.20", Port: "54321", Type: "host"},
+			family: "ipv4",
+		},
+		{
+			raw:    "candidate:842163049 1 udp 1677729535 203.0.113.7 61002 typ srflx raddr 192.168.1.20 rport 54321 generation 0",
+			want:   iceCandidate{Protocol: "udp", Address: "203.0.113.7", Port: "61002", Type: "srflx", RelatedAddress: "192.168.1.20"},
+			family: "ipv4",
+		},
+		{
+			raw:    "candidate:1 1 TCP 1518280447 2001:db8:85a3::8a2e:370:7334 9 typ host tcptype active",
+			want:   iceCandidate{Protocol: "tcp", Address: "2001:db8:85a3::8a2e:370:7334", Port: "9", Type: "host", TCPType: "active"},
+			family: "ipv6",
+		},
+		{
+			raw:    "a=candidate:2 1 udp 2122262783 5f3c1d2e-8a9b-4c7d-9e0f-123456789abc.local 50123 typ host",
+			want:   iceCandidate{Protocol: "udp", Address: "5f3c1d2e-8a9b-4c7d-9e0f-123456789abc.local", Port: "50123", Type: "host"},
+			family: "mdns",
+		},
+		{
+			raw:    "4 1 udp 41885439 198.51.100.4 3478 typ relay raddr 203.0.113.7 rport 61002",
+			want:   iceCandidate{Protocol: "udp", Address: "198.51.100.4", Port: "3478", Type: "relay", RelatedAddress: "203.0.113.7"},
+			family: "ipv4",
+		},
+		{raw: "candidate:1 1 udp 1 10.0.0.1 9 typ bogus", invalid: true},
+		{raw: "candidate:1 1 udp 1 10.0.0.1", invalid: true},
+		{raw: "", invalid: true},
+	} {
+		c, err := parseCandidate(tt.raw)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%q parsed as %+v", tt.raw, c)
+			}
+			continue
+		}
+		if err != nil || c != tt.want || c.family() != tt.family {
+			t.Errorf("%q = %+v (%s), %v; want %+v (%s)", tt.raw, c, c.family(), err, tt.want, tt.family)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for in, want := range map[string]string{
+		"203.0.113.7":                  "203.0.113.x",
+		"2001:db8:85a3::8a2e:370:7334": "2001:db8:85a3::x",
+		"[2001:db8::1]":                "2001:db8::x",
+		"0.0.0.0":                      "0.0.0.0",
+		"abc.local":                    "abc.local",
+	} {
+		if got := redactIP(in); got != want {
+			t.Errorf("redactIP(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := logAddr("[2001:db8:85a3::1]:443"); got != "[2001:db8:85a3::x]:443" {
+		t.Errorf("logAddr = %q", got)
+	}
+	line := "candidate:842163049 1 udp 1677729535 203.0.113.7 61002 typ srflx raddr 192.168.1.20 rport 54321"
+	if got := redactSDPLine(line); got != "candidate:842163049 1 udp 1677729535 203.0.113.x 61002 typ srflx raddr 192.168.1.x rport 54321" {
+		t.Errorf("redactSDPLine = %q", got)
+	}
+}
+
+func TestCandidateFilter(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "relay-only", "alice")
+	readUntil(t, alice, `"room_info"`)
+	bob := dial(t, url, "relay-only", "bob")
+	readUntil(t, bob, `"room_info"`)
+
+	send := func(conn *websocket.Conn, v interface{}) {
+		t.Helper()
+		if err := conn.WriteJSON(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	candidate := func(c string) map[string]interface{} {
+		return map[string]interface{}{
+			"type": "ice_candidate",
+			"ice":  map[string]interface{}{"candidate": c, "sdpMid": "0", "sdpMLineIndex": 0},
+		}
+	}
+	host := "candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host"
+	relay := "candidate:4 1 udp 41885439 198.51.100.4 3478 typ relay raddr 203.0.113.7 rport 61002"
+
+	// alice owns the room, having joined first.
+	send(alice, map[string]interface{}{"type": "room_settings", "data": map[string]bool{"relayOnly": true}})
+	readUntil(t, bob, `"relayOnly":true`)
+
+	// No address of alice's reaches bob: neither her host candidate nor the
+	// related address of her relay candidate, which is her public one.
+	leaks := func(s string) bool {
+		return strings.Contains(s, "192.168.1.20") || strings.Contains(s, "203.0.113.7") ||
+			strings.Contains(s, "54321") || strings.Contains(s, "61002")
+	}
+	send(alice, candidate(host))
+	send(alice, candidate(relay))
+	msg := readUntil(t, bob, `"ice_candidate"`)
+	if !strings.Contains(string(msg), "typ relay raddr 0.0.0.0 rport 0") || !strings.Contains(string(msg), `"sdpMid":"0"`) || leaks(string(msg)) {
+		t.Errorf("relayed candidate: %s", msg)
+	}
+
+	// A description keeps its relay candidate only, and no address.
+	raw := strings.Replace(browserOffer, "a=mid:0\r\n", "a=mid:0\r\na="+host+"\r\na="+relay+"\r\n", 1)
+	raw = strings.Replace(raw, "m=audio 9 ", "m=audio 54321 ", 1)
+	raw = strings.Replace(raw, "c=IN IP4 0.0.0.0\r\n", "c=IN IP4 192.168.1.20\r\n", 1)
+	send(alice, map[string]interface{}{"type": "offer", "sdp": map[string]string{"type": "offer", "sdp": raw}})
+	var offer struct {
+		SDP struct {
+			SDP string `json:"sdp"`
+		} `json:"sdp"`
+	}
+	if err := json.Unmarshal(readUntil(t, bob, `"offer"`), &offer); err != nil {
+		t.Fatal(err)
+	}
+	if got := offer.SDP.SDP; leaks(got) || !strings.Contains(got, "typ relay raddr 0.0.0.0 rport 0") || !strings.Contains(got, "m=audio 9 ") {
+		t.Errorf("relayed description:\n%s", got)
+	}
+	if err := roundTrip(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := roomPeer(t, "relay-only", "alice")
+	peer.joined.mu.Lock()
+	stats := peer.candidates
+	peer.joined.mu.Unlock()
+	if want := (candidateStats{Host: 2, Relay: 2, UDP: 4, IPv4: 4, Dropped: 2}); stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+}
+
+func TestRelayOnlyDefault(t *testing.T) {
+	saved := *iceRelayOnly
+	*iceRelayOnly = true
+	t.Cleanup(func() { *iceRelayOnly = saved })
+
+	// Settings saved without relayOnly, such as before it existed, leave the
+	// room to -ice-relay-only.
+	if err := roomStore.SaveSettings("relay-default", store.RoomSettings{LastN: 2}); err != nil {
+		t.Fatal(err)
+	}
+	url := startServer(t)
+	alice := dial(t, url, "relay-default", "alice")
+	readUntil(t, alice, `"room_info"`)
+	peer := roomPeer(t, "relay-default", "alice")
+	peer.joined.mu.Lock()
+	relayOnly, lastN := peer.joined.relayOnly, peer.joined.lastN
+	peer.joined.mu.Unlock()
+	if !relayOnly || lastN != 2 {
+		t.Errorf("relayOnly %v, lastN %d; want true, 2", relayOnly, lastN)
+	}
+
+	// Changing another setting does not pin the default either.
+	if err := alice.WriteJSON(map[string]interface{}{"type": "room_settings", "data": map[string]int{"lastN": 3}}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, alice, `"lastN":3`)
+	if s, _, _ := roomStore.Settings("relay-default"); s.RelayOnly != nil {
+		t.Errorf("relayOnly saved as %v", *s.RelayOnly)
+	}
+}
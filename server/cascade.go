@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// SFU cascading. When members of a room are connected to different nodes,
+// a node with publishers in the room opens an outbound PeerConnection to
+// every other node hosting members of it and sends each local track over
+// it once. The receiving node republishes those tracks to its own
+// subscribers through stand-in peers for their publishers. Only tracks of
+// local publishers are cascaded, so media crosses at most one inter-node
+// link. Each direction has its own PeerConnection offered by the sending
+// node, which rules out offer glare between nodes.
+
+// cascadeSignal is the payload of "cascade" cluster messages, addressed to
+// the channel of one node.
+type cascadeSignal struct {
+	Room      string                     `json:"room"`
+	Outbound  bool                       `json:"outbound"` // from the sending side of the link
+	SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Tracks    []sfuTrackInfo             `json:"tracks,omitempty"`
+	Close     bool                       `json:"close,omitempty"`
+}
+
+// cascadeIn receives the tracks another node cascades into a room.
+type cascadeIn struct {
+	node    string
+	link    *Peer             // owns the PeerConnection
+	owners  map[string]string // key: track ID, value: publisher username
+	proxies map[string]*Peer  // key: username, stand-ins owning the republished tracks
+}
+
+func nodeChannel(node string) string {
+	return "node:" + node
+}
+
+func sendCascade(node string, sig cascadeSignal) {
+	data, err := json.Marshal(sig)
+	if err != nil {
+		log.Printf("Error encoding cascade signal: %v", err)
+		return
+	}
+	publishCluster(nodeChannel(node), clusterMessage{Kind: "cascade", Room: sig.Room, Payload: data})
+}
+
+// updateCascades opens and closes the cascade links of room to match the
+// nodes its members are on, and renegotiates the outbound ones. Caller
+// must hold room.mu.
+func updateCascades(room *Room) {
+	if broker == nil {
+		return
+	}
+	nodes := make(map[string]bool)
+	for _, r := range room.remote {
+		nodes[r.node] = true
+	}
+	local := false
+	for _, t := range room.tracks {
+		if t.owner.origin == "" {
+			local = true
+			break
+		}
+	}
+
+	for node, link := range room.cascadesOut {
+		if !nodes[node] || !local {
+			closeCascadeOut(room, link)
+		}
+	}
+	for node, in := range room.cascadesIn {
+		if !nodes[node] {
+			closeCascadeIn(room, in)
+		}
+	}
+	if local {
+		for node := range nodes {
+			if room.cascadesOut[node] == nil {
+				openCascadeOut(room, node)
+			}
+		}
+	}
+	for _, link := range room.cascadesOut {
+		negotiate(room, link)
+	}
+}
+
+// openCascadeOut creates the link sending local tracks of room to node.
+// Caller must hold room.mu.
+func openCascadeOut(room *Room, node string) {
+	link := &Peer{
+		username:    nodeChannel(node),
+		room:        room.name,
+		joined:      room,
+		sfu:         true,
+		cascadeNode: node,
+		downTracks:  make(map[string]*downTrack),
+	}
+	pc, err := newPeerConnection(link)
+	if err != nil {
+		log.Printf("Error creating cascade link to node '%s': %v", node, err)
+		return
+	}
+	link.pc = pc
+	refuseDataChannels(pc, node)
+	name := room.name
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		init := c.ToJSON()
+		sendCascade(node, cascadeSignal{Room: name, Outbound: true, Candidate: &init})
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("Cascade of room '%s' to node '%s': %s", name, node, state)
+	})
+	room.cascadesOut[node] = link
+	log.Printf("Cascading room '%s' to node '%s'", room.name, node)
+}
+
+// closeCascadeOut stops sending to the node of link. Caller must hold room.mu.
+func closeCascadeOut(room *Room, link *Peer) {
+	for id := range link.downTracks {
+		unsubscribe(link, id)
+	}
+	if err := link.pc.Close(); err != nil {
+		log.Printf("Error closing cascade link to node '%s': %v", link.cascadeNode, err)
+	}
+	delete(room.cascadesOut, link.cascadeNode)
+	sendCascade(link.cascadeNode, cascadeSignal{Room: room.name, Outbound: true, Close: true})
+}
+
+// openCascadeIn creates the link receiving tracks of room from node.
+// Caller must hold room.mu.
+func openCascadeIn(room *Room, node string) *cascadeIn {
+	in := &cascadeIn{
+		node:    node,
+		link:    &Peer{username: nodeChannel(node), room: room.name, joined: room, downTracks: make(map[string]*downTrack)},
+		owners:  make(map[string]string),
+		proxies: make(map[string]*Peer),
+	}
+	pc, err := newPeerConnection(in.link)
+	if err != nil {
+		log.Printf("Error creating cascade link from node '%s': %v", node, err)
+		return nil
+	}
+	in.link.pc = pc
+	refuseDataChannels(pc, node)
+	name := room.name
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		init := c.ToJSON()
+		sendCascade(node, cascadeSignal{Room: name, Candidate: &init})
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		room.mu.Lock()
+		owner := in.owners[remote.ID()]
+		proxy := in.proxies[owner]
+		if owner != "" && proxy == nil {
+			proxy = &Peer{
+				username:   owner,
+				room:       name,
+				joined:     room,
+				pc:         pc,
+				origin:     node,
+				downTracks: make(map[string]*downTrack),
+			}
+			in.proxies[owner] = proxy
+		}
+		room.mu.Unlock()
+		if proxy == nil {
+			log.Printf("Cascaded track %s from node '%s' has no known owner", remote.ID(), node)
+			return
+		}
+		publishTrack(proxy, remote, receiver)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("Cascade of room '%s' from node '%s': %s", name, node, state)
+	})
+	room.cascadesIn[node] = in
+	return in
+}
+
+// refuseDataChannels closes the data channels node opens on a cascade
+// link, which carries media only; the client handlers newPeerConnection
+// installs expect a member behind the connection. A channel can only be
+// closed once open.
+func refuseDataChannels(pc *webrtc.PeerConnection, node string) {
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		log.Printf("Data channel '%s' from node '%s' refused on cascade link", dc.Label(), node)
+		dc.OnOpen(func() {
+			if err := dc.Close(); err != nil {
+				log.Printf("Error closing data channel '%s' from node '%s': %v", dc.Label(), node, err)
+			}
+		})
+	})
+}
+
+// closeCascadeIn drops the link from in.node and the tracks it carried.
+// The caller renegotiates. Caller must hold room.mu.
+func closeCascadeIn(room *Room, in *cascadeIn) {
+	for id, t := range room.tracks {
+		if t.owner.origin == in.node && in.proxies[t.owner.username] == t.owner {
+			delete(room.tracks, id)
+		}
+	}
+	if err := in.link.pc.Close(); err != nil {
+		log.Printf("Error closing cascade link from node '%s': %v", in.node, err)
+	}
+	delete(room.cascadesIn, in.node)
+}
+
+// closeCascades drops every link of a room this node stops hosting.
+// Caller must hold room.mu.
+func closeCascades(room *Room) {
+	for _, link := range room.cascadesOut {
+		closeCascadeOut(room, link)
+	}
+	for _, in := range room.cascadesIn {
+		closeCascadeIn(room, in)
+	}
+}
+
+// handleCascadeSignal applies a signal from node to the matching link.
+// Caller must hold room.mu.
+func handleCascadeSignal(room *Room, node string, payload []byte) {
+	var sig cascadeSignal
+	if err := json.Unmarshal(payload, &sig); err != nil {
+		log.Printf("Invalid cascade signal from node '%s': %v", node, err)
+		return
+	}
+
+	if !sig.Outbound {
+		// Answer or candidate for our outbound link.
+		link := room.cascadesOut[node]
+		if link == nil {
+			return
+		}
+		if sig.SDP != nil {
+			if err := link.pc.SetRemoteDescription(*sig.SDP); err != nil {
+				log.Printf("Cascade answer from node '%s' rejected: %v", node, err)
+				return
+			}
+			addPendingCandidates(link)
+			if link.negotiationPending {
+				link.negotiationPending = false
+				negotiate(room, link)
+			}
+		}
+		if sig.Candidate != nil {
+			addCandidate(link, *sig.Candidate)
+		}
+		return
+	}
+
+	in := room.cascadesIn[node]
+	if sig.Close {
+		if in != nil {
+			closeCascadeIn(room, in)
+			renegotiateRoom(room)
+		}
+		return
+	}
+	if in == nil {
+		if in = openCascadeIn(room, node); in == nil {
+			return
+		}
+	}
+	if sig.SDP != nil {
+		for _, t := range sig.Tracks {
+			in.owners[t.TrackID] = t.Username
+		}
+		pc := in.link.pc
+		if err := pc.SetRemoteDescription(*sig.SDP); err != nil {
+			log.Printf("Cascade offer from node '%s' rejected: %v", node, err)
+			return
+		}
+		addPendingCandidates(in.link)
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			log.Printf("Cascade answer for node '%s' failed: %v", node, err)
+			return
+		}
+		if err := pc.SetLocalDescription(answer); err != nil {
+			log.Printf("Cascade answer for node '%s' failed: %v", node, err)
+			return
+		}
+		sendCascade(node, cascadeSignal{Room: room.name, SDP: &answer})
+	}
+	if sig.Candidate != nil {
+		addCandidate(in.link, *sig.Candidate)
+	}
+}
+
+// addCandidate adds a remote candidate to a link, holding it back until the
+// remote description is known: candidates and descriptions are published
+// from different goroutines and may arrive in either order. Caller must
+// hold room.mu.
+func addCandidate(link *Peer, c webrtc.ICECandidateInit) {
+	if link.pc.RemoteDescription() == nil {
+		link.pendingCandidates = append(link.pendingCandidates, c)
+		return
+	}
+	if err := link.pc.AddICECandidate(c); err != nil {
+		log.Printf("Cascade candidate for %s rejected: %v", link.username, err)
+	}
+}
+
+func addPendingCandidates(link *Peer) {
+	pending := link.pendingCandidates
+	link.pendingCandidates = nil
+	for _, c := range pending {
+		addCandidate(link, c)
+	}
+}
+
+// hosts reports whether p may publish into r: a local member, or the
+// stand-in of a member on a node cascading into r. Caller must hold room.mu.
+func (r *Room) hosts(p *Peer) bool {
+	if p.origin == "" {
+		return r.peers[p.username] == p
+	}
+	in := r.cascadesIn[p.origin]
+	return in != nil && in.proxies[p.username] == p
+}
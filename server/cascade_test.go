@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"server/cluster"
+)
+
+// publishCascade sends sig to this node as node would.
+func publishCascade(t *testing.T, b cluster.Broker, node string, sig cascadeSignal) {
+	t.Helper()
+	payload, err := json.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(clusterMessage{Node: node, Kind: "cascade", Room: sig.Room, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), nodeChannel(*nodeID), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cascadeSignals returns the signals this node sends to node.
+func cascadeSignals(t *testing.T, b cluster.Broker, node string) <-chan cascadeSignal {
+	t.Helper()
+	signals := make(chan cascadeSignal, 64)
+	unsubscribe, err := b.Subscribe(nodeChannel(node), func(data []byte) {
+		var m clusterMessage
+		var sig cascadeSignal
+		if json.Unmarshal(data, &m) == nil && m.Kind == "cascade" && json.Unmarshal(m.Payload, &sig) == nil {
+			signals <- sig
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unsubscribe)
+	return signals
+}
+
+// joinRemote announces username as a member of room on node.
+func joinRemote(t *testing.T, b cluster.Broker, node, room, username string) {
+	t.Helper()
+	join, err := json.Marshal(clusterMessage{Node: node, Kind: "join", Room: room, Participant: &Participant{Username: username}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), roomChannel(room), join); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCascadeLink has a peer node cascade into a room hosted here. The
+// link carries media only: a data channel the node opens on it is closed,
+// and the process keeps serving the room.
+func TestCascadeLink(t *testing.T) {
+	b := withCluster(t)
+	url := startServer(t)
+	alice := dial(t, url, "cascade", "alice")
+	readUntil(t, alice, `"room_info"`)
+
+	const node = "peer"
+	publish := func(sig cascadeSignal) {
+		t.Helper()
+		sig.Room, sig.Outbound = "cascade", true
+		publishCascade(t, b, node, sig)
+	}
+
+	// The node announces a member, then offers its link.
+	joinRemote(t, b, node, "cascade", "bob")
+	readUntil(t, alice, `"bob"`)
+	signals := cascadeSignals(t, b, node)
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	dc, err := pc.CreateDataChannel("room", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	dc.OnClose(func() { close(closed) })
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			init := c.ToJSON()
+			publish(cascadeSignal{Candidate: &init})
+		}
+	})
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	publish(cascadeSignal{SDP: &offer})
+
+	var pending []webrtc.ICECandidateInit
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case sig := <-signals:
+			switch {
+			case sig.SDP != nil:
+				if err := pc.SetRemoteDescription(*sig.SDP); err != nil {
+					t.Fatal(err)
+				}
+				for _, c := range pending {
+					pc.AddICECandidate(c)
+				}
+			case sig.Candidate != nil && pc.RemoteDescription() == nil:
+				pending = append(pending, *sig.Candidate)
+			case sig.Candidate != nil:
+				pc.AddICECandidate(*sig.Candidate)
+			}
+			continue
+		case <-closed:
+		case <-timeout:
+			t.Fatal("data channel on the cascade link never closed")
+		}
+		break
+	}
+
+	if err := roundTrip(alice); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCascadeMedia has alice publish video to this node while bob is on
+// node "peer", played by the test. alice's track reaches the peer node
+// over the cascade link this node opens, and carries her RTP. Both nodes
+// are on a virtual network.
+func TestCascadeMedia(t *testing.T) {
+	router := newRouter(t)
+	// Restored once the rooms of the test are closed.
+	prev := settingEngine
+	t.Cleanup(func() { settingEngine = prev })
+	settingEngine = vnetSettings(t, router)
+	b := withCluster(t)
+	url := startServer(t)
+
+	const node = "peer"
+	newAPI := func() *webrtc.API {
+		m := &webrtc.MediaEngine{}
+		if err := m.RegisterDefaultCodecs(); err != nil {
+			t.Fatal(err)
+		}
+		return webrtc.NewAPI(webrtc.WithSettingEngine(vnetSettings(t, router)), webrtc.WithMediaEngine(m))
+	}
+	alice := newSFUClient(t, newAPI(), url, "cascade-media", "alice")
+	alice.publishVideo(t)
+	alice.negotiate(t)
+
+	signals := cascadeSignals(t, b, node)
+	joinRemote(t, b, node, "cascade-media", "bob")
+
+	pc, err := newAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	tracks := make(chan *webrtc.TrackRemote, 4)
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) { tracks <- remote })
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			init := c.ToJSON()
+			publishCascade(t, b, node, cascadeSignal{Room: "cascade-media", Candidate: &init})
+		}
+	})
+
+	owners := make(map[string]string)
+	var pending []webrtc.ICECandidateInit
+	var remote *webrtc.TrackRemote
+	timeout := time.After(10 * time.Second)
+	for remote == nil {
+		select {
+		case sig := <-signals:
+			switch {
+			case !sig.Outbound || sig.Room != "cascade-media":
+				t.Fatalf("unexpected signal %+v", sig)
+			case sig.SDP != nil:
+				for _, track := range sig.Tracks {
+					owners[track.TrackID] = track.Username
+				}
+				if err := pc.SetRemoteDescription(*sig.SDP); err != nil {
+					t.Fatal(err)
+				}
+				for _, c := range pending {
+					if err := pc.AddICECandidate(c); err != nil {
+						t.Fatal(err)
+					}
+				}
+				pending = nil
+				answer, err := pc.CreateAnswer(nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := pc.SetLocalDescription(answer); err != nil {
+					t.Fatal(err)
+				}
+				publishCascade(t, b, node, cascadeSignal{Room: "cascade-media", SDP: &answer})
+			case sig.Candidate != nil && pc.RemoteDescription() == nil:
+				pending = append(pending, *sig.Candidate)
+			case sig.Candidate != nil:
+				if err := pc.AddICECandidate(*sig.Candidate); err != nil {
+					t.Fatal(err)
+				}
+			}
+		case remote = <-tracks:
+		case <-timeout:
+			t.Fatal("no track over the cascade link")
+		}
+	}
+	if owner := owners[remote.ID()]; owner != "alice" {
+		t.Errorf("track %s cascaded as %q's, want alice's", remote.ID(), owner)
+	}
+
+	packets := make(chan *rtp.Packet, 1)
+	go func() {
+		// Ends when pc is closed.
+		if pkt, _, err := remote.ReadRTP(); err == nil {
+			packets <- pkt
+		}
+	}()
+	if pkt := await(t, packets, "RTP over the cascade link"); len(pkt.Payload) == 0 {
+		t.Error("empty RTP packet over the cascade link")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"server/store"
+)
+
+// In-room text chat. The server assigns every message an ID and timestamp,
+// keeps the last -chat-history messages of a room and replays them to new
+// members. Recipients acknowledge delivery and reading, authors may edit
+// or delete their messages.
+
+// chatMessage is kept in Room.chat and mirrored to roomStore.
+type chatMessage = store.ChatMessage
+
+type chatRequest struct {
+	Data struct {
+		ID       string `json:"id"`
+		ClientID string `json:"clientId"`
+		Text     string `json:"text"`
+		Status   string `json:"status"` // chat_ack: "delivered" or "read"
+	} `json:"data"`
+}
+
+// handleChatMessage processes chat, chat_edit, chat_delete and chat_ack.
+func handleChatMessage(peer *Peer, msgType string, msg []byte) {
+	var req chatRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		sendError(peer, "invalid_message", "Invalid "+msgType+" message")
+		return
+	}
+	if msgType == "chat" || msgType == "chat_edit" {
+		if req.Data.Text == "" {
+			sendError(peer, "invalid_message", "Chat message is empty")
+			return
+		}
+		if utf8.RuneCountInString(req.Data.Text) > *maxChatLength {
+			sendError(peer, "chat_too_long", "Chat message is too long")
+			return
+		}
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+
+	if msgType == "chat" {
+		m := &chatMessage{
+			ID:        randSeq(16),
+			ClientID:  req.Data.ClientID,
+			From:      peer.username,
+			Text:      req.Data.Text,
+			Timestamp: now,
+		}
+		room.chat = append(room.chat, m)
+		if over := len(room.chat) - *chatHistory; over > 0 {
+			room.chat = room.chat[over:]
+		}
+		if err := roomStore.AppendChat(room.name, *m, *chatHistory); err != nil {
+			log.Printf("Error storing chat message of room '%s': %v", room.name, err)
+		}
+		broadcastRoom(room, "chat", m)
+		return
+	}
+
+	m := room.findChat(req.Data.ID)
+	if m == nil {
+		sendError(peer, "chat_not_found", "Chat message not found")
+		return
+	}
+
+	switch msgType {
+	case "chat_edit", "chat_delete":
+		if m.From != peer.username {
+			sendError(peer, "forbidden", "Only the author can change a chat message")
+			return
+		}
+		if m.Deleted {
+			sendError(peer, "chat_not_found", "Chat message was deleted")
+			return
+		}
+		if msgType == "chat_edit" {
+			m.Text = req.Data.Text
+			m.Edited = now
+		} else {
+			m.Text = ""
+			m.Deleted = true
+		}
+		storeChat(room, m)
+		broadcastRoom(room, msgType, m)
+	case "chat_ack":
+		switch req.Data.Status {
+		case "delivered":
+			m.DeliveredTo = appendUnique(m.DeliveredTo, peer.username)
+		case "read":
+			m.DeliveredTo = appendUnique(m.DeliveredTo, peer.username)
+			m.ReadBy = appendUnique(m.ReadBy, peer.username)
+		default:
+			sendError(peer, "invalid_message", "Unknown chat_ack status")
+			return
+		}
+		storeChat(room, m)
+		if author, ok := room.peers[m.From]; ok {
+			if err := author.writeJSON(map[string]interface{}{
+				"type": "chat_ack",
+				"data": map[string]interface{}{
+					"id":       m.ID,
+					"username": peer.username,
+					"status":   req.Data.Status,
+				},
+			}); err != nil {
+				log.Printf("Error sending chat ack to %s: %v", author.username, err)
+			}
+		}
+	}
+}
+
+// sendChatHistory replays the room's chat to a member that just joined.
+// Caller must hold room.mu.
+func sendChatHistory(peer *Peer) {
+	history := peer.joined.chat
+	if len(history) == 0 {
+		return
+	}
+	if err := peer.writeJSON(map[string]interface{}{
+		"type": "chat_history",
+		"data": history,
+	}); err != nil {
+		log.Printf("Error sending chat history to %s: %v", peer.username, err)
+	}
+}
+
+func storeChat(room *Room, m *chatMessage) {
+	if err := roomStore.UpdateChat(room.name, *m); err != nil {
+		log.Printf("Error storing chat message %s of room '%s': %v", m.ID, room.name, err)
+	}
+}
+
+func (r *Room) findChat(id string) *chatMessage {
+	for _, m := range r.chat {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
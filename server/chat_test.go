@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestChatDiesWithRoom(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "chat-gone", "alice")
+	readUntil(t, alice, `"room_info"`)
+	if err := alice.WriteJSON(map[string]interface{}{"type": "chat", "data": map[string]string{"text": "secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, alice, `"secret"`)
+	alice.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for roomCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("room never closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if history, _ := roomStore.ChatHistory("chat-gone"); len(history) != 0 {
+		t.Errorf("chat kept after the room closed: %+v", history)
+	}
+
+	// Whoever opens the room next starts with an empty chat, which would be
+	// replayed before the screen share policy.
+	bob := dial(t, url, "chat-gone", "bob")
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, msg, err := bob.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(msg), "secret") {
+			t.Fatalf("old chat replayed: %s", msg)
+		}
+		if strings.Contains(string(msg), `"screen_share_policy"`) {
+			break
+		}
+	}
+}
+
+// TestChatEditDelete has the author edit and then delete a message: the
+// room sees both, the history keeps the result, and nobody else may touch
+// the message.
+func TestChatEditDelete(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "chat-edit", "alice")
+	readUntil(t, alice, `"room_info"`)
+	bob := dial(t, url, "chat-edit", "bob")
+	readUntil(t, bob, `"room_info"`)
+
+	send := func(conn *websocket.Conn, typ string, data map[string]string) {
+		t.Helper()
+		if err := conn.WriteJSON(map[string]interface{}{"type": typ, "data": data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(conn *websocket.Conn, typ string) chatMessage {
+		t.Helper()
+		var m struct {
+			Data chatMessage `json:"data"`
+		}
+		if err := json.Unmarshal(readUntil(t, conn, `"type":"`+typ+`"`), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Data
+	}
+	errorCode := func(conn *websocket.Conn) string {
+		t.Helper()
+		var m struct {
+			Code string `json:"code"`
+		}
+		if err := json.Unmarshal(readUntil(t, conn, `"type":"error"`), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Code
+	}
+
+	send(alice, "chat", map[string]string{"text": "helo"})
+	id := read(alice, "chat").ID
+	read(bob, "chat")
+
+	send(bob, "chat_edit", map[string]string{"id": id, "text": "bob was here"})
+	if code := errorCode(bob); code != "forbidden" {
+		t.Errorf("edit by another member answered %q", code)
+	}
+
+	send(alice, "chat_edit", map[string]string{"id": id, "text": "hello"})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if m := read(conn, "chat_edit"); m.ID != id || m.Text != "hello" || m.Edited == 0 {
+			t.Errorf("edit %+v", m)
+		}
+	}
+
+	// A member joining now gets the edited text.
+	carol := dial(t, url, "chat-edit", "carol")
+	var history struct {
+		Data []chatMessage `json:"data"`
+	}
+	if err := json.Unmarshal(readUntil(t, carol, `"chat_history"`), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Data) != 1 || history.Data[0].Text != "hello" {
+		t.Errorf("history %+v", history.Data)
+	}
+
+	send(alice, "chat_delete", map[string]string{"id": id})
+	for _, conn := range []*websocket.Conn{alice, bob, carol} {
+		if m := read(conn, "chat_delete"); m.ID != id || !m.Deleted || m.Text != "" {
+			t.Errorf("delete %+v", m)
+		}
+	}
+	send(alice, "chat_edit", map[string]string{"id": id, "text": "back"})
+	if code := errorCode(alice); code != "chat_not_found" {
+		t.Errorf("edit of a deleted message answered %q", code)
+	}
+	if stored, _ := roomStore.ChatHistory("chat-edit"); len(stored) != 1 || !stored[0].Deleted || stored[0].Text != "" {
+		t.Errorf("stored %+v", stored)
+	}
+}
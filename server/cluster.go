@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"server/cluster"
+)
+
+// Clustering. With -broker set, every node subscribes to the broker
+// channels of all rooms with one pattern and ignores the rooms it hosts no
+// members of. Nodes announce joins, leaves and participant updates there, so room_info and the participant_* messages
+// cover the members of all nodes, and the signaling messages clients relay
+// to each other reach members on other nodes too. A node that starts
+// hosting a room asks the others for their members and waits
+// clusterSyncWait for them before electing the room's owner. Membership
+// messages are never lost to a full outbox: the node announces its members
+// again once the outbox drained. Chat, polls and SFU media stay
+// node-local; the ring of -cluster-nodes tells a load balancer (through
+// /route) which node should host a room so its members normally land
+// together.
+
+const (
+	clusterHeartbeat   = 5 * time.Second
+	clusterNodeTimeout = 3 * clusterHeartbeat
+	clusterOutbox      = 4096
+	clusterSyncWait    = time.Second
+)
+
+var (
+	broker   cluster.Broker // nil without -broker
+	ring     *cluster.Ring
+	nodeURLs = make(map[string]string) // key: node ID
+
+	outbox   = make(chan clusterPublication, clusterOutbox)
+	lastSeen = make(map[string]time.Time) // key: node ID, guarded by mu
+
+	// resyncNeeded is set when a membership message did not fit in the
+	// outbox.
+	resyncNeeded atomic.Bool
+)
+
+// clusterMessage is what nodes publish to each other.
+type clusterMessage struct {
+	Node        string          `json:"node"`
+	Kind        string          `json:"kind"` // heartbeat, join, update, leave, sync, members, relay
+	Room        string          `json:"room,omitempty"`
+	Participant *Participant    `json:"participant,omitempty"`
+	Members     []Participant   `json:"members,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+type clusterPublication struct {
+	channel string
+	msg     clusterMessage
+}
+
+// remoteMember is a room member connected to another node.
+type remoteMember struct {
+	node string
+	info Participant
+}
+
+// startCluster connects to the broker and starts announcing this node.
+func startCluster() {
+	if *nodeID == "" {
+		*nodeID, _ = os.Hostname()
+	}
+	ring = cluster.NewRing(0, *nodeID)
+	for _, entry := range strings.Split(*clusterNodes, ",") {
+		if entry == "" {
+			continue
+		}
+		id, url, _ := strings.Cut(entry, "=")
+		ring.Add(id)
+		nodeURLs[id] = url
+	}
+
+	if *brokerKind == "" {
+		return
+	}
+	b, err := cluster.Open(*brokerKind, *brokerAddr)
+	if err != nil {
+		log.Fatalf("Opening %s broker: %v", *brokerKind, err)
+	}
+	broker = b
+	if _, err := broker.Subscribe("nodes", handleClusterMessage); err != nil {
+		log.Fatalf("Subscribing to cluster nodes: %v", err)
+	}
+	if _, err := broker.Subscribe(nodeChannel(*nodeID), handleClusterMessage); err != nil {
+		log.Fatalf("Subscribing to node channel: %v", err)
+	}
+	if _, err := broker.PSubscribe(roomChannel("*"), handleClusterMessage); err != nil {
+		log.Fatalf("Subscribing to room channels: %v", err)
+	}
+	go runOutbox(broker)
+	go runHeartbeat()
+	log.Printf("Node '%s' joined the cluster through %s", *nodeID, *brokerKind)
+}
+
+// runOutbox publishes queued messages to b, so holders of mu never wait
+// for the broker.
+func runOutbox(b cluster.Broker) {
+	for p := range outbox {
+		data, err := json.Marshal(p.msg)
+		if err != nil {
+			log.Printf("Error encoding cluster message: %v", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := b.Publish(ctx, p.channel, data); err != nil {
+			log.Printf("Error publishing to %s: %v", p.channel, err)
+		}
+		cancel()
+		if len(outbox) == 0 && resyncNeeded.CompareAndSwap(true, false) {
+			go resyncMembership()
+		}
+	}
+}
+
+// resyncMembership announces the members of every room again, and asks
+// the other nodes for theirs, after membership messages were dropped.
+func resyncMembership() {
+	log.Printf("Resyncing cluster membership")
+	for _, room := range snapshotRooms() {
+		room.mu.Lock()
+		if !room.closed {
+			publishMembers(room)
+			publishCluster(roomChannel(room.name), clusterMessage{Kind: "sync", Room: room.name})
+		}
+		room.mu.Unlock()
+	}
+}
+
+func runHeartbeat() {
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		publishCluster("nodes", clusterMessage{Kind: "heartbeat"})
+
+		var gone []string
+		mu.Lock()
+		for node, seen := range lastSeen {
+			if now.Sub(seen) > clusterNodeTimeout {
+				log.Printf("Node '%s' timed out, dropping its members", node)
+				delete(lastSeen, node)
+				gone = append(gone, node)
+			}
+		}
+		mu.Unlock()
+		for _, node := range gone {
+			dropNode(node)
+		}
+	}
+}
+
+// publishCluster queues msg for the other nodes. Safe to call with mu held:
+// it never waits for the broker. A membership message that does not fit
+// is made up for by resyncMembership.
+func publishCluster(channel string, msg clusterMessage) {
+	if broker == nil {
+		return
+	}
+	msg.Node = *nodeID
+	select {
+	case outbox <- clusterPublication{channel, msg}:
+	default:
+		switch msg.Kind {
+		case "join", "update", "leave", "sync", "members":
+			resyncNeeded.Store(true)
+			log.Printf("Cluster outbox full, dropping %s message for %s until the resync", msg.Kind, channel)
+		default:
+			log.Printf("Cluster outbox full, dropping %s message for %s", msg.Kind, channel)
+		}
+	}
+}
+
+func roomChannel(name string) string {
+	return "room:" + name
+}
+
+// joinClusterRoom asks the other nodes who is already in a room this node
+// just started hosting. Until they had time to answer, nobody owns the
+// room. Caller must hold room.mu.
+func joinClusterRoom(room *Room) {
+	if broker == nil {
+		return
+	}
+	room.syncing = true
+	publishCluster(roomChannel(room.name), clusterMessage{Kind: "sync", Room: room.name})
+	time.AfterFunc(clusterSyncWait, func() {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if !room.closed {
+			room.syncing = false
+			electOwner(room)
+		}
+	})
+}
+
+// leaveClusterRoom stops following a room without local members. Caller
+// must hold room.mu.
+func leaveClusterRoom(room *Room) {
+	closeCascades(room)
+}
+
+// publishMember announces a join, update or leave of a local member.
+// Caller must hold room.mu.
+func publishMember(room *Room, kind string, info Participant) {
+	publishCluster(roomChannel(room.name), clusterMessage{Kind: kind, Room: room.name, Participant: &info})
+}
+
+// publishMembers announces every local member of room at once. Caller must
+// hold room.mu.
+func publishMembers(room *Room) {
+	members := make([]Participant, 0, len(room.peers))
+	for _, p := range room.peers {
+		members = append(members, p.info)
+	}
+	publishCluster(roomChannel(room.name), clusterMessage{Kind: "members", Room: room.name, Members: members})
+}
+
+// publishRelay hands a client message relayed to the room to the members
+// on other nodes. Caller must hold room.mu.
+func publishRelay(room *Room, msg []byte) {
+	publishCluster(roomChannel(room.name), clusterMessage{Kind: "relay", Room: room.name, Payload: msg})
+}
+
+func handleClusterMessage(data []byte) {
+	var m clusterMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		log.Printf("Invalid cluster message: %v", err)
+		return
+	}
+	if m.Node == *nodeID {
+		return
+	}
+
+	mu.Lock()
+	lastSeen[m.Node] = time.Now()
+	room := rooms[m.Room]
+	mu.Unlock()
+	if m.Kind == "heartbeat" || room == nil {
+		return
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.closed {
+		return
+	}
+
+	switch m.Kind {
+	case "cascade":
+		handleCascadeSignal(room, m.Node, m.Payload)
+	case "join", "update":
+		if m.Participant == nil || room.peers[m.Participant.Username] != nil {
+			return
+		}
+		old, known := room.remote[m.Participant.Username]
+		room.remote[m.Participant.Username] = remoteMember{node: m.Node, info: *m.Participant}
+		if !known {
+			broadcastRoom(room, "participant_joined", *m.Participant)
+			renegotiateRoom(room)
+		} else if !equalParticipants(old.info, *m.Participant) {
+			broadcastRoom(room, "participant_updated", *m.Participant)
+		}
+		electOwner(room)
+	case "leave":
+		if m.Participant == nil {
+			return
+		}
+		if r, ok := room.remote[m.Participant.Username]; ok && r.node == m.Node {
+			delete(room.remote, m.Participant.Username)
+			announceLeave(room, m.Participant.Username)
+			renegotiateRoom(room)
+			electOwner(room)
+		}
+	case "sync":
+		publishMembers(room)
+	case "members":
+		// The complete list of the members on m.Node; the room hears
+		// what differs from what was known.
+		members := make(map[string]Participant, len(m.Members))
+		for _, info := range m.Members {
+			if room.peers[info.Username] == nil {
+				members[info.Username] = info
+			}
+		}
+		for username, r := range room.remote {
+			if _, ok := members[username]; !ok && r.node == m.Node {
+				delete(room.remote, username)
+				announceLeave(room, username)
+			}
+		}
+		for username, info := range members {
+			old, known := room.remote[username]
+			room.remote[username] = remoteMember{node: m.Node, info: info}
+			switch {
+			case !known:
+				broadcastRoom(room, "participant_joined", info)
+			case !equalParticipants(old.info, info):
+				broadcastRoom(room, "participant_updated", info)
+			}
+		}
+		renegotiateRoom(room)
+		electOwner(room)
+	case "relay":
+		relayToRoom(room, nil, m.Payload)
+	}
+}
+
+// dropNode forgets the members of a node that went away.
+func dropNode(node string) {
+	for _, room := range snapshotRooms() {
+		room.mu.Lock()
+		changed := false
+		for username, r := range room.remote {
+			if r.node == node {
+				delete(room.remote, username)
+				announceLeave(room, username)
+				changed = true
+			}
+		}
+		if changed {
+			renegotiateRoom(room)
+			electOwner(room)
+		}
+		room.mu.Unlock()
+	}
+}
+
+// handleRoute tells a load balancer or client which node should host a room.
+func handleRoute(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	node := ring.Node(room)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"room": room,
+		"node": node,
+		"url":  nodeURLs[node],
+	})
+}
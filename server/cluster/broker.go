@@ -0,0 +1,43 @@
+// Package cluster lets several signaling nodes serve the same rooms. Nodes
+// exchange messages through a Broker and agree on which node should host a
+// room with a Ring.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned when publishing or subscribing on a closed Broker.
+var ErrClosed = errors.New("cluster: broker closed")
+
+// Handler receives the messages published on a channel. Handlers of one
+// subscription are called one at a time, in publish order.
+type Handler func(data []byte)
+
+// Broker is a publish/subscribe transport between nodes. A message
+// published on a channel reaches every subscription of that channel,
+// including the publisher's own.
+type Broker interface {
+	Publish(ctx context.Context, channel string, data []byte) error
+	// Subscribe calls h for every message published on channel until the
+	// returned function is called.
+	Subscribe(channel string, h Handler) (unsubscribe func(), err error)
+	// PSubscribe is Subscribe for every channel matching pattern, in which
+	// each * stands for any run of characters.
+	PSubscribe(pattern string, h Handler) (unsubscribe func(), err error)
+	Close() error
+}
+
+// Open returns the broker of the given kind: "local" (single process) or
+// "redis" at addr.
+func Open(kind, addr string) (Broker, error) {
+	switch kind {
+	case "local":
+		return NewLocal(), nil
+	case "redis":
+		return OpenRedis(addr)
+	}
+	return nil, fmt.Errorf("cluster: unknown broker %q", kind)
+}
@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testBroker checks the Broker contract; it runs against every implementation.
+func testBroker(t *testing.T, b Broker) {
+	ctx := context.Background()
+	channel := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	got1 := make(chan string, 10)
+	got2 := make(chan string, 10)
+	unsub1, err := b.Subscribe(channel, func(data []byte) { got1 <- string(data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsub2, err := b.Subscribe(channel, func(data []byte) { got2 <- string(data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsub2()
+
+	other := make(chan string, 10)
+	unsubOther, err := b.Subscribe(channel+"-other", func(data []byte) { other <- string(data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubOther()
+
+	for _, m := range []string{"one", "two", "three"} {
+		if err := b.Publish(ctx, channel, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, got := range []chan string{got1, got2} {
+		for _, want := range []string{"one", "two", "three"} {
+			select {
+			case m := <-got:
+				if m != want {
+					t.Fatalf("received %q, want %q", m, want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timed out waiting for %q", want)
+			}
+		}
+	}
+
+	unsub1()
+	unsub1() // idempotent
+	if err := b.Publish(ctx, channel, []byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-got2:
+		if m != "four" {
+			t.Fatalf("received %q, want four", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for four")
+	}
+	select {
+	case m := <-got1:
+		t.Fatalf("unsubscribed handler received %q", m)
+	case m := <-other:
+		t.Fatalf("other channel received %q", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A pattern subscription hears every matching channel; ? and [ are
+	// not wildcards.
+	matched := make(chan string, 10)
+	unsubPattern, err := b.PSubscribe(channel+":*?", func(data []byte) { matched <- string(data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubPattern()
+	for _, c := range []string{channel + ":a?", channel + ":b/[c]?", channel + ":x", channel} {
+		if err := b.Publish(ctx, c, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{channel + ":a?", channel + ":b/[c]?"} {
+		select {
+		case m := <-matched:
+			if m != want {
+				t.Fatalf("pattern received %q, want %q", m, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	select {
+	case m := <-matched:
+		t.Fatalf("pattern received %q", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLocalBroker(t *testing.T) {
+	b := NewLocal()
+	testBroker(t, b)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), "x", nil); err != ErrClosed {
+		t.Fatalf("Publish after Close = %v, want ErrClosed", err)
+	}
+}
+
+// TestRedisBroker needs a Redis server, e.g. REDIS_ADDR=localhost:6379.
+func TestRedisBroker(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	b, err := OpenRedis(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	testBroker(t, b)
+}
@@ -0,0 +1,152 @@
+package cluster
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// subscriptionQueue is the number of messages buffered per subscription
+// before Publish blocks.
+const subscriptionQueue = 1024
+
+// Local is an in-process Broker. Several nodes in one process (as in tests)
+// share it to talk to each other.
+type Local struct {
+	mu     sync.Mutex
+	subs   map[string]map[*localSub]struct{}
+	psubs  map[string]map[*localSub]struct{} // key: pattern
+	closed bool
+}
+
+type localSub struct {
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewLocal returns an empty in-process broker.
+func NewLocal() *Local {
+	return &Local{
+		subs:  make(map[string]map[*localSub]struct{}),
+		psubs: make(map[string]map[*localSub]struct{}),
+	}
+}
+
+func (b *Local) Publish(ctx context.Context, channel string, data []byte) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	subs := make([]*localSub, 0, len(b.subs[channel]))
+	for s := range b.subs[channel] {
+		subs = append(subs, s)
+	}
+	for pattern, psubs := range b.psubs {
+		if match(pattern, channel) {
+			for s := range psubs {
+				subs = append(subs, s)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	msg := append([]byte(nil), data...)
+	for _, s := range subs {
+		select {
+		case s.queue <- msg:
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *Local) Subscribe(channel string, h Handler) (func(), error) {
+	return b.subscribe(b.subs, channel, h)
+}
+
+func (b *Local) PSubscribe(pattern string, h Handler) (func(), error) {
+	return b.subscribe(b.psubs, pattern, h)
+}
+
+// subscribe adds a subscription to subs, the exact or the pattern ones.
+func (b *Local) subscribe(subs map[string]map[*localSub]struct{}, key string, h Handler) (func(), error) {
+	s := &localSub{
+		queue: make(chan []byte, subscriptionQueue),
+		done:  make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if subs[key] == nil {
+		subs[key] = make(map[*localSub]struct{})
+	}
+	subs[key][s] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case msg := <-s.queue:
+				h(msg)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		b.mu.Lock()
+		delete(subs[key], s)
+		if len(subs[key]) == 0 {
+			delete(subs, key)
+		}
+		b.mu.Unlock()
+		s.stop()
+	}, nil
+}
+
+func (b *Local) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for _, all := range []map[string]map[*localSub]struct{}{b.subs, b.psubs} {
+		for _, subs := range all {
+			for s := range subs {
+				s.stop()
+			}
+		}
+	}
+	b.subs, b.psubs = nil, nil
+	return nil
+}
+
+func (s *localSub) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// match reports whether channel matches pattern, where each * in pattern
+// stands for any run of characters.
+func match(pattern, channel string) bool {
+	prefix, rest, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == channel
+	}
+	if !strings.HasPrefix(channel, prefix) {
+		return false
+	}
+	channel = channel[len(prefix):]
+	for i := 0; i <= len(channel); i++ {
+		if match(rest, channel[i:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package cluster
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// subscribeTimeout bounds the wait for Redis to confirm a subscription.
+const subscribeTimeout = 5 * time.Second
+
+// Redis is a Broker on top of Redis pub/sub, for nodes in different
+// processes or machines. Messages are not persisted: a node only receives
+// what is published while it is subscribed.
+type Redis struct {
+	client *redis.Client
+
+	mu   sync.Mutex
+	subs map[*redis.PubSub]struct{}
+}
+
+// OpenRedis connects to the Redis server at addr ("host:port").
+func OpenRedis(addr string) (*Redis, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &Redis{client: client, subs: make(map[*redis.PubSub]struct{})}, nil
+}
+
+func (b *Redis) Publish(ctx context.Context, channel string, data []byte) error {
+	return b.client.Publish(ctx, channel, data).Err()
+}
+
+func (b *Redis) Subscribe(channel string, h Handler) (func(), error) {
+	return b.subscribe(func(ctx context.Context) *redis.PubSub {
+		return b.client.Subscribe(ctx, channel)
+	}, h)
+}
+
+func (b *Redis) PSubscribe(pattern string, h Handler) (func(), error) {
+	// Redis reads the pattern as a glob; only * is meant as one.
+	pattern = globEscaper.Replace(pattern)
+	return b.subscribe(func(ctx context.Context) *redis.PubSub {
+		return b.client.PSubscribe(ctx, pattern)
+	}, h)
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// subscribe opens a PubSub with open and hands its messages to h.
+func (b *Redis) subscribe(open func(context.Context) *redis.PubSub, h Handler) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+	defer cancel()
+	ps := open(ctx)
+	// Wait for the confirmation so messages published after Subscribe
+	// returns are not missed.
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.subs[ps] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		for msg := range ps.Channel(redis.WithChannelSize(subscriptionQueue)) {
+			h([]byte(msg.Payload))
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ps)
+			b.mu.Unlock()
+			ps.Close()
+		})
+	}, nil
+}
+
+func (b *Redis) Close() error {
+	b.mu.Lock()
+	for ps := range b.subs {
+		ps.Close()
+	}
+	b.subs = nil
+	b.mu.Unlock()
+	return b.client.Close()
+}
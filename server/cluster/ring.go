@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultReplicas is the number of points per node on the ring; more
+// points spread rooms more evenly.
+const defaultReplicas = 128
+
+// Ring assigns keys (room names) to nodes with consistent hashing: adding
+// or removing a node only moves the keys of that node.
+type Ring struct {
+	replicas int
+
+	mu     sync.RWMutex
+	points []uint32          // sorted
+	owners map[uint32]string // key: point
+	nodes  map[string]bool
+}
+
+// NewRing returns a ring of nodes with replicas points per node, or
+// defaultReplicas when replicas <= 0.
+func NewRing(replicas int, nodes ...string) *Ring {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	r := &Ring{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+		nodes:    make(map[string]bool),
+	}
+	for _, n := range nodes {
+		r.Add(n)
+	}
+	return r
+}
+
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.replicas; i++ {
+		p := point(node, i)
+		// On the rare collision the smaller name wins, so every node
+		// builds the same ring whatever the order of Add calls.
+		if owner, taken := r.owners[p]; taken && owner < node {
+			continue
+		}
+		r.owners[p] = node
+	}
+	r.rebuild()
+}
+
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	for p, owner := range r.owners {
+		if owner == node {
+			delete(r.owners, p)
+		}
+	}
+	// Give collided points back to the remaining nodes.
+	for n := range r.nodes {
+		for i := 0; i < r.replicas; i++ {
+			p := point(n, i)
+			if owner, taken := r.owners[p]; !taken || n < owner {
+				r.owners[p] = n
+			}
+		}
+	}
+	r.rebuild()
+}
+
+// Node returns the node responsible for key, "" if the ring is empty.
+func (r *Ring) Node(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Nodes returns the nodes of the ring by name.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for n := range r.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// rebuild sorts the points after a change. Caller must hold r.mu.
+func (r *Ring) rebuild() {
+	r.points = r.points[:0]
+	for p := range r.owners {
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func point(node string, i int) uint32 {
+	return crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+}
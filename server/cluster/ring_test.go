@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func rooms(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("room-%d", i)
+	}
+	return keys
+}
+
+func TestRingIsDeterministic(t *testing.T) {
+	a := NewRing(0, "node-a", "node-b", "node-c")
+	b := NewRing(0, "node-c", "node-a", "node-b")
+	for _, k := range rooms(1000) {
+		if a.Node(k) != b.Node(k) {
+			t.Fatalf("%s maps to %s and %s depending on insertion order", k, a.Node(k), b.Node(k))
+		}
+	}
+}
+
+func TestRingBalance(t *testing.T) {
+	r := NewRing(0, "node-a", "node-b", "node-c")
+	counts := make(map[string]int)
+	keys := rooms(3000)
+	for _, k := range keys {
+		counts[r.Node(k)]++
+	}
+	for _, n := range r.Nodes() {
+		// A third each, within a generous margin.
+		if c := counts[n]; c < 600 || c > 1400 {
+			t.Errorf("node %s owns %d of %d rooms", n, c, len(keys))
+		}
+	}
+}
+
+func TestRingMovesOnlyAffectedKeys(t *testing.T) {
+	r := NewRing(0, "node-a", "node-b", "node-c")
+	keys := rooms(2000)
+	before := make(map[string]string, len(keys))
+	for _, k := range keys {
+		before[k] = r.Node(k)
+	}
+
+	r.Add("node-d")
+	for _, k := range keys {
+		if now := r.Node(k); now != before[k] && now != "node-d" {
+			t.Fatalf("adding node-d moved %s from %s to %s", k, before[k], now)
+		}
+	}
+
+	r.Remove("node-d")
+	for _, k := range keys {
+		if now := r.Node(k); now != before[k] {
+			t.Fatalf("removing node-d left %s on %s, want %s", k, now, before[k])
+		}
+	}
+
+	r.Remove("node-b")
+	for _, k := range keys {
+		if before[k] != "node-b" && r.Node(k) != before[k] {
+			t.Fatalf("removing node-b moved %s away from %s", k, before[k])
+		}
+	}
+}
+
+func TestEmptyRing(t *testing.T) {
+	if n := NewRing(0).Node("lobby"); n != "" {
+		t.Fatalf("empty ring returned %q", n)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server/cluster"
+)
+
+// testOutbox is what the outbox publishes to in tests: the broker of the
+// running test. runOutbox never returns, so one serves every test.
+type testOutbox struct {
+	cluster.Broker
+}
+
+var (
+	outboxOnce   sync.Once
+	outboxBroker atomic.Pointer[cluster.Local]
+)
+
+func (testOutbox) Publish(ctx context.Context, channel string, data []byte) error {
+	if b := outboxBroker.Load(); b != nil {
+		return b.Publish(ctx, channel, data)
+	}
+	return nil
+}
+
+// waitRoomsClosed waits a while for every room to close.
+func waitRoomsClosed() {
+	deadline := time.Now().Add(5 * time.Second)
+	for roomCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// withCluster makes this process node "test" of a cluster on a local
+// broker for the duration of the test, and returns the broker. The test
+// plays the other nodes by publishing on it.
+func withCluster(t *testing.T) cluster.Broker {
+	t.Helper()
+	// Members of earlier tests may still be leaving, and announce it
+	// through broker.
+	waitRoomsClosed()
+	b := cluster.NewLocal()
+	for _, channel := range []string{"nodes", nodeChannel(*nodeID)} {
+		unsubscribe, err := b.Subscribe(channel, handleClusterMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(unsubscribe)
+	}
+	unsubscribe, err := b.PSubscribe(roomChannel("*"), handleClusterMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unsubscribe)
+	broker = b
+	outboxBroker.Store(b)
+	outboxOnce.Do(func() { go runOutbox(testOutbox{}) })
+	t.Cleanup(func() {
+		// Registered before the server of the test starts, so this runs
+		// once its connections are gone.
+		waitRoomsClosed()
+		broker = nil
+		outboxBroker.Store(nil)
+		b.Close()
+	})
+	return b
+}
+
+// TestClusterOwner splits a room between this node and node "peer", played
+// by the test. The member who joined first owns the room on every node,
+// whichever node the others joined, and a resync of the members of a node
+// replaces what was known about them.
+func TestClusterOwner(t *testing.T) {
+	b := withCluster(t)
+	url := startServer(t)
+
+	publish := func(m clusterMessage) {
+		t.Helper()
+		m.Node, m.Room = "peer", "split"
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Publish(context.Background(), roomChannel("split"), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncs := make(chan struct{}, 4)
+	unsubscribe, err := b.Subscribe(roomChannel("split"), func(data []byte) {
+		var m clusterMessage
+		if json.Unmarshal(data, &m) == nil && m.Kind == "sync" {
+			syncs <- struct{}{}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unsubscribe)
+
+	alice := dial(t, url, "split", "alice")
+	readUntil(t, alice, `"room_info"`)
+	select {
+	case <-syncs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no sync for the new room")
+	}
+	// bob has been in the room for a minute, owning it on his node.
+	bob := Participant{Username: "bob", JoinedAt: time.Now().Add(-time.Minute).UnixMilli(), Role: roleOwner, Quality: "unknown"}
+	publish(clusterMessage{Kind: "members", Members: []Participant{bob}})
+	readUntil(t, alice, `"bob"`)
+
+	// Past the sync, alice is still not the owner.
+	time.Sleep(clusterSyncWait + 100*time.Millisecond)
+	peer := roomPeer(t, "split", "alice")
+	peer.joined.mu.Lock()
+	role, owner := peer.info.Role, peer.joined.owner()
+	peer.joined.mu.Unlock()
+	if role != roleParticipant || owner != "bob" {
+		t.Fatalf("alice is %s, owner %q; want participant, bob", role, owner)
+	}
+
+	// The node's members, resent after its leave for bob was lost.
+	publish(clusterMessage{Kind: "members", Members: []Participant{}})
+	for {
+		msg := readUntil(t, alice, `"participant_updated"`)
+		if strings.Contains(string(msg), `"alice"`) && strings.Contains(string(msg), `"owner"`) {
+			break
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Command loadgen measures how much signaling one server instance holds.
+// It opens many websocket sessions, groups them in rooms, replays the
+// offer/answer/candidate traffic of calls in every room and reports join
+// latency, relay latency and errors:
+//
+//	loadgen -sessions 2000 -room-sizes 2,4,8 -duration 5m -report soak.json
+//
+// Sessions join at -rate per second; traffic starts in a room once all of
+// its members are in and runs for -duration after the last session
+// joined. By default the descriptions and candidates are synthetic, sized
+// like a browser's; with -pion every call is negotiated by real
+// PeerConnections and connects over ICE. The report is JSON, or CSV when
+// -report ends in .csv, so runs can be compared with each other.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	serverURL   = flag.String("url", "ws://localhost:8080/ws", "websocket endpoint of the server")
+	sessions    = flag.Int("sessions", 100, "websocket sessions to open")
+	roomSizes   = flag.String("room-sizes", "2,4", "comma-separated room sizes, used in turn until every session has a room")
+	roomPrefix  = flag.String("room-prefix", "", "prefix of room names (default: loadgen-<random number>)")
+	rate        = flag.Float64("rate", 50, "sessions joining per second")
+	duration    = flag.Duration("duration", 30*time.Second, "how long to keep the traffic going once every session joined")
+	interval    = flag.Duration("interval", 5*time.Second, "time between negotiations in a room")
+	candidates  = flag.Int("candidates", 4, "ICE candidates each side of a synthetic negotiation trickles")
+	pionMode    = flag.Bool("pion", false, "negotiate with real PeerConnections instead of replaying synthetic SDP")
+	joinTimeout = flag.Duration("join-timeout", 10*time.Second, "how long a session may take to join")
+	grace       = flag.Duration("grace", 2*time.Second, "how long to wait for messages in flight before counting them lost")
+	reportPath  = flag.String("report", "", "file to write the report to, CSV if it ends in .csv (default: JSON on stdout)")
+)
+
+func main() {
+	flag.Parse()
+	cfg, err := parseConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	m := newMetrics()
+	started := time.Now()
+	run(ctx, cfg, m)
+	r := m.report(cfg, started, time.Since(started))
+
+	out := os.Stdout
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if strings.HasSuffix(*reportPath, ".csv") {
+		err = r.writeCSV(out)
+	} else {
+		err = r.writeJSON(out)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Joined %d of %d sessions, join p99 %.1fms, relay p99 %.1fms, %d lost, %d errors",
+		r.Sessions.Joined, r.Sessions.Attempted, r.Join.P99, r.Relay["all"].P99, r.Messages.Lost, r.errorCount())
+}
+
+// config is what a run was asked to do; the report repeats it.
+type config struct {
+	URL         string  `json:"url"`
+	Sessions    int     `json:"sessions"`
+	RoomSizes   []int   `json:"roomSizes"`
+	Rooms       int     `json:"rooms"`
+	Rate        float64 `json:"rate"`
+	Duration    string  `json:"duration"`
+	Interval    string  `json:"interval"`
+	Candidates  int     `json:"candidates"`
+	Pion        bool    `json:"pion"`
+	JoinTimeout string  `json:"joinTimeout"`
+
+	prefix string
+	plan   []int // size of every room
+}
+
+func parseConfig() (config, error) {
+	cfg := config{
+		URL:         *serverURL,
+		Sessions:    *sessions,
+		Rate:        *rate,
+		Duration:    duration.String(),
+		Interval:    interval.String(),
+		Candidates:  *candidates,
+		Pion:        *pionMode,
+		JoinTimeout: joinTimeout.String(),
+		prefix:      *roomPrefix,
+	}
+	if cfg.Sessions <= 0 || cfg.Rate <= 0 || *interval <= 0 || cfg.Candidates < 0 {
+		return cfg, fmt.Errorf("-sessions, -rate and -interval must be positive, -candidates not negative")
+	}
+	for _, s := range strings.Split(*roomSizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid room size %q", s)
+		}
+		cfg.RoomSizes = append(cfg.RoomSizes, n)
+	}
+	for left, i := cfg.Sessions, 0; left > 0; i++ {
+		n := min(cfg.RoomSizes[i%len(cfg.RoomSizes)], left)
+		cfg.plan = append(cfg.plan, n)
+		left -= n
+	}
+	cfg.Rooms = len(cfg.plan)
+	if cfg.prefix == "" {
+		cfg.prefix = fmt.Sprintf("loadgen-%04d", rand.Intn(10000))
+	}
+	return cfg, nil
+}
+
+// run joins every session, keeps the rooms busy for -duration and leaves.
+func run(ctx context.Context, cfg config, m *metrics) {
+	// Sessions join in room order, paced by one ticker for the whole run.
+	tick := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+	defer tick.Stop()
+	pace := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-tick.C:
+			return true
+		}
+	}
+
+	traffic, stopTraffic := context.WithCancel(ctx)
+	defer stopTraffic()
+	var joined, done sync.WaitGroup
+	var rooms []*room
+	log.Printf("Opening %d sessions in %d rooms on %s", cfg.Sessions, cfg.Rooms, cfg.URL)
+	for i, size := range cfg.plan {
+		r := newRoom(fmt.Sprintf("%s-%d", cfg.prefix, i), size, cfg, m)
+		rooms = append(rooms, r)
+		for j := 0; j < size; j++ {
+			if !pace() {
+				break
+			}
+			joined.Add(1)
+			go func() {
+				defer joined.Done()
+				r.join(ctx, j)
+			}()
+		}
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			r.run(traffic)
+		}()
+		if (i+1)%max(1, cfg.Rooms/10) == 0 {
+			log.Printf("%d of %d rooms joining", i+1, cfg.Rooms)
+		}
+	}
+	joined.Wait()
+	log.Printf("%d sessions joined, running traffic for %s", m.joined(), cfg.Duration)
+
+	soak, _ := time.ParseDuration(cfg.Duration)
+	select {
+	case <-ctx.Done():
+	case <-time.After(soak):
+	}
+	stopTraffic()
+	done.Wait()
+
+	// Give the last relays time to arrive before leaving.
+	time.Sleep(*grace)
+	log.Printf("Leaving")
+	for _, r := range rooms {
+		r.close()
+	}
+}
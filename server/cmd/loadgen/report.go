@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics collects what the sessions measure during a run.
+type metrics struct {
+	mu             sync.Mutex
+	attempted      int
+	join           []time.Duration
+	relay          map[string][]time.Duration // by message type
+	sentCount      map[string]int
+	deliveredCount map[string]int
+	expected       int // deliveries: every message once per other member
+	inflight       map[string]*inflight
+	errors         map[string]int
+	counters       map[string]int
+}
+
+// inflight is a relayed message not every member received yet.
+type inflight struct {
+	at        time.Time
+	remaining int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		relay:          make(map[string][]time.Duration),
+		sentCount:      make(map[string]int),
+		deliveredCount: make(map[string]int),
+		inflight:       make(map[string]*inflight),
+		errors:         make(map[string]int),
+		counters:       make(map[string]int),
+	}
+}
+
+// joinDone records a join attempt; code is empty when it succeeded.
+func (m *metrics) joinDone(d time.Duration, code string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempted++
+	if code != "" {
+		m.errors[code]++
+		return
+	}
+	m.join = append(m.join, d)
+}
+
+func (m *metrics) joined() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.join)
+}
+
+func inflightKey(typ, room, payload string) string {
+	return typ + "\x00" + room + "\x00" + messageID(typ, payload)
+}
+
+// messageID identifies a description or candidate by what the server
+// leaves alone when it rewrites one for the room's policy: the session ID
+// and version of a description's o= line, and a candidate up to its
+// address and port. Anything else is matched as a whole.
+func messageID(typ, payload string) string {
+	if typ == "candidate" {
+		if fields := strings.Fields(payload); len(fields) >= 6 {
+			return strings.Join(fields[:6], " ")
+		}
+		return payload
+	}
+	_, origin, found := strings.Cut(payload, "\no=")
+	if !found {
+		return payload
+	}
+	origin, _, _ = strings.Cut(origin, "\r\n")
+	if fields := strings.Fields(origin); len(fields) >= 3 {
+		return fields[1] + " " + fields[2]
+	}
+	return payload
+}
+
+// sent records a message about to be relayed to receivers members.
+func (m *metrics) sent(typ, room, payload string, receivers int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sentCount[typ]++
+	if receivers <= 0 {
+		return
+	}
+	m.expected += receivers
+	m.inflight[inflightKey(typ, room, payload)] = &inflight{at: time.Now(), remaining: receivers}
+}
+
+// unsent forgets a message that could not be sent.
+func (m *metrics) unsent(typ, room, payload string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := inflightKey(typ, room, payload)
+	if f := m.inflight[key]; f != nil {
+		m.expected -= f.remaining
+		delete(m.inflight, key)
+	}
+	m.sentCount[typ]--
+}
+
+// delivered records a message reaching one member.
+func (m *metrics) delivered(typ, room, payload string) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := inflightKey(typ, room, payload)
+	f := m.inflight[key]
+	if f == nil {
+		m.errors["unexpected_"+typ]++
+		return
+	}
+	m.relay[typ] = append(m.relay[typ], now.Sub(f.at))
+	m.deliveredCount[typ]++
+	if f.remaining--; f.remaining == 0 {
+		delete(m.inflight, key)
+	}
+}
+
+func (m *metrics) fail(code string) {
+	m.mu.Lock()
+	m.errors[code]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) count(name string) {
+	m.mu.Lock()
+	m.counters[name]++
+	m.mu.Unlock()
+}
+
+// report is the result of a run.
+type report struct {
+	Config   config             `json:"config"`
+	Started  time.Time          `json:"started"`
+	Elapsed  float64            `json:"elapsedSeconds"`
+	Sessions sessionCounts      `json:"sessions"`
+	Join     latency            `json:"joinLatency"`
+	Relay    map[string]latency `json:"relayLatency"` // by message type, and "all"
+	Messages messageCounts      `json:"messages"`
+	Counters map[string]int     `json:"counters,omitempty"` // such as ice_connected with -pion
+	Errors   map[string]int     `json:"errors"`
+}
+
+type sessionCounts struct {
+	Attempted int     `json:"attempted"`
+	Joined    int     `json:"joined"`
+	ErrorRate float64 `json:"errorRate"` // failed joins per attempt
+}
+
+type messageCounts struct {
+	Sent      map[string]int `json:"sent"`
+	Delivered map[string]int `json:"delivered"`
+	Expected  int            `json:"expectedDeliveries"`
+	Lost      int            `json:"lost"`
+	LossRate  float64        `json:"lossRate"`
+	PerSecond float64        `json:"deliveredPerSecond"`
+}
+
+// latency summarizes durations in milliseconds.
+type latency struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"minMs"`
+	Mean  float64 `json:"meanMs"`
+	P50   float64 `json:"p50Ms"`
+	P90   float64 `json:"p90Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+func summarize(ds []time.Duration) latency {
+	if len(ds) == 0 {
+		return latency{}
+	}
+	ds = slices.Clone(ds)
+	slices.Sort(ds)
+	ms := func(d time.Duration) float64 { return math.Round(float64(d)/float64(time.Millisecond)*1000) / 1000 }
+	// Nearest rank.
+	pct := func(p float64) float64 { return ms(ds[int(math.Ceil(p*float64(len(ds))))-1]) }
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	return latency{
+		Count: len(ds),
+		Min:   ms(ds[0]),
+		Mean:  ms(sum / time.Duration(len(ds))),
+		P50:   pct(0.50),
+		P90:   pct(0.90),
+		P99:   pct(0.99),
+		Max:   ms(ds[len(ds)-1]),
+	}
+}
+
+// report summarizes the run. Messages still in flight count as lost.
+func (m *metrics) report(cfg config, started time.Time, elapsed time.Duration) report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := report{
+		Config:  cfg,
+		Started: started.UTC(),
+		Elapsed: math.Round(elapsed.Seconds()*1000) / 1000,
+		Sessions: sessionCounts{
+			Attempted: m.attempted,
+			Joined:    len(m.join),
+		},
+		Join:     summarize(m.join),
+		Relay:    make(map[string]latency),
+		Counters: maps.Clone(m.counters),
+		Errors:   maps.Clone(m.errors),
+		Messages: messageCounts{
+			Sent:      maps.Clone(m.sentCount),
+			Delivered: maps.Clone(m.deliveredCount),
+			Expected:  m.expected,
+		},
+	}
+	if m.attempted > 0 {
+		r.Sessions.ErrorRate = float64(m.attempted-len(m.join)) / float64(m.attempted)
+	}
+	var all []time.Duration
+	for typ, ds := range m.relay {
+		r.Relay[typ] = summarize(ds)
+		all = append(all, ds...)
+	}
+	r.Relay["all"] = summarize(all)
+	for _, f := range m.inflight {
+		r.Messages.Lost += f.remaining
+	}
+	if r.Messages.Lost > 0 {
+		r.Errors["lost"] = r.Messages.Lost
+	}
+	if m.expected > 0 {
+		r.Messages.LossRate = float64(r.Messages.Lost) / float64(m.expected)
+	}
+	if elapsed > 0 {
+		r.Messages.PerSecond = math.Round(float64(len(all))/elapsed.Seconds()*10) / 10
+	}
+	return r
+}
+
+func (r report) errorCount() int {
+	n := 0
+	for _, c := range r.Errors {
+		n += c
+	}
+	return n
+}
+
+func (r report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeCSV writes one metric,value row per number, in a stable order, so
+// reports of two runs can be diffed or joined on the metric column.
+func (r report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	row := func(metric string, v float64) {
+		cw.Write([]string{metric, strconv.FormatFloat(v, 'f', -1, 64)})
+	}
+	cw.Write([]string{"metric", "value"})
+	row("sessions", float64(r.Config.Sessions))
+	row("rooms", float64(r.Config.Rooms))
+	row("elapsed_seconds", r.Elapsed)
+	row("sessions_attempted", float64(r.Sessions.Attempted))
+	row("sessions_joined", float64(r.Sessions.Joined))
+	row("join_error_rate", r.Sessions.ErrorRate)
+	latencyRows := func(prefix string, l latency) {
+		row(prefix+"_count", float64(l.Count))
+		row(prefix+"_min_ms", l.Min)
+		row(prefix+"_mean_ms", l.Mean)
+		row(prefix+"_p50_ms", l.P50)
+		row(prefix+"_p90_ms", l.P90)
+		row(prefix+"_p99_ms", l.P99)
+		row(prefix+"_max_ms", l.Max)
+	}
+	latencyRows("join", r.Join)
+	for _, typ := range slices.Sorted(maps.Keys(r.Relay)) {
+		latencyRows("relay_"+typ, r.Relay[typ])
+	}
+	for _, typ := range slices.Sorted(maps.Keys(r.Messages.Sent)) {
+		row("sent_"+typ, float64(r.Messages.Sent[typ]))
+	}
+	for _, typ := range slices.Sorted(maps.Keys(r.Messages.Delivered)) {
+		row("delivered_"+typ, float64(r.Messages.Delivered[typ]))
+	}
+	row("expected_deliveries", float64(r.Messages.Expected))
+	row("lost", float64(r.Messages.Lost))
+	row("loss_rate", r.Messages.LossRate)
+	row("delivered_per_second", r.Messages.PerSecond)
+	for _, name := range slices.Sorted(maps.Keys(r.Counters)) {
+		row(name, float64(r.Counters[name]))
+	}
+	for _, code := range slices.Sorted(maps.Keys(r.Errors)) {
+		row(fmt.Sprintf("errors_%s", code), float64(r.Errors[code]))
+	}
+	cw.Flush()
+	return cw.Error()
+}
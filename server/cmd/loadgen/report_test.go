@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestSummarize(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i >= 1; i-- {
+		ds = append(ds, time.Duration(i)*time.Millisecond)
+	}
+	got := summarize(ds)
+	want := latency{Count: 100, Min: 1, Mean: 50.5, P50: 50, P90: 90, P99: 99, Max: 100}
+	if got != want {
+		t.Errorf("summarize = %+v, want %+v", got, want)
+	}
+	if ds[0] != 100*time.Millisecond {
+		t.Error("summarize sorted its argument")
+	}
+	if got := summarize(nil); got != (latency{}) {
+		t.Errorf("summarize(nil) = %+v", got)
+	}
+}
+
+func TestReportDeliveries(t *testing.T) {
+	m := newMetrics()
+	m.joinDone(time.Millisecond, "")
+	m.joinDone(time.Millisecond, "join_username_taken")
+	m.sent("offer", "r1", "sdp", 2)
+	m.sent("offer", "r2", "sdp", 1) // same payload, another room
+	m.sent("candidate", "r1", "c", 3)
+	m.sent("answer", "r1", "gone", 1)
+	m.unsent("answer", "r1", "gone")
+	m.delivered("offer", "r1", "sdp")
+	m.delivered("offer", "r1", "sdp")
+	m.delivered("offer", "r2", "sdp")
+	m.delivered("candidate", "r1", "c")
+	m.delivered("offer", "r1", "unknown")
+
+	r := m.report(config{}, time.Now(), time.Second)
+	if r.Sessions.Attempted != 2 || r.Sessions.Joined != 1 || r.Sessions.ErrorRate != 0.5 {
+		t.Errorf("sessions %+v", r.Sessions)
+	}
+	if r.Messages.Expected != 6 || r.Messages.Lost != 2 || r.Messages.Delivered["offer"] != 3 || r.Messages.Sent["answer"] != 0 {
+		t.Errorf("messages %+v", r.Messages)
+	}
+	if r.Relay["all"].Count != 4 || r.Relay["offer"].Count != 3 {
+		t.Errorf("relay counts: all %d, offer %d", r.Relay["all"].Count, r.Relay["offer"].Count)
+	}
+	if r.Errors["lost"] != 2 || r.Errors["unexpected_offer"] != 1 || r.Errors["join_username_taken"] != 1 {
+		t.Errorf("errors %v", r.Errors)
+	}
+
+	var buf bytes.Buffer
+	if err := r.writeCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"metric,value\n", "\nsessions_joined,1\n", "\nrelay_offer_count,3\n", "\nlost,2\n", "\nerrors_lost,2\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("CSV lacks %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+// TestReportRewrites matches deliveries the server rewrote for its policy
+// with what was sent.
+func TestReportRewrites(t *testing.T) {
+	m := newMetrics()
+	offer := syntheticSDP(webrtc.SDPTypeOffer, "u1", 7)
+	candidate := "candidate:1 1 udp 1677729535 203.0.113.5 50000 typ srflx raddr 10.0.0.5 rport 50000"
+	m.sent("offer", "r1", offer, 1)
+	m.sent("candidate", "r1", candidate, 1)
+	m.delivered("offer", "r1", strings.Replace(offer, "a=rtpmap:63 red/48000/2\r\n", "", 1))
+	m.delivered("candidate", "r1", "candidate:1 1 udp 1677729535 203.0.113.5 50000 typ srflx raddr 0.0.0.0 rport 0")
+
+	r := m.report(config{}, time.Now(), time.Second)
+	if r.Messages.Lost != 0 || len(r.Errors) != 0 {
+		t.Errorf("rewritten messages not matched: lost %d, errors %v", r.Messages.Lost, r.Errors)
+	}
+}
+
+func TestSyntheticSDP(t *testing.T) {
+	for _, typ := range []webrtc.SDPType{webrtc.SDPTypeOffer, webrtc.SDPTypeAnswer} {
+		raw := syntheticSDP(typ, "u1", 42)
+		var desc sdp.SessionDescription
+		if err := desc.UnmarshalString(raw); err != nil {
+			t.Fatalf("%s does not parse: %v", typ, err)
+		}
+		if len(desc.MediaDescriptions) != 2 {
+			t.Errorf("%s has %d media sections", typ, len(desc.MediaDescriptions))
+		}
+		if len(raw) < 3000 {
+			t.Errorf("%s of %d bytes, smaller than a browser's", typ, len(raw))
+		}
+		if seq := syntheticSeq(raw); seq != 42 {
+			t.Errorf("syntheticSeq = %d, want 42", seq)
+		}
+	}
+	if syntheticSDP(webrtc.SDPTypeOffer, "u1", 1) == syntheticSDP(webrtc.SDPTypeOffer, "u1", 2) {
+		t.Error("descriptions of two negotiations are equal")
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"server/signaling"
+)
+
+// room is one room of the run. Its first member calls the second every
+// -interval; the server relays both sides to every member, as it does
+// for a browser mesh, and every member reports what reached it.
+type room struct {
+	name string
+	cfg  config
+	m    *metrics
+
+	mu      sync.Mutex
+	members []*session // by join order; nil where joining failed
+	waiting int        // joins not finished yet
+	ready   chan struct{}
+	live    atomic.Int32 // members in the room
+}
+
+func newRoom(name string, size int, cfg config, m *metrics) *room {
+	return &room{
+		name:    name,
+		cfg:     cfg,
+		m:       m,
+		members: make([]*session, size),
+		waiting: size,
+		ready:   make(chan struct{}),
+	}
+}
+
+// join opens the session of the index-th member.
+func (r *room) join(ctx context.Context, index int) {
+	s := newSession(r, index)
+	ctx, cancel := context.WithTimeout(ctx, *joinTimeout)
+	defer cancel()
+	start := time.Now()
+	err := s.sig.Connect(ctx, r.name, s.name)
+	r.m.joinDone(time.Since(start), joinErrorCode(err))
+	if err == nil {
+		r.live.Add(1)
+		go s.loop()
+	} else {
+		s.sig.Close()
+		s = nil
+	}
+
+	r.mu.Lock()
+	r.members[index] = s
+	r.waiting--
+	if r.waiting == 0 {
+		close(r.ready)
+	}
+	r.mu.Unlock()
+}
+
+// joinErrorCode sorts failed joins for the report.
+func joinErrorCode(err error) string {
+	var e *signaling.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &e):
+		return "join_" + e.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return "join_timeout"
+	}
+	return "join_failed"
+}
+
+// run negotiates a call between the first two members every -interval
+// until ctx is done.
+func (r *room) run(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-r.ready:
+	}
+	r.mu.Lock()
+	members := r.members
+	r.mu.Unlock()
+	if len(members) < 2 || members[0] == nil || members[1] == nil {
+		return
+	}
+	caller := members[0]
+
+	// Spread the rooms' negotiations over the interval.
+	wait := time.Duration(rand.Int63n(int64(*interval)))
+	for seq := 1; ; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait = *interval
+		select {
+		case caller.rounds <- seq:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// close leaves the room.
+func (r *room) close() {
+	r.mu.Lock()
+	members := r.members
+	r.mu.Unlock()
+	for _, s := range members {
+		if s != nil {
+			s.close()
+		}
+	}
+}
+
+// session is one member of a room.
+type session struct {
+	r     *room
+	index int // 0 calls, 1 answers, the others listen
+	name  string
+	sig   *signaling.Client
+
+	offers     <-chan signaling.Description
+	answers    <-chan signaling.Description
+	candidates <-chan signaling.Candidate
+	rounds     chan int // tells the caller to offer
+	leaving    atomic.Bool
+
+	// -pion, for the caller and the answerer.
+	mu      sync.Mutex
+	pc      *webrtc.PeerConnection
+	pending []webrtc.ICECandidateInit // arrived before the description
+}
+
+func newSession(r *room, index int) *session {
+	sig := signaling.New(*serverURL, signaling.Options{MaxReconnectAttempts: -1, ConnectionTimeout: *joinTimeout})
+	return &session{
+		r:          r,
+		index:      index,
+		name:       fmt.Sprintf("%s-u%d", r.name, index),
+		sig:        sig,
+		offers:     sig.Offers(),
+		answers:    sig.Answers(),
+		candidates: sig.Candidates(),
+		rounds:     make(chan int),
+	}
+}
+
+// partner is the name of the other side of the room's call.
+func (s *session) partner() string {
+	return fmt.Sprintf("%s-u%d", s.r.name, 1-s.index)
+}
+
+// loop handles what the server relays until the session closes.
+func (s *session) loop() {
+	defer func() {
+		if !s.leaving.Load() {
+			s.r.live.Add(-1)
+			s.r.m.fail("disconnected")
+		}
+	}()
+	for {
+		select {
+		case seq := <-s.rounds:
+			s.offer(seq)
+		case d, ok := <-s.offers:
+			if !ok {
+				return
+			}
+			s.r.m.delivered("offer", s.r.name, d.SDP.SDP)
+			if s.index == 1 && d.From == s.partner() {
+				s.answer(d.SDP)
+			}
+		case d, ok := <-s.answers:
+			if !ok {
+				return
+			}
+			s.r.m.delivered("answer", s.r.name, d.SDP.SDP)
+			if s.index == 0 && d.From == s.partner() {
+				s.onAnswer(d.SDP)
+			}
+		case c, ok := <-s.candidates:
+			if !ok {
+				return
+			}
+			s.r.m.delivered("candidate", s.r.name, c.Candidate.Candidate)
+			if s.index < 2 && c.From == s.partner() {
+				s.addCandidate(c.Candidate)
+			}
+		}
+	}
+}
+
+// send relays a description or candidate, expecting it to reach every
+// other member of the room.
+func (s *session) send(typ, payload string, send func() error) {
+	s.r.m.sent(typ, s.r.name, payload, int(s.r.live.Load())-1)
+	if err := send(); err != nil {
+		s.r.m.unsent(typ, s.r.name, payload)
+		s.r.m.fail("send_failed")
+	}
+}
+
+func (s *session) sendDescription(desc webrtc.SessionDescription) {
+	typ := desc.Type.String()
+	s.send(typ, desc.SDP, func() error {
+		if desc.Type == webrtc.SDPTypeOffer {
+			return s.sig.SendOffer(desc)
+		}
+		return s.sig.SendAnswer(desc)
+	})
+}
+
+func (s *session) sendCandidate(c webrtc.ICECandidateInit) {
+	s.send("candidate", c.Candidate, func() error { return s.sig.SendCandidate(c) })
+}
+
+// offer starts the seq-th negotiation of the room.
+func (s *session) offer(seq int) {
+	if !s.r.cfg.Pion {
+		s.sendDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: syntheticSDP(webrtc.SDPTypeOffer, s.name, seq)})
+		s.sendSyntheticCandidates(seq)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.newPeerConnection() {
+		return
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := s.pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendrecv}); err != nil {
+			s.r.m.fail("pion")
+			return
+		}
+	}
+	offer, err := s.pc.CreateOffer(nil)
+	if err == nil {
+		err = s.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("Offer in %s failed: %v", s.r.name, err)
+		s.r.m.fail("pion")
+		return
+	}
+	s.sendDescription(offer)
+}
+
+// answer completes a negotiation the caller started.
+func (s *session) answer(offer webrtc.SessionDescription) {
+	if !s.r.cfg.Pion {
+		seq := syntheticSeq(offer.SDP)
+		s.sendDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: syntheticSDP(webrtc.SDPTypeAnswer, s.name, seq)})
+		s.sendSyntheticCandidates(seq)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	if !s.newPeerConnection() {
+		return
+	}
+	if err := s.pc.SetRemoteDescription(offer); err != nil {
+		log.Printf("Offer in %s rejected: %v", s.r.name, err)
+		s.r.m.fail("pion")
+		return
+	}
+	s.addPending(pending)
+	answer, err := s.pc.CreateAnswer(nil)
+	if err == nil {
+		err = s.pc.SetLocalDescription(answer)
+	}
+	if err != nil {
+		log.Printf("Answer in %s failed: %v", s.r.name, err)
+		s.r.m.fail("pion")
+		return
+	}
+	s.sendDescription(answer)
+}
+
+func (s *session) onAnswer(answer webrtc.SessionDescription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pc == nil || s.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return
+	}
+	if err := s.pc.SetRemoteDescription(answer); err != nil {
+		log.Printf("Answer in %s rejected: %v", s.r.name, err)
+		s.r.m.fail("pion")
+		return
+	}
+	pending := s.pending
+	s.pending = nil
+	s.addPending(pending)
+}
+
+func (s *session) addCandidate(c webrtc.ICECandidateInit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.r.cfg.Pion {
+		return
+	}
+	if s.pc == nil || s.pc.RemoteDescription() == nil {
+		s.pending = append(s.pending, c)
+		return
+	}
+	if err := s.pc.AddICECandidate(c); err != nil {
+		s.r.m.fail("pion")
+	}
+}
+
+// addPending adds candidates kept for the current call. Caller must hold
+// s.mu.
+func (s *session) addPending(pending []webrtc.ICECandidateInit) {
+	for _, c := range pending {
+		if err := s.pc.AddICECandidate(c); err != nil {
+			s.r.m.fail("pion")
+		}
+	}
+}
+
+// newPeerConnection replaces the PeerConnection of the previous call.
+// Caller must hold s.mu.
+func (s *session) newPeerConnection() bool {
+	if s.pc != nil {
+		s.pc.Close()
+	}
+	s.pending = nil
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		log.Printf("PeerConnection error: %v", err)
+		s.r.m.fail("pion")
+		s.pc = nil
+		return false
+	}
+	s.pc = pc
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			s.sendCandidate(c.ToJSON())
+		}
+	})
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		switch state {
+		case webrtc.ICEConnectionStateConnected:
+			s.r.m.count("ice_connected")
+		case webrtc.ICEConnectionStateFailed:
+			s.r.m.fail("ice_failed")
+		}
+	})
+	return true
+}
+
+// sendSyntheticCandidates trickles -candidates host candidates.
+func (s *session) sendSyntheticCandidates(seq int) {
+	mid, index := "0", uint16(0)
+	for i := 0; i < s.r.cfg.Candidates; i++ {
+		// The foundation makes every candidate of the room unique, so
+		// deliveries can be matched with sends.
+		c := fmt.Sprintf("candidate:%d%d%02d 1 udp 2122260223 10.%d.%d.%d %d typ host generation 0 ufrag lg%02d network-id %d",
+			seq, s.index, i, s.index, seq%250, i+1, 50000+i, seq%100, i+1)
+		s.sendCandidate(webrtc.ICECandidateInit{Candidate: c, SDPMid: &mid, SDPMLineIndex: &index})
+	}
+}
+
+// close leaves the room.
+func (s *session) close() {
+	s.leaving.Store(true)
+	s.sig.Close()
+	s.mu.Lock()
+	if s.pc != nil {
+		s.pc.Close()
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// syntheticSDP returns a description shaped like a browser's: an audio
+// and a video section with the codecs, extensions and feedback Chrome
+// offers, about 4 KB. The session ID is seq, which the answerer echoes so
+// every description of a room is unique.
+func syntheticSDP(typ webrtc.SDPType, username string, seq int) string {
+	setup := "actpass"
+	if typ == webrtc.SDPTypeAnswer {
+		setup = "active"
+	}
+	ufrag := fmt.Sprintf("%08x", uint32(seq)*2654435761)
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=- %d 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n", seq)
+	b.WriteString("a=group:BUNDLE 0 1\r\na=extmap-allow-mixed\r\na=msid-semantic: WMS " + username + "\r\n")
+
+	section := func(mid int, kind, payloads string, lines []string) {
+		fmt.Fprintf(&b, "m=%s 9 UDP/TLS/RTP/SAVPF %s\r\nc=IN IP4 0.0.0.0\r\na=rtcp:9 IN IP4 0.0.0.0\r\n", kind, payloads)
+		fmt.Fprintf(&b, "a=ice-ufrag:%s\r\na=ice-pwd:%s%s%s\r\na=ice-options:trickle\r\n", ufrag[:4], ufrag, ufrag, ufrag[:6])
+		b.WriteString("a=fingerprint:sha-256 5F:1B:7A:0E:62:9C:D4:33:A8:11:4E:C0:9B:27:F5:6D:80:3A:E2:19:BC:44:07:D1:6E:95:2F:C8:73:A0:5B:E6\r\n")
+		fmt.Fprintf(&b, "a=setup:%s\r\na=mid:%d\r\n", setup, mid)
+		b.WriteString("a=extmap:1 urn:ietf:params:rtp-hdrext:ssrc-audio-level\r\na=extmap:2 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time\r\n")
+		b.WriteString("a=extmap:3 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01\r\na=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid\r\n")
+		fmt.Fprintf(&b, "a=sendrecv\r\na=msid:%s %s-%s\r\na=rtcp-mux\r\n", username, username, kind)
+		for _, l := range lines {
+			b.WriteString("a=" + l + "\r\n")
+		}
+		fmt.Fprintf(&b, "a=ssrc:%d cname:%s\r\na=ssrc:%d msid:%s %s-%s\r\n", 1000*seq+mid, ufrag, 1000*seq+mid, username, username, kind)
+	}
+	section(0, "audio", "111 63 9 0 8 13 110 126", []string{
+		"rtpmap:111 opus/48000/2", "rtcp-fb:111 transport-cc", "fmtp:111 minptime=10;useinbandfec=1",
+		"rtpmap:63 red/48000/2", "fmtp:63 111/111", "rtpmap:9 G722/8000", "rtpmap:0 PCMU/8000",
+		"rtpmap:8 PCMA/8000", "rtpmap:13 CN/8000", "rtpmap:110 telephone-event/48000", "rtpmap:126 telephone-event/8000",
+	})
+	video := []string{
+		"extmap:5 urn:ietf:params:rtp-hdrext:toffset", "extmap:6 urn:3gpp:video-orientation",
+		"extmap:7 http://www.webrtc.org/experiments/rtp-hdrext/playout-delay",
+		"extmap:8 http://www.webrtc.org/experiments/rtp-hdrext/video-content-type",
+		"extmap:9 http://www.webrtc.org/experiments/rtp-hdrext/video-timing",
+		"extmap:10 http://www.webrtc.org/experiments/rtp-hdrext/color-space",
+		"extmap:11 urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+		"extmap:12 urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+		fmt.Sprintf("ssrc-group:FID %d %d", 1000*seq+1, 1000*seq+2),
+		fmt.Sprintf("ssrc:%d cname:%s", 1000*seq+2, ufrag),
+	}
+	for i, codec := range []string{"VP8/90000", "VP9/90000", "H264/90000", "H264/90000", "AV1/90000"} {
+		pt, rtx := 96+2*i, 97+2*i
+		video = append(video,
+			fmt.Sprintf("rtpmap:%d %s", pt, codec),
+			fmt.Sprintf("rtcp-fb:%d goog-remb", pt), fmt.Sprintf("rtcp-fb:%d transport-cc", pt),
+			fmt.Sprintf("rtcp-fb:%d ccm fir", pt), fmt.Sprintf("rtcp-fb:%d nack", pt), fmt.Sprintf("rtcp-fb:%d nack pli", pt),
+			fmt.Sprintf("rtpmap:%d rtx/90000", rtx), fmt.Sprintf("fmtp:%d apt=%d", rtx, pt),
+		)
+		if strings.HasPrefix(codec, "H264") {
+			video = append(video, fmt.Sprintf("fmtp:%d level-asymmetry-allowed=1;packetization-mode=%d;profile-level-id=42e01f", pt, i-2))
+		}
+	}
+	section(1, "video", "96 97 98 99 100 101 102 103 104 105", video)
+	return b.String()
+}
+
+// syntheticSeq returns the seq a synthetic description was made for.
+func syntheticSeq(sdp string) int {
+	_, rest, _ := strings.Cut(sdp, "\r\no=- ")
+	id, _, _ := strings.Cut(rest, " ")
+	seq, _ := strconv.Atoi(id)
+	return seq
+}
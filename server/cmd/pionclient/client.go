@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+
+	"server/signaling"
+)
+
+type localTrack struct {
+	track  *webrtc.TrackLocalStaticSample
+	source mediaSource
+}
+
+// receivedTrack is a remote track and what arrived on it.
+type receivedTrack struct {
+	id, kind, codec, from, path string
+	packets, bytes              atomic.Int64
+}
+
+// client is one participant: its signaling connection and the
+// PeerConnection of its call, either with another participant, the way
+// browsers call, or with the server's SFU.
+type client struct {
+	sig      *signaling.Client
+	room     string
+	username string
+	sfu      bool
+	config   webrtc.Configuration
+	tracks   []localTrack
+	record   string // directory received tracks are saved in, empty for none
+
+	mu       sync.Mutex
+	pc       *webrtc.PeerConnection
+	remote   string // peer-to-peer: who the call is with, empty until connected
+	pending  []pendingCandidate
+	owners   map[string]string // SFU: track ID -> username of the publisher
+	received []*receivedTrack
+	wg       sync.WaitGroup // track readers
+	closed   bool
+}
+
+// pendingCandidate arrived before the description it belongs to.
+type pendingCandidate struct {
+	from string
+	init webrtc.ICECandidateInit
+}
+
+// newPeerConnection creates a PeerConnection publishing the local tracks.
+// Caller must hold c.mu.
+func (c *client) newPeerConnection() (*webrtc.PeerConnection, error) {
+	pc, err := webrtc.NewPeerConnection(c.config)
+	if err != nil {
+		return nil, err
+	}
+
+	kinds := map[webrtc.RTPCodecType]bool{}
+	for _, t := range c.tracks {
+		sender, err := pc.AddTrack(t.track)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		kinds[t.track.Kind()] = true
+		go readRTCP(sender, t.source)
+	}
+	// A peer-to-peer offer must have room for what the other side sends,
+	// and the SFU rejects offers without any media.
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if kinds[kind] {
+			continue
+		}
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+
+	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
+		if cand == nil {
+			return
+		}
+		send := c.sig.SendCandidate
+		if c.sfu {
+			send = c.sig.SendSFUCandidate
+		}
+		if err := send(cand.ToJSON()); err != nil {
+			log.Printf("Error sending candidate: %v", err)
+		}
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		c.receive(pc, remote)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("Connection state: %s", state)
+	})
+	return pc, nil
+}
+
+// readRTCP drains what receivers report about a published track and
+// passes keyframe requests on to its source.
+func readRTCP(sender *webrtc.RTPSender, source mediaSource) {
+	kf, _ := source.(keyframer)
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if kf != nil {
+					kf.requestKeyframe()
+				}
+			}
+		}
+	}
+}
+
+// start begins the call: with the SFU, or by offering a call to whoever
+// is in the room.
+func (c *client) start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := c.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	if c.sfu {
+		return c.sig.SendSFUOffer(offer)
+	}
+	return c.sig.SendOffer(offer)
+}
+
+// restart calls again after the client rejoined the room: the server
+// dropped its SFU connection and the other participant hung up.
+func (c *client) restart() error {
+	c.mu.Lock()
+	c.resetCall()
+	c.mu.Unlock()
+	return c.start()
+}
+
+// onRoomInfo hangs up when the other participant left.
+func (c *client) onRoomInfo(info signaling.RoomInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	log.Printf("Room '%s': %v", c.room, info.Users)
+	if !c.sfu && c.remote != "" && !slices.Contains(info.Users, c.remote) {
+		log.Printf("User '%s' left, call ended", c.remote)
+		c.resetCall()
+	}
+}
+
+// onCandidate adds a candidate of the peer-to-peer call.
+func (c *client) onCandidate(cand signaling.Candidate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.sfu && (c.remote == "" || cand.From == c.remote) {
+		c.addCandidate(cand.From, cand.Candidate)
+	}
+}
+
+// onOffer answers a peer-to-peer call. While its own offer is unanswered,
+// the client with the smaller username keeps it and sends it again for
+// the newcomer, which yields.
+func (c *client) onOffer(from string, offer webrtc.SessionDescription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sfu {
+		return
+	}
+	if c.remote != "" && from != c.remote {
+		log.Printf("Ignoring offer from '%s', in a call with '%s'", from, c.remote)
+		return
+	}
+	if c.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if c.username < from {
+			if err := c.sig.SendOffer(*c.pc.LocalDescription()); err != nil {
+				log.Printf("Error sending offer: %v", err)
+			}
+			return
+		}
+		// Pion cannot roll an offer back; start over instead.
+		c.pc.Close()
+		pc, err := c.newPeerConnection()
+		if err != nil {
+			log.Printf("PeerConnection error: %v", err)
+			return
+		}
+		c.pc = pc
+	}
+
+	if err := c.pc.SetRemoteDescription(offer); err != nil {
+		log.Printf("Offer from '%s' rejected: %v", from, err)
+		return
+	}
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("Answer for '%s' failed: %v", from, err)
+		return
+	}
+	if err := c.pc.SetLocalDescription(answer); err != nil {
+		log.Printf("Answer for '%s' failed: %v", from, err)
+		return
+	}
+	if err := c.sig.SendAnswer(answer); err != nil {
+		log.Printf("Error sending answer: %v", err)
+	}
+	if c.remote == "" {
+		log.Printf("In a call with '%s'", from)
+	}
+	c.remote = from
+	c.addPendingCandidates()
+}
+
+// onAnswer completes a call the client offered.
+func (c *client) onAnswer(from string, answer webrtc.SessionDescription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sfu || c.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer || (c.remote != "" && from != c.remote) {
+		return
+	}
+	if err := c.pc.SetRemoteDescription(answer); err != nil {
+		log.Printf("Answer from '%s' rejected: %v", from, err)
+		return
+	}
+	log.Printf("In a call with '%s'", from)
+	c.remote = from
+	c.addPendingCandidates()
+}
+
+// onSFUOffer answers the server when it changes what the client receives.
+func (c *client) onSFUOffer(offer signaling.Description) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.sfu {
+		return
+	}
+	for _, t := range offer.Tracks {
+		c.owners[t.TrackID] = t.Username
+	}
+	if err := c.pc.SetRemoteDescription(offer.SDP); err != nil {
+		log.Printf("SFU offer rejected: %v", err)
+		return
+	}
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("SFU answer failed: %v", err)
+		return
+	}
+	if err := c.pc.SetLocalDescription(answer); err != nil {
+		log.Printf("SFU answer failed: %v", err)
+		return
+	}
+	if err := c.sig.SendSFUAnswer(answer); err != nil {
+		log.Printf("Error sending SFU answer: %v", err)
+	}
+	c.addPendingCandidates()
+}
+
+// onSFUAnswer completes an offer the client sent the SFU.
+func (c *client) onSFUAnswer(answer webrtc.SessionDescription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.sfu {
+		return
+	}
+	if err := c.pc.SetRemoteDescription(answer); err != nil {
+		log.Printf("SFU answer rejected: %v", err)
+		return
+	}
+	c.addPendingCandidates()
+}
+
+// onSFUCandidate adds a candidate of the SFU.
+func (c *client) onSFUCandidate(cand webrtc.ICECandidateInit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sfu {
+		c.addCandidate("", cand)
+	}
+}
+
+// addCandidate adds a remote candidate, or keeps it until the remote
+// description arrives. Caller must hold c.mu.
+func (c *client) addCandidate(from string, init webrtc.ICECandidateInit) {
+	if c.pc.RemoteDescription() == nil {
+		c.pending = append(c.pending, pendingCandidate{from: from, init: init})
+		return
+	}
+	if err := c.pc.AddICECandidate(init); err != nil {
+		log.Printf("Candidate rejected: %v", err)
+	}
+}
+
+// addPendingCandidates adds the kept candidates of the call's remote side.
+// Caller must hold c.mu.
+func (c *client) addPendingCandidates() {
+	for _, p := range c.pending {
+		if p.from != c.remote {
+			continue
+		}
+		if err := c.pc.AddICECandidate(p.init); err != nil {
+			log.Printf("Candidate rejected: %v", err)
+		}
+	}
+	c.pending = nil
+}
+
+// resetCall hangs up and waits for the next participant to call. Caller
+// must hold c.mu.
+func (c *client) resetCall() {
+	c.pc.Close()
+	c.remote = ""
+	c.pending = nil
+	pc, err := c.newPeerConnection()
+	if err != nil {
+		log.Printf("PeerConnection error: %v", err)
+		return
+	}
+	c.pc = pc
+}
+
+// receive reads a remote track until it ends, saving it with -record.
+func (c *client) receive(pc *webrtc.PeerConnection, remote *webrtc.TrackRemote) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	from := remote.StreamID()
+	if c.sfu {
+		if owner, ok := c.owners[remote.ID()]; ok {
+			from = owner
+		}
+	} else if c.remote != "" {
+		from = c.remote
+	}
+	rt := &receivedTrack{
+		id:    remote.ID(),
+		kind:  remote.Kind().String(),
+		codec: remote.Codec().MimeType,
+		from:  from,
+	}
+	c.received = append(c.received, rt)
+	c.wg.Add(1)
+	c.mu.Unlock()
+	defer c.wg.Done()
+
+	log.Printf("Receiving %s track %s (%s) from '%s'", rt.kind, rt.id, rt.codec, rt.from)
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		// Recordings and players need a keyframe to start from.
+		if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())}}); err != nil {
+			log.Printf("Error requesting keyframe: %v", err)
+		}
+	}
+
+	var rec recorder
+	if c.record != "" {
+		var err error
+		rec, rt.path, err = newRecorder(c.record, rt.id, remote.Codec())
+		switch {
+		case err != nil:
+			log.Printf("Not saving track %s: %v", rt.id, err)
+		case rec == nil:
+			log.Printf("Not saving track %s: cannot save %s", rt.id, rt.codec)
+		}
+	}
+	defer func() {
+		if rec != nil {
+			rec.Close()
+		}
+	}()
+
+	for {
+		p, _, err := remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		rt.packets.Add(1)
+		rt.bytes.Add(int64(len(p.Payload)))
+		if rec != nil {
+			if err := rec.WriteRTP(p); err != nil {
+				log.Printf("Error saving track %s: %v", rt.id, err)
+				rec.Close()
+				rec = nil
+			}
+		}
+	}
+}
+
+// close hangs up and waits for the received tracks to be saved. Calling
+// it again does nothing.
+func (c *client) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.pc.Close()
+	c.mu.Unlock()
+
+	c.sig.Close()
+	c.wg.Wait()
+}
+
+// report logs what arrived and returns how many tracks delivered media.
+func (c *client) report() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, rt := range c.received {
+		line := fmt.Sprintf("Track %s (%s %s) from '%s': %d packets, %d bytes", rt.id, rt.kind, rt.codec, rt.from, rt.packets.Load(), rt.bytes.Load())
+		if rt.path != "" {
+			line += ", saved to " + rt.path
+		}
+		log.Print(line)
+		if rt.packets.Load() > 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,273 @@
+package main
+
+import "math/bits"
+
+// A minimal H.264 encoder for the generated test pattern, so the client
+// needs no codec library. Keyframes carry every macroblock as I_PCM, that
+// is raw samples. Later frames are P slices: macroblocks that did not
+// change are skipped and the others are sent as I_PCM again. This costs
+// bandwidth (a 320x240 keyframe is about 115 KB) but any decoder plays it.
+
+const (
+	nalSlice = 1
+	nalIDR   = 5
+	nalSPS   = 7
+	nalPPS   = 8
+
+	sliceP = 5 // slice_type values meaning all slices of the picture have this type
+	sliceI = 7
+
+	mbTypeIPCM  = 25 // mb_type of I_PCM in I slices
+	mbTypePIPCM = 30 // and in P slices, where intra types start at 5
+
+	// log2MaxFrameNum is the width of frame_num in slice headers.
+	log2MaxFrameNum = 4
+
+	// h264ProfileLevelID is constrained baseline, level 3.1.
+	h264ProfileLevelID = "42e01f"
+)
+
+// frame is a picture in I420 layout.
+type frame struct {
+	width, height int
+	y, u, v       []byte
+}
+
+func newFrame(width, height int) *frame {
+	return &frame{
+		width:  width,
+		height: height,
+		y:      make([]byte, width*height),
+		u:      make([]byte, width*height/4),
+		v:      make([]byte, width*height/4),
+	}
+}
+
+// h264Encoder turns frames of a fixed size, multiples of 16, into Annex B
+// access units.
+type h264Encoder struct {
+	width, height int
+	prev          *frame // last frame encoded, the reference of P slices
+	frameNum      uint32
+	idrPicID      uint32
+}
+
+func newH264Encoder(width, height int) *h264Encoder {
+	return &h264Encoder{width: width, height: height}
+}
+
+// encode returns f as an access unit. The first frame and those with
+// keyframe set are IDR pictures preceded by SPS and PPS. f must not be
+// modified afterwards.
+func (e *h264Encoder) encode(f *frame, keyframe bool) []byte {
+	var out []byte
+	if keyframe || e.prev == nil {
+		e.frameNum = 0
+		out = appendNAL(out, 3<<5|nalSPS, e.sps())
+		out = appendNAL(out, 3<<5|nalPPS, e.pps())
+		out = appendNAL(out, 3<<5|nalIDR, e.slice(f, true))
+		// Consecutive IDR pictures must differ in idr_pic_id.
+		e.idrPicID = (e.idrPicID + 1) % 2
+	} else {
+		out = appendNAL(out, 2<<5|nalSlice, e.slice(f, false))
+	}
+	e.frameNum = (e.frameNum + 1) % (1 << log2MaxFrameNum)
+	e.prev = f
+	return out
+}
+
+func (e *h264Encoder) sps() []byte {
+	var w bitWriter
+	w.bits(66, 8)   // profile_idc: baseline
+	w.bits(0xe0, 8) // constraint_set0..2_flag, reserved_zero_5bits
+	w.bits(31, 8)   // level_idc
+	w.ue(0)         // seq_parameter_set_id
+	w.ue(log2MaxFrameNum - 4)
+	w.ue(2)      // pic_order_cnt_type: output order is decoding order
+	w.ue(1)      // max_num_ref_frames
+	w.bits(0, 1) // gaps_in_frame_num_value_allowed_flag
+	w.ue(uint32(e.width/16 - 1))
+	w.ue(uint32(e.height/16 - 1))
+	w.bits(1, 1) // frame_mbs_only_flag
+	w.bits(1, 1) // direct_8x8_inference_flag
+	w.bits(0, 1) // frame_cropping_flag
+	w.bits(0, 1) // vui_parameters_present_flag
+	w.trailing()
+	return w.buf
+}
+
+func (e *h264Encoder) pps() []byte {
+	var w bitWriter
+	w.ue(0)      // pic_parameter_set_id
+	w.ue(0)      // seq_parameter_set_id
+	w.bits(0, 1) // entropy_coding_mode_flag: CAVLC
+	w.bits(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)      // num_slice_groups_minus1
+	w.ue(0)      // num_ref_idx_l0_default_active_minus1
+	w.ue(0)      // num_ref_idx_l1_default_active_minus1
+	w.bits(0, 1) // weighted_pred_flag
+	w.bits(0, 2) // weighted_bipred_idc
+	w.se(0)      // pic_init_qp_minus26
+	w.se(0)      // pic_init_qs_minus26
+	w.se(0)      // chroma_qp_index_offset
+	w.bits(1, 1) // deblocking_filter_control_present_flag
+	w.bits(0, 1) // constrained_intra_pred_flag
+	w.bits(0, 1) // redundant_pic_cnt_present_flag
+	w.trailing()
+	return w.buf
+}
+
+// slice codes f as a single slice. In an IDR slice every macroblock is
+// I_PCM; in a P slice only those that differ from the previous frame.
+func (e *h264Encoder) slice(f *frame, idr bool) []byte {
+	var w bitWriter
+	w.ue(0) // first_mb_in_slice
+	if idr {
+		w.ue(sliceI)
+	} else {
+		w.ue(sliceP)
+	}
+	w.ue(0) // pic_parameter_set_id
+	w.bits(e.frameNum, log2MaxFrameNum)
+	if idr {
+		w.ue(e.idrPicID)
+		w.bits(0, 1) // no_output_of_prior_pics_flag
+		w.bits(0, 1) // long_term_reference_flag
+	} else {
+		w.bits(0, 1) // num_ref_idx_active_override_flag
+		w.bits(0, 1) // ref_pic_list_modification_flag_l0
+		w.bits(0, 1) // adaptive_ref_pic_marking_mode_flag
+	}
+	w.se(0) // slice_qp_delta
+	w.ue(1) // disable_deblocking_filter_idc: I_PCM needs no filtering
+
+	mbWidth, mbHeight := e.width/16, e.height/16
+	skipped := uint32(0)
+	for mby := 0; mby < mbHeight; mby++ {
+		for mbx := 0; mbx < mbWidth; mbx++ {
+			if idr {
+				w.ue(mbTypeIPCM)
+				writePCM(&w, f, mbx, mby)
+				continue
+			}
+			if !macroblockChanged(f, e.prev, mbx, mby) {
+				skipped++
+				continue
+			}
+			w.ue(skipped) // mb_skip_run
+			skipped = 0
+			w.ue(mbTypePIPCM)
+			writePCM(&w, f, mbx, mby)
+		}
+	}
+	if skipped > 0 {
+		w.ue(skipped)
+	}
+	w.trailing()
+	return w.buf
+}
+
+// writePCM writes the samples of a macroblock after its mb_type.
+func writePCM(w *bitWriter, f *frame, mbx, mby int) {
+	w.align() // pcm_alignment_zero_bit
+	for row := 0; row < 16; row++ {
+		off := (mby*16+row)*f.width + mbx*16
+		w.samples(f.y[off : off+16])
+	}
+	for _, plane := range [][]byte{f.u, f.v} {
+		for row := 0; row < 8; row++ {
+			off := (mby*8+row)*f.width/2 + mbx*8
+			w.samples(plane[off : off+8])
+		}
+	}
+}
+
+func macroblockChanged(f, prev *frame, mbx, mby int) bool {
+	for row := 0; row < 16; row++ {
+		off := (mby*16+row)*f.width + mbx*16
+		if string(f.y[off:off+16]) != string(prev.y[off:off+16]) {
+			return true
+		}
+	}
+	for _, planes := range [][2][]byte{{f.u, prev.u}, {f.v, prev.v}} {
+		for row := 0; row < 8; row++ {
+			off := (mby*8+row)*f.width/2 + mbx*8
+			if string(planes[0][off:off+8]) != string(planes[1][off:off+8]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appendNAL appends a NAL unit with a start code to out, inserting
+// emulation prevention bytes into rbsp.
+func appendNAL(out []byte, header byte, rbsp []byte) []byte {
+	out = append(out, 0, 0, 0, 1, header)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// bitWriter writes the bit fields of an RBSP, most significant bit first.
+type bitWriter struct {
+	buf []byte
+	n   uint // bits used in the last byte of buf, 0 when aligned
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>uint(i)&1) << (7 - w.n)
+		w.n = (w.n + 1) % 8
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code.
+func (w *bitWriter) ue(v uint32) {
+	n := bits.Len32(v + 1)
+	w.bits(0, n-1)
+	w.bits(v+1, n)
+}
+
+// se writes a signed Exp-Golomb code.
+func (w *bitWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+func (w *bitWriter) align() {
+	if w.n != 0 {
+		w.bits(0, int(8-w.n))
+	}
+}
+
+// samples writes 8-bit samples at a byte boundary. Zero is avoided: older
+// decoders reject it in I_PCM macroblocks.
+func (w *bitWriter) samples(s []byte) {
+	for _, b := range s {
+		w.buf = append(w.buf, max(b, 1))
+	}
+}
+
+// trailing writes rbsp_trailing_bits.
+func (w *bitWriter) trailing() {
+	w.bits(1, 1)
+	w.align()
+}
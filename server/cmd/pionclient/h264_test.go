@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// bitReader reads the fields bitWriter writes.
+type bitReader struct {
+	t   *testing.T
+	buf []byte
+	pos int // in bits
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos/8 >= len(r.buf) {
+			r.t.Fatalf("read past the end of a %d byte RBSP", len(r.buf))
+		}
+		v = v<<1 | uint32(r.buf[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 {
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+func (r *bitReader) align() {
+	for r.pos%8 != 0 {
+		if r.bits(1) != 0 {
+			r.t.Fatal("non-zero alignment bit")
+		}
+	}
+}
+
+// trailing checks that only rbsp_trailing_bits are left.
+func (r *bitReader) trailing() {
+	if r.bits(1) != 1 {
+		r.t.Fatal("missing rbsp_stop_one_bit")
+	}
+	r.align()
+	if r.pos/8 != len(r.buf) {
+		r.t.Fatalf("%d bytes after the trailing bits", len(r.buf)-r.pos/8)
+	}
+}
+
+// splitNALs splits an access unit at its start codes and removes
+// emulation prevention bytes.
+func splitNALs(t *testing.T, au []byte) [][]byte {
+	t.Helper()
+	var nals [][]byte
+	for _, chunk := range bytes.Split(au, []byte{0, 0, 0, 1})[1:] {
+		if bytes.Contains(chunk, []byte{0, 0, 0}) || bytes.Contains(chunk, []byte{0, 0, 1}) || bytes.Contains(chunk, []byte{0, 0, 2}) {
+			t.Fatal("start code emulated inside a NAL unit")
+		}
+		nal := chunk[:1]
+		zeros := 0
+		for _, b := range chunk[1:] {
+			if zeros == 2 && b == 3 {
+				zeros = 0
+				continue
+			}
+			nal = append(nal, b)
+			if b == 0 {
+				zeros++
+			} else {
+				zeros = 0
+			}
+		}
+		nals = append(nals, nal)
+	}
+	return nals
+}
+
+// decoder reconstructs what h264Encoder produces, and nothing else.
+type decoder struct {
+	t             *testing.T
+	width, height int
+	frame         *frame
+}
+
+func (d *decoder) decode(au []byte) (idr bool) {
+	t := d.t
+	t.Helper()
+	for _, nal := range splitNALs(t, au) {
+		r := &bitReader{t: t, buf: nal[1:]}
+		switch nal[0] & 0x1f {
+		case nalSPS:
+			if profile := r.bits(8); profile != 66 {
+				t.Errorf("profile_idc %d", profile)
+			}
+			r.bits(16) // constraint flags, level_idc
+			r.ue()     // seq_parameter_set_id
+			if got := r.ue() + 4; got != log2MaxFrameNum {
+				t.Errorf("log2_max_frame_num %d", got)
+			}
+			if got := r.ue(); got != 2 {
+				t.Errorf("pic_order_cnt_type %d", got)
+			}
+			r.ue()
+			r.bits(1)
+			d.width = int(r.ue()+1) * 16
+			d.height = int(r.ue()+1) * 16
+			r.bits(4)
+			r.trailing()
+		case nalPPS:
+			r.ue()
+			r.ue()
+			if r.bits(1) != 0 {
+				t.Error("CABAC enabled")
+			}
+			r.bits(1)
+			r.ue()
+			r.ue()
+			r.ue()
+			r.bits(3)
+			r.se()
+			r.se()
+			r.se()
+			if r.bits(1) != 1 {
+				t.Error("deblocking filter control absent")
+			}
+			r.bits(2)
+			r.trailing()
+		case nalIDR, nalSlice:
+			idr = nal[0]&0x1f == nalIDR
+			d.slice(r, idr)
+		default:
+			t.Fatalf("unexpected NAL unit type %d", nal[0]&0x1f)
+		}
+	}
+	return idr
+}
+
+func (d *decoder) slice(r *bitReader, idr bool) {
+	t := d.t
+	if d.width == 0 {
+		t.Fatal("slice before SPS")
+	}
+	if !idr && d.frame == nil {
+		t.Fatal("P slice without a reference")
+	}
+	r.ue() // first_mb_in_slice
+	sliceType := r.ue()
+	if (idr && sliceType != sliceI) || (!idr && sliceType != sliceP) {
+		t.Fatalf("slice_type %d in IDR=%v", sliceType, idr)
+	}
+	r.ue()
+	frameNum := r.bits(log2MaxFrameNum)
+	if idr {
+		if frameNum != 0 {
+			t.Errorf("IDR frame_num %d", frameNum)
+		}
+		r.ue()
+		r.bits(2)
+	} else {
+		r.bits(3)
+	}
+	r.se()
+	if r.ue() != 1 {
+		t.Error("deblocking enabled")
+	}
+
+	f := newFrame(d.width, d.height)
+	if !idr {
+		copy(f.y, d.frame.y)
+		copy(f.u, d.frame.u)
+		copy(f.v, d.frame.v)
+	}
+	mbWidth := d.width / 16
+	total := mbWidth * d.height / 16
+	for mb := 0; mb < total; mb++ {
+		if !idr {
+			mb += int(r.ue()) // skipped macroblocks keep the reference
+			if mb == total {
+				break
+			}
+		}
+		want := uint32(mbTypeIPCM)
+		if !idr {
+			want = mbTypePIPCM
+		}
+		if mbType := r.ue(); mbType != want {
+			t.Fatalf("mb_type %d, want %d", mbType, want)
+		}
+		r.align()
+		mbx, mby := mb%mbWidth, mb/mbWidth
+		for row := 0; row < 16; row++ {
+			for col := 0; col < 16; col++ {
+				f.y[(mby*16+row)*d.width+mbx*16+col] = byte(r.bits(8))
+			}
+		}
+		for _, plane := range [][]byte{f.u, f.v} {
+			for row := 0; row < 8; row++ {
+				for col := 0; col < 8; col++ {
+					plane[(mby*8+row)*d.width/2+mbx*8+col] = byte(r.bits(8))
+				}
+			}
+		}
+	}
+	r.trailing()
+	d.frame = f
+}
+
+func TestH264Encoder(t *testing.T) {
+	const w, h = 96, 64
+	p := newTestPattern(w, h, 15, time.Second)
+	enc := newH264Encoder(w, h)
+	d := &decoder{t: t}
+
+	var keySize int
+	for n := 0; n < 12; n++ {
+		f := p.render(n)
+		au := enc.encode(f, n == 8)
+		idr := d.decode(au)
+		if wantIDR := n == 0 || n == 8; idr != wantIDR {
+			t.Errorf("frame %d: IDR = %v, want %v", n, idr, wantIDR)
+		}
+		if !bytes.Equal(d.frame.y, f.y) || !bytes.Equal(d.frame.u, f.u) || !bytes.Equal(d.frame.v, f.v) {
+			t.Fatalf("frame %d decodes to a different picture", n)
+		}
+		if idr {
+			keySize = len(au)
+		} else if len(au) >= keySize/2 {
+			t.Errorf("frame %d: P frame of %d bytes, keyframe %d", n, len(au), keySize)
+		}
+	}
+}
+
+func TestH264EncoderUnchangedFrame(t *testing.T) {
+	p := newTestPattern(32, 32, 15, time.Hour)
+	enc := newH264Encoder(32, 32)
+	d := &decoder{t: t}
+	d.decode(enc.encode(p.render(0), false))
+	au := enc.encode(p.render(0), false)
+	d.decode(au)
+	// Start code, NAL header and a slice of skipped macroblocks.
+	if len(au) > 12 {
+		t.Errorf("unchanged frame took %d bytes", len(au))
+	}
+}
+
+func TestLinearToMulaw(t *testing.T) {
+	for _, tc := range []struct {
+		in   int16
+		want byte
+	}{
+		{0, 0xff},
+		{-1, 0x7f},
+		{32767, 0x80},
+		{-32768, 0x00},
+		{1000, 0xce},
+		{-1000, 0x4e},
+	} {
+		if got := linearToMulaw(tc.in); got != tc.want {
+			t.Errorf("linearToMulaw(%d) = %#x, want %#x", tc.in, got, tc.want)
+		}
+	}
+}
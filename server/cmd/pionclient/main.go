@@ -0,0 +1,212 @@
+// Command pionclient is a headless participant for scripting calls against
+// the server. It joins a room over /ws, publishes generated or recorded
+// media and can save what it receives:
+//
+//	pionclient -room demo -record out/ -duration 30s -expect-tracks 2
+//
+// By default it calls the other participant peer to peer, as the browser
+// client does; with -sfu it sends and receives through the server's SFU.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"server/signaling"
+)
+
+var (
+	serverURL = flag.String("url", "ws://localhost:8080/ws", "websocket endpoint of the server")
+	room      = flag.String("room", "test", "room to join")
+	username  = flag.String("username", "", "name in the room (default: pionclient-<random number>)")
+	sfuMode   = flag.Bool("sfu", false, "send and receive media through the server's SFU instead of calling another participant")
+
+	video            = flag.String("video", "testsrc", "video to publish: testsrc (H.264 test pattern), none, or an .ivf or .h264 file")
+	audio            = flag.String("audio", "tone", "audio to publish: tone (PCMU sine wave), none, or an .ogg (Opus) file")
+	loop             = flag.Bool("loop", false, "play -video and -audio files again when they end")
+	width            = flag.Int("width", 320, "test pattern width, a multiple of 16")
+	height           = flag.Int("height", 240, "test pattern height, a multiple of 16")
+	fps              = flag.Int("fps", 15, "frame rate of the test pattern and of .h264 files")
+	keyframeInterval = flag.Duration("keyframe-interval", 3*time.Second, "time between test pattern keyframes")
+	toneFreq         = flag.Float64("tone-freq", 440, "frequency of the test tone, in Hz")
+
+	recordDir    = flag.String("record", "", "directory to save received tracks in (empty: do not save)")
+	stunURL      = flag.String("stun", "stun:stun.l.google.com:19302", "STUN server (empty: host candidates only)")
+	duration     = flag.Duration("duration", 0, "leave the room after this long (0: run until interrupted)")
+	expectTracks = flag.Int("expect-tracks", 0, "exit with status 1 unless at least this many remote tracks delivered media")
+)
+
+func main() {
+	flag.Parse()
+	if *username == "" {
+		*username = fmt.Sprintf("pionclient-%04d", rand.Intn(10000))
+	}
+	if *fps <= 0 {
+		log.Fatalf("Invalid -fps %d", *fps)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	received, err := run(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if received < *expectTracks {
+		log.Printf("Media arrived on %d tracks, expected %d", received, *expectTracks)
+		os.Exit(1)
+	}
+}
+
+// run takes part in the call until ctx is done and returns the number of
+// remote tracks media arrived on.
+func run(ctx context.Context) (int, error) {
+	c := &client{
+		room:     *room,
+		username: *username,
+		sfu:      *sfuMode,
+		record:   *recordDir,
+		owners:   make(map[string]string),
+	}
+	if *stunURL != "" {
+		c.config.ICEServers = []webrtc.ICEServer{{URLs: []string{*stunURL}}}
+	}
+
+	videoSource, err := openVideo(*video)
+	if err != nil {
+		return 0, err
+	}
+	audioSource, err := openAudio(*audio)
+	if err != nil {
+		return 0, err
+	}
+	for _, source := range []mediaSource{videoSource, audioSource} {
+		if source == nil {
+			continue
+		}
+		kind := webrtc.RTPCodecTypeVideo
+		if source == audioSource {
+			kind = webrtc.RTPCodecTypeAudio
+		}
+		// Track IDs must be unique in the room, as those of browsers are.
+		track, err := webrtc.NewTrackLocalStaticSample(source.codec(), c.username+"-"+kind.String(), c.username)
+		if err != nil {
+			return 0, err
+		}
+		c.tracks = append(c.tracks, localTrack{track: track, source: source})
+	}
+	if c.record != "" {
+		if err := os.MkdirAll(c.record, 0o755); err != nil {
+			return 0, err
+		}
+	}
+
+	c.sig = signaling.New(*serverURL, signaling.Options{})
+	roomInfo, states, errs := c.sig.RoomInfo(), c.sig.States(), c.sig.Errors()
+	offers, answers, candidates := c.sig.Offers(), c.sig.Answers(), c.sig.Candidates()
+	sfuOffers, sfuAnswers, sfuCandidates := c.sig.SFUOffers(), c.sig.SFUAnswers(), c.sig.SFUCandidates()
+	log.Printf("Joining room '%s' as '%s' on %s", c.room, c.username, *serverURL)
+	if err := c.sig.Connect(ctx, c.room, c.username); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.pc, err = c.newPeerConnection()
+	c.mu.Unlock()
+	if err != nil {
+		c.sig.Close()
+		return 0, err
+	}
+	defer c.close()
+
+	for _, t := range c.tracks {
+		go func() {
+			if err := t.source.run(ctx, t.track); err != nil {
+				log.Printf("Publishing %s stopped: %v", t.track.Kind(), err)
+			}
+		}()
+	}
+	if err := c.start(); err != nil {
+		return 0, err
+	}
+
+	// The signaling client closes every channel once it gave up
+	// reconnecting.
+	reconnecting := false
+	for {
+		var ok bool
+		select {
+		case <-ctx.Done():
+			log.Printf("Leaving room '%s'", c.room)
+			c.close()
+			return c.report(), nil
+		case state, open := <-states:
+			ok = open && state != signaling.Closed
+			switch state {
+			case signaling.Reconnecting:
+				log.Printf("Connection to the server lost, reconnecting")
+				reconnecting = true
+			case signaling.Connected:
+				if !reconnecting {
+					break // Connect returned already
+				}
+				reconnecting = false
+				log.Printf("Rejoined room '%s'", c.room)
+				if err := c.restart(); err != nil {
+					log.Printf("Error calling again: %v", err)
+				}
+			}
+		case e, open := <-errs:
+			if ok = open; ok {
+				log.Printf("Server error %s: %s", e.Code, e.Message)
+			}
+		case info, open := <-roomInfo:
+			if ok = open; ok {
+				c.onRoomInfo(info)
+			}
+		case d, open := <-offers:
+			if ok = open; ok {
+				c.onOffer(d.From, d.SDP)
+			}
+		case d, open := <-answers:
+			if ok = open; ok {
+				c.onAnswer(d.From, d.SDP)
+			}
+		case cand, open := <-candidates:
+			if ok = open; ok {
+				c.onCandidate(cand)
+			}
+		case d, open := <-sfuOffers:
+			if ok = open; ok {
+				c.onSFUOffer(d)
+			}
+		case d, open := <-sfuAnswers:
+			if ok = open; ok {
+				c.onSFUAnswer(d.SDP)
+			}
+		case cand, open := <-sfuCandidates:
+			if ok = open; ok {
+				c.onSFUCandidate(cand.Candidate)
+			}
+		}
+		if !ok {
+			log.Printf("Connection to the server closed")
+			c.close()
+			return c.report(), nil
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// mediaSource produces the samples of one published track.
+type mediaSource interface {
+	codec() webrtc.RTPCodecCapability
+	// run writes samples to track in real time until ctx is done or,
+	// unless looping, the source ends.
+	run(ctx context.Context, track *webrtc.TrackLocalStaticSample) error
+}
+
+// keyframer is a source that can produce a keyframe when a receiver
+// asks for one.
+type keyframer interface {
+	requestKeyframe()
+}
+
+var (
+	h264Codec = webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + h264ProfileLevelID,
+	}
+	pcmuCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000, Channels: 1}
+	opusCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+)
+
+// openVideo returns the source named by -video, nil for "none".
+func openVideo(spec string) (mediaSource, error) {
+	switch spec {
+	case "none":
+		return nil, nil
+	case "testsrc":
+		if *width%16 != 0 || *height%16 != 0 || *width <= 0 || *height <= 0 {
+			return nil, fmt.Errorf("test pattern size %dx%d is not a multiple of 16", *width, *height)
+		}
+		return newTestPattern(*width, *height, *fps, *keyframeInterval), nil
+	}
+	switch strings.ToLower(filepath.Ext(spec)) {
+	case ".ivf":
+		return openIVF(spec)
+	case ".h264", ".264":
+		return &h264File{path: spec, frame: time.Second / time.Duration(*fps)}, nil
+	}
+	return nil, fmt.Errorf("unknown video source %q: want testsrc, none or an .ivf or .h264 file", spec)
+}
+
+// openAudio returns the source named by -audio, nil for "none".
+func openAudio(spec string) (mediaSource, error) {
+	switch spec {
+	case "none":
+		return nil, nil
+	case "tone":
+		return &tone{freq: *toneFreq}, nil
+	}
+	if strings.ToLower(filepath.Ext(spec)) == ".ogg" {
+		return openOgg(spec)
+	}
+	return nil, fmt.Errorf("unknown audio source %q: want tone, none or an .ogg file", spec)
+}
+
+// pacer spaces samples out in real time.
+type pacer struct {
+	next time.Time
+}
+
+func (p *pacer) wait(ctx context.Context, d time.Duration) error {
+	if p.next.IsZero() {
+		p.next = time.Now()
+	}
+	p.next = p.next.Add(d)
+	t := time.NewTimer(time.Until(p.next))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// testPattern is generated video: color bars with a box moving across
+// them, so a frozen picture is easy to tell apart.
+type testPattern struct {
+	width, height, fps int
+	keyframeEvery      int // frames between keyframes
+	keyframes          chan struct{}
+}
+
+func newTestPattern(width, height, fps int, keyframeInterval time.Duration) *testPattern {
+	return &testPattern{
+		width:         width,
+		height:        height,
+		fps:           fps,
+		keyframeEvery: max(1, int(keyframeInterval.Seconds()*float64(fps))),
+		keyframes:     make(chan struct{}, 1),
+	}
+}
+
+func (p *testPattern) codec() webrtc.RTPCodecCapability { return h264Codec }
+
+func (p *testPattern) requestKeyframe() {
+	select {
+	case p.keyframes <- struct{}{}:
+	default:
+	}
+}
+
+func (p *testPattern) run(ctx context.Context, track *webrtc.TrackLocalStaticSample) error {
+	enc := newH264Encoder(p.width, p.height)
+	duration := time.Second / time.Duration(p.fps)
+	var pace pacer
+	for n := 0; ; n++ {
+		keyframe := n%p.keyframeEvery == 0
+		select {
+		case <-p.keyframes:
+			keyframe = true
+		default:
+		}
+		au := enc.encode(p.render(n), keyframe)
+		if err := track.WriteSample(media.Sample{Data: au, Duration: duration}); err != nil {
+			return err
+		}
+		if err := pace.wait(ctx, duration); err != nil {
+			return nil
+		}
+	}
+}
+
+// barColors are the Y, Cb and Cr values of the usual eight color bars.
+var barColors = [][3]byte{
+	{235, 128, 128}, // white
+	{210, 16, 146},  // yellow
+	{170, 166, 16},  // cyan
+	{145, 54, 34},   // green
+	{106, 202, 222}, // magenta
+	{81, 90, 240},   // red
+	{41, 240, 110},  // blue
+	{16, 128, 128},  // black
+}
+
+const boxSize = 16
+
+// render draws frame n.
+func (p *testPattern) render(n int) *frame {
+	f := newFrame(p.width, p.height)
+	for x := 0; x < p.width; x++ {
+		c := barColors[x*len(barColors)/p.width]
+		for y := 0; y < p.height; y++ {
+			f.y[y*p.width+x] = c[0]
+		}
+		if x%2 == 0 {
+			for y := 0; y < p.height/2; y++ {
+				f.u[y*p.width/2+x/2] = c[1]
+				f.v[y*p.width/2+x/2] = c[2]
+			}
+		}
+	}
+
+	// The box bounces from side to side, 4 pixels a frame.
+	size := min(boxSize, p.width, p.height)
+	pos := 0
+	if span := p.width - size; span > 0 {
+		pos = n * 4 % (2 * span)
+		if pos > span {
+			pos = 2*span - pos
+		}
+	}
+	top := (p.height - size) / 2 &^ 1
+	for y := top; y < top+size; y++ {
+		for x := pos; x < pos+size; x++ {
+			f.y[y*p.width+x] = 128
+		}
+	}
+	for y := top / 2; y < (top+size)/2; y++ {
+		for x := pos / 2; x < (pos+size)/2; x++ {
+			f.u[y*p.width/2+x] = 128
+			f.v[y*p.width/2+x] = 128
+		}
+	}
+	return f
+}
+
+// tone is a sine wave sent as G.711 µ-law, the one audio codec simple
+// enough to encode here.
+type tone struct {
+	freq float64
+}
+
+func (t *tone) codec() webrtc.RTPCodecCapability { return pcmuCodec }
+
+func (t *tone) run(ctx context.Context, track *webrtc.TrackLocalStaticSample) error {
+	const (
+		rate      = 8000
+		ptime     = 20 * time.Millisecond
+		perPacket = rate * int(ptime/time.Millisecond) / 1000
+		amplitude = 0.3 * math.MaxInt16
+	)
+	var pace pacer
+	for n := 0; ; n++ {
+		payload := make([]byte, perPacket)
+		for i := range payload {
+			s := amplitude * math.Sin(2*math.Pi*t.freq*float64(n*perPacket+i)/rate)
+			payload[i] = linearToMulaw(int16(s))
+		}
+		if err := track.WriteSample(media.Sample{Data: payload, Duration: ptime}); err != nil {
+			return err
+		}
+		if err := pace.wait(ctx, ptime); err != nil {
+			return nil
+		}
+	}
+}
+
+// linearToMulaw encodes a 16-bit sample as G.711 µ-law.
+func linearToMulaw(sample int16) byte {
+	const (
+		bias = 0x84
+		clip = 32635
+	)
+	s := int(sample)
+	sign := 0
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > clip {
+		s = clip
+	}
+	s += bias
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := s >> (exponent + 3) & 0x0f
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// ivfFile plays VP8, VP9 or AV1 frames from an IVF file.
+type ivfFile struct {
+	path  string
+	mime  string
+	frame time.Duration
+}
+
+var ivfCodecs = map[string]string{
+	"VP80": webrtc.MimeTypeVP8,
+	"VP90": webrtc.MimeTypeVP9,
+	"AV01": webrtc.MimeTypeAV1,
+}
+
+func openIVF(path string) (*ivfFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	mime, ok := ivfCodecs[header.FourCC]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported codec %q", path, header.FourCC)
+	}
+	if header.TimebaseDenominator == 0 {
+		return nil, fmt.Errorf("%s: invalid time base", path)
+	}
+	return &ivfFile{
+		path:  path,
+		mime:  mime,
+		frame: time.Duration(float64(header.TimebaseNumerator) / float64(header.TimebaseDenominator) * float64(time.Second)),
+	}, nil
+}
+
+func (s *ivfFile) codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{MimeType: s.mime, ClockRate: 90000}
+}
+
+func (s *ivfFile) run(ctx context.Context, track *webrtc.TrackLocalStaticSample) error {
+	var pace pacer
+	return playFile(ctx, s.path, func(r io.Reader) error {
+		reader, _, err := ivfreader.NewWith(r)
+		if err != nil {
+			return err
+		}
+		for {
+			data, _, err := reader.ParseNextFrame()
+			if err != nil {
+				return err
+			}
+			if err := track.WriteSample(media.Sample{Data: data, Duration: s.frame}); err != nil {
+				return err
+			}
+			if err := pace.wait(ctx, s.frame); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// h264File plays an Annex B H.264 stream at -fps.
+type h264File struct {
+	path  string
+	frame time.Duration
+}
+
+func (s *h264File) codec() webrtc.RTPCodecCapability { return h264Codec }
+
+func (s *h264File) run(ctx context.Context, track *webrtc.TrackLocalStaticSample) error {
+	var pace pacer
+	return playFile(ctx, s.path, func(r io.Reader) error {
+		reader, err := h264reader.NewReader(r)
+		if err != nil {
+			return err
+		}
+		for {
+			nal, err := reader.NextNAL()
+			if err != nil {
+				return err
+			}
+			// Parameter sets go out with the timestamp of the picture
+			// that follows them.
+			var d time.Duration
+			if nal.UnitType == h264reader.NalUnitTypeCodedSliceNonIdr || nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr {
+				d = s.frame
+			}
+			data := append([]byte{0, 0, 0, 1}, nal.Data...)
+			if err := track.WriteSample(media.Sample{Data: data, Duration: d}); err != nil {
+				return err
+			}
+			if d > 0 {
+				if err := pace.wait(ctx, d); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+// oggFile plays Opus pages from an Ogg file.
+type oggFile struct {
+	path string
+}
+
+func openOgg(path string) (*oggFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, _, err := oggreader.NewWith(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &oggFile{path: path}, nil
+}
+
+func (s *oggFile) codec() webrtc.RTPCodecCapability { return opusCodec }
+
+func (s *oggFile) run(ctx context.Context, track *webrtc.TrackLocalStaticSample) error {
+	var pace pacer
+	return playFile(ctx, s.path, func(r io.Reader) error {
+		reader, _, err := oggreader.NewWith(r)
+		if err != nil {
+			return err
+		}
+		var granule uint64
+		for {
+			data, header, err := reader.ParseNextPage()
+			if err != nil {
+				return err
+			}
+			// Pages with granule position 0 hold headers, not audio.
+			if header.GranulePosition == 0 || header.GranulePosition < granule {
+				continue
+			}
+			d := time.Duration(header.GranulePosition-granule) * time.Second / 48000
+			granule = header.GranulePosition
+			if err := track.WriteSample(media.Sample{Data: data, Duration: d}); err != nil {
+				return err
+			}
+			if err := pace.wait(ctx, d); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// playFile opens path and passes it to play, again and again with -loop,
+// until ctx is done.
+func playFile(ctx context.Context, path string, play func(io.Reader) error) error {
+	for {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = play(f)
+		f.Close()
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case !errors.Is(err, io.EOF):
+			return fmt.Errorf("%s: %w", path, err)
+		case !*loop:
+			return nil
+		}
+	}
+}
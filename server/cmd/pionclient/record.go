@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// recorder saves the RTP packets of a received track to a file.
+type recorder interface {
+	WriteRTP(*rtp.Packet) error
+	Close() error
+}
+
+// newRecorder creates a file in dir for a track of the given codec, named
+// after name. It returns a nil recorder for codecs it cannot save.
+func newRecorder(dir, name string, codec webrtc.RTPCodecParameters) (recorder, string, error) {
+	base := filepath.Join(dir, sanitize(name))
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeAV1):
+		path := base + ".ivf"
+		w, err := ivfwriter.New(path, ivfwriter.WithCodec(codec.MimeType))
+		return w, path, err
+	case strings.ToLower(webrtc.MimeTypeH264):
+		path := base + ".h264"
+		w, err := h264writer.New(path)
+		return w, path, err
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		path := base + ".ogg"
+		w, err := oggwriter.New(path, codec.ClockRate, max(codec.Channels, 1))
+		return w, path, err
+	case strings.ToLower(webrtc.MimeTypePCMU), strings.ToLower(webrtc.MimeTypePCMA):
+		path := base + ".wav"
+		w, err := newWAVWriter(path, codec)
+		return w, path, err
+	}
+	return nil, "", nil
+}
+
+// sanitize makes name usable as a file name.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// wavWriter saves G.711 audio as it arrives, in a WAV file players
+// understand without transcoding. Lost packets are not filled in.
+type wavWriter struct {
+	f       *os.File
+	format  uint16
+	rate    uint32
+	samples uint32
+}
+
+const (
+	wavFormatALaw  = 6
+	wavFormatMuLaw = 7
+
+	wavHeaderSize = 58 // RIFF, fmt with cbSize, fact and data chunk headers
+)
+
+func newWAVWriter(path string, codec webrtc.RTPCodecParameters) (*wavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{f: f, format: wavFormatMuLaw, rate: codec.ClockRate}
+	if strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMA) {
+		w.format = wavFormatALaw
+	}
+	if err := w.writeHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wavWriter) WriteRTP(p *rtp.Packet) error {
+	n, err := w.f.Write(p.Payload)
+	w.samples += uint32(n)
+	return err
+}
+
+// Close fills in the sizes the header was written without.
+func (w *wavWriter) Close() error {
+	if _, err := w.f.Seek(0, 0); err != nil {
+		w.f.Close()
+		return err
+	}
+	if err := w.writeHeader(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+func (w *wavWriter) writeHeader() error {
+	h := make([]byte, 0, wavHeaderSize)
+	h = append(h, "RIFF"...)
+	h = binary.LittleEndian.AppendUint32(h, wavHeaderSize-8+w.samples)
+	h = append(h, "WAVEfmt "...)
+	h = binary.LittleEndian.AppendUint32(h, 18)
+	h = binary.LittleEndian.AppendUint16(h, w.format)
+	h = binary.LittleEndian.AppendUint16(h, 1)      // channels
+	h = binary.LittleEndian.AppendUint32(h, w.rate) // sample rate
+	h = binary.LittleEndian.AppendUint32(h, w.rate) // bytes per second
+	h = binary.LittleEndian.AppendUint16(h, 1)      // block align
+	h = binary.LittleEndian.AppendUint16(h, 8)      // bits per sample
+	h = binary.LittleEndian.AppendUint16(h, 0)      // cbSize
+	h = append(h, "fact"...)
+	h = binary.LittleEndian.AppendUint32(h, 4)
+	h = binary.LittleEndian.AppendUint32(h, w.samples)
+	h = append(h, "data"...)
+	h = binary.LittleEndian.AppendUint32(h, w.samples)
+	_, err := w.f.Write(h)
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Signaling compression. With -compression the server accepts the
+// permessage-deflate extension offered by clients. Only messages of at
+// least -compression-threshold bytes are deflated: for small ones the CPU
+// is wasted and the frame may even grow. Browsers always offer the
+// extension, so a client refuses compression of what it receives with
+// "compression": false in its init message.
+
+// compressionCounters tracks what compression saves on signaling
+// connections, for one peer or for the whole server.
+type compressionCounters struct {
+	messages   atomic.Int64 // data messages written
+	compressed atomic.Int64 // of which deflated
+	payload    atomic.Int64 // bytes of those messages before framing and deflate
+	wire       atomic.Int64 // bytes written to the connection after the upgrade
+}
+
+// signalingCounters adds up the counters of every peer.
+var signalingCounters compressionCounters
+
+type compressionStats struct {
+	Messages     int64 `json:"messages"`
+	Compressed   int64 `json:"compressed"`
+	PayloadBytes int64 `json:"payloadBytes"`
+	WireBytes    int64 `json:"wireBytes"`
+	// SavedBytes is PayloadBytes minus WireBytes. Frame headers and
+	// control frames count as wire bytes, so it is negative without
+	// compression.
+	SavedBytes int64 `json:"savedBytes"`
+}
+
+func (c *compressionCounters) count(size int, compressed bool) {
+	c.messages.Add(1)
+	c.payload.Add(int64(size))
+	if compressed {
+		c.compressed.Add(1)
+	}
+}
+
+func (c *compressionCounters) stats() compressionStats {
+	s := compressionStats{
+		Messages:     c.messages.Load(),
+		Compressed:   c.compressed.Load(),
+		PayloadBytes: c.payload.Load(),
+		WireBytes:    c.wire.Load(),
+	}
+	s.SavedBytes = s.PayloadBytes - s.WireBytes
+	return s
+}
+
+func checkCompression() {
+	if *compressionLevel < -2 || *compressionLevel > 9 {
+		log.Fatalf("Invalid -compression-level %d: must be between -2 and 9", *compressionLevel)
+	}
+	upgrader.EnableCompression = *compression
+}
+
+// offersCompression reports whether the client asked for permessage-deflate
+// in its upgrade request, which gorilla accepts when compression is enabled.
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setupCompression decides whether peer's connection deflates what the
+// server writes and starts counting its wire bytes.
+func setupCompression(peer *Peer, r *http.Request, optOut bool) {
+	peer.compress = upgrader.EnableCompression && offersCompression(r) && !optOut
+	if peer.compress {
+		if err := peer.conn.SetCompressionLevel(*compressionLevel); err != nil {
+			log.Printf("Error setting compression level for %s: %v", peer.username, err)
+		}
+	}
+	if cc, ok := peer.conn.UnderlyingConn().(*countingConn); ok {
+		cc.counters.Store(&peer.counters)
+	}
+}
+
+// compressNext turns compression on for the next message written to p if
+// it is worth it, and counts the message. Only p's writer calls it.
+func (p *Peer) compressNext(size int) {
+	compress := p.compress && size >= *compressionThreshold
+	p.conn.EnableWriteCompression(compress)
+	p.counters.count(size, compress)
+	signalingCounters.count(size, compress)
+}
+
+// countingListener counts the bytes written to the connections it accepts
+// once they become websockets.
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	counters atomic.Pointer[compressionCounters] // nil until the peer is set up
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if counters := c.counters.Load(); counters != nil {
+		counters.wire.Add(int64(n))
+		signalingCounters.wire.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withCompression sets -compression for the duration of the test.
+func withCompression(t *testing.T, on bool) {
+	t.Helper()
+	saved := upgrader.EnableCompression
+	upgrader.EnableCompression = on
+	t.Cleanup(func() { upgrader.EnableCompression = saved })
+}
+
+// dialInit joins with the given init message, offering permessage-deflate
+// when compress is set, and returns the server's extensions header.
+func dialInit(t *testing.T, url string, compress bool, init map[string]interface{}) (*websocket.Conn, string) {
+	t.Helper()
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = compress
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(init); err != nil {
+		t.Fatal(err)
+	}
+	return conn, resp.Header.Get("Sec-WebSocket-Extensions")
+}
+
+// roomPeer waits for username to be a member of room.
+func roomPeer(t *testing.T, room, username string) *Peer {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		r := rooms[room]
+		mu.Unlock()
+		if r != nil {
+			r.mu.Lock()
+			p := r.peers[username]
+			r.mu.Unlock()
+			if p != nil {
+				return p
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never joined %s", username, room)
+	return nil
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		server, client bool
+		optOut         bool
+		want           bool
+	}{
+		{"both", true, true, false, true},
+		{"server only", true, false, false, false},
+		{"client only", false, true, false, false},
+		{"opt-out", true, true, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withCompression(t, tc.server)
+			url := startServer(t)
+			room := "negotiation-" + strings.ReplaceAll(tc.name, " ", "-")
+			init := map[string]interface{}{"room": room, "username": "alice"}
+			if tc.optOut {
+				init["compression"] = false
+			}
+			_, ext := dialInit(t, url, tc.client, init)
+
+			// The extension is negotiated whenever both sides support it;
+			// opting out only keeps the server from using it.
+			if negotiated := strings.Contains(ext, "permessage-deflate"); negotiated != (tc.server && tc.client) {
+				t.Errorf("extensions %q, negotiated = %v", ext, negotiated)
+			}
+			if p := roomPeer(t, room, "alice"); p.compress != tc.want {
+				t.Errorf("compress = %v, want %v", p.compress, tc.want)
+			}
+		})
+	}
+}
+
+// sendRelay has from send msg to the room and waits until to receives it
+// intact, returning how the counters of recipient changed meanwhile.
+func sendRelay(t *testing.T, from, to *websocket.Conn, recipient *Peer, msg string) compressionStats {
+	t.Helper()
+	before := recipient.counters.stats()
+	if err := from.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readUntil(t, to, `"relay-test"`); string(got) != msg {
+		t.Fatalf("received %d bytes, sent %d", len(got), len(msg))
+	}
+	after := recipient.counters.stats()
+	return compressionStats{
+		Messages:     after.Messages - before.Messages,
+		Compressed:   after.Compressed - before.Compressed,
+		PayloadBytes: after.PayloadBytes - before.PayloadBytes,
+		WireBytes:    after.WireBytes - before.WireBytes,
+		SavedBytes:   after.SavedBytes - before.SavedBytes,
+	}
+}
+
+// joinPair puts alice and bob in room; bob refuses compression when
+// optOut is set. It returns both connections and bob's peer once bob saw
+// alice join.
+func joinPair(t *testing.T, room string, optOut bool) (alice, bob *websocket.Conn, bobPeer *Peer) {
+	t.Helper()
+	withCompression(t, true)
+	url := startServer(t)
+	init := map[string]interface{}{"room": room, "username": "bob"}
+	if optOut {
+		init["compression"] = false
+	}
+	bob, _ = dialInit(t, url, true, init)
+	readUntil(t, bob, `"bob"`)
+	alice, _ = dialInit(t, url, true, map[string]interface{}{"room": room, "username": "alice"})
+	readUntil(t, bob, `"alice"`)
+	readUntil(t, alice, `"room_info"`)
+	return alice, bob, roomPeer(t, room, "bob")
+}
+
+var largeRelay = `{"type":"relay-test",` + offer[1:]
+
+func TestCompressionThreshold(t *testing.T) {
+	alice, bob, bobPeer := joinPair(t, "threshold", false)
+
+	small := sendRelay(t, alice, bob, bobPeer, `{"type":"relay-test"}`)
+	if small.Messages != 1 || small.Compressed != 0 {
+		t.Errorf("small message: %+v, want 1 message sent uncompressed", small)
+	}
+	if small.SavedBytes >= 0 {
+		t.Errorf("small message saved %d bytes without compression", small.SavedBytes)
+	}
+
+	large := sendRelay(t, alice, bob, bobPeer, largeRelay)
+	if large.Messages != 1 || large.Compressed != 1 {
+		t.Errorf("large message: %+v, want 1 message sent compressed", large)
+	}
+	if large.PayloadBytes != int64(len(largeRelay)) {
+		t.Errorf("payload %d bytes, want %d", large.PayloadBytes, len(largeRelay))
+	}
+	if large.WireBytes >= large.PayloadBytes/2 {
+		t.Errorf("large message took %d bytes on the wire for %d of payload", large.WireBytes, large.PayloadBytes)
+	}
+
+	rec := httptest.NewRecorder()
+	handleStats(rec, httptest.NewRequest("GET", "/stats", nil))
+	var stats struct {
+		Compression compressionStats `json:"compression"`
+		Rooms       []roomStats      `json:"rooms"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Compression.Compressed == 0 || stats.Compression.SavedBytes <= 0 {
+		t.Errorf("server compression stats %+v show no savings", stats.Compression)
+	}
+	for _, rs := range stats.Rooms {
+		if rs.Name != "threshold" {
+			continue
+		}
+		for _, ps := range rs.Peers {
+			if ps.Username == "bob" && (!ps.Compress || ps.Compression.Compressed == 0) {
+				t.Errorf("stats of bob: %+v", ps)
+			}
+		}
+	}
+}
+
+func TestCompressionOptOut(t *testing.T) {
+	alice, bob, bobPeer := joinPair(t, "opt-out", true)
+
+	large := sendRelay(t, alice, bob, bobPeer, largeRelay)
+	if large.Messages != 1 || large.Compressed != 0 {
+		t.Errorf("large message: %+v, want 1 message sent uncompressed", large)
+	}
+	if large.WireBytes < large.PayloadBytes {
+		t.Errorf("large message took %d bytes on the wire for %d of payload", large.WireBytes, large.PayloadBytes)
+	}
+}
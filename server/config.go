@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var (
+	maxMessageSize = flag.Int64("max-message-size", 64*1024, "largest websocket message accepted from a client, in bytes")
+	maxChatLength  = flag.Int("max-chat-length", 4000, "longest chat message, in characters")
+	chatHistory    = flag.Int("chat-history", 100, "chat messages kept per room and replayed on join")
+	maxFileSize    = flag.Int64("max-file-size", 100<<20, "largest file a participant may offer, in bytes")
+	writeTimeout   = flag.Duration("write-timeout", 10*time.Second, "time a write to a client may take before the client is disconnected")
+	sendQueue      = flag.Int("send-queue", 256, "messages queued for a client before it is disconnected as too slow")
+
+	compression          = flag.Bool("compression", true, "accept the permessage-deflate extension offered by websocket clients")
+	compressionLevel     = flag.Int("compression-level", 1, "deflate level of -compression, from -2 (Huffman only) to 9 (best)")
+	compressionThreshold = flag.Int("compression-threshold", 512, "smallest signaling message deflated, in bytes")
+
+	reactionBurst  = flag.Int("reaction-burst", 5, "reactions a participant may send within -reaction-window")
+	reactionWindow = flag.Duration("reaction-window", 3*time.Second, "window of the reaction rate limit")
+	maxPolls       = flag.Int("max-polls", 50, "polls kept per room; the oldest closed poll makes way for a new one")
+
+	speakerThreshold  = flag.Int("speaker-threshold", 50, "audio level in -dBov (0 loudest, 127 silence) at or below which a participant is speaking")
+	speakerHysteresis = flag.Int("speaker-hysteresis", 10, "dB the level must rise above -speaker-threshold before a participant stops speaking")
+	speakerSmoothing  = flag.Float64("speaker-smoothing", 0.3, "weight of the newest audio level sample in the smoothed level (0..1]")
+	speakerHold       = flag.Duration("speaker-hold", time.Second, "minimum time a participant stays the active speaker / keeps speaking through silence")
+
+	lastN = flag.Int("last-n", 0, "video sources forwarded to each SFU subscriber, most recent speakers first (0 forwards all)")
+
+	maxPresenters = flag.Int("max-presenters", 1, "participants allowed to share their screen at the same time in a room")
+
+	storeKind = flag.String("store", "memory", "where room settings, bans and chat history are kept: memory or bolt")
+	storePath = flag.String("store-path", "rooms.db", "database file of -store bolt")
+
+	nodeID       = flag.String("node-id", "", "name of this node in the cluster (default: hostname)")
+	brokerKind   = flag.String("broker", "", "pub/sub broker shared with the other nodes: local or redis (empty: single node)")
+	brokerAddr   = flag.String("broker-addr", "localhost:6379", "address of the -broker redis server")
+	clusterNodes = flag.String("cluster-nodes", "", "comma-separated id=url list of the other nodes, used to route rooms")
+
+	logSDP             = flag.Bool("log-sdp", false, "log the full text of every session description, besides its summary")
+	sdpCodecs          = flag.String("sdp-codecs", "", "comma-separated codecs relayed offers and answers may use, most preferred first, such as VP8,opus (empty allows all; rtx follows the codec it repairs)")
+	sdpMaxBitrate      = flag.Int("sdp-max-bitrate", 0, "bitrate in kbps set with b=AS and b=TIAS on each audio and video section of relayed descriptions (0 for no limit)")
+	sdpStripExtensions = flag.String("sdp-strip-extensions", "", "comma-separated RTP header extension URIs removed from relayed descriptions")
+	sdpStripMedia      = flag.String("sdp-strip-media", "", "comma-separated media kinds (audio, video, application) whose sections are rejected in relayed descriptions")
+	sdpPolicyAction    = flag.String("sdp-policy-action", "rewrite", "what happens to a relayed description using other codecs, extensions or media: rewrite it or reject it")
+
+	iceDrop         = flag.String("ice-drop", "", "comma-separated candidates never relayed to other participants, by type (host, srflx, prflx, relay), protocol (udp, tcp) or address family (ipv4, ipv6, mdns)")
+	iceRelayOnly    = flag.Bool("ice-relay-only", false, "relay only relay candidates between participants of new rooms, hiding their addresses; owners may change it with room_settings")
+	redactAddresses = flag.Bool("redact-addresses", true, "hide the host part of IP addresses in logs: the last byte of IPv4, all but the first 48 bits of IPv6")
+
+	audioMix = flag.Bool("audio-mix", false, "let SFU participants receive a single server-mixed audio track (needs a build with -tags opus)")
+)
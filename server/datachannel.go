@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Server-terminated data channels. Each SFU participant may open an
+// ordered, reliable "room" data channel to the server; the server relays
+// what arrives on it to the other members of the room. A message is a JSON
+// envelope whose "to" lists the recipients (everybody when empty). A
+// channel labelled "user:<name>" is a direct line: everything sent on it
+// goes to <name> only. Members without a data channel get the envelope
+// over the websocket as the "data" of a "data" message, and may send one
+// the same way: {"type":"data","data":{"to":[...],"payload":...}}.
+
+const (
+	roomChannelLabel   = "room"
+	directChannelLabel = "user:"
+)
+
+// dataEnvelope is what recipients get on their "room" channel.
+type dataEnvelope struct {
+	From    string          `json:"from"`
+	To      []string        `json:"to,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// onDataChannel accepts the data channels a client opens to the server.
+func onDataChannel(peer *Peer, dc *webrtc.DataChannel) {
+	label := dc.Label()
+	if label != roomChannelLabel && !strings.HasPrefix(label, directChannelLabel) {
+		log.Printf("Rejecting data channel '%s' from %s", label, peer.username)
+		rejectDataChannel(peer, dc)
+		return
+	}
+	if !dc.Ordered() || dc.MaxRetransmits() != nil || dc.MaxPacketLifeTime() != nil {
+		log.Printf("Rejecting unreliable data channel '%s' from %s", label, peer.username)
+		rejectDataChannel(peer, dc)
+		return
+	}
+
+	dc.OnOpen(func() {
+		peer.joined.mu.Lock()
+		peer.dataChannels[label] = dc
+		peer.joined.mu.Unlock()
+		log.Printf("Data channel '%s' of %s open", label, peer.username)
+	})
+	dc.OnClose(func() {
+		peer.joined.mu.Lock()
+		if peer.dataChannels[label] == dc {
+			delete(peer.dataChannels, label)
+		}
+		peer.joined.mu.Unlock()
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var to []string
+		if strings.HasPrefix(label, directChannelLabel) {
+			to = []string{strings.TrimPrefix(label, directChannelLabel)}
+		}
+		if !msg.IsString {
+			relayBinary(peer, to, msg.Data)
+			return
+		}
+		if to != nil {
+			relayData(peer, dataEnvelope{From: peer.username, To: to, Payload: msg.Data})
+			return
+		}
+
+		var env dataEnvelope
+		if err := json.Unmarshal(msg.Data, &env); err != nil || env.Payload == nil {
+			log.Printf("Invalid data channel message from %s: %v", peer.username, err)
+			return
+		}
+		env.From = peer.username
+		relayData(peer, env)
+	})
+}
+
+// rejectDataChannel closes a channel the server does not accept. It can
+// only be closed once open.
+func rejectDataChannel(peer *Peer, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		if err := dc.Close(); err != nil {
+			log.Printf("Error closing data channel '%s' of %s: %v", dc.Label(), peer.username, err)
+		}
+	})
+}
+
+// handleDataMessage relays a "data" message a client sent over the websocket.
+func handleDataMessage(peer *Peer, msg []byte) {
+	var m struct {
+		Data dataEnvelope `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil || m.Data.Payload == nil {
+		log.Printf("Invalid data message from %s: %v", peer.username, err)
+		return
+	}
+	env := m.Data
+	env.From = peer.username
+	relayData(peer, env)
+}
+
+// recipients returns the members of from's room an envelope addressed to
+// is delivered to. Caller must hold room.mu.
+func recipients(from *Peer, to []string) []*Peer {
+	room := from.joined
+	var out []*Peer
+	if len(to) == 0 {
+		for _, p := range room.peers {
+			if p != from {
+				out = append(out, p)
+			}
+		}
+		return out
+	}
+	for _, username := range to {
+		if p, ok := room.peers[username]; ok && p != from {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func relayData(from *Peer, env dataEnvelope) {
+	raw, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("Error encoding data from %s: %v", from.username, err)
+		return
+	}
+
+	room := from.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for _, p := range recipients(from, env.To) {
+		if dc := p.dataChannels[roomChannelLabel]; dc != nil {
+			if err := dc.SendText(string(raw)); err != nil {
+				log.Printf("Error relaying data to %s: %v", p.username, err)
+			}
+			continue
+		}
+		if err := p.writeJSON(map[string]interface{}{
+			"type": "data",
+			"data": env,
+		}); err != nil {
+			log.Printf("Error relaying data to %s: %v", p.username, err)
+		}
+	}
+}
+
+// relayBinary passes binary messages through unchanged; they only reach
+// members with a "room" data channel.
+func relayBinary(from *Peer, to []string, data []byte) {
+	room := from.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for _, p := range recipients(from, to) {
+		if dc := p.dataChannels[roomChannelLabel]; dc != nil {
+			if err := dc.Send(data); err != nil {
+				log.Printf("Error relaying data to %s: %v", p.username, err)
+			}
+		}
+	}
+}
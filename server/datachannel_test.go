@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// TestDataMessage relays a "data" message over the websocket to the
+// member it is addressed to.
+func TestDataMessage(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "data", "alice")
+	readUntil(t, alice, `"room_info"`)
+	bob := dial(t, url, "data", "bob")
+	readUntil(t, bob, `"room_info"`)
+
+	if err := alice.WriteJSON(map[string]interface{}{
+		"type": "data",
+		"data": map[string]interface{}{"to": []string{"bob"}, "payload": map[string]int{"x": 120}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		Data dataEnvelope `json:"data"`
+	}
+	if err := json.Unmarshal(readUntil(t, bob, `"type":"data"`), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Data.From != "alice" || len(m.Data.To) != 1 || m.Data.To[0] != "bob" || string(m.Data.Payload) != `{"x":120}` {
+		t.Errorf("bob got %+v", m.Data)
+	}
+}
+
+// TestDataChannelRefused opens a data channel the server does not accept;
+// the server closes it.
+func TestDataChannelRefused(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "data-refused", "alice")
+	readUntil(t, alice, `"room_info"`)
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	dc, err := pc.CreateDataChannel("whiteboard", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	dc.OnClose(func() { close(closed) })
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-webrtc.GatheringCompletePromise(pc)
+	if err := alice.WriteJSON(map[string]interface{}{"type": "sfu_offer", "sdp": pc.LocalDescription()}); err != nil {
+		t.Fatal(err)
+	}
+
+	var answer struct {
+		SDP webrtc.SessionDescription `json:"sdp"`
+	}
+	if err := json.Unmarshal(readUntil(t, alice, `"sfu_answer"`), &answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetRemoteDescription(answer.SDP); err != nil {
+		t.Fatal(err)
+	}
+	// The server trickles its candidates.
+	go func() {
+		for {
+			_, msg, err := alice.ReadMessage()
+			if err != nil {
+				return
+			}
+			var c struct {
+				Type      string                  `json:"type"`
+				Candidate webrtc.ICECandidateInit `json:"candidate"`
+			}
+			if json.Unmarshal(msg, &c) == nil && c.Type == "sfu_candidate" {
+				pc.AddICECandidate(c.Candidate)
+			}
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("refused data channel never closed")
+	}
+}
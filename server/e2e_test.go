@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+
+	"server/signaling"
+)
+
+// The tests in this file run whole calls: pion peers on a virtual network
+// join through the signaling package, the way bots do, and call each
+// other peer to peer with the server relaying offers, answers and
+// candidates.
+
+// e2eNet is the virtual network the peers of a test share.
+type e2eNet struct {
+	url    string
+	router *vnet.Router
+}
+
+func newE2ENet(t *testing.T) *e2eNet {
+	t.Helper()
+	return &e2eNet{router: newRouter(t), url: startServer(t)}
+}
+
+// newRouter starts a virtual network for the duration of the test.
+func newRouter(t *testing.T) *vnet.Router {
+	t.Helper()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "10.0.0.0/24",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { router.Stop() })
+	return router
+}
+
+// vnetSettings puts the PeerConnections of an API on a new host of router.
+func vnetSettings(t *testing.T, router *vnet.Router) webrtc.SettingEngine {
+	t.Helper()
+	nw, err := vnet.NewNet(&vnet.NetConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.AddNet(nw); err != nil {
+		t.Fatal(err)
+	}
+	se := webrtc.SettingEngine{}
+	se.SetNet(nw)
+	se.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled) // no multicast on a vnet
+	return se
+}
+
+// e2ePeer is a participant: its signaling client and a PeerConnection
+// publishing a video track.
+type e2ePeer struct {
+	name string
+	sig  *signaling.Client
+	pc   *webrtc.PeerConnection
+
+	roomInfo   <-chan signaling.RoomInfo
+	joins      <-chan string
+	leaves     <-chan string
+	offers     <-chan signaling.Description
+	answers    <-chan signaling.Description
+	candidates <-chan signaling.Candidate
+
+	connected chan struct{} // closed once ICE connected
+	media     chan string   // IDs of remote tracks, once a packet arrived
+	relayed   atomic.Int32  // remote candidates added
+}
+
+// newE2EPeer creates a peer on the virtual network and joins room.
+func (n *e2eNet) newE2EPeer(t *testing.T, room, name string) *e2ePeer {
+	t.Helper()
+	p := n.newUnjoinedPeer(t, name)
+	if err := p.sig.Connect(context.Background(), room, name); err != nil {
+		t.Fatalf("%s joining %s: %v", name, room, err)
+	}
+	return p
+}
+
+func (n *e2eNet) newUnjoinedPeer(t *testing.T, name string) *e2ePeer {
+	t.Helper()
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(vnetSettings(t, n.router)), webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := signaling.New(n.url, signaling.Options{MaxReconnectAttempts: -1})
+	p := &e2ePeer{
+		name:       name,
+		sig:        sig,
+		pc:         pc,
+		roomInfo:   sig.RoomInfo(),
+		joins:      sig.Joins(),
+		leaves:     sig.Leaves(),
+		offers:     sig.Offers(),
+		answers:    sig.Answers(),
+		candidates: sig.Candidates(),
+		connected:  make(chan struct{}),
+		media:      make(chan string, 4),
+	}
+	t.Cleanup(p.leave)
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, name+"-video", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				track.WriteSample(media.Sample{Data: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			p.sig.SendCandidate(c.ToJSON())
+		}
+	})
+	var once atomic.Bool
+	pc.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+		if s == webrtc.ICEConnectionStateConnected && once.CompareAndSwap(false, true) {
+			close(p.connected)
+		}
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := remote.ReadRTP(); err == nil {
+			p.media <- remote.ID()
+		}
+		for {
+			if _, _, err := remote.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+	return p
+}
+
+// leave closes the peer; the server sees it leave the room.
+func (p *e2ePeer) leave() {
+	p.sig.Close()
+	p.pc.Close()
+}
+
+// addCandidates adds the candidates the server relays to p, checking
+// they come from want, until p leaves. What went wrong is reported when
+// the test ends, by which time p has left.
+func (p *e2ePeer) addCandidates(t *testing.T, want string) {
+	done := make(chan error, 1)
+	go func() {
+		var errs []error
+		for c := range p.candidates {
+			if c.From != want {
+				errs = append(errs, fmt.Errorf("%s got a candidate from %q, want %q", p.name, c.From, want))
+				continue
+			}
+			if err := p.pc.AddICECandidate(c.Candidate); err != nil {
+				errs = append(errs, fmt.Errorf("%s adding a candidate: %v", p.name, err))
+				continue
+			}
+			p.relayed.Add(1)
+		}
+		done <- errors.Join(errs...)
+	}()
+	t.Cleanup(func() {
+		p.leave()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// e2eCall connects caller and callee through the server and waits until
+// media flows both ways.
+func e2eCall(t *testing.T, caller, callee *e2ePeer) {
+	t.Helper()
+	offer, err := caller.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.sig.SendOffer(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	got := await(t, callee.offers, callee.name+" waiting for an offer")
+	if got.From != caller.name || got.SDP.Type != webrtc.SDPTypeOffer || got.SDP.SDP != offer.SDP {
+		t.Fatalf("%s got offer from %q of type %s, changed: %v", callee.name, got.From, got.SDP.Type, got.SDP.SDP != offer.SDP)
+	}
+	if err := callee.pc.SetRemoteDescription(got.SDP); err != nil {
+		t.Fatal(err)
+	}
+	callee.addCandidates(t, caller.name)
+	answer, err := callee.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callee.pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := callee.sig.SendAnswer(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	got = await(t, caller.answers, caller.name+" waiting for an answer")
+	if got.From != callee.name || got.SDP.Type != webrtc.SDPTypeAnswer || got.SDP.SDP != answer.SDP {
+		t.Fatalf("%s got answer from %q of type %s", caller.name, got.From, got.SDP.Type)
+	}
+	if err := caller.pc.SetRemoteDescription(got.SDP); err != nil {
+		t.Fatal(err)
+	}
+	caller.addCandidates(t, callee.name)
+
+	for _, p := range []*e2ePeer{caller, callee} {
+		select {
+		case <-p.connected:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: ICE did not connect", p.name)
+		}
+		if p.relayed.Load() == 0 {
+			t.Errorf("%s connected without relayed candidates", p.name)
+		}
+	}
+	for _, pair := range [][2]*e2ePeer{{caller, callee}, {callee, caller}} {
+		if id := await(t, pair[0].media, pair[0].name+" waiting for media"); id != pair[1].name+"-video" {
+			t.Errorf("%s received track %s, want %s-video", pair[0].name, id, pair[1].name)
+		}
+	}
+}
+
+func await[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v, ok := <-ch:
+		if !ok {
+			t.Fatalf("%s: channel closed", what)
+		}
+		return v
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s: timed out", what)
+	}
+	var zero T
+	return zero
+}
+
+// waitUntil polls cond until it holds.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// roomMembers returns the usernames in room, nil once it is removed.
+func roomMembers(room string) []string {
+	mu.Lock()
+	r := rooms[room]
+	mu.Unlock()
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.peers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// connected reports whether the server holds a connection of room.
+func connected(room string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range peers {
+		if p.room == room {
+			return true
+		}
+	}
+	return false
+}
+
+func TestE2ECall(t *testing.T) {
+	n := newE2ENet(t)
+
+	alice := n.newE2EPeer(t, "e2e-call", "alice")
+	if info := await(t, alice.roomInfo, "alice's room_info"); !slices.Equal(info.Users, []string{"alice"}) {
+		t.Errorf("alice joined an empty room listing %v", info.Users)
+	}
+	bob := n.newE2EPeer(t, "e2e-call", "bob")
+	if info := await(t, bob.roomInfo, "bob's room_info"); !slices.Equal(slices.Sorted(slices.Values(info.Users)), []string{"alice", "bob"}) {
+		t.Errorf("bob joined a room listing %v", info.Users)
+	}
+	if joined := await(t, alice.joins, "alice waiting for bob"); joined != "bob" {
+		t.Errorf("alice saw %q join, want bob", joined)
+	}
+	if got := roomMembers("e2e-call"); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Errorf("server room members %v", got)
+	}
+
+	e2eCall(t, alice, bob)
+
+	bob.leave()
+	if left := await(t, alice.leaves, "alice waiting for bob to leave"); left != "bob" {
+		t.Errorf("alice saw %q leave, want bob", left)
+	}
+	for info := await(t, alice.roomInfo, "alice's room_info"); !slices.Equal(info.Users, []string{"alice"}); {
+		info = await(t, alice.roomInfo, "alice's room_info without bob")
+	}
+	waitUntil(t, "bob is removed from the room", func() bool {
+		return slices.Equal(roomMembers("e2e-call"), []string{"alice"})
+	})
+
+	alice.leave()
+	waitUntil(t, "the empty room is removed", func() bool { return roomMembers("e2e-call") == nil })
+	waitUntil(t, "the connections are removed", func() bool { return !connected("e2e-call") })
+}
+
+func TestE2EUsernameTaken(t *testing.T) {
+	n := newE2ENet(t)
+	alice := n.newE2EPeer(t, "e2e-taken", "alice")
+	await(t, alice.roomInfo, "alice's room_info")
+
+	impostor := n.newUnjoinedPeer(t, "alice")
+	err := impostor.sig.Connect(context.Background(), "e2e-taken", "alice")
+	var e *signaling.Error
+	if !errors.As(err, &e) || e.Code != "username_taken" {
+		t.Fatalf("joining under a taken name: %v, want username_taken", err)
+	}
+	if got := roomMembers("e2e-taken"); !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("server room members %v", got)
+	}
+
+	// The refused client is gone and the name still works for calls.
+	bob := n.newE2EPeer(t, "e2e-taken", "bob")
+	e2eCall(t, bob, alice)
+}
+
+// TestE2ERooms runs calls in several rooms at once: signaling must stay
+// within each room.
+func TestE2ERooms(t *testing.T) {
+	const calls = 3
+	n := newE2ENet(t)
+	var callers, callees []*e2ePeer
+	for i := 0; i < calls; i++ {
+		room := fmt.Sprintf("e2e-room-%d", i)
+		callers = append(callers, n.newE2EPeer(t, room, fmt.Sprintf("caller-%d", i)))
+		callees = append(callees, n.newE2EPeer(t, room, fmt.Sprintf("callee-%d", i)))
+	}
+	// e2eCall checks who every description and candidate came from.
+	for i := 0; i < calls; i++ {
+		e2eCall(t, callers[i], callees[i])
+	}
+	for i := 0; i < calls; i++ {
+		if got := roomMembers(fmt.Sprintf("e2e-room-%d", i)); len(got) != 2 {
+			t.Errorf("room %d members %v", i, got)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"log"
+	"strings"
+	"time"
+)
+
+// File transfer brokering. A sender offers a file to one member of the
+// room; when the recipient accepts, the server either assigns both sides a
+// negotiated data channel on their own peer connection ("datachannel") or
+// relays base64 chunks over the websocket ("relay"). In relay mode the
+// server hashes what passes through and can resume an interrupted transfer
+// from any chunk boundary. Either way the SHA-256 from the offer is checked
+// before the transfer counts as complete.
+
+const (
+	maxFileChunk     = 32 * 1024 // raw bytes per file_chunk, base64 must fit -max-message-size
+	fileTransferTTL  = 10 * time.Minute
+	firstFileChannel = 1000 // data channel IDs below are left to the application
+)
+
+type fileTransfer struct {
+	ID      string `json:"id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Mime    string `json:"mime,omitempty"`
+	SHA256  string `json:"sha256"`
+	State   string `json:"state"`          // offered, accepted, interrupted, complete, failed, rejected, cancelled
+	Mode    string `json:"mode,omitempty"` // datachannel or relay
+	Offset  int64  `json:"offset"`         // bytes relayed so far, where a relay resumes
+	Channel uint16 `json:"channelId,omitempty"`
+
+	hasher      hash.Hash
+	checkpoints map[int64][]byte // offset -> marshaled hash state, for resuming
+	updated     time.Time
+}
+
+type fileRequest struct {
+	Data struct {
+		ID     string `json:"id"`
+		To     string `json:"to"`
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		Mime   string `json:"mime"`
+		SHA256 string `json:"sha256"`
+		Mode   string `json:"mode"`
+		Offset int64  `json:"offset"`
+		Chunk  string `json:"data"`
+	} `json:"data"`
+}
+
+func (t *fileTransfer) finished() bool {
+	switch t.State {
+	case "complete", "failed", "rejected", "cancelled":
+		return true
+	}
+	return false
+}
+
+// handleFileMessage processes the file_* messages of a transfer.
+func handleFileMessage(peer *Peer, msgType string, msg []byte) {
+	var req fileRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		sendError(peer, "invalid_message", "Invalid "+msgType+" message")
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	expireTransfers(room)
+
+	if msgType == "file_offer" {
+		offerFile(room, peer, req)
+		return
+	}
+
+	t := room.transfers[req.Data.ID]
+	if t == nil || (t.From != peer.username && t.To != peer.username) {
+		sendError(peer, "transfer_not_found", "File transfer not found")
+		return
+	}
+	if t.finished() {
+		sendError(peer, "transfer_finished", "File transfer is already "+t.State)
+		return
+	}
+	t.updated = time.Now()
+
+	switch msgType {
+	case "file_accept":
+		if peer.username != t.To || t.State != "offered" {
+			sendError(peer, "forbidden", "Only the recipient can accept an offered file")
+			return
+		}
+		switch req.Data.Mode {
+		case "datachannel":
+			t.Channel = fileChannelID(room, t)
+		case "relay", "":
+			req.Data.Mode = "relay"
+			t.hasher = sha256.New()
+			t.checkpoints = map[int64][]byte{0: marshalHash(t.hasher)}
+		default:
+			sendError(peer, "invalid_message", "Unknown transfer mode")
+			return
+		}
+		t.Mode = req.Data.Mode
+		t.State = "accepted"
+		notifyTransfer(room, t)
+	case "file_reject", "file_cancel":
+		if msgType == "file_reject" && peer.username != t.To {
+			sendError(peer, "forbidden", "Only the recipient can reject a file")
+			return
+		}
+		t.State = "cancelled"
+		if msgType == "file_reject" {
+			t.State = "rejected"
+		}
+		t.hasher, t.checkpoints = nil, nil
+		notifyTransfer(room, t)
+	case "file_chunk":
+		relayChunk(room, peer, t, req.Data.Offset, req.Data.Chunk)
+	case "file_resume":
+		resumeTransfer(room, peer, t, req.Data.Offset)
+	case "file_complete":
+		completeTransfer(room, peer, t, req.Data.SHA256)
+	}
+}
+
+func offerFile(room *Room, peer *Peer, req fileRequest) {
+	d := req.Data
+	switch {
+	case d.To == peer.username || room.peers[d.To] == nil:
+		sendError(peer, "user_not_found", "Recipient is not in the room")
+		return
+	case d.Name == "" || d.Size <= 0:
+		sendError(peer, "invalid_message", "File offer needs a name and a size")
+		return
+	case d.Size > *maxFileSize:
+		sendError(peer, "file_too_large", "File is too large")
+		return
+	}
+	if sum, err := hex.DecodeString(d.SHA256); err != nil || len(sum) != sha256.Size {
+		sendError(peer, "invalid_message", "File offer needs a hex SHA-256")
+		return
+	}
+
+	t := &fileTransfer{
+		ID:      randSeq(16),
+		From:    peer.username,
+		To:      d.To,
+		Name:    d.Name,
+		Size:    d.Size,
+		Mime:    d.Mime,
+		SHA256:  strings.ToLower(d.SHA256),
+		State:   "offered",
+		updated: time.Now(),
+	}
+	room.transfers[t.ID] = t
+	log.Printf("User '%s' offers '%s' (%d bytes) to '%s'", t.From, t.Name, t.Size, t.To)
+	notifyTransfer(room, t)
+}
+
+// relayChunk passes one chunk from the sender to the recipient. Chunks must
+// arrive in order; a chunk at the wrong offset is answered with the offset
+// the server expects. A chunk is refused with slow_down while the
+// recipient has half of -send-queue still to receive; the sender resends it
+// later.
+func relayChunk(room *Room, peer *Peer, t *fileTransfer, offset int64, chunk string) {
+	if peer.username != t.From || t.Mode != "relay" || t.State != "accepted" {
+		sendError(peer, "forbidden", "File transfer is not relaying chunks from you")
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(chunk)
+	if err != nil || len(data) == 0 || len(data) > maxFileChunk {
+		sendError(peer, "invalid_chunk", "File chunk must be 1 to 32768 base64 encoded bytes")
+		return
+	}
+	if offset != t.Offset {
+		notifyTransfer(room, t) // tells the sender where to continue
+		return
+	}
+	if t.Offset+int64(len(data)) > t.Size {
+		failTransfer(room, t, "File is larger than offered")
+		return
+	}
+
+	recipient := room.peers[t.To]
+	if recipient == nil {
+		t.State = "interrupted"
+		notifyTransfer(room, t)
+		return
+	}
+	if recipient.backlog() > *sendQueue/2 {
+		sendError(peer, "slow_down", "Recipient is not keeping up, resend the chunk later")
+		return
+	}
+	if err := recipient.writeJSON(map[string]interface{}{
+		"type": "file_chunk",
+		"data": map[string]interface{}{
+			"id":     t.ID,
+			"offset": offset,
+			"data":   chunk,
+		},
+	}); err != nil {
+		log.Printf("Error relaying file chunk to %s: %v", recipient.username, err)
+		return
+	}
+
+	t.hasher.Write(data)
+	t.Offset += int64(len(data))
+	t.checkpoints[t.Offset] = marshalHash(t.hasher)
+}
+
+// resumeTransfer restarts an interrupted relay at offset, which the
+// recipient reports as the amount it has stored.
+func resumeTransfer(room *Room, peer *Peer, t *fileTransfer, offset int64) {
+	if t.Mode != "relay" {
+		sendError(peer, "invalid_message", "Only relayed transfers can be resumed")
+		return
+	}
+	state, ok := t.checkpoints[offset]
+	if !ok {
+		sendError(peer, "invalid_offset", "Transfer can only resume at a chunk boundary")
+		return
+	}
+	if err := t.hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		failTransfer(room, t, "Cannot resume transfer")
+		return
+	}
+	for o := range t.checkpoints {
+		if o > offset {
+			delete(t.checkpoints, o)
+		}
+	}
+	t.Offset = offset
+	t.State = "accepted"
+	notifyTransfer(room, t)
+}
+
+// completeTransfer checks the SHA-256 of the file. In relay mode the server
+// hashed the chunks itself, otherwise the recipient reports its hash.
+func completeTransfer(room *Room, peer *Peer, t *fileTransfer, reported string) {
+	var sum string
+	switch {
+	case t.Mode == "relay" && peer.username == t.From:
+		if t.Offset != t.Size {
+			failTransfer(room, t, "File is smaller than offered")
+			return
+		}
+		sum = hex.EncodeToString(t.hasher.Sum(nil))
+	case t.Mode == "datachannel" && peer.username == t.To:
+		sum = strings.ToLower(reported)
+	default:
+		sendError(peer, "forbidden", "You cannot complete this transfer")
+		return
+	}
+
+	if sum != t.SHA256 {
+		failTransfer(room, t, "SHA-256 mismatch")
+		return
+	}
+	t.State = "complete"
+	t.hasher, t.checkpoints = nil, nil
+	log.Printf("File '%s' from '%s' to '%s' complete", t.Name, t.From, t.To)
+	notifyTransfer(room, t)
+}
+
+func failTransfer(room *Room, t *fileTransfer, reason string) {
+	t.State = "failed"
+	t.hasher, t.checkpoints = nil, nil
+	log.Printf("File '%s' from '%s' to '%s' failed: %s", t.Name, t.From, t.To, reason)
+	for _, username := range []string{t.From, t.To} {
+		if p := room.peers[username]; p != nil {
+			sendError(p, "transfer_failed", reason)
+		}
+	}
+	notifyTransfer(room, t)
+}
+
+// notifyTransfer sends the state of t to both parties. Caller must hold room.mu.
+func notifyTransfer(room *Room, t *fileTransfer) {
+	for _, username := range []string{t.From, t.To} {
+		p := room.peers[username]
+		if p == nil {
+			continue
+		}
+		msgType := "file_transfer"
+		if username == t.To && t.State == "offered" {
+			msgType = "file_offer"
+		}
+		if err := p.writeJSON(map[string]interface{}{
+			"type": msgType,
+			"data": t,
+		}); err != nil {
+			log.Printf("Error sending %s to %s: %v", msgType, username, err)
+		}
+	}
+}
+
+// fileChannelID picks a negotiated data channel ID not used by another
+// open transfer between the same two users. Caller must hold room.mu.
+func fileChannelID(room *Room, t *fileTransfer) uint16 {
+	used := make(map[uint16]bool)
+	for _, o := range room.transfers {
+		samePair := (o.From == t.From && o.To == t.To) || (o.From == t.To && o.To == t.From)
+		if samePair && o.Channel != 0 && !o.finished() {
+			used[o.Channel] = true
+		}
+	}
+	id := uint16(firstFileChannel)
+	for used[id] {
+		id += 2
+	}
+	return id
+}
+
+// interruptTransfers pauses the transfers of a departing member so they
+// can resume if it comes back; pending offers are cancelled. Caller must
+// hold room.mu.
+func interruptTransfers(peer *Peer) {
+	room := peer.joined
+	for _, t := range room.transfers {
+		if (t.From != peer.username && t.To != peer.username) || t.finished() {
+			continue
+		}
+		if t.State == "offered" {
+			t.State = "cancelled"
+		} else {
+			t.State = "interrupted"
+		}
+		t.updated = time.Now()
+		notifyTransfer(room, t)
+	}
+}
+
+// expireTransfers forgets transfers idle for longer than fileTransferTTL.
+// Caller must hold room.mu.
+func expireTransfers(room *Room) {
+	for id, t := range room.transfers {
+		if time.Since(t.updated) > fileTransferTTL {
+			delete(room.transfers, id)
+		}
+	}
+}
+
+func marshalHash(h hash.Hash) []byte {
+	state, _ := h.(encoding.BinaryMarshaler).MarshalBinary()
+	return state
+}
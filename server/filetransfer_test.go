@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestTransferResume relays a file in chunks, loses the recipient halfway
+// and resumes at what it reports to have stored. The server's hash picks
+// up from its checkpoint, so the file still completes.
+func TestTransferResume(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "transfer", "alice")
+	readUntil(t, alice, `"room_info"`)
+	bob := dial(t, url, "transfer", "bob")
+	readUntil(t, bob, `"room_info"`)
+
+	chunks := []string{"first chunk, ", "second chunk, ", "third chunk"}
+	var file []byte
+	for _, c := range chunks {
+		file = append(file, c...)
+	}
+	sum := sha256.Sum256(file)
+
+	send := func(conn *websocket.Conn, typ string, data map[string]interface{}) {
+		t.Helper()
+		if err := conn.WriteJSON(map[string]interface{}{"type": typ, "data": data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(conn *websocket.Conn, substr string) fileTransfer {
+		t.Helper()
+		var m struct {
+			Data fileTransfer `json:"data"`
+		}
+		if err := json.Unmarshal(readUntil(t, conn, substr), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Data
+	}
+	var id string
+	offset := int64(0)
+	sendChunk := func(i int) {
+		t.Helper()
+		send(alice, "file_chunk", map[string]interface{}{
+			"id":     id,
+			"offset": offset,
+			"data":   base64.StdEncoding.EncodeToString([]byte(chunks[i])),
+		})
+		offset += int64(len(chunks[i]))
+	}
+
+	send(alice, "file_offer", map[string]interface{}{
+		"to": "bob", "name": "notes.txt", "size": len(file), "sha256": hex.EncodeToString(sum[:]),
+	})
+	id = read(bob, `"file_offer"`).ID
+	send(bob, "file_accept", map[string]interface{}{"id": id, "mode": "relay"})
+	read(alice, `"accepted"`)
+
+	sendChunk(0)
+	sendChunk(1)
+	readUntil(t, bob, `"offset":13`)
+	bob.Close()
+	if tr := read(alice, `"interrupted"`); tr.Offset != int64(len(file)-len(chunks[2])) {
+		t.Errorf("interrupted at %d", tr.Offset)
+	}
+	waitUntil(t, "bob to leave", func() bool { return !slices.Contains(roomMembers("transfer"), "bob") })
+
+	// Bob only stored the first chunk before it went away.
+	bob = dial(t, url, "transfer", "bob")
+	readUntil(t, bob, `"room_info"`)
+	send(bob, "file_resume", map[string]interface{}{"id": id, "offset": 5})
+	readUntil(t, bob, `"invalid_offset"`)
+	send(bob, "file_resume", map[string]interface{}{"id": id, "offset": len(chunks[0])})
+	if tr := read(alice, `"accepted"`); tr.Offset != int64(len(chunks[0])) {
+		t.Fatalf("resumed at %d", tr.Offset)
+	}
+
+	offset = int64(len(chunks[0]))
+	sendChunk(1)
+	sendChunk(2)
+	readUntil(t, bob, `"offset":27`)
+	send(alice, "file_complete", map[string]interface{}{"id": id})
+	if tr := read(bob, `"complete"`); tr.Offset != int64(len(file)) {
+		t.Errorf("completed at %d", tr.Offset)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The fuzz targets send arbitrary bytes over real connections, as the
+// join message and as a message of a joined member. Seeds are browser
+// messages in testdata/fuzz; run them longer with
+//
+//	go test -fuzz FuzzMessage -fuzztime 1m
+
+// fuzzServer serves the websocket endpoint and records panics of its
+// connection goroutines, which net/http would only log.
+type fuzzServer struct {
+	url    string
+	active sync.WaitGroup
+
+	mu     sync.Mutex
+	panics []string
+}
+
+func startFuzzServer(f *testing.F) *fuzzServer {
+	s := &fuzzServer{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.active.Add(1)
+		defer s.active.Done()
+		defer func() {
+			if p := recover(); p != nil {
+				s.mu.Lock()
+				s.panics = append(s.panics, fmt.Sprintf("%v\n%s", p, debug.Stack()))
+				s.mu.Unlock()
+			}
+		}()
+		handleWebSocket(w, r)
+	}))
+	srv.Listener = countingListener{srv.Listener}
+	srv.Start()
+	f.Cleanup(srv.Close)
+	s.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+	return s
+}
+
+// settle closes conns, waits until the server is done with them and fails
+// if any input made it panic.
+func (s *fuzzServer) settle(t *testing.T, conns ...*websocket.Conn) {
+	t.Helper()
+	for _, c := range conns {
+		c.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection goroutines did not return")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.panics) > 0 {
+		t.Fatalf("connection goroutine panicked: %s", s.panics[0])
+	}
+}
+
+func (s *fuzzServer) dialRaw(t *testing.T) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(s.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// errPong ends the read a ping was sent for.
+var errPong = errors.New("pong")
+
+// roundTrip pings the server and reads until the pong: the server answers
+// once it has handled everything sent before.
+func roundTrip(conn *websocket.Conn) error {
+	conn.SetPongHandler(func(string) error { return errPong })
+	if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if errors.Is(err, errPong) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func FuzzJoin(f *testing.F) {
+	s := startFuzzServer(f)
+	f.Fuzz(func(t *testing.T, init []byte) {
+		if int64(len(init)) > *maxMessageSize {
+			t.Skip("larger than -max-message-size")
+		}
+		conn := s.dialRaw(t)
+		defer s.settle(t, conn)
+		if err := conn.WriteMessage(websocket.TextMessage, init); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, reply, err := conn.ReadMessage()
+		if err != nil {
+			s.settle(t, conn)
+			t.Fatalf("no reply to the join message: %v", err)
+		}
+
+		var m struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		}
+		if err := json.Unmarshal(reply, &m); err != nil {
+			t.Fatalf("reply %s: %v", reply, err)
+		}
+		req, err := decodeJoin(init)
+		switch {
+		case err != nil && (m.Type != "error" || m.Code != "invalid_join"):
+			t.Fatalf("invalid join (%v) answered with %s", err, reply)
+		case err == nil && m.Type == "room_info" && !bytes.Contains(reply, []byte(mustJSON(t, req.Username))):
+			t.Fatalf("joined as %q, not in %s", req.Username, reply)
+		case err == nil && m.Type != "room_info" && m.Type != "error":
+			t.Fatalf("valid join answered with %s", reply)
+		}
+	})
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func FuzzMessage(f *testing.F) {
+	s := startFuzzServer(f)
+	var rooms atomic.Int64
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		if int64(len(msg)) > *maxMessageSize {
+			t.Skip("larger than -max-message-size")
+		}
+		// A fresh room each time, with a second member for relays to
+		// reach: whatever the input does to a room stays in it.
+		room := fmt.Sprintf("fuzz-%d", rooms.Add(1))
+		alice := dial(t, s.url, room, "alice")
+		readUntil(t, alice, `"room_info"`)
+		bob := dial(t, s.url, room, "bob")
+		readUntil(t, bob, `"room_info"`)
+		defer s.settle(t, alice, bob)
+
+		if err := alice.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := roundTrip(alice); err != nil {
+			s.settle(t, alice, bob)
+			t.Fatalf("connection lost after the message: %v", err)
+		}
+	})
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Meeting interactions: a raised hand queue, ephemeral emoji reactions and
+// polls. Hands and polls are room state replayed to new members, reactions
+// are only broadcast.
+
+const (
+	maxReactionLength = 32 // bytes; one emoji, possibly with modifiers
+	maxPollOptions    = 10
+)
+
+// poll is a question with a fixed set of options; each participant votes
+// once and may change the vote until the poll is closed.
+type poll struct {
+	ID        string   `json:"id"`
+	From      string   `json:"from"`
+	Question  string   `json:"question"`
+	Options   []string `json:"options"`
+	Multiple  bool     `json:"multiple"`  // several options per vote
+	Anonymous bool     `json:"anonymous"` // results do not name voters
+	Closed    bool     `json:"closed"`
+	Timestamp int64    `json:"ts"` // unix milliseconds
+
+	votes map[string][]int // key: username, value: option indexes
+}
+
+// pollResults is broadcast as "poll_results" after every vote and when a
+// poll closes.
+type pollResults struct {
+	*poll
+	Counts []int      `json:"counts"`
+	Voters [][]string `json:"voters,omitempty"` // per option, unless anonymous
+	Total  int        `json:"total"`            // participants that voted
+}
+
+type interactionRequest struct {
+	Data struct {
+		Username string `json:"username"` // lower_hand: whose hand, owner only
+
+		Emoji string `json:"emoji"`
+
+		PollID    string   `json:"pollId"`
+		Question  string   `json:"question"`
+		Options   []string `json:"options"`
+		Multiple  bool     `json:"multiple"`
+		Anonymous bool     `json:"anonymous"`
+		Votes     []int    `json:"votes"`
+	} `json:"data"`
+}
+
+// handleInteraction processes raise_hand, lower_hand, reaction,
+// poll_create, poll_vote and poll_close.
+func handleInteraction(peer *Peer, msgType string, msg []byte) {
+	var req interactionRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		sendError(peer, "invalid_message", "Invalid "+msgType+" message")
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	switch msgType {
+	case "raise_hand":
+		for _, u := range room.hands {
+			if u == peer.username {
+				return
+			}
+		}
+		room.hands = append(room.hands, peer.username)
+		setHandRaised(peer, true)
+		broadcastRoom(room, "hand_queue", room.handQueue())
+	case "lower_hand":
+		target := peer
+		if req.Data.Username != "" && req.Data.Username != peer.username {
+			if peer.info.Role != roleOwner {
+				sendError(peer, "forbidden", "Only the room owner can lower another participant's hand")
+				return
+			}
+			if target = room.peers[req.Data.Username]; target == nil {
+				sendError(peer, "invalid_message", "No such participant")
+				return
+			}
+		}
+		if lowerHand(room, target) {
+			broadcastRoom(room, "hand_queue", room.handQueue())
+		}
+	case "reaction":
+		if !isEmoji(req.Data.Emoji) {
+			sendError(peer, "invalid_message", "Reaction must be a single emoji")
+			return
+		}
+		if !peer.allowReaction(time.Now()) {
+			sendError(peer, "rate_limited", "Too many reactions, slow down")
+			return
+		}
+		broadcastRoom(room, "reaction", map[string]interface{}{
+			"from":  peer.username,
+			"emoji": req.Data.Emoji,
+			"ts":    time.Now().UnixMilli(),
+		})
+	case "poll_create":
+		createPoll(peer, room, req)
+	case "poll_vote":
+		p := room.polls[req.Data.PollID]
+		if p == nil {
+			sendError(peer, "poll_not_found", "Poll not found")
+			return
+		}
+		if p.Closed {
+			sendError(peer, "poll_closed", "Poll is closed")
+			return
+		}
+		if !p.validVotes(req.Data.Votes) {
+			sendError(peer, "invalid_message", "Invalid poll vote")
+			return
+		}
+		p.votes[peer.username] = req.Data.Votes
+		broadcastRoom(room, "poll_results", p.results())
+	case "poll_close":
+		p := room.polls[req.Data.PollID]
+		if p == nil {
+			sendError(peer, "poll_not_found", "Poll not found")
+			return
+		}
+		if p.From != peer.username && peer.info.Role != roleOwner {
+			sendError(peer, "forbidden", "Only the poll's author or the room owner can close it")
+			return
+		}
+		if p.Closed {
+			return
+		}
+		p.Closed = true
+		log.Printf("Poll %s in room '%s' closed by %s", p.ID, room.name, peer.username)
+		broadcastRoom(room, "poll_closed", p.results())
+	}
+}
+
+func createPoll(peer *Peer, room *Room, req interactionRequest) {
+	d := req.Data
+	if d.Question == "" || utf8.RuneCountInString(d.Question) > *maxChatLength {
+		sendError(peer, "invalid_message", "Poll question is empty or too long")
+		return
+	}
+	if len(d.Options) < 2 || len(d.Options) > maxPollOptions {
+		sendError(peer, "invalid_message", "A poll needs between 2 and 10 options")
+		return
+	}
+	for _, o := range d.Options {
+		if o == "" || utf8.RuneCountInString(o) > *maxChatLength {
+			sendError(peer, "invalid_message", "Poll option is empty or too long")
+			return
+		}
+	}
+	if len(room.polls) >= *maxPolls && !evictClosedPoll(room) {
+		sendError(peer, "poll_limit", "Too many open polls in this room")
+		return
+	}
+
+	p := &poll{
+		ID:        randSeq(16),
+		From:      peer.username,
+		Question:  d.Question,
+		Options:   d.Options,
+		Multiple:  d.Multiple,
+		Anonymous: d.Anonymous,
+		Timestamp: time.Now().UnixMilli(),
+		votes:     make(map[string][]int),
+	}
+	room.polls[p.ID] = p
+	log.Printf("User '%s' created poll %s in room '%s'", peer.username, p.ID, room.name)
+	broadcastRoom(room, "poll_created", p.results())
+}
+
+// evictClosedPoll forgets the oldest closed poll of room to make way for a
+// new one. It reports false when every poll is still open. Caller must
+// hold room.mu.
+func evictClosedPoll(room *Room) bool {
+	var oldest *poll
+	for _, p := range room.polls {
+		if !p.Closed {
+			continue
+		}
+		if oldest == nil || p.Timestamp < oldest.Timestamp || p.Timestamp == oldest.Timestamp && p.ID < oldest.ID {
+			oldest = p
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(room.polls, oldest.ID)
+	return true
+}
+
+// validVotes checks a ballot: option indexes in range, no duplicates, one
+// option unless the poll allows several. An empty ballot withdraws the vote.
+func (p *poll) validVotes(votes []int) bool {
+	if len(votes) > 1 && !p.Multiple {
+		return false
+	}
+	seen := make(map[int]bool, len(votes))
+	for _, v := range votes {
+		if v < 0 || v >= len(p.Options) || seen[v] {
+			return false
+		}
+		seen[v] = true
+	}
+	return true
+}
+
+func (p *poll) results() pollResults {
+	r := pollResults{poll: p, Counts: make([]int, len(p.Options))}
+	if !p.Anonymous {
+		r.Voters = make([][]string, len(p.Options))
+		for i := range r.Voters {
+			r.Voters[i] = []string{}
+		}
+	}
+	for username, votes := range p.votes {
+		if len(votes) == 0 {
+			continue
+		}
+		r.Total++
+		for _, v := range votes {
+			r.Counts[v]++
+			if !p.Anonymous {
+				r.Voters[v] = append(r.Voters[v], username)
+			}
+		}
+	}
+	for _, voters := range r.Voters {
+		sort.Strings(voters)
+	}
+	return r
+}
+
+// allowReaction applies the per-participant reaction rate limit: at most
+// -reaction-burst reactions in any -reaction-window. Caller must hold room.mu.
+func (p *Peer) allowReaction(now time.Time) bool {
+	recent := p.reactions[:0]
+	for _, t := range p.reactions {
+		if now.Sub(t) < *reactionWindow {
+			recent = append(recent, t)
+		}
+	}
+	p.reactions = recent
+	if len(p.reactions) >= *reactionBurst {
+		return false
+	}
+	p.reactions = append(p.reactions, now)
+	return true
+}
+
+// pictographic holds the code points that start an emoji, from Unicode's
+// Extended_Pictographic less the regional indicators and skin tones.
+var pictographic = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00A9, 0x00A9, 1}, {0x00AE, 0x00AE, 1}, {0x203C, 0x203C, 1}, {0x2049, 0x2049, 1},
+		{0x2122, 0x2122, 1}, {0x2139, 0x2139, 1}, {0x2194, 0x2199, 1}, {0x21A9, 0x21AA, 1},
+		{0x231A, 0x231B, 1}, {0x2328, 0x2328, 1}, {0x23CF, 0x23CF, 1}, {0x23E9, 0x23F3, 1},
+		{0x23F8, 0x23FA, 1}, {0x24C2, 0x24C2, 1}, {0x25AA, 0x25AB, 1}, {0x25B6, 0x25B6, 1},
+		{0x25C0, 0x25C0, 1}, {0x25FB, 0x25FE, 1}, {0x2600, 0x27BF, 1}, {0x2934, 0x2935, 1},
+		{0x2B05, 0x2B07, 1}, {0x2B1B, 0x2B1C, 1}, {0x2B50, 0x2B50, 1}, {0x2B55, 0x2B55, 1},
+		{0x3030, 0x3030, 1}, {0x303D, 0x303D, 1}, {0x3297, 0x3297, 1}, {0x3299, 0x3299, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1F000, 0x1F1E5, 1}, {0x1F200, 0x1F3FA, 1}, {0x1F400, 0x1FAFF, 1},
+	},
+	LatinOffset: 2,
+}
+
+// isEmoji reports whether s is a single emoji: a pictograph with an
+// optional presentation selector and skin tone, a flag, a keycap, or such
+// emoji joined with ZWJ, no longer than maxReactionLength.
+func isEmoji(s string) bool {
+	if s == "" || len(s) > maxReactionLength || !utf8.ValidString(s) {
+		return false
+	}
+	r := []rune(s)
+	for {
+		n := emojiElement(r)
+		if n == 0 {
+			return false
+		}
+		r = r[n:]
+		if len(r) == 0 {
+			return true
+		}
+		if r[0] != 0x200D || len(r) == 1 { // ZWJ joins another emoji
+			return false
+		}
+		r = r[1:]
+	}
+}
+
+// emojiElement returns the length of the emoji r starts with, 0 if none.
+func emojiElement(r []rune) int {
+	regional := func(c rune) bool { return c >= 0x1F1E6 && c <= 0x1F1FF }
+	switch {
+	case regional(r[0]):
+		if len(r) > 1 && regional(r[1]) {
+			return 2
+		}
+		return 0
+	case r[0] >= '0' && r[0] <= '9' || r[0] == '#' || r[0] == '*':
+		n := 1
+		if len(r) > n && r[n] == 0xFE0F {
+			n++
+		}
+		if len(r) > n && r[n] == 0x20E3 {
+			return n + 1
+		}
+		return 0
+	case !unicode.Is(pictographic, r[0]):
+		return 0
+	}
+
+	n := 1
+	if len(r) > n && r[n] == 0xFE0F {
+		n++
+	}
+	if len(r) > n && r[n] >= 0x1F3FB && r[n] <= 0x1F3FF {
+		n++
+	}
+	// A black flag followed by tags is a subdivision flag.
+	if r[0] == 0x1F3F4 && len(r) > n && r[n] >= 0xE0020 && r[n] <= 0xE007E {
+		for len(r) > n && r[n] >= 0xE0020 && r[n] <= 0xE007E {
+			n++
+		}
+		if len(r) > n && r[n] == 0xE007F {
+			return n + 1
+		}
+		return 0
+	}
+	return n
+}
+
+// lowerHand removes peer from the hand queue. Caller must hold room.mu.
+func lowerHand(room *Room, peer *Peer) bool {
+	for i, u := range room.hands {
+		if u == peer.username {
+			room.hands = append(room.hands[:i], room.hands[i+1:]...)
+			setHandRaised(peer, false)
+			return true
+		}
+	}
+	return false
+}
+
+func setHandRaised(peer *Peer, raised bool) {
+	info := peer.info
+	info.HandRaised = raised
+	updateParticipant(peer, info)
+}
+
+// handQueue lists raised hands in the order they were raised. Caller must hold room.mu.
+func (r *Room) handQueue() map[string]interface{} {
+	queue := make([]string, len(r.hands))
+	copy(queue, r.hands)
+	return map[string]interface{}{"queue": queue}
+}
+
+// sendInteractions replays the hand queue and the polls of the room to
+// peer. Caller must hold room.mu.
+func sendInteractions(peer *Peer) {
+	room := peer.joined
+	polls := make([]pollResults, 0, len(room.polls))
+	for _, p := range room.polls {
+		polls = append(polls, p.results())
+	}
+	sort.Slice(polls, func(i, j int) bool {
+		if polls[i].Timestamp != polls[j].Timestamp {
+			return polls[i].Timestamp < polls[j].Timestamp
+		}
+		return polls[i].ID < polls[j].ID
+	})
+	if err := peer.writeJSON(map[string]interface{}{
+		"type": "interactions",
+		"data": map[string]interface{}{
+			"hands": room.handQueue()["queue"],
+			"polls": polls,
+		},
+	}); err != nil {
+		log.Printf("Error sending interactions to %s: %v", peer.username, err)
+	}
+}
+
+// leaveInteractions drops the raised hand of a departing peer. Caller must hold room.mu.
+func leaveInteractions(peer *Peer) {
+	room := peer.joined
+	if lowerHand(room, peer) {
+		broadcastRoom(room, "hand_queue", room.handQueue())
+	}
+}
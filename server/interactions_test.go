@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIsEmoji(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want bool
+	}{
+		{"👍", true},
+		{"❤️", true},
+		{"👍🏽", true},
+		{"👩‍💻", true},
+		{"👨‍👩‍👧‍👦", true},
+		{"🇫🇷", true},
+		{"🏴󠁧󠁢󠁳󠁣󠁴󠁿", true},
+		{"#️⃣", true},
+		{"", false},
+		{"ok", false},
+		{"👍👍", false},
+		{"👍 ", false},
+		{"🇫", false},
+		{"🏽", false},
+		{"1", false},
+		{"👩‍", false},
+		{"‍👍", false},
+		{"<script>", false},
+	} {
+		if got := isEmoji(tc.s); got != tc.want {
+			t.Errorf("isEmoji(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+// TestPollLimit fills a room with polls: a new poll is refused while they
+// are all open and replaces the oldest closed one otherwise.
+func TestPollLimit(t *testing.T) {
+	defer func(n int) { *maxPolls = n }(*maxPolls)
+	*maxPolls = 2
+	room := newRoom("polls")
+	alice, conn := addMember(t, room, "alice")
+
+	create := func() string {
+		t.Helper()
+		handleInteraction(alice, "poll_create", []byte(`{"type":"poll_create","data":{"question":"Lunch?","options":["yes","no"]}}`))
+		var m struct {
+			Data struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(readUntil(t, conn, `"poll_created"`), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Data.ID
+	}
+	first := create()
+	create()
+	handleInteraction(alice, "poll_create", []byte(`{"type":"poll_create","data":{"question":"Lunch?","options":["yes","no"]}}`))
+	readUntil(t, conn, `"code":"poll_limit"`)
+
+	handleInteraction(alice, "poll_close", []byte(`{"type":"poll_close","data":{"pollId":"`+first+`"}}`))
+	readUntil(t, conn, `"poll_closed"`)
+	third := create()
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if len(room.polls) != 2 || room.polls[first] != nil || room.polls[third] == nil {
+		t.Errorf("polls after replacing the closed one: %v", room.polls)
+	}
+}
+
+// TestHandQueue raises and lowers hands and checks the queue keeps the
+// order hands were raised in.
+func TestHandQueue(t *testing.T) {
+	room := newRoom("hands")
+	members := make(map[string]*Peer)
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		members[name], conns[name] = addMember(t, room, name)
+	}
+	members["alice"].info.Role = roleOwner
+
+	for _, step := range []struct {
+		who, msgType, username string
+		code                   string // error expected
+		queue                  []string
+	}{
+		{who: "bob", msgType: "raise_hand", queue: []string{"bob"}},
+		{who: "alice", msgType: "raise_hand", queue: []string{"bob", "alice"}},
+		{who: "bob", msgType: "raise_hand", queue: []string{"bob", "alice"}},
+		{who: "carol", msgType: "raise_hand", queue: []string{"bob", "alice", "carol"}},
+		{who: "bob", msgType: "lower_hand", queue: []string{"alice", "carol"}},
+		{who: "bob", msgType: "lower_hand", queue: []string{"alice", "carol"}},
+		{who: "bob", msgType: "raise_hand", queue: []string{"alice", "carol", "bob"}},
+		{who: "carol", msgType: "lower_hand", username: "alice", code: "forbidden", queue: []string{"alice", "carol", "bob"}},
+		{who: "alice", msgType: "lower_hand", username: "nobody", code: "invalid_message", queue: []string{"alice", "carol", "bob"}},
+		{who: "alice", msgType: "lower_hand", username: "carol", queue: []string{"alice", "bob"}},
+	} {
+		msg, _ := json.Marshal(map[string]interface{}{
+			"type": step.msgType,
+			"data": map[string]string{"username": step.username},
+		})
+		handleInteraction(members[step.who], step.msgType, msg)
+		if step.code != "" {
+			readUntil(t, conns[step.who], `"code":"`+step.code+`"`)
+		}
+
+		room.mu.Lock()
+		queue := room.handQueue()["queue"].([]string)
+		raised := make(map[string]bool)
+		for name, p := range members {
+			raised[name] = p.info.HandRaised
+		}
+		room.mu.Unlock()
+		if !slices.Equal(queue, step.queue) {
+			t.Fatalf("%s %s %s: queue %v, want %v", step.who, step.msgType, step.username, queue, step.queue)
+		}
+		for name, r := range raised {
+			if r != slices.Contains(step.queue, name) {
+				t.Fatalf("%s %s %s: %s has HandRaised %v", step.who, step.msgType, step.username, name, r)
+			}
+		}
+	}
+}
+
+// TestReactionLimit sends reactions at given times against a limit of two
+// per second.
+func TestReactionLimit(t *testing.T) {
+	defer func(burst int, window time.Duration) { *reactionBurst, *reactionWindow = burst, window }(*reactionBurst, *reactionWindow)
+	*reactionBurst, *reactionWindow = 2, time.Second
+
+	p := &Peer{}
+	start := time.Now()
+	for _, tc := range []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, true},
+		{100 * time.Millisecond, true},
+		{200 * time.Millisecond, false},
+		{999 * time.Millisecond, false},
+		{time.Second, true}, // the first one is out of the window
+		{1050 * time.Millisecond, false},
+		{1100 * time.Millisecond, true},
+		{5 * time.Second, true},
+	} {
+		if got := p.allowReaction(start.Add(tc.at)); got != tc.want {
+			t.Errorf("reaction at %v allowed = %v, want %v", tc.at, got, tc.want)
+		}
+	}
+
+	room := newRoom("reactions")
+	alice, conn := addMember(t, room, "alice")
+	for _, tc := range []struct {
+		emoji, want string
+	}{
+		{"👍", `"type":"reaction"`},
+		{"no", `"code":"invalid_message"`},
+		{"🎉", `"type":"reaction"`},
+		{"👏", `"code":"rate_limited"`},
+	} {
+		handleInteraction(alice, "reaction", []byte(`{"type":"reaction","data":{"emoji":"`+tc.emoji+`"}}`))
+		if msg := readUntil(t, conn, `"`); !strings.Contains(string(msg), tc.want) {
+			t.Errorf("reaction %q: got %s, want %s", tc.emoji, msg, tc.want)
+		}
+	}
+}
+
+// TestPollVotes votes on a poll, changes and withdraws votes and closes
+// it.
+func TestPollVotes(t *testing.T) {
+	room := newRoom("votes")
+	members := make(map[string]*Peer)
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		members[name], conns[name] = addMember(t, room, name)
+	}
+	members["alice"].info.Role = roleOwner
+
+	handleInteraction(members["carol"], "poll_create", []byte(`{"type":"poll_create","data":{"question":"Where?","options":["here","there","elsewhere"]}}`))
+	var created struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(readUntil(t, conns["carol"], `"poll_created"`), &created); err != nil {
+		t.Fatal(err)
+	}
+	id := created.Data.ID
+
+	for _, step := range []struct {
+		who, msgType, data string
+		code               string // error expected
+		counts             []int
+	}{
+		{who: "bob", msgType: "poll_vote", data: `"votes":[0]`, counts: []int{1, 0, 0}},
+		{who: "bob", msgType: "poll_vote", data: `"votes":[1]`, counts: []int{0, 1, 0}},
+		{who: "alice", msgType: "poll_vote", data: `"votes":[0,1]`, code: "invalid_message", counts: []int{0, 1, 0}},
+		{who: "alice", msgType: "poll_vote", data: `"votes":[3]`, code: "invalid_message", counts: []int{0, 1, 0}},
+		{who: "alice", msgType: "poll_vote", data: `"votes":[1]`, counts: []int{0, 2, 0}},
+		{who: "carol", msgType: "poll_vote", data: `"votes":[2]`, counts: []int{0, 2, 1}},
+		{who: "carol", msgType: "poll_vote", data: `"votes":[]`, counts: []int{0, 2, 0}},
+		{who: "bob", msgType: "poll_close", code: "forbidden", counts: []int{0, 2, 0}},
+		{who: "alice", msgType: "poll_close", counts: []int{0, 2, 0}},
+		{who: "carol", msgType: "poll_vote", data: `"votes":[0]`, code: "poll_closed", counts: []int{0, 2, 0}},
+		{who: "bob", msgType: "poll_vote", data: `"votes":[0]`, code: "poll_closed", counts: []int{0, 2, 0}},
+	} {
+		data := `{"pollId":"` + id + `"`
+		if step.data != "" {
+			data += "," + step.data
+		}
+		handleInteraction(members[step.who], step.msgType, []byte(`{"type":"`+step.msgType+`","data":`+data+`}}`))
+		if step.code != "" {
+			readUntil(t, conns[step.who], `"code":"`+step.code+`"`)
+		}
+		room.mu.Lock()
+		r := room.polls[id].results()
+		room.mu.Unlock()
+		if !slices.Equal(r.Counts, step.counts) {
+			t.Fatalf("%s %s %s: counts %v, want %v", step.who, step.msgType, step.data, r.Counts, step.counts)
+		}
+	}
+
+	room.mu.Lock()
+	r := room.polls[id].results()
+	room.mu.Unlock()
+	if !r.Closed || r.Total != 2 || !slices.Equal(r.Voters[1], []string{"alice", "bob"}) {
+		t.Errorf("final results: %+v", r)
+	}
+	handleInteraction(members["bob"], "poll_vote", []byte(`{"type":"poll_vote","data":{"pollId":"nope","votes":[0]}}`))
+	readUntil(t, conns["bob"], `"code":"poll_not_found"`)
+}
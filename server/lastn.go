@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sort"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Last-N forwarding. In large rooms each subscriber only receives the video
+// of the N participants that spoke most recently plus the ones it pinned;
+// the other video tracks stay negotiated but paused.
+
+type videoConstraints struct {
+	LastN  int      `json:"lastN"`  // 0 keeps the room's limit
+	Pinned []string `json:"pinned"` // always forwarded, not counted in N
+}
+
+// handleVideoConstraints stores a subscriber's last-N preferences.
+func handleVideoConstraints(peer *Peer, msg []byte) {
+	var m struct {
+		Data videoConstraints `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil || m.Data.LastN < 0 {
+		sendError(peer, "invalid_message", "Invalid video_constraints message")
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	peer.lastN = m.Data.LastN
+	peer.pinned = m.Data.Pinned
+	applyLastN(peer.joined)
+}
+
+// videoSources returns the usernames publishing video in room, most recent
+// speakers first and the rest by name. Caller must hold room.mu.
+func videoSources(room *Room) []string {
+	publishers := make(map[string]bool)
+	for _, t := range room.tracks {
+		if t.kind == webrtc.RTPCodecTypeVideo {
+			publishers[t.owner.username] = true
+		}
+	}
+
+	order := make([]string, 0, len(publishers))
+	for _, u := range room.speakers.recentSpeakers() {
+		if publishers[u] {
+			order = append(order, u)
+			delete(publishers, u)
+		}
+	}
+	rest := make([]string, 0, len(publishers))
+	for u := range publishers {
+		rest = append(rest, u)
+	}
+	sort.Strings(rest)
+	return append(order, rest...)
+}
+
+// applyLastN selects the forwarded video of every SFU participant of room
+// and tells each one whose selection changed. Caller must hold room.mu.
+func applyLastN(room *Room) {
+	sources := videoSources(room)
+
+	for _, p := range room.peers {
+		if !p.sfu {
+			continue
+		}
+
+		n := room.lastN
+		if p.lastN > 0 && (n == 0 || p.lastN < n) {
+			n = p.lastN
+		}
+		pinned := make(map[string]bool, len(p.pinned))
+		for _, u := range p.pinned {
+			pinned[u] = true
+		}
+
+		selected := make(map[string]bool)
+		forwarded := make([]string, 0, len(sources))
+		count := 0
+		for _, u := range sources {
+			if u == p.username {
+				continue
+			}
+			if pinned[u] || n == 0 || count < n {
+				selected[u] = true
+				forwarded = append(forwarded, u)
+				if !pinned[u] {
+					count++
+				}
+			}
+		}
+
+		changed := false
+		for _, dt := range p.downTracks {
+			if dt.source.kind != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+			// Presentations are not subject to last-N.
+			want := selected[dt.source.owner.username] || dt.source.source == sourceScreen
+			dt.mu.Lock()
+			if dt.selected != want {
+				dt.selected = !dt.selected
+				changed = true
+			}
+			dt.mu.Unlock()
+		}
+		if !changed && slices.Equal(forwarded, p.forwarded) {
+			continue
+		}
+		p.forwarded = forwarded
+
+		if p.bwe != nil {
+			allocateBandwidth(p)
+		}
+		if err := p.writeJSON(map[string]interface{}{
+			"type": "forwarded_sources",
+			"data": map[string]interface{}{
+				"lastN":     n,
+				"forwarded": forwarded,
+				"pinned":    p.pinned,
+			},
+		}); err != nil {
+			log.Printf("Error sending forwarded sources to %s: %v", p.username, err)
+		}
+	}
+}
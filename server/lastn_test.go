@@ -0,0 +1,99 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// TestLastN publishes the video of four members and checks which of them
+// two subscribers are forwarded as the members speak and as N changes. A
+// presentation is always forwarded.
+func TestLastN(t *testing.T) {
+	defer func(smoothing float64) { *speakerSmoothing = smoothing }(*speakerSmoothing)
+	*speakerSmoothing = 1
+
+	room := newRoom("lastn")
+	room.lastN = 2
+	members := make(map[string]*Peer)
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		members[name], _ = addMember(t, room, name)
+	}
+	erin, erinConn := addMember(t, room, "erin")
+	alice := members["alice"]
+	alice.sfu, erin.sfu = true, true
+
+	publish := func(id, owner, source string) {
+		track := &publishedTrack{id: id, kind: webrtc.RTPCodecTypeVideo, owner: members[owner], source: source}
+		room.tracks[id] = track
+		for _, p := range []*Peer{erin, alice} {
+			if p != track.owner {
+				p.downTracks[id] = &downTrack{source: track, subscriber: p}
+			}
+		}
+	}
+	room.mu.Lock()
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		publish(name+"-camera", name, sourceCamera)
+	}
+	publish("bob-screen", "bob", sourceScreen)
+	room.mu.Unlock()
+
+	now := time.Now()
+	speak := func(username string) {
+		// Long enough after the previous speaker for it to fall silent.
+		now = now.Add(2 * time.Second)
+		room.speakers.observe(username, 0)
+		room.speakers.update(now)
+	}
+	constrain := func(msg string) func() {
+		return func() { handleVideoConstraints(erin, []byte(msg)) }
+	}
+
+	for _, step := range []struct {
+		name        string
+		do          func() // called without room.mu
+		erin, alice []string
+	}{
+		{"nobody spoke", func() {}, []string{"alice", "bob"}, []string{"bob", "carol"}},
+		{"dave speaks", func() { speak("dave") }, []string{"dave", "alice"}, []string{"dave", "bob"}},
+		{"carol speaks", func() { speak("carol") }, []string{"carol", "dave"}, []string{"carol", "dave"}},
+		{"alice speaks", func() { speak("alice") }, []string{"alice", "carol"}, []string{"carol", "dave"}},
+		{"erin wants one", constrain(`{"type":"video_constraints","data":{"lastN":1}}`), []string{"alice"}, []string{"carol", "dave"}},
+		{"erin pins bob", constrain(`{"type":"video_constraints","data":{"lastN":1,"pinned":["bob"]}}`), []string{"alice", "bob"}, []string{"carol", "dave"}},
+		{"erin wants more than the room allows", constrain(`{"type":"video_constraints","data":{"lastN":5}}`), []string{"alice", "carol"}, []string{"carol", "dave"}},
+		{"the room forwards everyone", func() { room.mu.Lock(); room.lastN = 0; room.mu.Unlock() }, []string{"alice", "carol", "dave", "bob"}, []string{"carol", "dave", "bob"}},
+	} {
+		step.do()
+		room.mu.Lock()
+		applyLastN(room)
+		for _, p := range []*Peer{erin, alice} {
+			want := step.erin
+			if p == alice {
+				want = step.alice
+			}
+			if !slices.Equal(p.forwarded, want) {
+				t.Errorf("%s: %s is forwarded %v, want %v", step.name, p.username, p.forwarded, want)
+			}
+			for id, dt := range p.downTracks {
+				dt.mu.Lock()
+				selected := dt.selected
+				dt.mu.Unlock()
+				if want := id == "bob-screen" || slices.Contains(want, dt.source.owner.username); selected != want {
+					t.Errorf("%s: %s's %s selected %v", step.name, p.username, id, selected)
+				}
+			}
+		}
+		room.mu.Unlock()
+	}
+
+	handleVideoConstraints(erin, []byte(`{"type":"video_constraints","data":{"lastN":-1}}`))
+	readUntil(t, erinConn, `"code":"invalid_message"`)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if erin.lastN != 5 {
+		t.Errorf("invalid constraints changed lastN to %d", erin.lastN)
+	}
+}
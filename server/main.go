@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -22,15 +26,82 @@ type Peer struct {
 	pc       *webrtc.PeerConnection
 	username string
 	room     string
+	joined   *Room           // set once the peer is in the room
+	send     chan outMessage // drained by the writer, the only one writing to conn
+	closed   chan struct{}   // closed once the connection is done
+	sendMu   sync.Mutex      // orders queuing against closing
+	stopped  bool            // closed was closed, guarded by sendMu
+	compress bool            // deflate large messages written to conn
+	counters compressionCounters
+
+	// SFU state, guarded by the room's mu
+	sfu                bool                  // peer negotiated Peer.pc with the server
+	downTracks         map[string]*downTrack // key: published track ID
+	negotiationPending bool                  // renegotiate once the current offer is answered
+	bwe                cc.BandwidthEstimator // estimate of what the server can send to this peer
+	lastN              int                   // video sources wanted by the peer, 0 for the room's limit
+	pinned             []string              // usernames whose video is always forwarded
+	forwarded          []string              // video sources last announced to the peer
+	audioMix           bool                  // peer receives the server's audio mix instead of per-user audio
+	mixSender          *webrtc.RTPSender
+	dataChannels       map[string]*webrtc.DataChannel // key: label, channels opened to the server
+
+	info      Participant // presence shown to the room, guarded by the room's mu
+	reactions []time.Time // recent reactions for rate limiting, guarded by the room's mu
+
+	// Cascading, guarded by the room's mu. Links to other nodes and stand-ins for
+	// their publishers are Peers without a websocket.
+	cascadeNode       string // outbound cascade link: the node it sends to
+	origin            string // stand-in: node the publisher is connected to
+	pendingCandidates []webrtc.ICECandidateInit
+
+	// Last descriptions and count of candidates the peer sent, guarded by
+	// the room's mu
+	sdp        *sdpSummary // to the room, peer to peer
+	sfuSDP     *sdpSummary // to the SFU
+	candidates candidateStats
+}
+
+// Room is guarded by its own mu, which also guards the state of its
+// members, so activity in one room never waits for another.
+type Room struct {
+	mu      sync.Mutex
+	closed  bool // the last member left; the room is being removed from rooms
+	syncing bool // the members on other nodes are not known yet
+
+	name      string
+	peers     map[string]*Peer           // key: username
+	tracks    map[string]*publishedTrack // key: track ID, tracks received by the SFU
+	speakers  *speakerDetector
+	lastN     int        // video sources forwarded to each subscriber, 0 for all
+	mixer     *roomMixer // nil unless -audio-mix is set
+	chat      []*chatMessage
+	transfers map[string]*fileTransfer // key: transfer ID
+
+	remote      map[string]remoteMember // key: username, members connected to other nodes
+	cascadesOut map[string]*Peer        // key: node ID, links sending local tracks
+	cascadesIn  map[string]*cascadeIn   // key: node ID, links receiving tracks
+
+	presenters    map[string]string // key: username, value: screen share stream ID
+	maxPresenters int
+	presenterLock bool // only the owner may start presenting
+	relayOnly     bool // only relay candidates are relayed, hiding members' addresses
+	relayOnlySet  bool // relayOnly was chosen by the owner rather than -ice-relay-only
+
+	hands []string         // raised hands in the order they were raised
+	polls map[string]*poll // key: poll ID
 }
 
 type RoomInfo struct {
-	Users []string `json:"users"`
+	Users        []string      `json:"users"`
+	Participants []Participant `json:"participants"`
 }
 
 var (
-	peers   = make(map[string]*Peer)
-	rooms   = make(map[string]map[string]*Peer)
+	peers = make(map[string]*Peer)
+	rooms = make(map[string]*Room)
+	// mu guards peers and rooms only. It is held briefly and never while
+	// waiting for a Room's mu, except to lock a Room nobody else can see yet.
 	mu      sync.Mutex
 	letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 )
@@ -47,13 +118,223 @@ func randSeq(n int) string {
 	return string(b)
 }
 
+// writeJSON queues v for p; it never waits on the network.
+func (p *Peer) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.enqueue(outMessage{data: data, size: len(data)})
+}
+
+// encodeBuffers recycles the buffers broadcast messages are encoded into.
+var encodeBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// prepareJSON encodes v once for any number of connections; the frames,
+// compressed or not, are built once per connection setting. release must
+// be called after the last write, which may be after the message is
+// queued. size is the length of the payload.
+func prepareJSON(v interface{}) (pm *websocket.PreparedMessage, size int, release func(), err error) {
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		encodeBuffers.Put(buf)
+		return nil, 0, nil, err
+	}
+	pm, err = websocket.NewPreparedMessage(websocket.TextMessage, buf.Bytes())
+	if err != nil {
+		encodeBuffers.Put(buf)
+		return nil, 0, nil, err
+	}
+	return pm, buf.Len(), func() { encodeBuffers.Put(buf) }, nil
+}
+
+// broadcastJSON writes v to every member of room except skip. Caller must
+// hold room.mu.
+func broadcastJSON(room *Room, skip *Peer, v interface{}) {
+	pm, size, release, err := prepareJSON(v)
+	if err != nil {
+		log.Printf("Error encoding message for room '%s': %v", room.name, err)
+		return
+	}
+	broadcastPrepared(room, skip, newSharedMessage(pm, size, release))
+}
+
+// broadcastPrepared queues m for every member of room except skip. Caller
+// must hold room.mu.
+func broadcastPrepared(room *Room, skip *Peer, m *sharedMessage) {
+	defer m.done()
+	for username, p := range room.peers {
+		if p == skip {
+			continue
+		}
+		if err := m.queue(p); err != nil {
+			log.Printf("Error sending to %s: %v", username, err)
+		}
+	}
+}
+
+// relayToRoom passes a client message on to the other members of room
+// unchanged. Caller must hold room.mu.
+func relayToRoom(room *Room, from *Peer, msg []byte) {
+	pm, err := websocket.NewPreparedMessage(websocket.TextMessage, msg)
+	if err != nil {
+		log.Printf("Error preparing message for room '%s': %v", room.name, err)
+		return
+	}
+	broadcastPrepared(room, from, newSharedMessage(pm, len(msg), nil))
+}
+
+// sendError reports a failed request to the client. code is stable for
+// programs, data is meant for humans.
+func sendError(p *Peer, code, data string) {
+	if err := p.writeJSON(map[string]interface{}{
+		"type": "error",
+		"code": code,
+		"data": data,
+	}); err != nil {
+		log.Printf("Error sending error to %s: %v", p.username, err)
+	}
+}
+
+// broadcastRoom sends a typed message to every member of room. Caller must hold room.mu.
+func broadcastRoom(room *Room, msgType string, data interface{}) {
+	broadcastJSON(room, nil, map[string]interface{}{
+		"type": msgType,
+		"data": data,
+	})
+}
+
 func logStatus() {
+	mu.Lock()
+	log.Printf("Status - Connections: %d, Rooms: %d", len(peers), len(rooms))
+	mu.Unlock()
+
+	for _, room := range snapshotRooms() {
+		room.mu.Lock()
+		log.Printf("Room '%s' (%d users, %d SFU tracks): %v", room.name, len(room.peers), len(room.tracks), getUsernames(room.peers))
+		room.mu.Unlock()
+	}
+}
+
+// snapshotRooms returns the current rooms, for loops that lock them one
+// at a time.
+func snapshotRooms() []*Room {
 	mu.Lock()
 	defer mu.Unlock()
 
-	log.Printf("Status - Connections: %d, Rooms: %d", len(peers), len(rooms))
-	for room, roomPeers := range rooms {
-		log.Printf("Room '%s' (%d users): %v", room, len(roomPeers), getUsernames(roomPeers))
+	list := make([]*Room, 0, len(rooms))
+	for _, room := range rooms {
+		list = append(list, room)
+	}
+	return list
+}
+
+func newRoom(name string) *Room {
+	return &Room{
+		name:      name,
+		peers:     make(map[string]*Peer),
+		tracks:    make(map[string]*publishedTrack),
+		speakers:  newSpeakerDetector(),
+		lastN:     *lastN,
+		mixer:     newRoomMixer(),
+		transfers: make(map[string]*fileTransfer),
+
+		presenters:    make(map[string]string),
+		maxPresenters: *maxPresenters,
+		relayOnly:     *iceRelayOnly,
+
+		polls: make(map[string]*poll),
+
+		remote:      make(map[string]remoteMember),
+		cascadesOut: make(map[string]*Peer),
+		cascadesIn:  make(map[string]*cascadeIn),
+	}
+}
+
+// joinRoom adds peer to the room it asked for, creating the room if
+// needed. It fails when the username is taken.
+func joinRoom(peer *Peer, displayName string, metadata map[string]string) bool {
+	for {
+		mu.Lock()
+		room, exists := rooms[peer.room]
+		if !exists {
+			room = newRoom(peer.room)
+			room.mu.Lock()
+			rooms[peer.room] = room
+			mu.Unlock()
+			loadRoomState(room)
+			joinClusterRoom(room)
+		} else {
+			mu.Unlock()
+			room.mu.Lock()
+		}
+
+		if room.closed {
+			// Lost the race with the last member leaving; start over
+			// with a new room.
+			room.mu.Unlock()
+			mu.Lock()
+			if rooms[peer.room] == room {
+				delete(rooms, peer.room)
+			}
+			mu.Unlock()
+			continue
+		}
+
+		_, remoteExists := room.remote[peer.username]
+		if _, userExists := room.peers[peer.username]; userExists || remoteExists {
+			room.mu.Unlock()
+			return false
+		}
+		peer.joined = room
+		peer.info = newParticipant(room, peer.username, displayName, metadata)
+		room.peers[peer.username] = peer
+		if room.owner() == peer.username {
+			peer.info.Role = roleOwner
+		}
+		sendRoomInfo(peer)
+		broadcastJSON(room, peer, map[string]interface{}{
+			"type": "participant_joined",
+			"data": peer.info,
+		})
+		publishMember(room, "join", peer.info)
+		electOwner(room)
+		room.mu.Unlock()
+		return true
+	}
+}
+
+// leaveRoom removes a departing peer from its room and releases everything
+// it held there. The last member to leave closes the room.
+func leaveRoom(peer *Peer) {
+	room := peer.joined
+	room.mu.Lock()
+	delete(room.peers, peer.username)
+	announceLeave(room, peer.username)
+	interruptTransfers(peer)
+	leaveAudioMix(peer)
+	leaveScreenShare(peer)
+	leaveInteractions(peer)
+	leaveSFU(peer)
+	room.speakers.remove(peer.username)
+	publishMember(room, "leave", peer.info)
+	empty := len(room.peers) == 0
+	if empty {
+		room.closed = true
+		leaveClusterRoom(room)
+		forgetChat(room)
+	} else {
+		electOwner(room)
+	}
+	room.mu.Unlock()
+
+	if empty {
+		mu.Lock()
+		if rooms[peer.room] == room {
+			delete(rooms, peer.room)
+		}
+		mu.Unlock()
 	}
 }
 
@@ -62,39 +343,55 @@ func getUsernames(peers map[string]*Peer) []string {
 	for username := range peers {
 		usernames = append(usernames, username)
 	}
+	sort.Strings(usernames)
 	return usernames
 }
 
-func sendRoomInfo(room string) {
-	mu.Lock()
-	defer mu.Unlock()
+// sendRoomInfo sends the complete member list to peer, which just joined;
+// the others hear about it with participant_joined. Caller must hold
+// peer.joined.mu.
+func sendRoomInfo(peer *Peer) {
+	roomInfo := RoomInfo{Participants: participants(peer.joined)}
+	roomInfo.Users = make([]string, len(roomInfo.Participants))
+	for i, p := range roomInfo.Participants {
+		roomInfo.Users[i] = p.Username
+	}
 
-	if roomPeers, exists := rooms[room]; exists {
-		users := getUsernames(roomPeers)
-		roomInfo := RoomInfo{Users: users}
-
-		for _, peer := range roomPeers {
-			err := peer.conn.WriteJSON(map[string]interface{}{
-				"type": "room_info",
-				"data": roomInfo,
-			})
-			if err != nil {
-				log.Printf("Error sending room info to %s: %v", peer.username, err)
-			}
-		}
+	if err := peer.writeJSON(map[string]interface{}{
+		"type": "room_info",
+		"data": roomInfo,
+	}); err != nil {
+		log.Printf("Error sending room info to %s: %v", peer.username, err)
 	}
 }
 
 func main() {
+	flag.Parse()
+	checkAudioMix()
+	checkCompression()
+	checkSDPPolicy()
+	checkICEFilter()
+	openRoomStore()
+	startCluster()
+
 	http.HandleFunc("/ws", handleWebSocket)
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		logStatus()
 		w.Write([]byte("Status logged to console"))
 	})
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/route", handleRoute)
+
+	go runBandwidthAllocator()
+	go runSpeakerDetector()
 
 	log.Println("Server started on :8080")
 	logStatus()
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	ln, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(http.Serve(countingListener{ln}, nil))
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
@@ -104,63 +401,88 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close()
+	conn.SetReadLimit(*maxMessageSize)
 
 	remoteAddr := conn.RemoteAddr().String()
-	log.Printf("New connection from: %s", remoteAddr)
+	log.Printf("New connection from: %s", logAddr(remoteAddr))
 
-	var initData struct {
-		Room     string `json:"room"`
-		Username string `json:"username"`
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		log.Printf("Read init data error from %s: %v", logAddr(remoteAddr), err)
+		return
 	}
-	if err := conn.ReadJSON(&initData); err != nil {
-		log.Printf("Read init data error from %s: %v", remoteAddr, err)
+	initData, err := decodeJoin(msg)
+	if err != nil {
+		log.Printf("Invalid init data from %s: %v", logAddr(remoteAddr), err)
+		conn.WriteJSON(map[string]interface{}{
+			"type": "error",
+			"code": "invalid_join",
+			"data": "Invalid join message",
+		})
 		return
 	}
 
 	log.Printf("User '%s' joining room '%s'", initData.Username, initData.Room)
 
-	mu.Lock()
-	if roomPeers, exists := rooms[initData.Room]; exists {
-		if _, userExists := roomPeers[initData.Username]; userExists {
-			conn.WriteJSON(map[string]interface{}{
-				"type": "error",
-				"data": "Username already exists",
-			})
-			mu.Unlock()
-			return
-		}
-	} else {
-		rooms[initData.Room] = make(map[string]*Peer)
+	if isBanned(initData.Room, initData.Username) {
+		conn.WriteJSON(map[string]interface{}{
+			"type": "error",
+			"code": "banned",
+			"data": "You are banned from this room",
+		})
+		return
 	}
-	mu.Unlock()
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+	peer := &Peer{
+		conn:         conn,
+		username:     initData.Username,
+		room:         initData.Room,
+		downTracks:   make(map[string]*downTrack),
+		dataChannels: make(map[string]*webrtc.DataChannel),
 	}
+	setupCompression(peer, r, initData.Compression != nil && !*initData.Compression)
+	peer.startWriting()
 
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := newPeerConnection(peer)
 	if err != nil {
 		log.Printf("PeerConnection error for %s: %v", initData.Username, err)
 		return
 	}
-
-	peer := &Peer{
-		conn:     conn,
-		pc:       peerConnection,
-		username: initData.Username,
-		room:     initData.Room,
+	peer.pc = peerConnection
+
+	if !joinRoom(peer, initData.DisplayName, initData.Metadata) {
+		conn.WriteJSON(map[string]interface{}{
+			"type": "error",
+			"code": "username_taken",
+			"data": "Username already exists",
+		})
+		peerConnection.Close()
+		return
+	}
+	if node := ring.Node(initData.Room); node != *nodeID {
+		log.Printf("Room '%s' belongs to node '%s', hosting '%s' here anyway", initData.Room, node, initData.Username)
 	}
+	room := peer.joined
+	go peer.writeLoop()
+	defer peer.stopWriting()
 
 	mu.Lock()
-	rooms[initData.Room][initData.Username] = peer
 	peers[remoteAddr] = peer
 	mu.Unlock()
 
 	log.Printf("User '%s' joined room '%s'", initData.Username, initData.Room)
 	logStatus()
-	sendRoomInfo(initData.Room)
+
+	room.mu.Lock()
+	sendChatHistory(peer)
+	if err := peer.writeJSON(map[string]interface{}{
+		"type": "screen_share_policy",
+		"data": room.screenSharePolicy(),
+	}); err != nil {
+		log.Printf("Error sending screen share policy to %s: %v", peer.username, err)
+	}
+	sendInteractions(peer)
+	room.mu.Unlock()
 
 	// Обработка входящих сообщений
 	for {
@@ -170,56 +492,107 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		var data map[string]interface{}
-		if err := json.Unmarshal(msg, &data); err != nil {
-			log.Printf("JSON error from %s: %v", initData.Username, err)
+		data, err := decodeSignal(msg)
+		if err != nil {
+			log.Printf("Invalid message from %s: %v", initData.Username, err)
+			sendError(peer, "invalid_message", "Invalid message")
 			continue
 		}
 
-		if sdp, ok := data["sdp"].(map[string]interface{}); ok {
-			sdpType := sdp["type"].(string)
-			sdpStr := sdp["sdp"].(string)
-
-			log.Printf("SDP %s from %s (%s)\n%s",
-				sdpType, initData.Username, initData.Room, sdpStr)
-
-			// Анализ видео в SDP
-			hasVideo := strings.Contains(sdpStr, "m=video")
-			log.Printf("Video in SDP: %v", hasVideo)
+		switch msgType := data.Type; msgType {
+		case "sfu_offer", "sfu_answer", "sfu_candidate":
+			handleSFUMessage(peer, msgType, msg)
+			continue
+		case "video_constraints":
+			handleVideoConstraints(peer, msg)
+			continue
+		case "audio_mix":
+			handleAudioMix(peer, msg)
+			continue
+		case "data":
+			handleDataMessage(peer, msg)
+			continue
+		case "chat", "chat_edit", "chat_delete", "chat_ack":
+			handleChatMessage(peer, msgType, msg)
+			continue
+		case "file_offer", "file_accept", "file_reject", "file_cancel", "file_chunk", "file_resume", "file_complete":
+			handleFileMessage(peer, msgType, msg)
+			continue
+		case "participant_state":
+			handleParticipantState(peer, msg)
+			continue
+		case "screen_share":
+			handleScreenShare(peer, msg)
+			continue
+		case "screen_share_lock":
+			handleScreenShareLock(peer, msg)
+			continue
+		case "raise_hand", "lower_hand", "reaction", "poll_create", "poll_vote", "poll_close":
+			handleInteraction(peer, msgType, msg)
+			continue
+		case "room_settings":
+			handleRoomSettings(peer, msg)
+			continue
+		case "ban", "unban":
+			handleBan(peer, msgType, msg)
+			continue
+		}
 
-			if !hasVideo && sdpType == "offer" {
-				log.Printf("WARNING: Offer from %s contains no video!", initData.Username)
+		// Descriptions are parsed and held to the policy before the room
+		// is locked.
+		var desc *description
+		if data.SDP != nil {
+			desc = parseDescription(data.SDP.Type, data.SDP.SDP)
+			if !enforceSDPPolicy(peer, "SDP", desc, true) {
+				continue
 			}
-		} else if ice, ok := data["ice"].(map[string]interface{}); ok {
-			log.Printf("ICE from %s: %s:%v %s",
-				initData.Username,
-				ice["sdpMid"].(string),
-				ice["sdpMLineIndex"].(float64),
-				ice["candidate"].(string))
 		}
 
 		// Пересылка сообщения другим участникам комнаты
-		mu.Lock()
-		for username, p := range rooms[peer.room] {
-			if username != peer.username {
-				if err := p.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-					log.Printf("Error sending to %s: %v", username, err)
+		room.mu.Lock()
+		if data.ICE != nil {
+			var ok bool
+			if msg, ok = inspectCandidate(peer, msg, &data); !ok {
+				room.mu.Unlock()
+				continue
+			}
+		}
+		if desc != nil {
+			if !filterSDPCandidates(peer, desc) {
+				room.mu.Unlock()
+				continue
+			}
+			if desc.changed {
+				var err error
+				if msg, err = rewriteSDP(msg, &data, desc); err != nil {
+					log.Printf("Error rewriting SDP %s from %s: %v", desc.typ, peer.username, err)
+					room.mu.Unlock()
+					continue
 				}
 			}
+			var offer *sdpSummary
+			if desc.typ == "answer" {
+				offer = room.offerFor(peer)
+			}
+			if s := noteDescription(peer, "SDP", desc, offer); s != nil {
+				peer.sdp = s
+			}
 		}
-		mu.Unlock()
+		relayToRoom(room, peer, msg)
+		publishRelay(room, msg)
+		room.mu.Unlock()
 	}
 
+	room.mu.Lock()
+	log.Printf("ICE candidates from %s: %s", peer.username, peer.candidates)
+	room.mu.Unlock()
+
 	// Очистка при отключении
 	mu.Lock()
 	delete(peers, remoteAddr)
-	delete(rooms[peer.room], peer.username)
-	if len(rooms[peer.room]) == 0 {
-		delete(rooms, peer.room)
-	}
 	mu.Unlock()
+	leaveRoom(peer)
 
 	log.Printf("User '%s' left room '%s'", peer.username, peer.room)
 	logStatus()
-	sendRoomInfo(peer.room)
-}
\ No newline at end of file
+}
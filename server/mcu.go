@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+
+	"server/audiomix"
+)
+
+// Audio-only MCU. A participant on a poor link can ask for "audio_mix":
+// instead of one audio track per room member it then receives a single
+// Opus track mixed by the server from everybody else's audio.
+
+// roomMixer feeds a room's audio into an audiomix.Mixer and sends every
+// listener its mix.
+type roomMixer struct {
+	*audiomix.Mixer
+
+	mu      sync.Mutex
+	tracks  map[string]*webrtc.TrackLocalStaticSample // key: listener username
+	running bool
+}
+
+// newRoomMixer returns nil when mixing is disabled.
+func newRoomMixer() *roomMixer {
+	if !*audioMix {
+		return nil
+	}
+	return &roomMixer{
+		Mixer:  audiomix.NewMixer(audiomix.NewOpusCodec),
+		tracks: make(map[string]*webrtc.TrackLocalStaticSample),
+	}
+}
+
+// checkAudioMix disables -audio-mix when the server was built without Opus.
+func checkAudioMix() {
+	if !*audioMix {
+		return
+	}
+	if _, err := audiomix.NewOpusCodec(); err != nil {
+		log.Printf("Audio mixing disabled: %v", err)
+		*audioMix = false
+	}
+}
+
+func (m *roomMixer) addListener(username string, track *webrtc.TrackLocalStaticSample) error {
+	if err := m.AddListener(username); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tracks[username] = track
+	if !m.running {
+		m.running = true
+		go m.run()
+	}
+	return nil
+}
+
+func (m *roomMixer) removeListener(username string) {
+	m.RemoveListener(username)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tracks, username)
+}
+
+// run mixes one frame per audiomix.FrameDuration until the last listener leaves.
+func (m *roomMixer) run() {
+	ticker := time.NewTicker(audiomix.FrameDuration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mixes, err := m.Mix()
+		if err != nil {
+			log.Printf("Audio mix error: %v", err)
+		}
+
+		m.mu.Lock()
+		if len(m.tracks) == 0 {
+			m.running = false
+			m.mu.Unlock()
+			return
+		}
+		for username, packet := range mixes {
+			if track := m.tracks[username]; track != nil {
+				if err := track.WriteSample(media.Sample{Data: packet, Duration: audiomix.FrameDuration}); err != nil {
+					log.Printf("Error sending audio mix to %s: %v", username, err)
+				}
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// handleAudioMix switches a participant between per-user audio tracks and
+// the server mix.
+func handleAudioMix(peer *Peer, msg []byte) {
+	var m struct {
+		Data struct {
+			Enabled bool `json:"enabled"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		log.Printf("Invalid audio_mix from %s: %v", peer.username, err)
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	switch {
+	case room.mixer == nil:
+		sendError(peer, "audio_mix_unavailable", "Audio mixing is not enabled on this server")
+		return
+	case !peer.sfu:
+		sendError(peer, "sfu_required", "Audio mixing requires an SFU connection")
+		return
+	case m.Data.Enabled == peer.audioMix:
+		return
+	}
+
+	if m.Data.Enabled {
+		track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: audiomix.SampleRate,
+			Channels:  2,
+		}, "audio-mix", "audio-mix")
+		if err != nil {
+			log.Printf("Error creating audio mix for %s: %v", peer.username, err)
+			return
+		}
+		sender, err := peer.pc.AddTrack(track)
+		if err != nil {
+			log.Printf("Error adding audio mix for %s: %v", peer.username, err)
+			return
+		}
+		go drainRTCP(sender)
+		if err := room.mixer.addListener(peer.username, track); err != nil {
+			log.Printf("Error starting audio mix for %s: %v", peer.username, err)
+			peer.pc.RemoveTrack(sender)
+			return
+		}
+		peer.mixSender = sender
+	} else {
+		room.mixer.removeListener(peer.username)
+		if err := peer.pc.RemoveTrack(peer.mixSender); err != nil {
+			log.Printf("Error removing audio mix of %s: %v", peer.username, err)
+		}
+		peer.mixSender = nil
+	}
+
+	peer.audioMix = m.Data.Enabled
+	peer.negotiationPending = true
+	log.Printf("Audio mix for %s: %v", peer.username, peer.audioMix)
+	negotiate(room, peer)
+}
+
+// leaveAudioMix removes a departing peer from its room's mixer. Caller must hold room.mu.
+func leaveAudioMix(peer *Peer) {
+	room := peer.joined
+	if room.mixer == nil {
+		return
+	}
+	room.mixer.removeListener(peer.username)
+	room.mixer.RemoveSource(peer.username)
+}
+
+// drainRTCP reads RTCP of a sender the server does not forward feedback for,
+// which keeps its interceptors running.
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
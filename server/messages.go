@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Decoding of what clients send. Fields the server reads are typed, so a
+// message whose fields have the wrong JSON type is rejected with an error
+// instead of reaching a type assertion.
+
+// joinRequest is the first message of every connection.
+type joinRequest struct {
+	Room        string            `json:"room"`
+	Username    string            `json:"username"`
+	DisplayName string            `json:"displayName"`
+	Metadata    map[string]string `json:"metadata"`
+	Compression *bool             `json:"compression"` // false refuses compression
+}
+
+func decodeJoin(msg []byte) (joinRequest, error) {
+	var req joinRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return req, err
+	}
+	if req.Room == "" || req.Username == "" {
+		return req, errors.New("room and username are required")
+	}
+	return req, nil
+}
+
+// signalMessage is what the read loop looks at in any later message: the
+// type it is dispatched by, and the description or candidate of a
+// peer-to-peer call, which it relays to the room.
+type signalMessage struct {
+	Type string `json:"type"`
+	SDP  *struct {
+		Type string `json:"type"`
+		SDP  string `json:"sdp"`
+	} `json:"sdp"`
+	ICE *struct {
+		Candidate     string  `json:"candidate"`
+		SDPMid        *string `json:"sdpMid"`
+		SDPMLineIndex *uint16 `json:"sdpMLineIndex"`
+	} `json:"ice"`
+}
+
+func decodeSignal(msg []byte) (signalMessage, error) {
+	var m signalMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return m, err
+	}
+	if m.SDP != nil {
+		switch m.SDP.Type {
+		case "offer", "answer", "pranswer", "rollback":
+		default:
+			return m, fmt.Errorf("invalid description type %q", m.SDP.Type)
+		}
+	}
+	return m, nil
+}
+
+// iceString describes the candidate for logs, as "mid:index candidate",
+// with its addresses redacted.
+func (m signalMessage) iceString() string {
+	mid, index := "-", "-"
+	if m.ICE.SDPMid != nil {
+		mid = *m.ICE.SDPMid
+	}
+	if m.ICE.SDPMLineIndex != nil {
+		index = fmt.Sprint(*m.ICE.SDPMLineIndex)
+	}
+	return mid + ":" + index + " " + redactSDPLine(m.ICE.Candidate)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Participant is the presence of one room member as carried by room_info,
+// participant_joined and participant_updated.
+type Participant struct {
+	Username    string            `json:"username"`
+	DisplayName string            `json:"displayName,omitempty"`
+	JoinedAt    int64             `json:"joinedAt"` // unix milliseconds
+	Role        string            `json:"role"`     // owner or participant
+	Audio       bool              `json:"audio"`
+	Video       bool              `json:"video"`
+	ScreenShare bool              `json:"screenShare"`
+	HandRaised  bool              `json:"handRaised"`
+	Quality     string            `json:"quality"` // good, fair, poor or unknown
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+const (
+	roleOwner       = "owner"
+	roleParticipant = "participant"
+)
+
+// participantState is what a client may change about itself; absent
+// fields keep their value.
+type participantState struct {
+	DisplayName *string           `json:"displayName"`
+	Audio       *bool             `json:"audio"`
+	Video       *bool             `json:"video"`
+	Quality     *string           `json:"quality"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// participants returns the presence of every member of room, in join
+// order. Caller must hold room.mu.
+func participants(room *Room) []Participant {
+	list := make([]Participant, 0, len(room.peers)+len(room.remote))
+	for _, p := range room.peers {
+		list = append(list, p.info)
+	}
+	for _, r := range room.remote {
+		list = append(list, r.info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].JoinedAt != list[j].JoinedAt {
+			return list[i].JoinedAt < list[j].JoinedAt
+		}
+		return list[i].Username < list[j].Username
+	})
+	return list
+}
+
+// newParticipant describes a member that just joined room. Its role is
+// settled by electOwner. Caller must hold room.mu.
+func newParticipant(room *Room, username, displayName string, metadata map[string]string) Participant {
+	return Participant{
+		Username:    username,
+		DisplayName: displayName,
+		JoinedAt:    time.Now().UnixMilli(),
+		Role:        roleParticipant,
+		Quality:     "unknown",
+		Metadata:    metadata,
+	}
+}
+
+// announceLeave tells the room that username left it. Caller must hold
+// room.mu.
+func announceLeave(room *Room, username string) {
+	broadcastRoom(room, "participant_left", map[string]string{"username": username})
+}
+
+// owner returns the username of the member owning room: the longest
+// present one across all nodes, ties going to the first username. Every
+// node derives the same owner from the same members, so a room split
+// across nodes has one owner. While the members on other nodes are not
+// known yet, nobody owns the room. Caller must hold room.mu.
+func (r *Room) owner() string {
+	if r.syncing {
+		return ""
+	}
+	members := participants(r)
+	if len(members) == 0 {
+		return ""
+	}
+	return members[0].Username
+}
+
+// electOwner gives the owner role to room.owner() and takes it from
+// anybody else, telling the room. Members on other nodes are announced by
+// their own node too; the update applied here keeps the room consistent
+// until it arrives. Caller must hold room.mu.
+func electOwner(room *Room) {
+	owner := room.owner()
+	if owner == "" {
+		return
+	}
+	role := func(username string) string {
+		if username == owner {
+			return roleOwner
+		}
+		return roleParticipant
+	}
+	for _, p := range room.peers {
+		if want := role(p.username); p.info.Role != want {
+			info := p.info
+			info.Role = want
+			updateParticipant(p, info)
+		}
+	}
+	for username, r := range room.remote {
+		if want := role(username); r.info.Role != want {
+			r.info.Role = want
+			room.remote[username] = r
+			broadcastRoom(room, "participant_updated", r.info)
+		}
+	}
+}
+
+// handleParticipantState applies a participant_state message and tells the
+// room what changed.
+func handleParticipantState(peer *Peer, msg []byte) {
+	var m struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		sendError(peer, "invalid_message", "Invalid participant_state message")
+		return
+	}
+	// The server keeps the other fields, such as the role and when the
+	// participant joined.
+	var s participantState
+	dec := json.NewDecoder(bytes.NewReader(m.Data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		sendError(peer, "invalid_message", "participant_state may only set displayName, audio, video, quality and metadata")
+		return
+	}
+	if s.Quality != nil && !validQuality(*s.Quality) {
+		sendError(peer, "invalid_message", "Unknown connection quality")
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	info := peer.info
+	if s.DisplayName != nil {
+		info.DisplayName = *s.DisplayName
+	}
+	if s.Audio != nil {
+		info.Audio = *s.Audio
+	}
+	if s.Video != nil {
+		info.Video = *s.Video
+	}
+	if s.Quality != nil && !peer.sfu {
+		// SFU participants are measured by the server instead.
+		info.Quality = *s.Quality
+	}
+	if s.Metadata != nil {
+		info.Metadata = s.Metadata
+	}
+	updateParticipant(peer, info)
+}
+
+// updateParticipant stores info and broadcasts it if anything changed.
+// Caller must hold room.mu.
+func updateParticipant(peer *Peer, info Participant) {
+	if equalParticipants(peer.info, info) {
+		return
+	}
+	peer.info = info
+	broadcastRoom(peer.joined, "participant_updated", info)
+	publishMember(peer.joined, "update", info)
+}
+
+// updateQuality derives the connection quality of an SFU participant from
+// the server's bandwidth estimate. Caller must hold room.mu.
+func updateQuality(peer *Peer) {
+	if peer.bwe == nil {
+		return
+	}
+	quality := "poor"
+	switch estimate := peer.bwe.GetTargetBitrate(); {
+	case estimate >= 1_000_000:
+		quality = "good"
+	case estimate >= 300_000:
+		quality = "fair"
+	}
+	info := peer.info
+	info.Quality = quality
+	updateParticipant(peer, info)
+}
+
+func validQuality(q string) bool {
+	switch q {
+	case "good", "fair", "poor", "unknown":
+		return true
+	}
+	return false
+}
+
+func equalParticipants(a, b Participant) bool {
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readMarked reads what the server sent conn up to the marker broadcast
+// after step, and returns the participant_updated messages and the codes
+// of the errors among them.
+func readMarked(t *testing.T, conn *websocket.Conn, step int) (updates []Participant, codes []string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for marker %d: %v", step, err)
+		}
+		var m struct {
+			Type string          `json:"type"`
+			Code string          `json:"code"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(msg, &m); err != nil {
+			t.Fatal(err)
+		}
+		switch m.Type {
+		case "marker":
+			if string(m.Data) == strconv.Itoa(step) {
+				return updates, codes
+			}
+		case "participant_updated":
+			var p Participant
+			if err := json.Unmarshal(m.Data, &p); err != nil {
+				t.Fatal(err)
+			}
+			updates = append(updates, p)
+		case "error":
+			codes = append(codes, m.Code)
+		}
+	}
+}
+
+// TestParticipantState changes the state of alice and checks what the
+// room is told: each change once, nothing when nothing changed, and an
+// error for fields only the server sets.
+func TestParticipantState(t *testing.T) {
+	room := newRoom("presence")
+	members := make(map[string]*Peer)
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		members[name], conns[name] = addMember(t, room, name)
+	}
+	alice := members["alice"]
+	joinedAt := alice.info.JoinedAt
+
+	for i, step := range []struct {
+		data    string
+		code    string // error sent to alice
+		changed bool
+	}{
+		{`{"audio":true,"displayName":"Alice"}`, "", true},
+		{`{"audio":true}`, "", false},
+		{`{"quality":"fair","metadata":{"team":"red"}}`, "", true},
+		{`{"quality":"great"}`, "invalid_message", false},
+		{`{"role":"owner"}`, "invalid_message", false},
+		{`{"video":true,"joinedAt":0}`, "invalid_message", false},
+		{`{"handRaised":true}`, "invalid_message", false},
+		{`{"video":true}`, "", true},
+	} {
+		handleParticipantState(alice, []byte(`{"type":"participant_state","data":`+step.data+`}`))
+		room.mu.Lock()
+		broadcastRoom(room, "marker", i)
+		info := alice.info
+		room.mu.Unlock()
+
+		for name, conn := range conns {
+			updates, codes := readMarked(t, conn, i)
+			if name == "alice" {
+				var want []string
+				if step.code != "" {
+					want = []string{step.code}
+				}
+				if !slices.Equal(codes, want) {
+					t.Errorf("%s: alice got errors %q, want %q", step.data, codes, want)
+				}
+				continue
+			}
+			if want := map[bool]int{true: 1}[step.changed]; len(updates) != want {
+				t.Fatalf("%s: %s got %d participant_updated, want %d", step.data, name, len(updates), want)
+			}
+			if len(updates) == 1 && !equalParticipants(updates[0], info) {
+				t.Errorf("%s: %s was told %+v, alice is %+v", step.data, name, updates[0], info)
+			}
+		}
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	want := Participant{
+		Username:    "alice",
+		DisplayName: "Alice",
+		JoinedAt:    joinedAt,
+		Role:        roleParticipant,
+		Audio:       true,
+		Video:       true,
+		Quality:     "fair",
+		Metadata:    map[string]string{"team": "red"},
+	}
+	if !equalParticipants(alice.info, want) {
+		t.Errorf("alice is %+v, want %+v", alice.info, want)
+	}
+}
+
+// TestUpdateQuality derives the quality of an SFU participant from the
+// estimate, which the participant cannot override.
+func TestUpdateQuality(t *testing.T) {
+	room := newRoom("quality")
+	alice, _ := addMember(t, room, "alice")
+	estimate := &fixedEstimate{}
+	alice.sfu, alice.bwe = true, estimate
+
+	for _, step := range []struct {
+		estimate int
+		quality  string
+	}{
+		{2_000_000, "good"},
+		{1_000_000, "good"},
+		{999_999, "fair"},
+		{300_000, "fair"},
+		{100_000, "poor"},
+	} {
+		estimate.bitrate = step.estimate
+		room.mu.Lock()
+		updateQuality(alice)
+		quality := alice.info.Quality
+		room.mu.Unlock()
+		if quality != step.quality {
+			t.Errorf("at %d bps: quality %q, want %q", step.estimate, quality, step.quality)
+		}
+	}
+
+	handleParticipantState(alice, []byte(`{"type":"participant_state","data":{"quality":"good"}}`))
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if alice.info.Quality != "poor" {
+		t.Errorf("SFU participant set its quality to %q", alice.info.Quality)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+
+	"server/cluster"
+	"server/store"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	roomStore = store.NewMemory()
+	*nodeID = "test"
+	ring = cluster.NewRing(0, *nodeID)
+	os.Exit(m.Run())
+}
+
+// startServer serves the websocket endpoint for the duration of the test
+// and returns its ws:// URL.
+func startServer(tb testing.TB) string {
+	tb.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(handleWebSocket))
+	srv.Listener = countingListener{srv.Listener}
+	srv.Start()
+	tb.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dial joins room as username.
+func dial(tb testing.TB, url, room, username string) *websocket.Conn {
+	tb.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]string{"room": room, "username": username}); err != nil {
+		tb.Fatal(err)
+	}
+	return conn
+}
+
+// readUntil reads messages until one contains substr.
+func readUntil(tb testing.TB, conn *websocket.Conn, substr string) []byte {
+	tb.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			tb.Fatalf("waiting for %q: %v", substr, err)
+		}
+		if bytes.Contains(msg, []byte(substr)) {
+			return msg
+		}
+	}
+}
+
+// addMember makes username a member of room without the join handshake.
+// It is connected over a loopback websocket, whose client end is returned
+// for the test to read what the server sends.
+func addMember(tb testing.TB, room *Room, username string) (*Peer, *websocket.Conn) {
+	tb.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil); err == nil {
+			conns <- conn
+		}
+	}))
+	tb.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.Close() })
+
+	peer := &Peer{
+		conn:         <-conns,
+		username:     username,
+		room:         room.name,
+		joined:       room,
+		downTracks:   make(map[string]*downTrack),
+		dataChannels: make(map[string]*webrtc.DataChannel),
+	}
+	tb.Cleanup(func() { peer.conn.Close() })
+	peer.startWriting()
+	go peer.writeLoop()
+	tb.Cleanup(peer.stopWriting)
+
+	room.mu.Lock()
+	peer.info = newParticipant(room, username, "", nil)
+	room.peers[username] = peer
+	room.mu.Unlock()
+	return peer, client
+}
+
+func roomCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(rooms)
+}
+
+func TestConcurrentRooms(t *testing.T) {
+	url := startServer(t)
+
+	const roomsN, members = 20, 3
+	t.Run("group", func(t *testing.T) {
+		for r := 0; r < roomsN; r++ {
+			room := fmt.Sprintf("room-%d", r)
+			t.Run(room, func(t *testing.T) {
+				t.Parallel()
+				conns := make([]*websocket.Conn, members)
+				for i := range conns {
+					conns[i] = dial(t, url, room, fmt.Sprintf("user-%d", i))
+				}
+				for _, c := range conns {
+					readUntil(t, c, `"user-2"`) // room_info listing everybody
+				}
+				if err := conns[0].WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","room":"`+room+`"}`)); err != nil {
+					t.Fatal(err)
+				}
+				for _, c := range conns[1:] {
+					if msg := readUntil(t, c, `"hello"`); !bytes.Contains(msg, []byte(room)) {
+						t.Errorf("message relayed across rooms: %s", msg)
+					}
+				}
+			})
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for roomCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d rooms left after everybody left", roomCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUsernameTaken(t *testing.T) {
+	url := startServer(t)
+	dial(t, url, "lobby", "alice")
+	conn := dial(t, url, "lobby", "alice")
+	readUntil(t, conn, "username_taken")
+}
+
+// TestMemberDeltas checks that only a joining member gets the whole
+// member list; the others hear who joined and left.
+func TestMemberDeltas(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "deltas", "alice")
+	readUntil(t, alice, `"room_info"`)
+	bob := dial(t, url, "deltas", "bob")
+	if msg := readUntil(t, bob, `"room_info"`); !bytes.Contains(msg, []byte(`"alice"`)) {
+		t.Errorf("bob's room_info %s", msg)
+	}
+
+	for {
+		msg := readUntil(t, alice, `"type":`)
+		if bytes.Contains(msg, []byte(`"room_info"`)) {
+			t.Fatalf("alice got the member list again: %s", msg)
+		}
+		if bytes.Contains(msg, []byte(`"participant_joined"`)) {
+			if !bytes.Contains(msg, []byte(`"bob"`)) {
+				t.Errorf("alice got %s", msg)
+			}
+			break
+		}
+	}
+
+	bob.Close()
+	if msg := readUntil(t, alice, `"participant_left"`); !bytes.Contains(msg, []byte(`"bob"`)) {
+		t.Errorf("alice got %s", msg)
+	}
+}
+
+// relayPair is a room with one member relaying to the other.
+type relayPair struct {
+	mu       sync.Mutex
+	sender   *websocket.Conn
+	received chan struct{}
+}
+
+var benchMessage = []byte(`{"type":"bench","data":"ping"}`)
+
+func newRelayPair(tb testing.TB, url, room string) *relayPair {
+	p := &relayPair{
+		sender:   dial(tb, url, room, "sender"),
+		received: make(chan struct{}, 1),
+	}
+	receiver := dial(tb, url, room, "receiver")
+	readUntil(tb, receiver, "room_info")
+	go func() {
+		for {
+			_, msg, err := receiver.ReadMessage()
+			if err != nil {
+				return
+			}
+			if bytes.Contains(msg, []byte(`"bench"`)) {
+				p.received <- struct{}{}
+			}
+		}
+	}()
+	return p
+}
+
+func (p *relayPair) roundTrip(tb testing.TB) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.sender.WriteMessage(websocket.TextMessage, benchMessage); err != nil {
+		tb.Fatal(err)
+	}
+	select {
+	case <-p.received:
+	case <-time.After(5 * time.Second):
+		tb.Fatal("relayed message never arrived")
+	}
+}
+
+// BenchmarkRoomRelay relays messages in many rooms at once while one more
+// room stays locked throughout, as if busy with a long operation. With a
+// lock per room the other rooms keep relaying; under a global lock none
+// would. The machine, not the number of rooms, bounds msgs/s, which drops
+// somewhat as thousands of connections compete for it.
+func BenchmarkRoomRelay(b *testing.B) {
+	for _, n := range []int{1, 100, 1000} {
+		url := startServer(b)
+		pairs := make([]*relayPair, n)
+		for i := range pairs {
+			pairs[i] = newRelayPair(b, url, fmt.Sprintf("bench-%d-%d", n, i))
+		}
+		busy := fmt.Sprintf("bench-%d-busy", n)
+		newRelayPair(b, url, busy)
+		mu.Lock()
+		locked := rooms[busy]
+		mu.Unlock()
+
+		b.Run(fmt.Sprintf("rooms=%d", n), func(b *testing.B) {
+			locked.mu.Lock()
+			defer locked.mu.Unlock()
+			var next atomic.Int64
+			b.SetParallelism(max(1, n/4))
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				p := pairs[int(next.Add(1)-1)%n]
+				for pb.Next() {
+					p.roundTrip(b)
+				}
+			})
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+		})
+	}
+}
+
+// TestStalledClient checks that a member who stops reading holds up
+// neither its room nor anybody joining it, and is disconnected.
+func TestStalledClient(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "stalled", "alice")
+	readUntil(t, alice, `"room_info"`)
+	dial(t, url, "stalled", "carol") // never reads again
+	bob := dial(t, url, "stalled", "bob")
+	readUntil(t, bob, `"bob"`)
+
+	// Enough to fill carol's socket buffers many times over.
+	const n = 400
+	bulk := []byte(`{"type":"bulk","data":"` + strings.Repeat("x", 60000) + `"}`)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := bob.WriteMessage(websocket.TextMessage, bulk); err != nil {
+				return
+			}
+		}
+	}()
+	// Carol is dropped somewhere along the way.
+	carolLeft := false
+	for received := 0; received < n || !carolLeft; {
+		msg := readUntil(t, alice, `"type":`)
+		switch {
+		case bytes.Contains(msg, []byte(`"bulk"`)):
+			received++
+		case bytes.Contains(msg, []byte(`"participant_left"`)) && bytes.Contains(msg, []byte(`"carol"`)):
+			carolLeft = true
+		}
+	}
+
+	dave := dial(t, url, "stalled", "dave")
+	readUntil(t, dave, `"room_info"`)
+	readUntil(t, alice, `"participant_joined"`)
+}
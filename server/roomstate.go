@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"server/store"
+)
+
+// Persistent room state. Settings, bans and chat history live in roomStore
+// (-store) so they outlive the process; a room picks them up again when its
+// first member joins. The memory store keeps chat only while the room is
+// open.
+
+var roomStore store.RoomStore
+
+func openRoomStore() {
+	s, err := store.Open(*storeKind, *storePath)
+	if err != nil {
+		log.Fatalf("Opening %s room store: %v", *storeKind, err)
+	}
+	roomStore = s
+}
+
+// roomSettingsRequest changes the settings of a room; absent fields keep
+// their value.
+type roomSettingsRequest struct {
+	LastN         *int  `json:"lastN"`
+	MaxPresenters *int  `json:"maxPresenters"`
+	PresenterLock *bool `json:"presenterLock"`
+	RelayOnly     *bool `json:"relayOnly"`
+}
+
+type banRequest struct {
+	Username string `json:"username"`
+	Reason   string `json:"reason"`
+	Duration int64  `json:"duration"` // seconds, 0 for ever
+}
+
+// loadRoomState restores the saved settings and chat of a room that was
+// just created. Caller must hold room.mu.
+func loadRoomState(room *Room) {
+	if s, ok, err := roomStore.Settings(room.name); err != nil {
+		log.Printf("Error loading settings of room '%s': %v", room.name, err)
+	} else if ok {
+		room.lastN = s.LastN
+		room.maxPresenters = s.MaxPresenters
+		room.presenterLock = s.PresenterLock
+		if s.RelayOnly != nil {
+			room.relayOnly = *s.RelayOnly
+			room.relayOnlySet = true
+		}
+	}
+
+	history, err := roomStore.ChatHistory(room.name)
+	if err != nil {
+		log.Printf("Error loading chat of room '%s': %v", room.name, err)
+		return
+	}
+	if over := len(history) - *chatHistory; over > 0 {
+		history = history[over:]
+	}
+	for i := range history {
+		room.chat = append(room.chat, &history[i])
+	}
+}
+
+// forgetChat drops the chat of a room its last member left, unless the
+// store keeps it across restarts: in memory, chat dies with the room
+// rather than piling up, or greeting whoever next opens a room of that
+// name. Caller must hold room.mu.
+func forgetChat(room *Room) {
+	if *storeKind != "memory" {
+		return
+	}
+	if err := roomStore.ClearChat(room.name); err != nil {
+		log.Printf("Error clearing chat of room '%s': %v", room.name, err)
+	}
+}
+
+// saveRoomSettings persists the settings of room. Relay-only is saved only
+// once the owner chose it, so that a room keeps following -ice-relay-only
+// until then. Caller must hold room.mu.
+func saveRoomSettings(room *Room) {
+	s := room.settings()
+	if !room.relayOnlySet {
+		s.RelayOnly = nil
+	}
+	if err := roomStore.SaveSettings(room.name, s); err != nil {
+		log.Printf("Error saving settings of room '%s': %v", room.name, err)
+	}
+}
+
+func (r *Room) settings() store.RoomSettings {
+	relayOnly := r.relayOnly
+	return store.RoomSettings{
+		LastN:         r.lastN,
+		MaxPresenters: r.maxPresenters,
+		PresenterLock: r.presenterLock,
+		RelayOnly:     &relayOnly,
+	}
+}
+
+// isBanned reports whether username may not join room.
+func isBanned(room, username string) bool {
+	bans, err := roomStore.Bans(room)
+	if err != nil {
+		log.Printf("Error loading bans of room '%s': %v", room, err)
+		return false
+	}
+	now := time.Now().UnixMilli()
+	for _, b := range bans {
+		if b.Username == username && b.Active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRoomSettings lets the room owner change and persist room settings.
+func handleRoomSettings(peer *Peer, msg []byte) {
+	var m struct {
+		Data roomSettingsRequest `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		sendError(peer, "invalid_message", "Invalid room_settings message")
+		return
+	}
+	s := m.Data
+	if (s.LastN != nil && *s.LastN < 0) || (s.MaxPresenters != nil && *s.MaxPresenters < 0) {
+		sendError(peer, "invalid_message", "Room settings must not be negative")
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if peer.info.Role != roleOwner {
+		sendError(peer, "forbidden", "Only the room owner can change room settings")
+		return
+	}
+	if s.LastN != nil {
+		room.lastN = *s.LastN
+	}
+	if s.MaxPresenters != nil {
+		room.maxPresenters = *s.MaxPresenters
+	}
+	if s.PresenterLock != nil {
+		room.presenterLock = *s.PresenterLock
+	}
+	if s.RelayOnly != nil {
+		room.relayOnly = *s.RelayOnly
+		room.relayOnlySet = true
+	}
+	saveRoomSettings(room)
+	log.Printf("User '%s' changed the settings of room '%s': lastN %d, maxPresenters %d, presenterLock %v, relayOnly %v",
+		peer.username, room.name, room.lastN, room.maxPresenters, room.presenterLock, room.relayOnly)
+
+	// Presenters over the new limit or locked out keep presenting until
+	// they stop; only new presentations are refused.
+	applyLastN(room)
+	broadcastRoom(room, "room_settings", room.settings())
+	broadcastRoom(room, "screen_share_policy", room.screenSharePolicy())
+}
+
+// handleBan lets the room owner ban and unban participants. A banned
+// participant present in the room is disconnected.
+func handleBan(peer *Peer, msgType string, msg []byte) {
+	var m struct {
+		Data banRequest `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil || m.Data.Username == "" || m.Data.Duration < 0 {
+		sendError(peer, "invalid_message", "Invalid "+msgType+" message")
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if peer.info.Role != roleOwner {
+		sendError(peer, "forbidden", "Only the room owner can ban participants")
+		return
+	}
+	if m.Data.Username == peer.username {
+		sendError(peer, "invalid_message", "The room owner cannot ban themselves")
+		return
+	}
+
+	if msgType == "unban" {
+		if err := roomStore.Unban(room.name, m.Data.Username); err != nil {
+			log.Printf("Error unbanning %s from room '%s': %v", m.Data.Username, room.name, err)
+			sendError(peer, "store_error", "Could not unban participant")
+			return
+		}
+		log.Printf("User '%s' unbanned %s from room '%s'", peer.username, m.Data.Username, room.name)
+		return
+	}
+
+	now := time.Now()
+	b := store.Ban{
+		Username:  m.Data.Username,
+		By:        peer.username,
+		Reason:    m.Data.Reason,
+		Timestamp: now.UnixMilli(),
+	}
+	if m.Data.Duration > 0 {
+		b.Until = now.Add(time.Duration(m.Data.Duration) * time.Second).UnixMilli()
+	}
+	if err := roomStore.Ban(room.name, b); err != nil {
+		log.Printf("Error banning %s from room '%s': %v", b.Username, room.name, err)
+		sendError(peer, "store_error", "Could not ban participant")
+		return
+	}
+	log.Printf("User '%s' banned %s from room '%s'", peer.username, b.Username, room.name)
+
+	if target := room.peers[b.Username]; target != nil {
+		sendError(target, "banned", "You were banned from this room")
+		// Closing makes the read loop of target exit and clean up.
+		target.closeAfterWrites()
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// nackCacheSize is the number of packets kept per outgoing stream so
+	// subscriber NACKs are answered by the server instead of the publisher.
+	nackCacheSize = 1024
+
+	// keyframeInterval limits how often PLI/FIR reaches a publisher; a burst
+	// of subscribers losing the same frame needs only one keyframe.
+	keyframeInterval = 500 * time.Millisecond
+)
+
+// configureRTCPFeedback enables NACK and keyframe feedback on Peer.pc.
+// The generator asks publishers to retransmit packets lost on the way to
+// the server, the responder retransmits from its cache to subscribers.
+func configureRTCPFeedback(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+	responder, err := nack.NewResponderInterceptor(nack.ResponderSize(nackCacheSize))
+	if err != nil {
+		return err
+	}
+
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "ccm", Parameter: "fir"}, webrtc.RTPCodecTypeVideo)
+	i.Add(generator)
+	i.Add(responder)
+	return nil
+}
+
+// keyframeRequester forwards keyframe requests to the publisher of a track
+// layer, at most once per keyframeInterval.
+type keyframeRequester struct {
+	layer *trackLayer
+
+	mu     sync.Mutex
+	last   time.Time
+	firSeq uint8
+}
+
+// request asks the publisher for a keyframe with a PLI.
+func (k *keyframeRequester) request() {
+	k.send(false)
+}
+
+// requestFull asks the publisher for a keyframe with a FIR.
+func (k *keyframeRequester) requestFull() {
+	k.send(true)
+}
+
+func (k *keyframeRequester) send(fir bool) {
+	seq, ok := k.next(time.Now())
+	if !ok {
+		return
+	}
+
+	ssrc := uint32(k.layer.remote.SSRC())
+	var pkt rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: ssrc}
+	if fir {
+		pkt = &rtcp.FullIntraRequest{
+			MediaSSRC: ssrc,
+			FIR:       []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: seq}},
+		}
+	}
+	owner := k.layer.track.owner
+	if err := owner.pc.WriteRTCP([]rtcp.Packet{pkt}); err != nil {
+		log.Printf("Error requesting keyframe from %s: %v", owner.username, err)
+	}
+}
+
+// next claims a keyframe request at now and returns its FIR sequence
+// number, or false within keyframeInterval of the last one.
+func (k *keyframeRequester) next(now time.Time) (uint8, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if now.Sub(k.last) < keyframeInterval {
+		return 0, false
+	}
+	k.last = now
+	k.firSeq++
+	return k.firSeq, true
+}
+
+// readSubscriberRTCP drains RTCP sent by a subscriber for one downTrack.
+// Reading is what drives the NACK responder; keyframe requests are passed
+// on to the publisher.
+func readSubscriberRTCP(dt *downTrack) {
+	for {
+		pkts, _, err := dt.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication:
+				dt.requestKeyframe(false)
+			case *rtcp.FullIntraRequest:
+				dt.requestKeyframe(true)
+			}
+		}
+	}
+}
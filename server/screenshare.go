@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Screen sharing. A participant announces the media stream carrying its
+// screen with "screen_share" before (or right after) publishing it. The
+// room limits how many participants present at once, and its owner may
+// lock presenting to themselves. Tracks of that stream are tagged as
+// screen share in server offers and are only forwarded while their
+// publisher holds a presenter slot.
+
+const (
+	sourceCamera = "camera"
+	sourceScreen = "screen"
+
+	// screenSharePriority keeps a presentation flowing longer than any
+	// camera, including the active speaker's.
+	screenSharePriority = 2
+)
+
+type screenShareRequest struct {
+	Action   string `json:"action"`   // start or stop
+	StreamID string `json:"streamId"` // stream carrying the screen, for start
+	Username string `json:"username"` // presenter to stop, owner only; empty for oneself
+}
+
+type screenShareLock struct {
+	Locked bool `json:"locked"`
+}
+
+// screenSharePolicy is broadcast as "screen_share_policy" whenever the
+// presenters or the lock change.
+type screenSharePolicy struct {
+	MaxPresenters int               `json:"maxPresenters"`
+	Locked        bool              `json:"locked"`
+	Presenters    map[string]string `json:"presenters"` // username -> stream ID
+}
+
+// handleScreenShare starts or stops a presentation.
+func handleScreenShare(peer *Peer, msg []byte) {
+	var m struct {
+		Data screenShareRequest `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		sendError(peer, "invalid_message", "Invalid screen_share message")
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	switch m.Data.Action {
+	case "start":
+		if m.Data.StreamID == "" {
+			sendError(peer, "invalid_message", "screen_share start needs a streamId")
+			return
+		}
+		if room.presenterLock && peer.info.Role != roleOwner {
+			sendError(peer, "presenter_locked", "Presenting is locked by the room owner")
+			return
+		}
+		if _, presenting := room.presenters[peer.username]; !presenting && len(room.presenters) >= room.maxPresenters {
+			sendError(peer, "presenter_limit", "Too many participants are presenting")
+			return
+		}
+		room.presenters[peer.username] = m.Data.StreamID
+		log.Printf("User '%s' started presenting stream %s", peer.username, m.Data.StreamID)
+		tagScreenShare(room, peer)
+		setScreenShare(peer, true)
+	case "stop":
+		target := peer
+		if m.Data.Username != "" && m.Data.Username != peer.username {
+			if peer.info.Role != roleOwner {
+				sendError(peer, "forbidden", "Only the room owner can stop another presenter")
+				return
+			}
+			target = room.peers[m.Data.Username]
+		}
+		if target == nil || !stopScreenShare(room, target) {
+			sendError(peer, "not_presenting", "Participant is not presenting")
+			return
+		}
+	default:
+		sendError(peer, "invalid_message", "Unknown screen_share action")
+		return
+	}
+	renegotiateRoom(room)
+	broadcastRoom(room, "screen_share_policy", room.screenSharePolicy())
+}
+
+// handleScreenShareLock lets the room owner restrict presenting to
+// themselves. Locking stops everybody else's presentation.
+func handleScreenShareLock(peer *Peer, msg []byte) {
+	var m struct {
+		Data screenShareLock `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		sendError(peer, "invalid_message", "Invalid screen_share_lock message")
+		return
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if peer.info.Role != roleOwner {
+		sendError(peer, "forbidden", "Only the room owner can lock presenting")
+		return
+	}
+	room.presenterLock = m.Data.Locked
+	saveRoomSettings(room)
+	if room.presenterLock {
+		for username := range room.presenters {
+			if p := room.peers[username]; p != nil && p.info.Role != roleOwner {
+				stopScreenShare(room, p)
+			}
+		}
+		renegotiateRoom(room)
+	}
+	broadcastRoom(room, "screen_share_policy", room.screenSharePolicy())
+}
+
+// stopScreenShare releases the presenter slot of peer. The caller
+// renegotiates so its screen tracks stop being forwarded. Caller must hold room.mu.
+func stopScreenShare(room *Room, peer *Peer) bool {
+	if _, ok := room.presenters[peer.username]; !ok {
+		return false
+	}
+	delete(room.presenters, peer.username)
+	log.Printf("User '%s' stopped presenting", peer.username)
+	setScreenShare(peer, false)
+	return true
+}
+
+// leaveScreenShare frees the slot of a departing peer. Its tracks go away
+// with leaveSFU. Caller must hold room.mu.
+func leaveScreenShare(peer *Peer) {
+	room := peer.joined
+	if _, ok := room.presenters[peer.username]; !ok {
+		return
+	}
+	delete(room.presenters, peer.username)
+	broadcastRoom(room, "screen_share_policy", room.screenSharePolicy())
+}
+
+func setScreenShare(peer *Peer, on bool) {
+	info := peer.info
+	info.ScreenShare = on
+	updateParticipant(peer, info)
+}
+
+// tagScreenShare marks the already published tracks of peer's announced
+// stream as screen share. Caller must hold room.mu.
+func tagScreenShare(room *Room, peer *Peer) {
+	for _, t := range room.tracks {
+		if t.owner == peer && room.trackSource(peer, t.streamID) == sourceScreen {
+			t.source = sourceScreen
+			t.priority = screenSharePriority
+		}
+	}
+}
+
+// trackSource tells whether a stream published by peer carries its screen.
+// Caller must hold room.mu.
+func (r *Room) trackSource(peer *Peer, streamID string) string {
+	if id, ok := r.presenters[peer.username]; ok && id == streamID {
+		return sourceScreen
+	}
+	return sourceCamera
+}
+
+// forwards reports whether t may be sent to subscribers: screen share
+// only while its publisher presents. Caller must hold room.mu.
+func (r *Room) forwards(t *publishedTrack) bool {
+	if t.source != sourceScreen {
+		return true
+	}
+	return r.presenters[t.owner.username] == t.streamID
+}
+
+// screenSharePolicy describes who presents in r. Caller must hold room.mu.
+func (r *Room) screenSharePolicy() screenSharePolicy {
+	presenters := make(map[string]string, len(r.presenters))
+	for u, id := range r.presenters {
+		presenters[u] = id
+	}
+	return screenSharePolicy{
+		MaxPresenters: r.maxPresenters,
+		Locked:        r.presenterLock,
+		Presenters:    presenters,
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// TestScreenShare starts and stops presentations in a room with two
+// presenter slots, and locks presenting to the owner.
+func TestScreenShare(t *testing.T) {
+	room := newRoom("screens")
+	room.maxPresenters = 2
+	members := make(map[string]*Peer)
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		members[name], conns[name] = addMember(t, room, name)
+	}
+	members["alice"].info.Role = roleOwner
+
+	for _, step := range []struct {
+		who, msgType string
+		data         map[string]interface{}
+		code         string            // error expected
+		presenters   map[string]string // afterwards
+	}{
+		{"bob", "screen_share", map[string]interface{}{"action": "start", "streamId": "s-bob"}, "", map[string]string{"bob": "s-bob"}},
+		{"carol", "screen_share", map[string]interface{}{"action": "start"}, "invalid_message", map[string]string{"bob": "s-bob"}},
+		{"carol", "screen_share", map[string]interface{}{"action": "share"}, "invalid_message", map[string]string{"bob": "s-bob"}},
+		{"carol", "screen_share", map[string]interface{}{"action": "start", "streamId": "s-carol"}, "", map[string]string{"bob": "s-bob", "carol": "s-carol"}},
+		{"dave", "screen_share", map[string]interface{}{"action": "start", "streamId": "s-dave"}, "presenter_limit", map[string]string{"bob": "s-bob", "carol": "s-carol"}},
+		// A presenter may move to another stream.
+		{"bob", "screen_share", map[string]interface{}{"action": "start", "streamId": "s-bob2"}, "", map[string]string{"bob": "s-bob2", "carol": "s-carol"}},
+		{"dave", "screen_share", map[string]interface{}{"action": "stop"}, "not_presenting", map[string]string{"bob": "s-bob2", "carol": "s-carol"}},
+		{"dave", "screen_share", map[string]interface{}{"action": "stop", "username": "bob"}, "forbidden", map[string]string{"bob": "s-bob2", "carol": "s-carol"}},
+		// Stopping frees the slot.
+		{"carol", "screen_share", map[string]interface{}{"action": "stop"}, "", map[string]string{"bob": "s-bob2"}},
+		{"dave", "screen_share", map[string]interface{}{"action": "start", "streamId": "s-dave"}, "", map[string]string{"bob": "s-bob2", "dave": "s-dave"}},
+		{"bob", "screen_share_lock", map[string]interface{}{"locked": true}, "forbidden", map[string]string{"bob": "s-bob2", "dave": "s-dave"}},
+		// Locking stops everybody else.
+		{"alice", "screen_share_lock", map[string]interface{}{"locked": true}, "", map[string]string{}},
+		{"bob", "screen_share", map[string]interface{}{"action": "start", "streamId": "s-bob"}, "presenter_locked", map[string]string{}},
+		{"alice", "screen_share", map[string]interface{}{"action": "start", "streamId": "s-alice"}, "", map[string]string{"alice": "s-alice"}},
+		{"alice", "screen_share", map[string]interface{}{"action": "stop", "username": "nobody"}, "not_presenting", map[string]string{"alice": "s-alice"}},
+		{"alice", "screen_share_lock", map[string]interface{}{"locked": false}, "", map[string]string{"alice": "s-alice"}},
+		{"bob", "screen_share", map[string]interface{}{"action": "start", "streamId": "s-bob"}, "", map[string]string{"alice": "s-alice", "bob": "s-bob"}},
+		{"alice", "screen_share", map[string]interface{}{"action": "stop", "username": "bob"}, "", map[string]string{"alice": "s-alice"}},
+	} {
+		msg, _ := json.Marshal(map[string]interface{}{"type": step.msgType, "data": step.data})
+		if step.msgType == "screen_share" {
+			handleScreenShare(members[step.who], msg)
+		} else {
+			handleScreenShareLock(members[step.who], msg)
+		}
+		if step.code != "" {
+			readUntil(t, conns[step.who], `"code":"`+step.code+`"`)
+		}
+
+		room.mu.Lock()
+		presenters := maps.Clone(room.presenters)
+		sharing := make(map[string]bool)
+		for name, p := range members {
+			sharing[name] = p.info.ScreenShare
+		}
+		room.mu.Unlock()
+		if !maps.Equal(presenters, step.presenters) {
+			t.Fatalf("%s %s %v: presenters %v, want %v", step.who, step.msgType, step.data, presenters, step.presenters)
+		}
+		for name, on := range sharing {
+			if _, want := step.presenters[name]; on != want {
+				t.Fatalf("%s %s %v: %s has ScreenShare %v", step.who, step.msgType, step.data, name, on)
+			}
+		}
+	}
+}
+
+// TestScreenShareForwarding checks which tracks of a presenter reach
+// subscribers as the presentation starts and stops.
+func TestScreenShareForwarding(t *testing.T) {
+	room := newRoom("screen-tracks")
+	bob, _ := addMember(t, room, "bob")
+	camera := &publishedTrack{id: "camera", streamID: "s-camera", kind: webrtc.RTPCodecTypeVideo, owner: bob, source: sourceCamera}
+	screen := &publishedTrack{id: "screen", streamID: "s-screen", kind: webrtc.RTPCodecTypeVideo, owner: bob, source: sourceCamera}
+	room.mu.Lock()
+	room.tracks[camera.id], room.tracks[screen.id] = camera, screen
+	room.mu.Unlock()
+
+	share := func(data string) {
+		t.Helper()
+		handleScreenShare(bob, []byte(`{"type":"screen_share","data":`+data+`}`))
+	}
+	check := func(what string, cameraForwarded, screenForwarded bool) {
+		t.Helper()
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if got := room.forwards(camera); got != cameraForwarded {
+			t.Errorf("%s: camera forwarded %v, want %v", what, got, cameraForwarded)
+		}
+		if got := room.forwards(screen); got != screenForwarded {
+			t.Errorf("%s: screen forwarded %v, want %v", what, got, screenForwarded)
+		}
+	}
+
+	check("before presenting", true, true)
+	// The stream published before it was announced is tagged on start.
+	share(`{"action":"start","streamId":"s-screen"}`)
+	room.mu.Lock()
+	source, priority := screen.source, screen.priority
+	room.mu.Unlock()
+	if source != sourceScreen || priority != screenSharePriority {
+		t.Fatalf("announced stream is %s with priority %d", source, priority)
+	}
+	check("presenting", true, true)
+	share(`{"action":"start","streamId":"s-other"}`)
+	check("presenting another stream", true, false)
+	share(`{"action":"stop"}`)
+	check("stopped", true, false)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// Session description analysis. Offers and answers the server relays or
+// negotiates are parsed into what matters when a call fails to set up:
+// media sections, codecs, extensions, simulcast, bundling and transport
+// parameters, plus the problems that commonly break a call. The summary is
+// logged and kept per participant for /stats.
+
+// description is a session description a participant sent, parsed once
+// for the policy, the candidate filter and the analysis, before the
+// room's mu is taken. They change parsed in place and set changed; raw is
+// then brought up to date by marshal.
+type description struct {
+	typ     string
+	raw     string
+	parsed  *sdp.SessionDescription // nil for a rollback or when raw does not parse
+	err     error                   // why raw does not parse
+	changed bool
+}
+
+func parseDescription(typ, raw string) *description {
+	d := &description{typ: typ, raw: raw}
+	if typ == "rollback" {
+		return d
+	}
+	d.parsed = &sdp.SessionDescription{}
+	if d.err = d.parsed.UnmarshalString(raw); d.err != nil {
+		d.parsed = nil
+	}
+	return d
+}
+
+// marshal updates raw after parsed changed.
+func (d *description) marshal() error {
+	if !d.changed {
+		return nil
+	}
+	out, err := d.parsed.Marshal()
+	if err != nil {
+		return err
+	}
+	d.raw = string(out)
+	d.changed = false
+	return nil
+}
+
+// sdpSummary describes one session description.
+type sdpSummary struct {
+	Type       string         `json:"type"`
+	Time       time.Time      `json:"time"`
+	Bundle     [][]string     `json:"bundle,omitempty"` // mids of each BUNDLE group
+	ICELite    bool           `json:"iceLite,omitempty"`
+	Media      []mediaSummary `json:"media"`
+	Candidates int            `json:"candidates"` // in all sections
+	Trickle    bool           `json:"trickle"`    // more candidates follow as messages
+	Problems   []sdpProblem   `json:"problems,omitempty"`
+}
+
+// mediaSummary describes one m= section.
+type mediaSummary struct {
+	Mid             string             `json:"mid"`
+	Kind            string             `json:"kind"` // audio, video or application
+	Direction       string             `json:"direction,omitempty"`
+	Rejected        bool               `json:"rejected,omitempty"` // port 0
+	Protocol        string             `json:"protocol"`
+	Codecs          []codecSummary     `json:"codecs,omitempty"`
+	Extensions      []extensionSummary `json:"extensions,omitempty"`
+	Simulcast       *simulcastSummary  `json:"simulcast,omitempty"`
+	SSRCs           []uint32           `json:"ssrcs,omitempty"`
+	ICEUfrag        string             `json:"iceUfrag,omitempty"` // the password is not kept
+	Fingerprint     string             `json:"fingerprint,omitempty"`
+	Setup           string             `json:"setup,omitempty"` // DTLS role: actpass, active or passive
+	RTCPMux         bool               `json:"rtcpMux"`
+	Candidates      int                `json:"candidates"`
+	EndOfCandidates bool               `json:"endOfCandidates,omitempty"`
+
+	icePwd bool
+}
+
+type codecSummary struct {
+	PayloadType uint8    `json:"payloadType"`
+	Name        string   `json:"name"` // such as VP8/90000 or opus/48000/2
+	Fmtp        string   `json:"fmtp,omitempty"`
+	Feedback    []string `json:"feedback,omitempty"`
+}
+
+type extensionSummary struct {
+	ID  int    `json:"id"`
+	URI string `json:"uri"`
+}
+
+// simulcastSummary lists the RIDs of each direction of a=simulcast.
+type simulcastSummary struct {
+	Send []string `json:"send,omitempty"`
+	Recv []string `json:"recv,omitempty"`
+}
+
+// sdpProblem is something likely to keep a call from working.
+type sdpProblem struct {
+	Code    string `json:"code"`
+	Mid     string `json:"mid,omitempty"` // section it was found in
+	Message string `json:"message"`
+}
+
+// staticPayloadTypes are the RFC 3551 types a section may use without an
+// rtpmap line.
+var staticPayloadTypes = map[uint8]string{
+	0:  "PCMU/8000",
+	3:  "GSM/8000",
+	4:  "G723/8000",
+	8:  "PCMA/8000",
+	9:  "G722/8000",
+	13: "CN/8000",
+	18: "G729/8000",
+	34: "H263/90000",
+}
+
+// analyzeSDP parses a description of type typ. offer is the description an
+// answer answers, or nil when it is unknown; it is used to check that the
+// answer's directions are compatible with it.
+func analyzeSDP(typ, raw string, offer *sdpSummary) (*sdpSummary, error) {
+	var desc sdp.SessionDescription
+	if err := desc.UnmarshalString(raw); err != nil {
+		return nil, err
+	}
+	return summarizeSDP(typ, &desc, offer), nil
+}
+
+// summarizeSDP is analyzeSDP for a parsed description.
+func summarizeSDP(typ string, desc *sdp.SessionDescription, offer *sdpSummary) *sdpSummary {
+	s := &sdpSummary{Type: typ, Time: time.Now()}
+	var session mediaSummary
+	for _, a := range desc.Attributes {
+		switch a.Key {
+		case "group":
+			if mids, ok := strings.CutPrefix(a.Value, "BUNDLE"); ok {
+				s.Bundle = append(s.Bundle, strings.Fields(mids))
+			}
+		case sdp.AttrKeyICELite:
+			s.ICELite = true
+		case "ice-options":
+			s.Trickle = s.Trickle || slices.Contains(strings.Fields(a.Value), "trickle")
+		default:
+			session.transportAttribute(a)
+		}
+	}
+
+	for i, md := range desc.MediaDescriptions {
+		m := mediaSummary{
+			Mid:         strconv.Itoa(i),
+			Kind:        md.MediaName.Media,
+			Rejected:    md.MediaName.Port.Value == 0,
+			Protocol:    strings.Join(md.MediaName.Protos, "/"),
+			ICEUfrag:    session.ICEUfrag,
+			Fingerprint: session.Fingerprint,
+			Setup:       session.Setup,
+			icePwd:      session.icePwd,
+		}
+		codecs := make(map[uint8]*codecSummary)
+		for _, a := range md.Attributes {
+			switch a.Key {
+			case "mid":
+				m.Mid = a.Value
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				m.Direction = a.Key
+			case "rtcp-mux":
+				m.RTCPMux = true
+			case "candidate":
+				m.Candidates++
+			case "end-of-candidates":
+				m.EndOfCandidates = true
+			case "ice-options":
+				s.Trickle = s.Trickle || slices.Contains(strings.Fields(a.Value), "trickle")
+			case "rtpmap", "fmtp", "rtcp-fb":
+				ptStr, value, _ := strings.Cut(a.Value, " ")
+				pt, err := strconv.ParseUint(ptStr, 10, 8)
+				if err != nil {
+					continue // rtcp-fb:* applies to every codec and is not listed
+				}
+				c := codecs[uint8(pt)]
+				if c == nil {
+					c = &codecSummary{PayloadType: uint8(pt)}
+					codecs[uint8(pt)] = c
+				}
+				switch a.Key {
+				case "rtpmap":
+					c.Name = value
+				case "fmtp":
+					c.Fmtp = value
+				case "rtcp-fb":
+					c.Feedback = append(c.Feedback, value)
+				}
+			case "extmap":
+				var e sdp.ExtMap
+				if err := e.Unmarshal("extmap:" + a.Value); err == nil && e.URI != nil {
+					m.Extensions = append(m.Extensions, extensionSummary{ID: e.Value, URI: e.URI.String()})
+				}
+			case "simulcast":
+				m.Simulcast = parseSimulcast(a.Value)
+			case "ssrc":
+				ssrcStr, _, _ := strings.Cut(a.Value, " ")
+				if ssrc, err := strconv.ParseUint(ssrcStr, 10, 32); err == nil && !slices.Contains(m.SSRCs, uint32(ssrc)) {
+					m.SSRCs = append(m.SSRCs, uint32(ssrc))
+				}
+			default:
+				m.transportAttribute(a)
+			}
+		}
+		if m.Kind != "application" && m.Direction == "" {
+			m.Direction = "sendrecv"
+		}
+		for _, f := range md.MediaName.Formats {
+			pt, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				continue // application sections list protocols, not payload types
+			}
+			c := codecs[uint8(pt)]
+			if c == nil {
+				c = &codecSummary{PayloadType: uint8(pt)}
+			}
+			if c.Name == "" {
+				c.Name = staticPayloadTypes[c.PayloadType]
+			}
+			m.Codecs = append(m.Codecs, *c)
+		}
+		s.Candidates += m.Candidates
+		s.Media = append(s.Media, m)
+	}
+
+	s.Problems = s.check(offer)
+	return s
+}
+
+// transportAttribute records an ICE or DTLS parameter, which may be given
+// for the session or per section.
+func (m *mediaSummary) transportAttribute(a sdp.Attribute) {
+	switch a.Key {
+	case "ice-ufrag":
+		m.ICEUfrag = a.Value
+	case "ice-pwd":
+		m.icePwd = a.Value != ""
+	case "fingerprint":
+		m.Fingerprint = a.Value
+	case "setup":
+		m.Setup = a.Value
+	}
+}
+
+// parseSimulcast reads "send h;m;l recv f", where each RID may be paused
+// with a ~ and list alternatives separated by commas.
+func parseSimulcast(value string) *simulcastSummary {
+	s := &simulcastSummary{}
+	fields := strings.Fields(value)
+	for i := 0; i+1 < len(fields); i += 2 {
+		var rids []string
+		for _, alt := range strings.Split(fields[i+1], ";") {
+			for _, rid := range strings.Split(alt, ",") {
+				rids = append(rids, strings.TrimPrefix(rid, "~"))
+			}
+		}
+		switch fields[i] {
+		case "send":
+			s.Send = append(s.Send, rids...)
+		case "recv":
+			s.Recv = append(s.Recv, rids...)
+		}
+	}
+	return s
+}
+
+// answerDirections are the directions an answer may give a section
+// offered with the key direction.
+var answerDirections = map[string][]string{
+	"sendrecv": {"sendrecv", "sendonly", "recvonly", "inactive"},
+	"sendonly": {"recvonly", "inactive"},
+	"recvonly": {"sendonly", "inactive"},
+	"inactive": {"inactive"},
+}
+
+func (s *sdpSummary) check(offer *sdpSummary) []sdpProblem {
+	var problems []sdpProblem
+	add := func(code, mid, format string, args ...interface{}) {
+		problems = append(problems, sdpProblem{Code: code, Mid: mid, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.Type == "offer" && !s.hasVideo() {
+		add("no_video", "", "the offer has no video section")
+	}
+	// Without candidates a description is fine as long as they are
+	// trickled, which not every implementation advertises with
+	// ice-options; it is not once it says gathering is over.
+	if s.Candidates == 0 && s.endOfCandidates() {
+		add("no_candidates", "", "gathering ended without candidates, the peer cannot be reached")
+	}
+
+	for i, m := range s.Media {
+		if m.Rejected {
+			continue
+		}
+		if m.ICEUfrag == "" || !m.icePwd {
+			add("no_ice_credentials", m.Mid, "section %s has no ice-ufrag or ice-pwd", m.Mid)
+		}
+		if m.Fingerprint == "" {
+			add("no_fingerprint", m.Mid, "section %s has no DTLS fingerprint", m.Mid)
+		}
+		if m.Kind == "audio" || m.Kind == "video" {
+			if len(m.Codecs) == 0 {
+				add("missing_codecs", m.Mid, "%s section %s offers no codecs", m.Kind, m.Mid)
+			}
+			for _, c := range m.Codecs {
+				if c.Name == "" {
+					add("missing_codecs", m.Mid, "payload type %d of section %s has no rtpmap", c.PayloadType, m.Mid)
+				}
+				if apt, ok := fmtpParam(c.Fmtp, "apt"); ok && strings.HasPrefix(strings.ToLower(c.Name), "rtx/") && !m.hasPayloadType(apt) {
+					add("missing_codecs", m.Mid, "rtx payload type %d of section %s repairs missing payload type %s", c.PayloadType, m.Mid, apt)
+				}
+			}
+		}
+
+		if offer == nil || s.Type != "answer" {
+			continue
+		}
+		o := offer.section(m.Mid, i)
+		if o == nil || o.Rejected || m.Direction == "" {
+			continue
+		}
+		if allowed, ok := answerDirections[o.Direction]; ok && !slices.Contains(allowed, m.Direction) {
+			add("direction_mismatch", m.Mid, "section %s is answered %s to an offer of %s", m.Mid, m.Direction, o.Direction)
+		}
+	}
+	return problems
+}
+
+func (s *sdpSummary) endOfCandidates() bool {
+	for _, m := range s.Media {
+		if m.EndOfCandidates {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sdpSummary) hasVideo() bool {
+	for _, m := range s.Media {
+		if m.Kind == "video" && !m.Rejected {
+			return true
+		}
+	}
+	return false
+}
+
+// section returns the section with mid, or the one at index i of a
+// description without mids.
+func (s *sdpSummary) section(mid string, i int) *mediaSummary {
+	for j := range s.Media {
+		if s.Media[j].Mid == mid {
+			return &s.Media[j]
+		}
+	}
+	if i < len(s.Media) && s.Media[i].Mid == strconv.Itoa(i) {
+		return &s.Media[i]
+	}
+	return nil
+}
+
+func (m *mediaSummary) hasPayloadType(pt string) bool {
+	for _, c := range m.Codecs {
+		if strconv.Itoa(int(c.PayloadType)) == pt {
+			return true
+		}
+	}
+	return false
+}
+
+// fmtpParam returns a parameter of an fmtp value such as "apt=96".
+func fmtpParam(fmtp, key string) (string, bool) {
+	for _, p := range strings.Split(fmtp, ";") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// String is the summary on one line, for logs.
+func (s *sdpSummary) String() string {
+	var b strings.Builder
+	b.WriteString(s.Type)
+	for _, m := range s.Media {
+		fmt.Fprintf(&b, "; %s mid=%s", m.Kind, m.Mid)
+		if m.Rejected {
+			b.WriteString(" rejected")
+			continue
+		}
+		if m.Direction != "" {
+			b.WriteString(" " + m.Direction)
+		}
+		if len(m.Codecs) > 0 {
+			names := make([]string, 0, len(m.Codecs))
+			for _, c := range m.Codecs {
+				name, _, _ := strings.Cut(c.Name, "/")
+				if name == "" {
+					name = "?"
+				}
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+			b.WriteString(" " + strings.Join(names, ","))
+		}
+		if len(m.Extensions) > 0 {
+			fmt.Fprintf(&b, " ext=%d", len(m.Extensions))
+		}
+		if m.Simulcast != nil && len(m.Simulcast.Send) > 0 {
+			b.WriteString(" simulcast=" + strings.Join(m.Simulcast.Send, ","))
+		}
+		if m.Setup != "" {
+			b.WriteString(" setup=" + m.Setup)
+		}
+	}
+	for _, g := range s.Bundle {
+		b.WriteString("; bundle " + strings.Join(g, " "))
+	}
+	fmt.Fprintf(&b, "; %d candidates", s.Candidates)
+	if s.Trickle {
+		b.WriteString(" (trickle)")
+	}
+	return b.String()
+}
+
+// noteDescription analyzes a description peer sent, logs the summary and
+// its problems, and returns it; nil when it cannot be parsed. what names it
+// in the log, such as "SDP" or "SFU". Caller must hold the room's mu.
+func noteDescription(peer *Peer, what string, d *description, offer *sdpSummary) *sdpSummary {
+	if *logSDP {
+		log.Printf("%s %s from %s (%s)\n%s", what, d.typ, peer.username, peer.room, redactSDP(d.raw))
+	}
+	if d.typ == "rollback" {
+		return nil
+	}
+	if d.parsed == nil {
+		log.Printf("WARNING: %s %s from %s does not parse: %v", what, d.typ, peer.username, d.err)
+		return nil
+	}
+	s := summarizeSDP(d.typ, d.parsed, offer)
+	log.Printf("%s from %s (%s): %s", what, peer.username, peer.room, s)
+	for _, p := range s.Problems {
+		log.Printf("WARNING: %s %s from %s: %s", what, d.typ, peer.username, p.Message)
+	}
+	return s
+}
+
+// offerFor returns the latest peer-to-peer offer another member of room
+// sent, which an answer from peer most likely answers. Caller must hold
+// room.mu.
+func (room *Room) offerFor(peer *Peer) *sdpSummary {
+	var offer *sdpSummary
+	for _, p := range room.peers {
+		if p == peer || p.sdp == nil || p.sdp.Type != "offer" {
+			continue
+		}
+		if offer == nil || p.sdp.Time.After(offer.Time) {
+			offer = p.sdp
+		}
+	}
+	return offer
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// browserOffer is a Chrome offer with an audio section and a simulcast
+// video section, its candidates still to be trickled.
+var browserOffer = strings.ReplaceAll(`v=0
+o=- 4611731400430051336 2 IN IP4 127.0.0.1
+s=-
+t=0 0
+a=group:BUNDLE 0 1
+a=extmap-allow-mixed
+a=msid-semantic: WMS 8f2e
+m=audio 9 UDP/TLS/RTP/SAVPF 111 63 0
+c=IN IP4 0.0.0.0
+a=rtcp:9 IN IP4 0.0.0.0
+a=ice-ufrag:Wm4b
+a=ice-pwd:q1Vz3kZbWnLr8cYtXeGfHs2d
+a=ice-options:trickle
+a=fingerprint:sha-256 5F:1B:7A:0E:62:9C:D4:33:A8:11:4E:C0:9B:27:F5:6D:80:3A:E2:19:BC:44:07:D1:6E:95:2F:C8:73:A0:5B:E6
+a=setup:actpass
+a=mid:0
+a=extmap:1 urn:ietf:params:rtp-hdrext:ssrc-audio-level
+a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid
+a=sendrecv
+a=msid:8f2e 1c9a
+a=rtcp-mux
+a=rtpmap:111 opus/48000/2
+a=rtcp-fb:111 transport-cc
+a=fmtp:111 minptime=10;useinbandfec=1
+a=rtpmap:63 red/48000/2
+a=fmtp:63 111/111
+a=ssrc:3735928559 cname:Kq2v
+a=ssrc:3735928559 msid:8f2e 1c9a
+m=video 9 UDP/TLS/RTP/SAVPF 96 97
+c=IN IP4 0.0.0.0
+a=rtcp:9 IN IP4 0.0.0.0
+a=ice-ufrag:Wm4b
+a=ice-pwd:q1Vz3kZbWnLr8cYtXeGfHs2d
+a=ice-options:trickle
+a=fingerprint:sha-256 5F:1B:7A:0E:62:9C:D4:33:A8:11:4E:C0:9B:27:F5:6D:80:3A:E2:19:BC:44:07:D1:6E:95:2F:C8:73:A0:5B:E6
+a=setup:actpass
+a=mid:1
+a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid
+a=extmap:10 urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id
+a=sendonly
+a=msid:8f2e 7d41
+a=rtcp-mux
+a=rtcp-rsize
+a=rtpmap:96 VP8/90000
+a=rtcp-fb:96 nack
+a=rtcp-fb:96 nack pli
+a=rtpmap:97 rtx/90000
+a=fmtp:97 apt=96
+a=rid:q send
+a=rid:h send
+a=rid:f send
+a=simulcast:send q;h;~f
+`, "\n", "\r\n")
+
+func TestAnalyzeSDP(t *testing.T) {
+	s, err := analyzeSDP("offer", browserOffer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Problems) != 0 {
+		t.Errorf("problems %+v", s.Problems)
+	}
+	if len(s.Bundle) != 1 || !slices.Equal(s.Bundle[0], []string{"0", "1"}) || !s.Trickle || s.Candidates != 0 {
+		t.Errorf("bundle %v, trickle %v, candidates %d", s.Bundle, s.Trickle, s.Candidates)
+	}
+	if len(s.Media) != 2 {
+		t.Fatalf("%d sections", len(s.Media))
+	}
+
+	audio, video := s.Media[0], s.Media[1]
+	if audio.Kind != "audio" || audio.Mid != "0" || audio.Direction != "sendrecv" || !audio.RTCPMux {
+		t.Errorf("audio %+v", audio)
+	}
+	if len(audio.Codecs) != 3 || audio.Codecs[0].Name != "opus/48000/2" || audio.Codecs[0].Fmtp != "minptime=10;useinbandfec=1" ||
+		!slices.Equal(audio.Codecs[0].Feedback, []string{"transport-cc"}) || audio.Codecs[2].Name != "PCMU/8000" {
+		t.Errorf("audio codecs %+v", audio.Codecs)
+	}
+	if len(audio.Extensions) != 2 || audio.Extensions[0] != (extensionSummary{ID: 1, URI: "urn:ietf:params:rtp-hdrext:ssrc-audio-level"}) {
+		t.Errorf("audio extensions %+v", audio.Extensions)
+	}
+	if !slices.Equal(audio.SSRCs, []uint32{3735928559}) || audio.ICEUfrag != "Wm4b" || audio.Setup != "actpass" || !strings.HasPrefix(audio.Fingerprint, "sha-256 5F:") {
+		t.Errorf("audio transport %+v", audio)
+	}
+	if video.Direction != "sendonly" || video.Simulcast == nil || !slices.Equal(video.Simulcast.Send, []string{"q", "h", "f"}) {
+		t.Errorf("video %+v", video)
+	}
+
+	want := "offer; audio mid=0 sendrecv opus,red,PCMU ext=2 setup=actpass; video mid=1 sendonly VP8,rtx ext=2 simulcast=q,h,f setup=actpass; bundle 0 1; 0 candidates (trickle)"
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestAnalyzeSDPProblems(t *testing.T) {
+	codes := func(s *sdpSummary) []string {
+		var c []string
+		for _, p := range s.Problems {
+			c = append(c, p.Code+"@"+p.Mid)
+		}
+		return c
+	}
+
+	// Audio only, gathered without candidates, a payload type without
+	// rtpmap, an rtx of a missing codec and no fingerprint.
+	raw := strings.Join([]string{
+		"v=0", "o=- 1 1 IN IP4 0.0.0.0", "s=-", "t=0 0",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111 100 101",
+		"a=mid:a", "a=ice-ufrag:u", "a=ice-pwd:p", "a=setup:actpass",
+		"a=rtpmap:111 opus/48000/2", "a=rtpmap:101 rtx/48000", "a=fmtp:101 apt=102", "a=end-of-candidates",
+		"m=video 0 UDP/TLS/RTP/SAVPF 96", "a=mid:v",
+		"",
+	}, "\r\n")
+	s, err := analyzeSDP("offer", raw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"no_video@", "no_candidates@", "no_fingerprint@a", "missing_codecs@a", "missing_codecs@a"}
+	if got := codes(s); !slices.Equal(got, want) {
+		t.Errorf("problems %v, want %v", got, want)
+	}
+
+	// An answer sending on a section offered sendonly.
+	offer, err := analyzeSDP("offer", browserOffer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := strings.Replace(strings.Replace(browserOffer, "a=sendonly", "a=sendrecv", 1), "a=setup:actpass", "a=setup:active", -1)
+	s, err = analyzeSDP("answer", answer, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := codes(s); !slices.Equal(got, []string{"direction_mismatch@1"}) {
+		t.Errorf("problems %v", got)
+	}
+	if _, err := analyzeSDP("offer", "v=0\r\nm=", nil); err == nil {
+		t.Error("a truncated description parsed")
+	}
+}
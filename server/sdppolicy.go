@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// SDP policy. Offers and answers relayed between participants or sent to
+// the SFU are held to the -sdp-* flags: only allowed codecs, in the
+// configured order of preference, no unwanted header extensions or media
+// sections, and a bitrate limit. A description breaking the codec,
+// extension or media rules is rewritten to comply, or refused with
+// -sdp-policy-action reject; the sender hears about either as an error.
+// Bitrate limits are always applied by rewriting, and so are SFU answers,
+// since refusing one would leave the server's offer pending. The SFU's own
+// offers list every codec it supports; what a participant publishes or
+// accepts is limited through its descriptions.
+
+// sdpPolicy is what relayed descriptions may negotiate.
+type sdpPolicy struct {
+	codecs          []string // lower-case codec names, most preferred first; empty allows all
+	maxBitrate      int      // kbps per audio or video section, 0 for no limit
+	stripExtensions []string // header extension URIs
+	stripMedia      []string // media kinds whose sections are rejected
+	reject          bool     // refuse descriptions breaking the rules instead of rewriting them
+}
+
+// policy is nil when no -sdp-* flag restricts descriptions.
+var policy *sdpPolicy
+
+func checkSDPPolicy() {
+	p := &sdpPolicy{
+		codecs:          splitList(strings.ToLower(*sdpCodecs)),
+		maxBitrate:      *sdpMaxBitrate,
+		stripExtensions: splitList(*sdpStripExtensions),
+		stripMedia:      splitList(strings.ToLower(*sdpStripMedia)),
+	}
+	switch *sdpPolicyAction {
+	case "rewrite":
+	case "reject":
+		p.reject = true
+	default:
+		log.Fatalf("Invalid -sdp-policy-action %q: must be rewrite or reject", *sdpPolicyAction)
+	}
+	if p.maxBitrate < 0 {
+		log.Fatalf("Invalid -sdp-max-bitrate %d: must not be negative", p.maxBitrate)
+	}
+	if len(p.codecs) == 0 && p.maxBitrate == 0 && len(p.stripExtensions) == 0 && len(p.stripMedia) == 0 {
+		return
+	}
+	policy = p
+	log.Printf("SDP policy: codecs %v, max bitrate %d kbps, stripped extensions %v, stripped media %v, %s",
+		p.codecs, p.maxBitrate, p.stripExtensions, p.stripMedia, *sdpPolicyAction)
+}
+
+// splitList splits a comma-separated flag, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// policyResult is what applying the policy to a description did.
+type policyResult struct {
+	violations []string // codecs, extensions or sections removed
+	limits     []string // bitrates capped
+	changed    bool     // the description was rewritten, if only to reorder codecs
+}
+
+// apply rewrites desc to comply with the policy. Reordering codecs alone is
+// not reported.
+func (p *sdpPolicy) apply(desc *sdp.SessionDescription) policyResult {
+	var res policyResult
+	changed := false
+	var rejected []string // mids
+	for i, md := range desc.MediaDescriptions {
+		if md.MediaName.Port.Value == 0 {
+			continue
+		}
+		kind := md.MediaName.Media
+		mid, ok := md.Attribute("mid")
+		if !ok {
+			mid = strconv.Itoa(i)
+		}
+		if slices.Contains(p.stripMedia, kind) {
+			md.MediaName.Port.Value = 0
+			rejected = append(rejected, mid)
+			res.violations = append(res.violations, fmt.Sprintf("%s section %s removed", kind, mid))
+			continue
+		}
+		if kind != "audio" && kind != "video" {
+			continue
+		}
+
+		if len(p.codecs) > 0 {
+			removed, reordered := p.filterCodecs(md)
+			changed = changed || reordered
+			switch {
+			case len(md.MediaName.Formats) == 0:
+				md.MediaName.Formats = []string{"0"} // a section lists at least one format
+				md.MediaName.Port.Value = 0
+				rejected = append(rejected, mid)
+				res.violations = append(res.violations, fmt.Sprintf("%s section %s removed, none of its codecs is allowed", kind, mid))
+				continue
+			case len(removed) > 0:
+				res.violations = append(res.violations, fmt.Sprintf("codecs %s removed from %s section %s", strings.Join(removed, ", "), kind, mid))
+			}
+		}
+
+		for _, uri := range p.filterExtensions(md) {
+			res.violations = append(res.violations, fmt.Sprintf("extension %s removed from section %s", uri, mid))
+		}
+
+		if p.maxBitrate > 0 && p.capBitrate(md) {
+			res.limits = append(res.limits, fmt.Sprintf("section %s capped at %d kbps", mid, p.maxBitrate))
+		}
+	}
+
+	if len(rejected) > 0 {
+		for i, a := range desc.Attributes {
+			if mids, ok := strings.CutPrefix(a.Value, "BUNDLE "); ok && a.Key == "group" {
+				kept := slices.DeleteFunc(strings.Fields(mids), func(mid string) bool { return slices.Contains(rejected, mid) })
+				desc.Attributes[i].Value = strings.Join(append([]string{"BUNDLE"}, kept...), " ")
+			}
+		}
+	}
+
+	res.changed = changed || len(res.violations) > 0 || len(res.limits) > 0
+	return res
+}
+
+// filterCodecs drops the payload types of codecs the policy does not allow
+// from md, along with their attributes, and orders the rest by preference.
+// An rtx payload type follows the codec it repairs. It returns the names of
+// the removed codecs and whether the order changed.
+func (p *sdpPolicy) filterCodecs(md *sdp.MediaDescription) (removed []string, reordered bool) {
+	names := make(map[string]string) // payload type -> lower-case codec name
+	apt := make(map[string]string)   // rtx payload type -> repaired payload type
+	for _, a := range md.Attributes {
+		pt, value, _ := strings.Cut(a.Value, " ")
+		switch a.Key {
+		case "rtpmap":
+			name, _, _ := strings.Cut(value, "/")
+			names[pt] = strings.ToLower(name)
+		case "fmtp":
+			if v, ok := fmtpParam(value, "apt"); ok {
+				apt[pt] = v
+			}
+		}
+	}
+	name := func(pt string) string {
+		if name, ok := names[pt]; ok {
+			return name
+		}
+		if n, err := strconv.ParseUint(pt, 10, 8); err == nil {
+			if static, ok := staticPayloadTypes[uint8(n)]; ok {
+				name, _, _ := strings.Cut(strings.ToLower(static), "/")
+				return name
+			}
+		}
+		return ""
+	}
+	rank := func(pt string) int {
+		n := name(pt)
+		if n == "rtx" {
+			n = name(apt[pt])
+		}
+		return slices.Index(p.codecs, n)
+	}
+
+	var kept, dropped []string
+	for _, pt := range md.MediaName.Formats {
+		if rank(pt) < 0 {
+			dropped = append(dropped, pt)
+			n := name(pt)
+			if n == "" {
+				n = "payload type " + pt
+			}
+			if n != "rtx" && !slices.Contains(removed, n) {
+				removed = append(removed, n)
+			}
+			continue
+		}
+		kept = append(kept, pt)
+	}
+	sorted := slices.Clone(kept)
+	slices.SortStableFunc(sorted, func(a, b string) int { return rank(a) - rank(b) })
+	reordered = !slices.Equal(sorted, kept)
+	md.MediaName.Formats = sorted
+
+	md.Attributes = slices.DeleteFunc(md.Attributes, func(a sdp.Attribute) bool {
+		pt, _, _ := strings.Cut(a.Value, " ")
+		return (a.Key == "rtpmap" || a.Key == "fmtp" || a.Key == "rtcp-fb") && slices.Contains(dropped, pt)
+	})
+	return removed, reordered
+}
+
+// filterExtensions drops the header extensions the policy strips from md
+// and returns their URIs.
+func (p *sdpPolicy) filterExtensions(md *sdp.MediaDescription) []string {
+	var removed []string
+	md.Attributes = slices.DeleteFunc(md.Attributes, func(a sdp.Attribute) bool {
+		if a.Key != "extmap" {
+			return false
+		}
+		var e sdp.ExtMap
+		if err := e.Unmarshal("extmap:" + a.Value); err != nil || e.URI == nil || !slices.Contains(p.stripExtensions, e.URI.String()) {
+			return false
+		}
+		removed = append(removed, e.URI.String())
+		return true
+	})
+	return removed
+}
+
+// capBitrate limits md to the policy's bitrate with b=AS (kbps) and b=TIAS
+// (bps), keeping lower limits the sender set. It reports whether it
+// changed anything.
+func (p *sdpPolicy) capBitrate(md *sdp.MediaDescription) bool {
+	limits := map[string]uint64{"AS": uint64(p.maxBitrate), "TIAS": uint64(p.maxBitrate) * 1000}
+	changed := false
+	for i, b := range md.Bandwidth {
+		limit, ok := limits[b.Type]
+		if !ok {
+			continue
+		}
+		if b.Bandwidth > limit {
+			md.Bandwidth[i].Bandwidth = limit
+			changed = true
+		}
+		delete(limits, b.Type)
+	}
+	for _, typ := range []string{"AS", "TIAS"} {
+		if limit, ok := limits[typ]; ok {
+			md.Bandwidth = append(md.Bandwidth, sdp.Bandwidth{Type: typ, Bandwidth: limit})
+			changed = true
+		}
+	}
+	return changed
+}
+
+// rewriteSDP returns msg, the message m was decoded from, with its
+// description replaced by d once d changed.
+func rewriteSDP(msg []byte, m *signalMessage, d *description) ([]byte, error) {
+	if err := d.marshal(); err != nil {
+		return nil, err
+	}
+	return replaceSDP(msg, m, d.raw)
+}
+
+// replaceSDP returns msg, the message m was decoded from, with its
+// description replaced by raw, and updates m to match.
+func replaceSDP(msg []byte, m *signalMessage, raw string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil, err
+	}
+	m.SDP.SDP = raw
+	sdpJSON, err := json.Marshal(m.SDP)
+	if err != nil {
+		return nil, err
+	}
+	fields["sdp"] = sdpJSON
+	return json.Marshal(fields)
+}
+
+// enforceSDPPolicy holds d, which peer sent, to the policy, rewriting it
+// if needed. It reports false when the description is refused; reject
+// false rewrites what -sdp-policy-action reject would refuse. what names
+// the description in logs, such as "SDP" or "SFU". The sender is told
+// about a rewrite or refusal with an sdp_rewritten or sdp_rejected error.
+// It needs no lock.
+func enforceSDPPolicy(peer *Peer, what string, d *description, reject bool) bool {
+	if policy == nil || d.typ == "rollback" {
+		return true
+	}
+	if d.parsed == nil {
+		log.Printf("%s %s from %s refused: %v", what, d.typ, peer.username, d.err)
+		sendError(peer, "sdp_rejected", "Description refused: it does not parse")
+		return false
+	}
+	res := policy.apply(d.parsed)
+	if reject && policy.reject && len(res.violations) > 0 {
+		log.Printf("%s %s from %s refused by policy: %s", what, d.typ, peer.username, strings.Join(res.violations, "; "))
+		sendError(peer, "sdp_rejected", "Description refused by the SDP policy: "+strings.Join(res.violations, "; "))
+		return false
+	}
+	d.changed = d.changed || res.changed
+	if changes := append(res.violations, res.limits...); len(changes) > 0 {
+		log.Printf("%s %s from %s rewritten by policy: %s", what, d.typ, peer.username, strings.Join(changes, "; "))
+		sendError(peer, "sdp_rewritten", "Description rewritten by the SDP policy: "+strings.Join(changes, "; "))
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// withPolicy sets the SDP policy for the duration of the test.
+func withPolicy(t *testing.T, p *sdpPolicy) {
+	t.Helper()
+	saved := policy
+	policy = p
+	t.Cleanup(func() { policy = saved })
+}
+
+// applyTo parses raw and applies p to it, returning the description as
+// the policy left it.
+func applyTo(p *sdpPolicy, raw string) (policyResult, string, error) {
+	d := parseDescription("offer", raw)
+	if d.parsed == nil {
+		return policyResult{}, "", d.err
+	}
+	res := p.apply(d.parsed)
+	d.changed = res.changed
+	err := d.marshal()
+	return res, d.raw, err
+}
+
+func TestSDPPolicyApply(t *testing.T) {
+	p := &sdpPolicy{
+		codecs:          []string{"vp8", "opus"},
+		maxBitrate:      1500,
+		stripExtensions: []string{"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"},
+	}
+	res, out, err := applyTo(p, browserOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantViolations := []string{
+		"codecs red, pcmu removed from audio section 0",
+		"extension urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id removed from section 1",
+	}
+	if !slices.Equal(res.violations, wantViolations) {
+		t.Errorf("violations %q", res.violations)
+	}
+	if !slices.Equal(res.limits, []string{"section 0 capped at 1500 kbps", "section 1 capped at 1500 kbps"}) {
+		t.Errorf("limits %q", res.limits)
+	}
+	if strings.Count(out, "b=AS:1500\r\n") != 2 || strings.Count(out, "b=TIAS:1500000\r\n") != 2 {
+		t.Errorf("bitrate lines missing:\n%s", out)
+	}
+
+	s, err := analyzeSDP("offer", out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, video := s.Media[0], s.Media[1]
+	if len(audio.Codecs) != 1 || audio.Codecs[0].Name != "opus/48000/2" || audio.Codecs[0].Fmtp == "" {
+		t.Errorf("audio codecs %+v", audio.Codecs)
+	}
+	if len(video.Codecs) != 2 || video.Codecs[1].Name != "rtx/90000" || len(video.Extensions) != 1 {
+		t.Errorf("video codecs %+v, extensions %+v", video.Codecs, video.Extensions)
+	}
+	if strings.Contains(out, "a=fmtp:63") {
+		t.Error("attributes of a removed codec kept")
+	}
+
+	// A lower limit of the sender's own is kept.
+	res, out, _ = applyTo(p, strings.Replace(browserOffer, "c=IN IP4 0.0.0.0\r\n", "c=IN IP4 0.0.0.0\r\nb=AS:300\r\n", 1))
+	if !strings.Contains(out, "b=AS:300\r\n") || len(res.limits) != 2 {
+		t.Errorf("sender's limit not kept: %q", res.limits)
+	}
+
+	// Nothing to change leaves the description as it was.
+	res, out, err = applyTo(&sdpPolicy{codecs: []string{"opus", "red", "pcmu", "vp8"}}, browserOffer)
+	if err != nil || res.changed || out != browserOffer || len(res.violations) != 0 {
+		t.Errorf("compliant description changed: %v %q", err, res.violations)
+	}
+}
+
+func TestSDPPolicyPreference(t *testing.T) {
+	raw := strings.Join([]string{
+		"v=0", "o=- 1 1 IN IP4 0.0.0.0", "s=-", "t=0 0",
+		"a=group:BUNDLE 0 1",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111", "a=mid:0", "a=rtpmap:111 opus/48000/2",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 97 102 103 45", "a=mid:1",
+		"a=rtpmap:96 VP8/90000", "a=rtpmap:97 rtx/90000", "a=fmtp:97 apt=96",
+		"a=rtpmap:102 H264/90000", "a=rtcp-fb:102 nack", "a=rtpmap:103 rtx/90000", "a=fmtp:103 apt=102",
+		"a=rtpmap:45 AV1/90000",
+		"",
+	}, "\r\n")
+
+	res, out, err := applyTo(&sdpPolicy{codecs: []string{"h264", "vp8", "opus"}}, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "m=video 9 UDP/TLS/RTP/SAVPF 102 103 96 97\r\n") || !slices.Equal(res.violations, []string{"codecs av1 removed from video section 1"}) {
+		t.Errorf("violations %q:\n%s", res.violations, out)
+	}
+
+	// A section without an allowed codec is rejected and leaves the bundle.
+	res, out, err = applyTo(&sdpPolicy{codecs: []string{"opus"}}, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "m=video 0 ") || !strings.Contains(out, "a=group:BUNDLE 0\r\n") {
+		t.Errorf("video section not rejected:\n%s", out)
+	}
+
+	res, out, err = applyTo(&sdpPolicy{stripMedia: []string{"audio"}}, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "m=audio 0 ") || !strings.Contains(out, "a=group:BUNDLE 1\r\n") || !slices.Equal(res.violations, []string{"audio section 0 removed"}) {
+		t.Errorf("violations %q:\n%s", res.violations, out)
+	}
+}
+
+func TestSDPPolicyRelay(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "policy", "alice")
+	readUntil(t, alice, `"room_info"`)
+	bob := dial(t, url, "policy", "bob")
+	readUntil(t, bob, `"room_info"`)
+
+	offer, _ := json.Marshal(map[string]interface{}{
+		"type": "offer",
+		"sdp":  map[string]string{"type": "offer", "sdp": browserOffer},
+		"room": "policy",
+	})
+
+	withPolicy(t, &sdpPolicy{codecs: []string{"opus"}, reject: true})
+	if err := alice.WriteMessage(websocket.TextMessage, offer); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readUntil(t, alice, `"error"`); !strings.Contains(string(msg), `"sdp_rejected"`) || !strings.Contains(string(msg), "video section 1 removed") {
+		t.Errorf("refusal %s", msg)
+	}
+
+	policy.reject = false
+	if err := alice.WriteMessage(websocket.TextMessage, offer); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readUntil(t, alice, `"error"`); !strings.Contains(string(msg), `"sdp_rewritten"`) {
+		t.Errorf("rewrite report %s", msg)
+	}
+	var relayed struct {
+		Type string `json:"type"`
+		Room string `json:"room"`
+		SDP  struct {
+			Type string `json:"type"`
+			SDP  string `json:"sdp"`
+		} `json:"sdp"`
+	}
+	if err := json.Unmarshal(readUntil(t, bob, `"offer"`), &relayed); err != nil {
+		t.Fatal(err)
+	}
+	if relayed.Room != "policy" || relayed.SDP.Type != "offer" || !strings.Contains(relayed.SDP.SDP, "m=video 0 ") || strings.Contains(relayed.SDP.SDP, "red/48000") {
+		t.Errorf("relayed %+v", relayed)
+	}
+}
+
+// TestSDPPolicySFU holds an sfu_offer to the policy: refused in reject
+// mode, otherwise rewritten before the SFU answers it.
+func TestSDPPolicySFU(t *testing.T) {
+	url := startServer(t)
+	alice := dial(t, url, "policy-sfu", "alice")
+	readUntil(t, alice, `"room_info"`)
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := json.Marshal(map[string]interface{}{"type": "sfu_offer", "sdp": offer})
+
+	withPolicy(t, &sdpPolicy{codecs: []string{"opus"}, reject: true})
+	if err := alice.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readUntil(t, alice, `"error"`); !strings.Contains(string(reply), `"sdp_rejected"`) {
+		t.Errorf("refusal %s", reply)
+	}
+
+	policy.reject = false
+	if err := alice.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readUntil(t, alice, `"error"`); !strings.Contains(string(reply), `"sdp_rewritten"`) {
+		t.Errorf("rewrite report %s", reply)
+	}
+	var answer struct {
+		SDP webrtc.SessionDescription `json:"sdp"`
+	}
+	if err := json.Unmarshal(readUntil(t, alice, `"sfu_answer"`), &answer); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(answer.SDP.SDP, "m=video 0 ") || !strings.Contains(answer.SDP.SDP, "opus/48000") {
+		t.Errorf("SFU answered a description the policy does not allow:\n%s", answer.SDP.SDP)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Outgoing messages. Every websocket has a queue drained by its own writer
+// goroutine, so whoever sends to a peer, usually with the room's mu held,
+// only queues the message and never waits on the network. A writer gives
+// up on a write after -write-timeout, and a peer whose queue fills up is
+// disconnected: one stalled client cannot hold up its room.
+
+var (
+	errSendQueueFull = errors.New("send queue full")
+	errPeerClosed    = errors.New("connection closed")
+	errNoWebsocket   = errors.New("peer has no websocket")
+)
+
+// outMessage is one message queued for a peer's writer: data, or pm whose
+// payload is size bytes long. done, if set, runs once the message is
+// written or dropped. close ends the connection after what was queued
+// before it.
+type outMessage struct {
+	data  []byte
+	pm    *websocket.PreparedMessage
+	size  int
+	done  func()
+	close bool
+}
+
+func (m outMessage) release() {
+	if m.done != nil {
+		m.done()
+	}
+}
+
+// sharedMessage is a prepared message queued for several peers. release
+// runs after the last of them wrote or dropped it.
+type sharedMessage struct {
+	pm      *websocket.PreparedMessage
+	size    int
+	refs    atomic.Int32
+	release func()
+}
+
+func newSharedMessage(pm *websocket.PreparedMessage, size int, release func()) *sharedMessage {
+	m := &sharedMessage{pm: pm, size: size, release: release}
+	m.refs.Store(1) // held by the sender until everybody got it
+	return m
+}
+
+func (m *sharedMessage) queue(p *Peer) error {
+	m.refs.Add(1)
+	return p.enqueue(outMessage{pm: m.pm, size: m.size, done: m.done})
+}
+
+func (m *sharedMessage) done() {
+	if m.refs.Add(-1) == 0 && m.release != nil {
+		m.release()
+	}
+}
+
+// startWriting gives p the queue messages to it wait in. Messages may be
+// queued before its writer runs.
+func (p *Peer) startWriting() {
+	p.send = make(chan outMessage, *sendQueue)
+	p.closed = make(chan struct{})
+}
+
+// stopWriting drops what is still queued for p and refuses new messages.
+func (p *Peer) stopWriting() {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	p.stopped = true
+	close(p.closed)
+}
+
+// enqueue hands m to p's writer. Once stopWriting ran, the writer may have
+// drained the queue for the last time, so m is released here instead.
+func (p *Peer) enqueue(m outMessage) error {
+	if p.send == nil {
+		m.release()
+		return errNoWebsocket
+	}
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	if p.stopped {
+		m.release()
+		return errPeerClosed
+	}
+	select {
+	case p.send <- m:
+		return nil
+	default:
+		m.release()
+		log.Printf("Send queue of %s is full, disconnecting", p.username)
+		// Closing makes the read loop of p exit and clean up.
+		p.conn.Close()
+		return errSendQueueFull
+	}
+}
+
+// backlog returns the number of messages waiting for p's writer.
+func (p *Peer) backlog() int {
+	return len(p.send)
+}
+
+// closeAfterWrites ends p's connection once what is queued is written.
+func (p *Peer) closeAfterWrites() {
+	p.enqueue(outMessage{close: true})
+}
+
+// writeLoop writes what is queued for p until stopWriting. After a failed
+// write the rest is dropped.
+func (p *Peer) writeLoop() {
+	failed := false
+	for {
+		select {
+		case m := <-p.send:
+			if !failed {
+				if err := p.write(m); err != nil {
+					log.Printf("Error writing to %s: %v", p.username, err)
+					failed = true
+				} else if m.close {
+					failed = true
+				}
+				if failed {
+					p.conn.Close()
+				}
+			}
+			m.release()
+		case <-p.closed:
+			for {
+				select {
+				case m := <-p.send:
+					m.release()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *Peer) write(m outMessage) error {
+	if m.close {
+		return nil
+	}
+	if err := p.conn.SetWriteDeadline(time.Now().Add(*writeTimeout)); err != nil {
+		return err
+	}
+	p.compressNext(m.size)
+	if m.pm != nil {
+		return p.conn.WritePreparedMessage(m.pm)
+	}
+	return p.conn.WriteMessage(websocket.TextMessage, m.data)
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// SFU media path. A client that sends "sfu_offer" negotiates Peer.pc with
+// the server instead of (or in addition to) the peer-to-peer call relayed
+// over the websocket. Every track it publishes is fanned out to the other
+// SFU participants of the room; when subscriptions change the server sends
+// its own "sfu_offer" and the client replies with "sfu_answer".
+
+// publishedTrack is a track received from a publisher. With simulcast
+// the publisher sends several layers of it, each with its own RID.
+type publishedTrack struct {
+	id       string
+	streamID string
+	kind     webrtc.RTPCodecType
+	codec    webrtc.RTPCodecCapability
+	owner    *Peer
+	priority int    // higher priority video keeps flowing longest on a weak link
+	source   string // sourceCamera or sourceScreen
+
+	mu         sync.RWMutex
+	layers     map[string]*trackLayer // key: RID, "" without simulcast
+	downTracks map[*Peer]*downTrack   // key: subscriber
+}
+
+// trackLayer is one encoding of a publishedTrack.
+type trackLayer struct {
+	track     *publishedTrack
+	remote    *webrtc.TrackRemote
+	rid       string
+	bitrate   rateMeter
+	keyframes keyframeRequester
+
+	audioLevelID uint8 // negotiated ID of the audio level extension, 0 if absent
+	speakers     *speakerDetector
+	mixer        *roomMixer // nil unless audio mixing is enabled
+}
+
+// downTrack is the copy of a publishedTrack sent to one subscriber.
+type downTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	source     *publishedTrack
+	subscriber *Peer
+	sender     *webrtc.RTPSender
+
+	mu       sync.Mutex
+	layer    *trackLayer // layer being forwarded, nil until the first keyframe
+	target   *trackLayer // layer to switch to, nil while paused
+	paused   bool
+	selected bool // chosen by last-N forwarding
+
+	// Subscribers must see one continuous stream across layer switches
+	// and pauses, so sequence numbers and timestamps are rewritten.
+	started   bool
+	resync    bool
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+// sfuTrackInfo tells subscribers who owns the tracks of a server offer.
+type sfuTrackInfo struct {
+	Username string `json:"username"`
+	TrackID  string `json:"trackId"`
+	StreamID string `json:"streamId"`
+	Kind     string `json:"kind"`
+	Source   string `json:"source"` // camera or screen
+}
+
+type sfuMessage struct {
+	SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+}
+
+// settingEngine configures the PeerConnections of the server. Tests put
+// them on a virtual network with it.
+var settingEngine webrtc.SettingEngine
+
+// newPeerConnection creates Peer.pc with the interceptors the SFU relies on.
+func newPeerConnection(peer *Peer) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	i := &interceptor.Registry{}
+	if err := configureRTCPFeedback(m, i); err != nil {
+		return nil, err
+	}
+	if err := configureCongestionControl(peer, m, i); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		return nil, err
+	}
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine), webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		init := c.ToJSON()
+		if err := peer.writeJSON(map[string]interface{}{
+			"type":      "sfu_candidate",
+			"candidate": init,
+		}); err != nil {
+			log.Printf("Error sending SFU candidate to %s: %v", peer.username, err)
+		}
+	})
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		publishTrack(peer, remote, receiver)
+	})
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		onDataChannel(peer, dc)
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("SFU connection of %s: %s", peer.username, state)
+	})
+
+	return pc, nil
+}
+
+func handleSFUMessage(peer *Peer, msgType string, msg []byte) {
+	var m sfuMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		log.Printf("Invalid %s from %s: %v", msgType, peer.username, err)
+		return
+	}
+
+	// Descriptions are parsed and held to the policy before the room is
+	// locked. An answer is rewritten rather than refused.
+	var desc *description
+	if m.SDP != nil && msgType != "sfu_candidate" {
+		desc = parseDescription(m.SDP.Type.String(), m.SDP.SDP)
+		if !enforceSDPPolicy(peer, "SFU", desc, msgType == "sfu_offer") {
+			return
+		}
+		if err := desc.marshal(); err != nil {
+			log.Printf("Error rewriting %s from %s: %v", msgType, peer.username, err)
+			return
+		}
+		m.SDP.SDP = desc.raw
+	}
+
+	room := peer.joined
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	switch msgType {
+	case "sfu_offer":
+		if m.SDP == nil {
+			return
+		}
+		if s := noteDescription(peer, "SFU", desc, nil); s != nil {
+			peer.sfuSDP = s
+		}
+		if peer.pc.SignalingState() != webrtc.SignalingStateStable {
+			// The server's own offer is in flight; the client retries after answering it.
+			sendError(peer, "sfu_offer_collision", "SFU offer collision, answer the pending sfu_offer first")
+			return
+		}
+		if err := peer.pc.SetRemoteDescription(*m.SDP); err != nil {
+			log.Printf("SFU offer from %s rejected: %v", peer.username, err)
+			return
+		}
+		answer, err := peer.pc.CreateAnswer(nil)
+		if err != nil {
+			log.Printf("SFU answer for %s failed: %v", peer.username, err)
+			return
+		}
+		if err := peer.pc.SetLocalDescription(answer); err != nil {
+			log.Printf("SFU answer for %s failed: %v", peer.username, err)
+			return
+		}
+		if err := peer.writeJSON(map[string]interface{}{
+			"type": "sfu_answer",
+			"sdp":  answer,
+		}); err != nil {
+			log.Printf("Error sending SFU answer to %s: %v", peer.username, err)
+		}
+
+		if !peer.sfu {
+			peer.sfu = true
+			log.Printf("User '%s' joined the SFU of room '%s'", peer.username, peer.room)
+			negotiate(peer.joined, peer)
+			applyLastN(peer.joined)
+		}
+	case "sfu_answer":
+		if m.SDP == nil {
+			return
+		}
+		// The server's offer, checked before it stops being pending.
+		var offer *sdpSummary
+		if local := peer.pc.LocalDescription(); local != nil {
+			offer, _ = analyzeSDP(local.Type.String(), local.SDP, nil)
+		}
+		if s := noteDescription(peer, "SFU", desc, offer); s != nil {
+			peer.sfuSDP = s
+		}
+		if err := peer.pc.SetRemoteDescription(*m.SDP); err != nil {
+			log.Printf("SFU answer from %s rejected: %v", peer.username, err)
+			return
+		}
+		if peer.negotiationPending {
+			peer.negotiationPending = false
+			negotiate(peer.joined, peer)
+		}
+	case "sfu_candidate":
+		if m.Candidate == nil {
+			return
+		}
+		if m.Candidate.Candidate != "" {
+			if c, err := parseCandidate(m.Candidate.Candidate); err != nil {
+				peer.candidates.Invalid++
+			} else {
+				peer.candidates.count(c)
+			}
+		}
+		if err := peer.pc.AddICECandidate(*m.Candidate); err != nil {
+			log.Printf("SFU candidate from %s rejected: %v", peer.username, err)
+		}
+	}
+}
+
+// publishTrack registers a track (or simulcast layer) received from peer
+// and forwards it until it ends.
+func publishTrack(peer *Peer, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	room := peer.joined
+	room.mu.Lock()
+	if room.closed || !room.hosts(peer) {
+		room.mu.Unlock()
+		return
+	}
+
+	t, exists := room.tracks[remote.ID()]
+	if !exists {
+		t = &publishedTrack{
+			id:         remote.ID(),
+			streamID:   remote.StreamID(),
+			kind:       remote.Kind(),
+			codec:      remote.Codec().RTPCodecCapability,
+			owner:      peer,
+			source:     room.trackSource(peer, remote.StreamID()),
+			layers:     make(map[string]*trackLayer),
+			downTracks: make(map[*Peer]*downTrack),
+		}
+		if t.source == sourceScreen {
+			t.priority = screenSharePriority
+		}
+		room.tracks[t.id] = t
+	} else if t.owner != peer {
+		room.mu.Unlock()
+		log.Printf("Ignoring track %s from %s, already published by %s", t.id, peer.username, t.owner.username)
+		return
+	}
+	layer := &trackLayer{track: t, remote: remote, rid: remote.RID(), speakers: room.speakers}
+	layer.keyframes.layer = layer
+	if t.kind == webrtc.RTPCodecTypeAudio {
+		layer.audioLevelID = audioLevelExtensionID(receiver)
+		if strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeOpus) {
+			layer.mixer = room.mixer
+		}
+	}
+	t.mu.Lock()
+	t.layers[layer.rid] = layer
+	t.mu.Unlock()
+
+	if exists {
+		log.Printf("User '%s' added layer '%s' to track %s", peer.username, layer.rid, t.id)
+	} else {
+		log.Printf("User '%s' published %s track %s (%s)", peer.username, t.kind, t.id, t.codec.MimeType)
+		renegotiateRoom(room)
+	}
+	room.mu.Unlock()
+
+	layer.forward()
+
+	room.mu.Lock()
+	t.mu.Lock()
+	delete(t.layers, layer.rid)
+	remaining := len(t.layers)
+	t.mu.Unlock()
+	if layer.mixer != nil {
+		layer.mixer.RemoveSource(peer.username)
+	}
+	if remaining == 0 && room.tracks[t.id] == t {
+		delete(room.tracks, t.id)
+		log.Printf("Track %s of %s ended", t.id, peer.username)
+		renegotiateRoom(room)
+	}
+	room.mu.Unlock()
+}
+
+// forward copies RTP from the publisher to every subscriber of this layer
+// until the remote track ends.
+func (l *trackLayer) forward() {
+	for {
+		pkt, _, err := l.remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		l.bitrate.add(pkt.MarshalSize())
+		l.observeAudioLevel(pkt)
+		if l.mixer != nil {
+			if err := l.mixer.Write(l.track.owner.username, pkt.Payload); err != nil {
+				log.Printf("Error decoding audio of %s: %v", l.track.owner.username, err)
+			}
+		}
+
+		l.track.mu.RLock()
+		for _, dt := range l.track.downTracks {
+			if err := dt.writeRTP(l, pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Printf("Error forwarding track %s to %s: %v", l.track.id, dt.subscriber.username, err)
+			}
+		}
+		l.track.mu.RUnlock()
+	}
+}
+
+// writeRTP forwards pkt from layer if it is the layer the subscriber
+// currently receives. A switch to the target layer happens on a keyframe.
+func (d *downTrack) writeRTP(layer *trackLayer, pkt *rtp.Packet) error {
+	d.mu.Lock()
+	if d.paused || d.target == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	if layer != d.layer {
+		if layer != d.target || !isKeyframe(d.source.codec.MimeType, pkt.Payload) {
+			d.mu.Unlock()
+			return nil
+		}
+		d.layer = layer
+		d.resync = true
+	}
+
+	now := time.Now()
+	if d.resync {
+		if d.started {
+			elapsed := uint32(now.Sub(d.lastWrite).Seconds()*float64(d.source.codec.ClockRate)) + 1
+			d.seqOffset = pkt.SequenceNumber - d.lastSeq - 1
+			d.tsOffset = pkt.Timestamp - d.lastTS - elapsed
+		}
+		d.resync = false
+	}
+
+	// Extension IDs are negotiated per PeerConnection, so the publisher's
+	// extensions are meaningless to the subscriber; interceptors add ours.
+	out := rtp.Packet{Header: pkt.Header, Payload: pkt.Payload}
+	out.Extension = false
+	out.Extensions = nil
+	out.SequenceNumber -= d.seqOffset
+	out.Timestamp -= d.tsOffset
+	if !d.started || int16(out.SequenceNumber-d.lastSeq) > 0 {
+		d.lastSeq = out.SequenceNumber
+		d.lastTS = out.Timestamp
+		d.lastWrite = now
+	}
+	d.started = true
+	d.mu.Unlock()
+
+	return d.TrackLocalStaticRTP.WriteRTP(&out)
+}
+
+// setLayer selects the layer the subscriber should receive; nil pauses
+// the downTrack. Reports whether anything changed.
+func (d *downTrack) setLayer(layer *trackLayer) bool {
+	d.mu.Lock()
+	changed := d.target != layer || d.paused != (layer == nil)
+	d.target = layer
+	d.paused = layer == nil
+	if layer == nil {
+		d.layer = nil
+	}
+	d.mu.Unlock()
+
+	if changed && layer != nil && layer != d.currentLayer() {
+		layer.keyframes.request()
+	}
+	return changed
+}
+
+func (d *downTrack) currentLayer() *trackLayer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.layer
+}
+
+// requestKeyframe asks the publisher of the layer the subscriber receives
+// (or is about to receive) for a keyframe.
+func (d *downTrack) requestKeyframe(full bool) {
+	d.mu.Lock()
+	layer := d.target
+	if layer == nil {
+		layer = d.layer
+	}
+	d.mu.Unlock()
+
+	if layer == nil {
+		return
+	}
+	if full {
+		layer.keyframes.requestFull()
+	} else {
+		layer.keyframes.request()
+	}
+}
+
+// Bind is called when the subscriber's sender starts; a fresh subscriber
+// cannot decode anything until the publisher sends a keyframe.
+func (d *downTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := d.TrackLocalStaticRTP.Bind(ctx)
+	if err == nil && d.Kind() == webrtc.RTPCodecTypeVideo {
+		d.requestKeyframe(false)
+	}
+	return codec, err
+}
+
+// isKeyframe reports whether an RTP payload starts a keyframe. Codecs the
+// server does not understand are treated as always switchable.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		if len(payload) < 1 || payload[0]&0x10 == 0 || payload[0]&0x0F != 0 {
+			return false // not the start of partition 0
+		}
+		i := 1
+		if payload[0]&0x80 != 0 {
+			if len(payload) < 2 {
+				return false
+			}
+			x := payload[1]
+			i++
+			if x&0x80 != 0 { // picture ID
+				if len(payload) > i && payload[i]&0x80 != 0 {
+					i++
+				}
+				i++
+			}
+			if x&0x40 != 0 { // TL0PICIDX
+				i++
+			}
+			if x&0x30 != 0 { // TID/KEYIDX
+				i++
+			}
+		}
+		return len(payload) > i && payload[i]&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return len(payload) > 0 && payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+	case strings.ToLower(webrtc.MimeTypeH264):
+		if len(payload) < 1 {
+			return false
+		}
+		switch nalType := payload[0] & 0x1F; nalType {
+		case 5, 7:
+			return true
+		case 24: // STAP-A
+			for i := 1; i+2 < len(payload); {
+				size := int(payload[i])<<8 | int(payload[i+1])
+				if t := payload[i+2] & 0x1F; t == 5 || t == 7 {
+					return true
+				}
+				i += 2 + size
+			}
+		case 28: // FU-A
+			return len(payload) > 1 && payload[1]&0x80 != 0 && (payload[1]&0x1F == 5 || payload[1]&0x1F == 7)
+		}
+		return false
+	}
+	return true
+}
+
+// renegotiateRoom updates the subscriptions of every SFU participant of
+// room. Caller must hold room.mu.
+func renegotiateRoom(room *Room) {
+	updateCascades(room)
+	for _, p := range room.peers {
+		if p.sfu {
+			negotiate(room, p)
+		}
+	}
+	applyLastN(room)
+}
+
+// negotiate subscribes peer to every track of room it does not publish
+// itself, drops subscriptions to tracks that ended and sends a new server
+// offer when anything changed. Caller must hold room.mu.
+func negotiate(room *Room, peer *Peer) {
+	changed := false
+
+	for id, t := range room.tracks {
+		if t.owner == peer || peer.downTracks[id] != nil || peer.mixesAudio(t) || !room.forwards(t) {
+			continue
+		}
+		if peer.cascadeNode != "" && t.owner.origin != "" {
+			// Cascaded tracks are not passed on to a third node.
+			continue
+		}
+		if err := subscribe(peer, t); err != nil {
+			log.Printf("Error subscribing %s to track %s: %v", peer.username, id, err)
+			continue
+		}
+		changed = true
+	}
+
+	for id, dt := range peer.downTracks {
+		if room.tracks[id] == dt.source && !peer.mixesAudio(dt.source) && room.forwards(dt.source) {
+			continue
+		}
+		unsubscribe(peer, id)
+		changed = true
+	}
+
+	if !changed && !peer.negotiationPending {
+		return
+	}
+	if peer.pc.SignalingState() != webrtc.SignalingStateStable {
+		peer.negotiationPending = true
+		return
+	}
+	peer.negotiationPending = false
+
+	offer, err := peer.pc.CreateOffer(nil)
+	if err != nil {
+		log.Printf("SFU offer for %s failed: %v", peer.username, err)
+		return
+	}
+	if err := peer.pc.SetLocalDescription(offer); err != nil {
+		log.Printf("SFU offer for %s failed: %v", peer.username, err)
+		return
+	}
+
+	tracks := make([]sfuTrackInfo, 0, len(peer.downTracks))
+	for _, dt := range peer.downTracks {
+		tracks = append(tracks, sfuTrackInfo{
+			Username: dt.source.owner.username,
+			TrackID:  dt.ID(),
+			StreamID: dt.StreamID(),
+			Kind:     dt.Kind().String(),
+			Source:   dt.source.source,
+		})
+	}
+	if peer.cascadeNode != "" {
+		sendCascade(peer.cascadeNode, cascadeSignal{Room: room.name, Outbound: true, SDP: &offer, Tracks: tracks})
+		return
+	}
+	if err := peer.writeJSON(map[string]interface{}{
+		"type":   "sfu_offer",
+		"sdp":    offer,
+		"tracks": tracks,
+	}); err != nil {
+		log.Printf("Error sending SFU offer to %s: %v", peer.username, err)
+	}
+}
+
+// mixesAudio reports whether peer hears t through the audio mix rather
+// than a downTrack of its own.
+func (p *Peer) mixesAudio(t *publishedTrack) bool {
+	return p.audioMix && t.kind == webrtc.RTPCodecTypeAudio
+}
+
+// subscribe adds a downTrack of t to peer.pc, starting with the lowest
+// layer until the bandwidth allocator knows better. Caller must hold room.mu.
+func subscribe(peer *Peer, t *publishedTrack) error {
+	local, err := webrtc.NewTrackLocalStaticRTP(t.codec, t.id, t.streamID)
+	if err != nil {
+		return err
+	}
+	dt := &downTrack{TrackLocalStaticRTP: local, source: t, subscriber: peer, selected: true}
+
+	sender, err := peer.pc.AddTrack(dt)
+	if err != nil {
+		return err
+	}
+	dt.sender = sender
+	go readSubscriberRTCP(dt)
+
+	t.mu.Lock()
+	dt.target = t.lowestLayer()
+	t.downTracks[peer] = dt
+	t.mu.Unlock()
+	peer.downTracks[t.id] = dt
+	return nil
+}
+
+// unsubscribe removes the downTrack of track id from peer.pc. Caller must hold room.mu.
+func unsubscribe(peer *Peer, id string) {
+	dt := peer.downTracks[id]
+	delete(peer.downTracks, id)
+
+	dt.source.mu.Lock()
+	delete(dt.source.downTracks, peer)
+	dt.source.mu.Unlock()
+
+	if err := peer.pc.RemoveTrack(dt.sender); err != nil && !errors.Is(err, webrtc.ErrConnectionClosed) {
+		log.Printf("Error removing track %s from %s: %v", id, peer.username, err)
+	}
+}
+
+// leaveSFU releases the media state of a departing peer. Caller must hold room.mu.
+func leaveSFU(peer *Peer) {
+	for id := range peer.downTracks {
+		unsubscribe(peer, id)
+	}
+	if err := peer.pc.Close(); err != nil {
+		log.Printf("Error closing PeerConnection of %s: %v", peer.username, err)
+	}
+
+	room := peer.joined
+	removed := false
+	for id, t := range room.tracks {
+		if t.owner == peer {
+			delete(room.tracks, id)
+			removed = true
+		}
+	}
+	if removed {
+		renegotiateRoom(room)
+	}
+}
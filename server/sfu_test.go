@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtpRecorder binds a track as a PeerConnection would and keeps the
+// headers written to it.
+type rtpRecorder struct {
+	codec   webrtc.RTPCodecParameters
+	headers []rtp.Header
+}
+
+func (r *rtpRecorder) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{r.codec}
+}
+func (r *rtpRecorder) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (r *rtpRecorder) SSRC() webrtc.SSRC                                      { return 1 }
+func (r *rtpRecorder) WriteStream() webrtc.TrackLocalWriter                   { return r }
+func (r *rtpRecorder) ID() string                                             { return "recorder" }
+func (r *rtpRecorder) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+func (r *rtpRecorder) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	r.headers = append(r.headers, *header)
+	return len(payload), nil
+}
+
+func (r *rtpRecorder) Write(b []byte) (int, error) { return len(b), nil }
+
+// TestDownTrackLayers switches a subscriber between simulcast layers and
+// pauses it: the subscriber sees one stream whose sequence numbers run on
+// and whose timestamps move forward by about the time that passed.
+func TestDownTrackLayers(t *testing.T) {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	source := &publishedTrack{id: "video", kind: webrtc.RTPCodecTypeVideo, codec: codec}
+	low := &trackLayer{track: source, rid: "l"}
+	high := &trackLayer{track: source, rid: "h"}
+	for _, l := range []*trackLayer{low, high} {
+		// Keyframe requests are rate limited; nobody is there to ask.
+		l.keyframes.layer = l
+		l.keyframes.last = time.Now()
+	}
+
+	local, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &rtpRecorder{codec: webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: 96}}
+	if _, err := local.Bind(rec); err != nil {
+		t.Fatal(err)
+	}
+	d := &downTrack{TrackLocalStaticRTP: local, source: source}
+
+	keyframe, delta := []byte{0x10, 0x00}, []byte{0x10, 0x01}
+	write := func(layer *trackLayer, seq uint16, ts uint32, payload []byte) {
+		t.Helper()
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts}, Payload: payload}
+		if err := d.writeRTP(layer, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := func() rtp.Header {
+		t.Helper()
+		if len(rec.headers) == 0 {
+			t.Fatal("nothing forwarded")
+		}
+		return rec.headers[len(rec.headers)-1]
+	}
+	forwarded := func(want int) {
+		t.Helper()
+		if len(rec.headers) != want {
+			t.Fatalf("%d packets forwarded, want %d", len(rec.headers), want)
+		}
+	}
+
+	d.setLayer(low)
+	write(low, 100, 1000, delta) // waits for a keyframe
+	forwarded(0)
+	write(low, 101, 4000, keyframe)
+	write(low, 102, 7000, delta)
+	forwarded(2)
+	if h := last(); h.SequenceNumber != 102 || h.Timestamp != 7000 {
+		t.Errorf("first layer rewritten: seq %d, ts %d", h.SequenceNumber, h.Timestamp)
+	}
+
+	// The switch happens on a keyframe of the new layer; until then the
+	// old one keeps flowing.
+	d.setLayer(high)
+	write(high, 9000, 500000, delta)
+	write(low, 103, 10000, delta)
+	forwarded(3)
+	time.Sleep(20 * time.Millisecond)
+	write(high, 9001, 503000, keyframe)
+	write(low, 104, 13000, delta) // the old layer is dropped
+	write(high, 9002, 506000, delta)
+	forwarded(5)
+	switched, next := rec.headers[3], rec.headers[4]
+	if switched.SequenceNumber != 104 || next.SequenceNumber != 105 {
+		t.Errorf("sequence numbers across the switch: %d, %d", switched.SequenceNumber, next.SequenceNumber)
+	}
+	// 20ms at 90kHz is 1800 ticks.
+	if gap := switched.Timestamp - 10000; gap < 1800 || gap > 90000 {
+		t.Errorf("timestamp moved by %d across the switch", gap)
+	}
+	if next.Timestamp-switched.Timestamp != 3000 {
+		t.Errorf("timestamps after the switch drift: %d", next.Timestamp-switched.Timestamp)
+	}
+
+	// A paused subscriber resumes where it stopped.
+	d.setLayer(nil)
+	write(high, 9003, 509000, keyframe)
+	forwarded(5)
+	d.setLayer(high)
+	write(high, 9500, 600000, keyframe)
+	forwarded(6)
+	if h := last(); h.SequenceNumber != 106 || h.Timestamp <= next.Timestamp {
+		t.Errorf("resumed at seq %d, ts %d after %d, %d", h.SequenceNumber, h.Timestamp, next.SequenceNumber, next.Timestamp)
+	}
+}
+
+func TestIsKeyframe(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{"VP8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"VP8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"VP8 continuation", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"VP8 later partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00}, false},
+		{"VP8 7-bit picture ID", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x05, 0x00}, true},
+		{"VP8 15-bit picture ID", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x85, 0x05, 0x00}, true},
+		{"VP8 15-bit picture ID interframe", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x85, 0x05, 0x01}, false},
+		{"VP8 picture ID, TL0PICIDX and TID", webrtc.MimeTypeVP8, []byte{0x90, 0xE0, 0x05, 0x11, 0x22, 0x00}, true},
+		{"VP8 truncated extension", webrtc.MimeTypeVP8, []byte{0x90}, false},
+		{"VP8 truncated header", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x05}, false},
+		{"VP8 empty", webrtc.MimeTypeVP8, nil, false},
+		{"VP8 lower case MIME type", "video/vp8", []byte{0x10, 0x00}, true},
+		{"VP9 keyframe", webrtc.MimeTypeVP9, []byte{0x08}, true},
+		{"VP9 inter-picture", webrtc.MimeTypeVP9, []byte{0x48}, false},
+		{"VP9 continuation", webrtc.MimeTypeVP9, []byte{0x00}, false},
+		{"VP9 empty", webrtc.MimeTypeVP9, nil, false},
+		{"H264 IDR", webrtc.MimeTypeH264, []byte{0x65}, true},
+		{"H264 SPS", webrtc.MimeTypeH264, []byte{0x67}, true},
+		{"H264 non-IDR slice", webrtc.MimeTypeH264, []byte{0x41}, false},
+		{"H264 STAP-A with SPS", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42}, true},
+		{"H264 STAP-A with IDR second", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x41, 0x00, 0x00, 0x01, 0x65}, true},
+		{"H264 STAP-A without", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x41, 0x00}, false},
+		{"H264 FU-A IDR start", webrtc.MimeTypeH264, []byte{0x7C, 0x85}, true},
+		{"H264 FU-A IDR continuation", webrtc.MimeTypeH264, []byte{0x7C, 0x05}, false},
+		{"H264 FU-A non-IDR start", webrtc.MimeTypeH264, []byte{0x7C, 0x81}, false},
+		{"H264 empty", webrtc.MimeTypeH264, nil, false},
+		{"other codec", webrtc.MimeTypeAV1, []byte{0x00}, true},
+	} {
+		if got := isKeyframe(tc.mimeType, tc.payload); got != tc.want {
+			t.Errorf("%s: isKeyframe(%s, % x) = %v, want %v", tc.name, tc.mimeType, tc.payload, got, tc.want)
+		}
+	}
+}
+
+// TestKeyframeInterval asks for keyframes at given times: one request per
+// keyframeInterval reaches the publisher, PLI and FIR alike.
+func TestKeyframeInterval(t *testing.T) {
+	var k keyframeRequester
+	start := time.Now()
+	var seqs []uint8
+	for _, tc := range []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, true},
+		{10 * time.Millisecond, false},
+		{keyframeInterval - time.Millisecond, false},
+		{keyframeInterval, true},
+		{keyframeInterval + 100*time.Millisecond, false},
+		{3 * keyframeInterval, true},
+	} {
+		seq, ok := k.next(start.Add(tc.at))
+		if ok != tc.want {
+			t.Errorf("request at %v sent = %v, want %v", tc.at, ok, tc.want)
+		}
+		if ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	// FIR sequence numbers count the requests sent.
+	if !slices.Equal(seqs, []uint8{1, 2, 3}) {
+		t.Errorf("FIR sequence numbers %v", seqs)
+	}
+}
+
+// sfuClient is a member connected to the SFU. It answers the server's
+// offers on its own; the test drives it through pc.
+type sfuClient struct {
+	name   string
+	conn   *websocket.Conn
+	pc     *webrtc.PeerConnection
+	tracks chan *webrtc.TrackRemote // remote tracks, as they start
+
+	writeMu sync.Mutex
+}
+
+// newSFUClient joins room as name. Its PeerConnection comes from api, or
+// has pion's defaults when api is nil.
+func newSFUClient(t *testing.T, api *webrtc.API, url, room, name string) *sfuClient {
+	t.Helper()
+	conn := dial(t, url, room, name)
+	readUntil(t, conn, `"room_info"`)
+
+	newPC := webrtc.NewPeerConnection
+	if api != nil {
+		newPC = api.NewPeerConnection
+	}
+	pc, err := newPC(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	c := &sfuClient{name: name, conn: conn, pc: pc, tracks: make(chan *webrtc.TrackRemote, 8)}
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) { c.tracks <- remote })
+
+	done := make(chan error, 1)
+	go func() { done <- c.signal() }()
+	t.Cleanup(func() {
+		conn.Close()
+		if err := <-done; err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	})
+	return c
+}
+
+func (c *sfuClient) send(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteJSON(v)
+}
+
+// describe sets a local description of pc's candidates and sends it as
+// msgType. Candidates are not trickled, so none can overtake it.
+func (c *sfuClient) describe(msgType string, d webrtc.SessionDescription) error {
+	gathered := webrtc.GatheringCompletePromise(c.pc)
+	if err := c.pc.SetLocalDescription(d); err != nil {
+		return err
+	}
+	<-gathered
+	return c.send(map[string]interface{}{"type": msgType, "sdp": c.pc.LocalDescription()})
+}
+
+// negotiate offers pc to the SFU.
+func (c *sfuClient) negotiate(t *testing.T) {
+	t.Helper()
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.describe("sfu_offer", offer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signal applies what the SFU sends until the connection closes.
+func (c *sfuClient) signal() error {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		var m struct {
+			Type      string                     `json:"type"`
+			SDP       *webrtc.SessionDescription `json:"sdp"`
+			Candidate *webrtc.ICECandidateInit   `json:"candidate"`
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		switch {
+		case m.Type == "sfu_answer" && m.SDP != nil:
+			if err := c.pc.SetRemoteDescription(*m.SDP); err != nil {
+				return err
+			}
+		case m.Type == "sfu_offer" && m.SDP != nil:
+			if err := c.pc.SetRemoteDescription(*m.SDP); err != nil {
+				return err
+			}
+			answer, err := c.pc.CreateAnswer(nil)
+			if err != nil {
+				return err
+			}
+			if err := c.describe("sfu_answer", answer); err != nil {
+				return err
+			}
+		case m.Type == "sfu_candidate" && m.Candidate != nil:
+			if err := c.pc.AddICECandidate(*m.Candidate); err != nil {
+				return err
+			}
+		case m.Type == "error":
+			return fmt.Errorf("server error: %s", data)
+		}
+	}
+}
+
+// publishVideo sends VP8 keyframes on a new track of c until the test
+// ends, and returns the keyframe requests the publisher receives.
+func (c *sfuClient) publishVideo(t *testing.T) <-chan rtcp.Packet {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, c.name+"-video", c.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := c.pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan rtcp.Packet, 64)
+	go func() {
+		for {
+			pkts, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				switch pkt.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					select {
+					case requests <- pkt:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96}, Payload: []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pkt.SequenceNumber++
+				pkt.Timestamp += 1800
+				track.WriteRTP(pkt)
+			}
+		}
+	}()
+	return requests
+}
+
+// TestKeyframeOnSubscribe has bob subscribe to alice's video through the
+// SFU. alice is asked for a keyframe when bob starts receiving, and the
+// keyframe requests bob sends reach her at most once per
+// keyframeInterval.
+func TestKeyframeOnSubscribe(t *testing.T) {
+	url := startServer(t)
+	alice := newSFUClient(t, nil, url, "keyframes", "alice")
+	requests := alice.publishVideo(t)
+	alice.negotiate(t)
+	waitUntil(t, "alice's track is published", func() bool {
+		mu.Lock()
+		room := rooms["keyframes"]
+		mu.Unlock()
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		return len(room.tracks) == 1
+	})
+
+	// Whatever alice was asked for so far is not bob's doing.
+	time.Sleep(keyframeInterval)
+	drain := func() {
+		for len(requests) > 0 {
+			<-requests
+		}
+	}
+	drain()
+
+	bob := newSFUClient(t, nil, url, "keyframes", "bob")
+	if _, err := bob.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	bob.negotiate(t)
+	if _, ok := await(t, requests, "a keyframe request for bob").(*rtcp.PictureLossIndication); !ok {
+		t.Error("alice was asked for a keyframe with a FIR, want a PLI")
+	}
+	remote := await(t, bob.tracks, "bob's track")
+	if _, _, err := remote.ReadRTP(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A burst of requests from bob makes one.
+	burst := func(pkt rtcp.Packet) int {
+		t.Helper()
+		time.Sleep(keyframeInterval)
+		drain()
+		for i := 0; i < 5; i++ {
+			if err := bob.pc.WriteRTCP([]rtcp.Packet{pkt}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n := 0
+		for timeout := time.After(keyframeInterval * 3 / 4); ; {
+			select {
+			case got := <-requests:
+				if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", pkt) {
+					t.Errorf("asked for a keyframe with %T, want %T", got, pkt)
+				}
+				n++
+				continue
+			case <-timeout:
+			}
+			return n
+		}
+	}
+	ssrc := uint32(remote.SSRC())
+	if n := burst(&rtcp.PictureLossIndication{MediaSSRC: ssrc}); n != 1 {
+		t.Errorf("5 PLIs from bob made %d, want 1", n)
+	}
+	if n := burst(&rtcp.FullIntraRequest{MediaSSRC: ssrc, FIR: []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: 1}}}); n != 1 {
+		t.Errorf("5 FIRs from bob made %d, want 1", n)
+	}
+}
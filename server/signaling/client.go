@@ -0,0 +1,576 @@
+// Package signaling is a client for the server's /ws protocol, the Go
+// counterpart of SignalingClient in client/app/webrtc/lib/signaling.ts,
+// for bots, load generators and tests:
+//
+//	c := signaling.New("ws://localhost:8080/ws", signaling.Options{})
+//	offers := c.Offers()
+//	if err := c.Connect(ctx, "demo", "bot"); err != nil {
+//		return err
+//	}
+//	for offer := range offers {
+//		// answer with c.SendAnswer
+//	}
+//
+// Events arrive on typed channels, each created by its first caller;
+// events of channels nobody asked for are dropped, so subscribe before
+// Connect. A subscriber must keep receiving: the Client waits for room in
+// its channel. When the connection drops the Client dials again with
+// exponential backoff and rejoins the same room under the same name. All
+// channels are closed once the Client is closed.
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	// ErrNotConnected is returned when sending while the Client is not in
+	// its room, including while it reconnects.
+	ErrNotConnected = errors.New("signaling: not connected")
+	// ErrClosed is returned when connecting a closed Client.
+	ErrClosed = errors.New("signaling: client closed")
+)
+
+// Options tune a Client. The zero value is usable.
+type Options struct {
+	// MaxReconnectAttempts bounds the attempts to rejoin after the
+	// connection drops: 0 means 5, a negative value never reconnects.
+	MaxReconnectAttempts int
+	// ReconnectDelay is the wait before the first attempt, doubled after
+	// each failure up to MaxReconnectDelay. Defaults: 1s and 30s.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// ConnectionTimeout bounds dialing and joining. Default: 5s.
+	ConnectionTimeout time.Duration
+
+	Dialer *websocket.Dialer // default: websocket.DefaultDialer
+	Header http.Header       // sent with the websocket handshake
+	// Join holds extra fields of the join message, such as displayName,
+	// metadata or compression.
+	Join map[string]interface{}
+}
+
+// Client is one participant's signaling connection.
+type Client struct {
+	url    string
+	opts   Options
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+
+	writeMu sync.Mutex // gorilla allows only one concurrent writer per conn
+
+	mu       sync.Mutex // guards the fields below
+	conn     *websocket.Conn
+	room     string
+	username string
+	state    State
+	running  bool          // the read loop owns the connection
+	stopped  chan struct{} // closed when the Client is closed for good
+
+	finishOnce sync.Once
+	// The member list, from room_info and the participant_* messages
+	// since; used by one goroutine at a time.
+	members []Participant
+	users   map[string]bool
+
+	roomInfo      feed[RoomInfo]
+	joins, leaves feed[string]
+	offers        feed[Description]
+	answers       feed[Description]
+	candidates    feed[Candidate]
+	sfuOffers     feed[Description]
+	sfuAnswers    feed[Description]
+	sfuCandidates feed[Candidate]
+	errors        feed[*Error]
+	messages      feed[Message]
+	states        feed[State]
+}
+
+// New returns a Client for the websocket endpoint at url, such as
+// ws://localhost:8080/ws.
+func New(url string, opts Options) *Client {
+	if opts.MaxReconnectAttempts == 0 {
+		opts.MaxReconnectAttempts = 5
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = time.Second
+	}
+	if opts.MaxReconnectDelay <= 0 {
+		opts.MaxReconnectDelay = 30 * time.Second
+	}
+	if opts.ConnectionTimeout <= 0 {
+		opts.ConnectionTimeout = 5 * time.Second
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		url:     url,
+		opts:    opts,
+		ctx:     ctx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+		users:   make(map[string]bool),
+	}
+}
+
+// RoomInfo delivers the member list whenever somebody joins or leaves.
+func (c *Client) RoomInfo() <-chan RoomInfo { return c.roomInfo.subscribe() }
+
+// Joins delivers the usernames of members who joined.
+func (c *Client) Joins() <-chan string { return c.joins.subscribe() }
+
+// Leaves delivers the usernames of members who left.
+func (c *Client) Leaves() <-chan string { return c.leaves.subscribe() }
+
+// Offers delivers peer-to-peer offers relayed by the server.
+func (c *Client) Offers() <-chan Description { return c.offers.subscribe() }
+
+// Answers delivers peer-to-peer answers.
+func (c *Client) Answers() <-chan Description { return c.answers.subscribe() }
+
+// Candidates delivers peer-to-peer ICE candidates.
+func (c *Client) Candidates() <-chan Candidate { return c.candidates.subscribe() }
+
+// SFUOffers delivers the server's offers when what the client receives
+// from the SFU changes.
+func (c *Client) SFUOffers() <-chan Description { return c.sfuOffers.subscribe() }
+
+// SFUAnswers delivers the server's answers to SendSFUOffer.
+func (c *Client) SFUAnswers() <-chan Description { return c.sfuAnswers.subscribe() }
+
+// SFUCandidates delivers the server's ICE candidates.
+func (c *Client) SFUCandidates() <-chan Candidate { return c.sfuCandidates.subscribe() }
+
+// Errors delivers the server's error messages, and a "reconnect_failed"
+// Error when the Client gives up reconnecting.
+func (c *Client) Errors() <-chan *Error { return c.errors.subscribe() }
+
+// Messages delivers every message of another type, such as chat.
+func (c *Client) Messages() <-chan Message { return c.messages.subscribe() }
+
+// States delivers the connection state as it changes.
+func (c *Client) States() <-chan State { return c.states.subscribe() }
+
+// Connect joins room as username and returns once the server sent the
+// first room_info. A refusal, such as a taken username, is returned as an
+// *Error.
+func (c *Client) Connect(ctx context.Context, room, username string) error {
+	c.mu.Lock()
+	switch {
+	case c.ctx.Err() != nil:
+		c.mu.Unlock()
+		return ErrClosed
+	case c.running:
+		c.mu.Unlock()
+		return errors.New("signaling: already connected")
+	}
+	c.room, c.username = room, username
+	c.mu.Unlock()
+
+	c.setState(Connecting)
+	conn, err := c.join(ctx)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return ErrClosed
+		}
+		return err
+	}
+
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+	c.running = true
+	c.mu.Unlock()
+	c.setState(Connected)
+	go c.run(conn)
+	return nil
+}
+
+// join dials the server, sends the join message and reads until the
+// first room_info arrives.
+func (c *Client) join(ctx context.Context) (*websocket.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.ConnectionTimeout)
+	defer cancel()
+	defer context.AfterFunc(c.ctx, cancel)() // Close aborts joining
+
+	conn, _, err := c.opts.Dialer.DialContext(ctx, c.url, c.opts.Header)
+	if err != nil {
+		return nil, err
+	}
+	// The server reads nothing else until the client joined, so the
+	// deadline covers the whole exchange.
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	msg := make(map[string]interface{}, len(c.opts.Join)+3)
+	for k, v := range c.opts.Join {
+		msg[k] = v
+	}
+	c.mu.Lock()
+	msg["type"], msg["room"], msg["username"] = "join", c.room, c.username
+	c.mu.Unlock()
+	if err := conn.WriteJSON(msg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("signaling: joining: %w", ctx.Err())
+			}
+			return nil, err
+		}
+		msgType, serverErr := c.dispatch(data)
+		if serverErr != nil {
+			conn.Close()
+			return nil, serverErr
+		}
+		if msgType == "room_info" {
+			stop()
+			conn.SetReadDeadline(time.Time{})
+			conn.SetWriteDeadline(time.Time{})
+			return conn, nil
+		}
+	}
+}
+
+// run reads from conn, and from the connections that replace it, until
+// the Client is closed or gives up reconnecting.
+func (c *Client) run(conn *websocket.Conn) {
+	defer c.finish()
+	for {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			c.dispatch(data)
+		}
+		conn.Close()
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		c.setState(Reconnecting)
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+		c.setState(Connected)
+	}
+}
+
+// reconnect rejoins the room, waiting longer after every failed attempt.
+func (c *Client) reconnect() *websocket.Conn {
+	delay := c.opts.ReconnectDelay
+	var err error
+	for attempt := 1; attempt <= c.opts.MaxReconnectAttempts; attempt++ {
+		t := time.NewTimer(delay)
+		select {
+		case <-c.ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+
+		var conn *websocket.Conn
+		if conn, err = c.join(c.ctx); err == nil {
+			c.mu.Lock()
+			c.conn = conn
+			c.mu.Unlock()
+			return conn
+		}
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		delay = min(2*delay, c.opts.MaxReconnectDelay)
+	}
+
+	if c.opts.MaxReconnectAttempts > 0 {
+		c.errors.send(&Error{
+			Code:    "reconnect_failed",
+			Message: fmt.Sprintf("gave up after %d attempts: %v", c.opts.MaxReconnectAttempts, err),
+		}, c.ctx.Done())
+	}
+	return nil
+}
+
+// envelope holds the fields of any message the server sends.
+type envelope struct {
+	Type      string                     `json:"type"`
+	Code      string                     `json:"code"`
+	Data      json.RawMessage            `json:"data"`
+	SDP       *webrtc.SessionDescription `json:"sdp"`
+	ICE       *webrtc.ICECandidateInit   `json:"ice"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate"`
+	Username  string                     `json:"username"`
+	Tracks    []TrackInfo                `json:"tracks"`
+}
+
+// dispatch delivers a message to its channel. It returns the message type,
+// and the message itself when it is an error.
+func (c *Client) dispatch(data []byte) (string, *Error) {
+	var m envelope
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", nil
+	}
+
+	done := c.ctx.Done()
+	switch m.Type {
+	case "room_info":
+		var info RoomInfo
+		if err := json.Unmarshal(m.Data, &info); err != nil {
+			return m.Type, nil
+		}
+		c.members = info.Participants
+		c.roomInfo.send(info, done)
+		c.diffUsers(info.Users)
+	case "participant_joined", "participant_left":
+		var p Participant
+		if err := json.Unmarshal(m.Data, &p); err != nil || p.Username == "" {
+			return m.Type, nil
+		}
+		members := c.withoutMember(p.Username)
+		if m.Type == "participant_joined" {
+			members = append(members, p)
+			sort.SliceStable(members, func(i, j int) bool {
+				if members[i].JoinedAt != members[j].JoinedAt {
+					return members[i].JoinedAt < members[j].JoinedAt
+				}
+				return members[i].Username < members[j].Username
+			})
+		}
+		c.members = members
+		info := RoomInfo{Users: make([]string, len(members)), Participants: members}
+		for i, p := range members {
+			info.Users[i] = p.Username
+		}
+		c.roomInfo.send(info, done)
+		c.diffUsers(info.Users)
+	case "participant_updated":
+		var p Participant
+		if err := json.Unmarshal(m.Data, &p); err == nil {
+			if i := slices.IndexFunc(c.members, func(o Participant) bool { return o.Username == p.Username }); i >= 0 {
+				members := slices.Clone(c.members)
+				members[i] = p
+				c.members = members
+			}
+		}
+		c.messages.send(Message{Type: m.Type, Raw: data}, done)
+	case "error":
+		e := &Error{Code: m.Code}
+		json.Unmarshal(m.Data, &e.Message)
+		c.errors.send(e, done)
+		return m.Type, e
+	case "offer", "answer":
+		if m.SDP == nil {
+			break
+		}
+		d := Description{From: m.Username, SDP: *m.SDP}
+		if m.Type == "offer" {
+			c.offers.send(d, done)
+		} else {
+			c.answers.send(d, done)
+		}
+	case "ice_candidate", "candidate":
+		// Browsers send "ice_candidate" with "ice"; older clients
+		// "candidate" with "candidate".
+		cand := m.ICE
+		if cand == nil {
+			cand = m.Candidate
+		}
+		if cand != nil {
+			c.candidates.send(Candidate{From: m.Username, Candidate: *cand}, done)
+		}
+	case "sfu_offer", "sfu_answer":
+		if m.SDP == nil {
+			break
+		}
+		d := Description{SDP: *m.SDP, Tracks: m.Tracks}
+		if m.Type == "sfu_offer" {
+			c.sfuOffers.send(d, done)
+		} else {
+			c.sfuAnswers.send(d, done)
+		}
+	case "sfu_candidate":
+		if m.Candidate != nil {
+			c.sfuCandidates.send(Candidate{Candidate: *m.Candidate}, done)
+		}
+	default:
+		c.messages.send(Message{Type: m.Type, Raw: data}, done)
+	}
+	return m.Type, nil
+}
+
+// withoutMember returns a copy of the member list without username; lists
+// already delivered on RoomInfo are never changed.
+func (c *Client) withoutMember(username string) []Participant {
+	members := make([]Participant, 0, len(c.members)+1)
+	for _, p := range c.members {
+		if p.Username != username {
+			members = append(members, p)
+		}
+	}
+	return members
+}
+
+// diffUsers reports who joined and left since the previous member list,
+// including while reconnecting.
+func (c *Client) diffUsers(users []string) {
+	c.mu.Lock()
+	self := c.username
+	c.mu.Unlock()
+
+	done := c.ctx.Done()
+	current := make(map[string]bool, len(users))
+	for _, u := range users {
+		current[u] = true
+		if !c.users[u] && u != self {
+			c.joins.send(u, done)
+		}
+	}
+	for u := range c.users {
+		if !current[u] && u != self {
+			c.leaves.send(u, done)
+		}
+	}
+	c.users = current
+}
+
+func (c *Client) setState(s State) {
+	c.mu.Lock()
+	c.state = s
+	c.mu.Unlock()
+	c.states.send(s, c.ctx.Done())
+}
+
+// IsConnected reports whether the Client is in its room.
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state == Connected
+}
+
+// SendOffer relays a peer-to-peer offer to the other members of the room.
+func (c *Client) SendOffer(sdp webrtc.SessionDescription) error {
+	return c.sendPeer(map[string]interface{}{"type": "offer", "sdp": sdp})
+}
+
+// SendAnswer relays a peer-to-peer answer.
+func (c *Client) SendAnswer(sdp webrtc.SessionDescription) error {
+	return c.sendPeer(map[string]interface{}{"type": "answer", "sdp": sdp})
+}
+
+// SendCandidate relays a peer-to-peer ICE candidate, the way browsers do.
+func (c *Client) SendCandidate(cand webrtc.ICECandidateInit) error {
+	return c.sendPeer(map[string]interface{}{"type": "ice_candidate", "ice": cand})
+}
+
+// sendPeer adds the sender to a relayed message so recipients know who
+// it is from.
+func (c *Client) sendPeer(msg map[string]interface{}) error {
+	c.mu.Lock()
+	msg["room"], msg["username"] = c.room, c.username
+	c.mu.Unlock()
+	return c.Send(msg)
+}
+
+// SendSFUOffer offers the server's SFU what the client publishes.
+func (c *Client) SendSFUOffer(sdp webrtc.SessionDescription) error {
+	return c.Send(map[string]interface{}{"type": "sfu_offer", "sdp": sdp})
+}
+
+// SendSFUAnswer answers an offer of the SFU.
+func (c *Client) SendSFUAnswer(sdp webrtc.SessionDescription) error {
+	return c.Send(map[string]interface{}{"type": "sfu_answer", "sdp": sdp})
+}
+
+// SendSFUCandidate sends an ICE candidate of the SFU connection.
+func (c *Client) SendSFUCandidate(cand webrtc.ICECandidateInit) error {
+	return c.Send(map[string]interface{}{"type": "sfu_candidate", "candidate": cand})
+}
+
+// Send writes any message, such as {"type": "chat", ...}, as JSON.
+func (c *Client) Send(v interface{}) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return conn.WriteJSON(v)
+}
+
+// Close leaves the room and stops reconnecting. Every channel is closed
+// by the time it returns.
+func (c *Client) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	conn, running := c.conn, c.running
+	c.mu.Unlock()
+
+	var err error
+	if conn != nil {
+		c.writeMu.Lock()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		c.writeMu.Unlock()
+		err = conn.Close()
+	}
+	if running {
+		<-c.stopped
+	} else {
+		c.finish()
+	}
+	return err
+}
+
+// finish closes the Client for good.
+func (c *Client) finish() {
+	c.finishOnce.Do(func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.running = false
+		c.state = Closed
+		c.mu.Unlock()
+
+		// The last state is delivered even after Close, unless the
+		// subscriber stopped receiving.
+		c.states.trySend(Closed)
+
+		for _, f := range []interface{ close() }{
+			&c.roomInfo, &c.joins, &c.leaves, &c.offers, &c.answers, &c.candidates,
+			&c.sfuOffers, &c.sfuAnswers, &c.sfuCandidates, &c.errors, &c.messages, &c.states,
+		} {
+			f.close()
+		}
+		close(c.stopped)
+	})
+}
@@ -0,0 +1,437 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeServer plays the server's side of the protocol: it answers a join
+// with room_info, or with an error while reject is set, and hands the
+// connection to the test.
+type fakeServer struct {
+	t     *testing.T
+	srv   *httptest.Server
+	joins chan map[string]interface{}
+	conns chan *fakeConn
+
+	mu     sync.Mutex
+	users  []string // others in the room, listed in room_info
+	reject string   // error code to refuse joins with
+}
+
+// fakeConn is one joined client as the fake server sees it.
+type fakeConn struct {
+	conn     *websocket.Conn
+	received chan map[string]interface{}
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	s := &fakeServer{
+		t:     t,
+		joins: make(chan map[string]interface{}, 16),
+		conns: make(chan *fakeConn, 16),
+	}
+	upgrader := websocket.Upgrader{}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var join map[string]interface{}
+		if err := conn.ReadJSON(&join); err != nil {
+			return
+		}
+		s.mu.Lock()
+		users, reject := append(s.users, join["username"].(string)), s.reject
+		s.mu.Unlock()
+		s.joins <- join
+		if reject != "" {
+			conn.WriteJSON(map[string]interface{}{"type": "error", "code": reject, "data": "refused"})
+			return
+		}
+		participants := make([]Participant, len(users))
+		for i, u := range users {
+			participants[i] = Participant{Username: u, JoinedAt: int64(i)}
+		}
+		conn.WriteJSON(map[string]interface{}{"type": "room_info", "data": RoomInfo{Users: users, Participants: participants}})
+
+		fc := &fakeConn{conn: conn, received: make(chan map[string]interface{}, 16)}
+		s.conns <- fc
+		for {
+			var m map[string]interface{}
+			if err := conn.ReadJSON(&m); err != nil {
+				close(fc.received)
+				return
+			}
+			fc.received <- m
+		}
+	}))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+func (s *fakeServer) url() string {
+	return "ws" + strings.TrimPrefix(s.srv.URL, "http")
+}
+
+func (s *fakeServer) setUsers(users ...string) {
+	s.mu.Lock()
+	s.users = users
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) setReject(code string) {
+	s.mu.Lock()
+	s.reject = code
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) nextConn() *fakeConn {
+	s.t.Helper()
+	select {
+	case fc := <-s.conns:
+		return fc
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("timed out waiting for the client to join")
+	}
+	return nil
+}
+
+func (s *fakeServer) nextJoin() map[string]interface{} {
+	s.t.Helper()
+	select {
+	case join := <-s.joins:
+		return join
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("timed out waiting for a join message")
+	}
+	return nil
+}
+
+func (fc *fakeConn) write(t *testing.T, m map[string]interface{}) {
+	t.Helper()
+	if err := fc.conn.WriteJSON(m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (fc *fakeConn) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	select {
+	case m, ok := <-fc.received:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+func recv[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	var zero T
+	return zero
+}
+
+// waitClosed drains ch until it is closed.
+func waitClosed[T any](t *testing.T, ch <-chan T) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("channel not closed")
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	s := newFakeServer(t)
+	s.setUsers("alice")
+	c := New(s.url(), Options{Join: map[string]interface{}{"displayName": "Bot"}})
+	roomInfo, joins, states := c.RoomInfo(), c.Joins(), c.States()
+
+	if err := c.Connect(context.Background(), "demo", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	join := s.nextJoin()
+	if join["type"] != "join" || join["room"] != "demo" || join["username"] != "bot" || join["displayName"] != "Bot" {
+		t.Errorf("join message %v", join)
+	}
+	if info := recv(t, roomInfo); len(info.Users) != 2 {
+		t.Errorf("room_info users %v", info.Users)
+	}
+	if u := recv(t, joins); u != "alice" {
+		t.Errorf("joined %q, want alice", u)
+	}
+	if s1, s2 := recv(t, states), recv(t, states); s1 != Connecting || s2 != Connected {
+		t.Errorf("states %v, %v", s1, s2)
+	}
+	if !c.IsConnected() {
+		t.Error("IsConnected() = false after Connect")
+	}
+	if err := c.Connect(context.Background(), "demo", "bot"); err == nil {
+		t.Error("second Connect succeeded")
+	}
+
+	fc := s.nextConn()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := recv(t, states); s != Closed {
+		t.Errorf("state %v after Close, want closed", s)
+	}
+	waitClosed(t, states)
+	waitClosed(t, roomInfo)
+	waitClosed(t, fc.received)
+	if err := c.SendOffer(webrtc.SessionDescription{}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("SendOffer after Close: %v", err)
+	}
+	if err := c.Connect(context.Background(), "demo", "bot"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Connect after Close: %v", err)
+	}
+}
+
+func TestConnectRejected(t *testing.T) {
+	s := newFakeServer(t)
+	s.setReject("username_taken")
+	c := New(s.url(), Options{})
+	defer c.Close()
+
+	err := c.Connect(context.Background(), "demo", "bot")
+	var e *Error
+	if !errors.As(err, &e) || e.Code != "username_taken" || e.Message != "refused" {
+		t.Fatalf("Connect: %v, want username_taken", err)
+	}
+	if c.IsConnected() {
+		t.Error("IsConnected() = true after a refused join")
+	}
+}
+
+// TestSend checks that messages go out in the format browsers use.
+func TestSend(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(s.url(), Options{})
+	defer c.Close()
+	if err := c.Connect(context.Background(), "demo", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	fc := s.nextConn()
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\n"}
+	mid, index := "0", uint16(0)
+	cand := webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 1 10.0.0.1 5000 typ host", SDPMid: &mid, SDPMLineIndex: &index}
+	for _, tc := range []struct {
+		send func() error
+		want string
+	}{
+		{func() error { return c.SendOffer(offer) }, `{"type":"offer","room":"demo","username":"bot","sdp":{"type":"offer","sdp":"v=0\r\n"}}`},
+		{func() error { return c.SendAnswer(offer) }, `{"type":"answer","room":"demo","username":"bot","sdp":{"type":"offer","sdp":"v=0\r\n"}}`},
+		{func() error { return c.SendCandidate(cand) }, `{"type":"ice_candidate","room":"demo","username":"bot","ice":{"candidate":"candidate:1 1 udp 1 10.0.0.1 5000 typ host","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":null}}`},
+		{func() error { return c.SendSFUOffer(offer) }, `{"type":"sfu_offer","sdp":{"type":"offer","sdp":"v=0\r\n"}}`},
+		{func() error { return c.SendSFUCandidate(cand) }, `{"type":"sfu_candidate","candidate":{"candidate":"candidate:1 1 udp 1 10.0.0.1 5000 typ host","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":null}}`},
+		{func() error { return c.Send(map[string]interface{}{"type": "chat", "data": "hi"}) }, `{"type":"chat","data":"hi"}`},
+	} {
+		if err := tc.send(); err != nil {
+			t.Fatal(err)
+		}
+		got := fc.next(t)
+		var want map[string]interface{}
+		json.Unmarshal([]byte(tc.want), &want)
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("sent %s, want %s", gotJSON, wantJSON)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(s.url(), Options{})
+	defer c.Close()
+	offers, candidates, sfuOffers, errs, messages := c.Offers(), c.Candidates(), c.SFUOffers(), c.Errors(), c.Messages()
+	if err := c.Connect(context.Background(), "demo", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	fc := s.nextConn()
+
+	// Nobody subscribed to answers: they must not hold up the rest.
+	for i := 0; i < 2*eventBuffer; i++ {
+		fc.write(t, map[string]interface{}{"type": "answer", "sdp": map[string]string{"type": "answer", "sdp": "v=0"}, "username": "alice"})
+	}
+	fc.write(t, map[string]interface{}{"type": "offer", "sdp": map[string]string{"type": "offer", "sdp": "v=0"}, "room": "demo", "username": "alice"})
+	if o := recv(t, offers); o.From != "alice" || o.SDP.Type != webrtc.SDPTypeOffer || o.SDP.SDP != "v=0" {
+		t.Errorf("offer %+v", o)
+	}
+
+	fc.write(t, map[string]interface{}{"type": "ice_candidate", "ice": map[string]string{"candidate": "a"}, "username": "alice"})
+	fc.write(t, map[string]interface{}{"type": "candidate", "candidate": map[string]string{"candidate": "b"}, "username": "carol"})
+	if cand := recv(t, candidates); cand.From != "alice" || cand.Candidate.Candidate != "a" {
+		t.Errorf("ice_candidate %+v", cand)
+	}
+	if cand := recv(t, candidates); cand.From != "carol" || cand.Candidate.Candidate != "b" {
+		t.Errorf("candidate %+v", cand)
+	}
+
+	fc.write(t, map[string]interface{}{
+		"type":   "sfu_offer",
+		"sdp":    map[string]string{"type": "offer", "sdp": "v=0"},
+		"tracks": []map[string]string{{"username": "alice", "trackId": "t1", "streamId": "s1", "kind": "video", "source": "camera"}},
+	})
+	if o := recv(t, sfuOffers); len(o.Tracks) != 1 || o.Tracks[0] != (TrackInfo{"alice", "t1", "s1", "video", "camera"}) {
+		t.Errorf("sfu_offer tracks %+v", o.Tracks)
+	}
+
+	fc.write(t, map[string]interface{}{"type": "error", "code": "forbidden", "data": "not the owner"})
+	if e := recv(t, errs); e.Code != "forbidden" || e.Message != "not the owner" {
+		t.Errorf("error %+v", e)
+	}
+
+	fc.write(t, map[string]interface{}{"type": "chat", "data": "hi"})
+	if m := recv(t, messages); m.Type != "chat" || !strings.Contains(string(m.Raw), `"hi"`) {
+		t.Errorf("message %s %s", m.Type, m.Raw)
+	}
+}
+
+// TestMembers keeps the member list from room_info up to date with the
+// participant_* messages that follow it.
+func TestMembers(t *testing.T) {
+	s := newFakeServer(t)
+	s.setUsers("alice")
+	c := New(s.url(), Options{})
+	defer c.Close()
+	roomInfo, joins, leaves, messages := c.RoomInfo(), c.Joins(), c.Leaves(), c.Messages()
+	if err := c.Connect(context.Background(), "demo", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	fc := s.nextConn()
+	first := recv(t, roomInfo)
+	if u := recv(t, joins); u != "alice" {
+		t.Errorf("joined %q, want alice", u)
+	}
+
+	fc.write(t, map[string]interface{}{"type": "participant_joined", "data": Participant{Username: "carol", JoinedAt: 5}})
+	if u := recv(t, joins); u != "carol" {
+		t.Errorf("joined %q, want carol", u)
+	}
+	if info := recv(t, roomInfo); !slices.Equal(info.Users, []string{"alice", "bot", "carol"}) || len(info.Participants) != 3 {
+		t.Errorf("after carol joined %+v", info)
+	}
+
+	fc.write(t, map[string]interface{}{"type": "participant_updated", "data": Participant{Username: "alice", Audio: true}})
+	recv(t, messages)
+	fc.write(t, map[string]interface{}{"type": "participant_left", "data": map[string]string{"username": "carol"}})
+	if u := recv(t, leaves); u != "carol" {
+		t.Errorf("left %q, want carol", u)
+	}
+	info := recv(t, roomInfo)
+	if !slices.Equal(info.Users, []string{"alice", "bot"}) || !info.Participants[0].Audio {
+		t.Errorf("after carol left %+v", info)
+	}
+	if len(first.Users) != 2 || first.Participants[0].Audio {
+		t.Errorf("delivered member list changed: %+v", first)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := newFakeServer(t)
+	s.setUsers("alice")
+	c := New(s.url(), Options{ReconnectDelay: 10 * time.Millisecond})
+	defer c.Close()
+	states, leaves := c.States(), c.Leaves()
+	if err := c.Connect(context.Background(), "demo", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	s.nextJoin()
+	recv(t, states)
+	recv(t, states)
+
+	// The first attempt is refused, as the server does while it still
+	// holds the old connection; alice left meanwhile.
+	s.setUsers()
+	s.setReject("username_taken")
+	s.nextConn().conn.Close()
+	if st := recv(t, states); st != Reconnecting {
+		t.Fatalf("state %v after the connection dropped", st)
+	}
+	s.nextJoin()
+	s.setReject("")
+
+	join := s.nextJoin()
+	if join["room"] != "demo" || join["username"] != "bot" {
+		t.Errorf("rejoined with %v", join)
+	}
+	if st := recv(t, states); st != Connected {
+		t.Fatalf("state %v after rejoining", st)
+	}
+	if u := recv(t, leaves); u != "alice" {
+		t.Errorf("left %q, want alice", u)
+	}
+
+	fc := s.nextConn()
+	if err := c.SendCandidate(webrtc.ICECandidateInit{Candidate: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := fc.next(t); m["type"] != "ice_candidate" {
+		t.Errorf("sent %v after rejoining", m)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(s.url(), Options{MaxReconnectAttempts: 2, ReconnectDelay: 10 * time.Millisecond})
+	defer c.Close()
+	states, errs := c.States(), c.Errors()
+	if err := c.Connect(context.Background(), "demo", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	recv(t, states)
+	recv(t, states)
+
+	s.setReject("banned")
+	s.nextConn().conn.Close()
+	if st := recv(t, states); st != Reconnecting {
+		t.Fatalf("state %v after the connection dropped", st)
+	}
+	for i := 0; i < 2; i++ {
+		if e := recv(t, errs); e.Code != "banned" {
+			t.Errorf("attempt %d: error %v", i+1, e)
+		}
+	}
+	if e := recv(t, errs); e.Code != "reconnect_failed" {
+		t.Errorf("error %v, want reconnect_failed", e)
+	}
+	if st := recv(t, states); st != Closed {
+		t.Errorf("state %v after giving up", st)
+	}
+	waitClosed(t, states)
+	waitClosed(t, errs)
+}
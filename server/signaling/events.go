@@ -0,0 +1,168 @@
+package signaling
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// RoomInfo lists the members of the room. The server sends it on joining
+// and participant_joined and participant_left after that; the Client
+// applies those to the list it delivers.
+type RoomInfo struct {
+	Users        []string      `json:"users"`
+	Participants []Participant `json:"participants"`
+}
+
+// Participant is the presence of one room member.
+type Participant struct {
+	Username    string            `json:"username"`
+	DisplayName string            `json:"displayName,omitempty"`
+	JoinedAt    int64             `json:"joinedAt"` // unix milliseconds
+	Role        string            `json:"role"`     // owner or participant
+	Audio       bool              `json:"audio"`
+	Video       bool              `json:"video"`
+	ScreenShare bool              `json:"screenShare"`
+	HandRaised  bool              `json:"handRaised"`
+	Quality     string            `json:"quality"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// Description is an offer or answer. From is the sender of a peer-to-peer
+// description and empty for the SFU's.
+type Description struct {
+	From string
+	SDP  webrtc.SessionDescription
+	// Tracks of an SFU offer: who publishes each track it carries.
+	Tracks []TrackInfo
+}
+
+// TrackInfo tells who publishes a track the SFU forwards.
+type TrackInfo struct {
+	Username string `json:"username"`
+	TrackID  string `json:"trackId"`
+	StreamID string `json:"streamId"`
+	Kind     string `json:"kind"`
+	Source   string `json:"source"` // camera or screen
+}
+
+// Candidate is a remote ICE candidate. From is empty for the SFU's.
+type Candidate struct {
+	From      string
+	Candidate webrtc.ICECandidateInit
+}
+
+// Error is an "error" message of the server. Code is stable, Message is
+// meant for humans.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "signaling: " + e.Code + ": " + e.Message
+}
+
+// Message is a message of a type the Client has no channel for, such as
+// chat or participant_updated.
+type Message struct {
+	Type string
+	Raw  json.RawMessage // the whole message
+}
+
+// State is the connection state of a Client.
+type State int
+
+const (
+	Connecting State = iota
+	Connected
+	Reconnecting // the connection dropped; the Client dials and rejoins
+	Closed       // for good: Close was called or reconnecting gave up
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// feed is one event channel. It is created by its first subscriber;
+// events nobody subscribed to are dropped.
+type feed[T any] struct {
+	// Senders hold a read lock while they wait for room in ch, so close
+	// cannot close it under them.
+	mu     sync.RWMutex
+	ch     chan T
+	closed bool
+}
+
+// eventBuffer is how many events a channel holds before the Client waits
+// for its subscriber.
+const eventBuffer = 64
+
+func (f *feed[T]) subscribe() <-chan T {
+	f.mu.RLock()
+	ch := f.ch
+	f.mu.RUnlock()
+	if ch != nil {
+		return ch
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ch == nil {
+		f.ch = make(chan T, eventBuffer)
+		if f.closed {
+			close(f.ch)
+		}
+	}
+	return f.ch
+}
+
+// send delivers v unless nobody subscribed, waiting for room in the
+// channel until done is closed.
+func (f *feed[T]) send(v T, done <-chan struct{}) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.ch == nil || f.closed {
+		return
+	}
+	select {
+	case f.ch <- v:
+	case <-done:
+	}
+}
+
+// trySend delivers v if the channel has room.
+func (f *feed[T]) trySend(v T) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.ch == nil || f.closed {
+		return
+	}
+	select {
+	case f.ch <- v:
+	default:
+	}
+}
+
+func (f *feed[T]) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	if f.ch != nil {
+		close(f.ch)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Active speaker detection. Publishers that negotiate the ssrc-audio-level
+// header extension (RFC 6464) tag every audio packet with its loudness; the
+// server smooths those levels per participant and tells the room who is
+// speaking.
+
+const speakerInterval = 200 * time.Millisecond
+
+// silentLevel is what a participant that sends no audio is assumed to have.
+const silentLevel = 127
+
+type speakerLevel struct {
+	sum, count int // samples of the current interval
+	smoothed   float64
+	speaking   bool
+	lastLoud   time.Time
+}
+
+type speakerDetector struct {
+	mu          sync.Mutex
+	levels      map[string]*speakerLevel // key: username
+	active      string
+	activeSince time.Time
+	recent      []string // usernames, most recent speaker first
+}
+
+type speakerEvent struct {
+	Type string
+	Data map[string]interface{}
+}
+
+func newSpeakerDetector() *speakerDetector {
+	return &speakerDetector{levels: make(map[string]*speakerLevel)}
+}
+
+// observe records the audio level of one packet from username.
+func (d *speakerDetector) observe(username string, level uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	l, ok := d.levels[username]
+	if !ok {
+		l = &speakerLevel{smoothed: silentLevel}
+		d.levels[username] = l
+	}
+	l.sum += int(level)
+	l.count++
+}
+
+// remove forgets a participant that left the room.
+func (d *speakerDetector) remove(username string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.levels, username)
+	for i, u := range d.recent {
+		if u == username {
+			d.recent = append(d.recent[:i], d.recent[i+1:]...)
+			break
+		}
+	}
+	if d.active == username {
+		d.active = ""
+	}
+}
+
+// update folds the samples of the last interval into the smoothed levels
+// and returns the events to broadcast.
+func (d *speakerDetector) update(now time.Time) []speakerEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var events []speakerEvent
+	loudest, loudestLevel := "", float64(silentLevel)
+
+	for username, l := range d.levels {
+		sample := float64(silentLevel)
+		if l.count > 0 {
+			sample = float64(l.sum) / float64(l.count)
+		}
+		l.sum, l.count = 0, 0
+		l.smoothed += *speakerSmoothing * (sample - l.smoothed)
+
+		if l.smoothed <= float64(*speakerThreshold) {
+			l.lastLoud = now
+		}
+		speaking := l.speaking
+		switch {
+		case !l.speaking && l.smoothed <= float64(*speakerThreshold):
+			speaking = true
+		case l.speaking && l.smoothed > float64(*speakerThreshold+*speakerHysteresis) && now.Sub(l.lastLoud) >= *speakerHold:
+			speaking = false
+		}
+		if speaking != l.speaking {
+			l.speaking = speaking
+			events = append(events, speakerEvent{Type: "speaking_changed", Data: map[string]interface{}{
+				"username": username,
+				"speaking": speaking,
+				"level":    int(l.smoothed),
+			}})
+			if speaking {
+				d.touch(username)
+			}
+		}
+
+		if l.speaking && l.smoothed < loudestLevel {
+			loudest, loudestLevel = username, l.smoothed
+		}
+	}
+
+	// The active speaker only changes when the current one went quiet or
+	// held the floor for at least speakerHold.
+	current, hasCurrent := d.levels[d.active]
+	if loudest != "" && loudest != d.active &&
+		(!hasCurrent || !current.speaking || now.Sub(d.activeSince) >= *speakerHold) {
+		d.active = loudest
+		d.activeSince = now
+		d.touch(loudest)
+		events = append(events, speakerEvent{Type: "active_speaker", Data: map[string]interface{}{
+			"username": loudest,
+			"level":    int(loudestLevel),
+		}})
+	}
+
+	return events
+}
+
+// touch moves username to the front of the recent speakers. Caller must hold d.mu.
+func (d *speakerDetector) touch(username string) {
+	for i, u := range d.recent {
+		if u == username {
+			d.recent = append(d.recent[:i], d.recent[i+1:]...)
+			break
+		}
+	}
+	d.recent = append([]string{username}, d.recent...)
+}
+
+// activeSpeaker returns the current active speaker, "" if nobody spoke yet.
+func (d *speakerDetector) activeSpeaker() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// recentSpeakers returns usernames ordered by how recently they spoke.
+func (d *speakerDetector) recentSpeakers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.recent...)
+}
+
+// audioLevelExtensionID returns the ID the publisher negotiated for the
+// audio level extension, 0 if it did not.
+func audioLevelExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.AudioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// observeAudioLevel feeds the level of an audio packet into the detector
+// of the publisher's room.
+func (l *trackLayer) observeAudioLevel(pkt *rtp.Packet) {
+	if l.audioLevelID == 0 {
+		return
+	}
+	raw := pkt.GetExtension(l.audioLevelID)
+	if raw == nil {
+		return
+	}
+	var ext rtp.AudioLevelExtension
+	if err := ext.Unmarshal(raw); err != nil {
+		return
+	}
+	l.speakers.observe(l.track.owner.username, ext.Level)
+}
+
+// runSpeakerDetector evaluates the detectors of all rooms and broadcasts
+// their events. The active speaker's video gets priority when bandwidth
+// is short.
+func runSpeakerDetector() {
+	ticker := time.NewTicker(speakerInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, room := range snapshotRooms() {
+			room.mu.Lock()
+			events := room.speakers.update(now)
+			if len(events) == 0 {
+				room.mu.Unlock()
+				continue
+			}
+
+			active := room.speakers.activeSpeaker()
+			for _, t := range room.tracks {
+				if t.kind == webrtc.RTPCodecTypeVideo && t.source != sourceScreen {
+					t.priority = 0
+					if t.owner.username == active {
+						t.priority = 1
+					}
+				}
+			}
+
+			applyLastN(room)
+
+			for _, e := range events {
+				broadcastRoom(room, e.Type, e.Data)
+			}
+			room.mu.Unlock()
+		}
+	}
+}
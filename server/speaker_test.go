@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestSpeakerDetector feeds audio levels into a detector one interval at
+// a time and checks the events of each interval.
+func TestSpeakerDetector(t *testing.T) {
+	defer func(threshold, hysteresis int, smoothing float64, hold time.Duration) {
+		*speakerThreshold, *speakerHysteresis, *speakerSmoothing, *speakerHold = threshold, hysteresis, smoothing, hold
+	}(*speakerThreshold, *speakerHysteresis, *speakerSmoothing, *speakerHold)
+	*speakerThreshold, *speakerHysteresis, *speakerHold = 50, 10, time.Second
+
+	type interval struct {
+		at     time.Duration
+		levels map[string]uint8 // one packet each; who is missing sent none
+		events []string
+	}
+	for _, tc := range []struct {
+		name      string
+		smoothing float64
+		intervals []interval
+		recent    []string
+	}{
+		{
+			name:      "threshold",
+			smoothing: 1,
+			intervals: []interval{
+				{0, map[string]uint8{"alice": 51, "bob": 90}, nil},
+				{200 * time.Millisecond, map[string]uint8{"alice": 50, "bob": 90}, []string{"alice active", "alice speaking"}},
+				{400 * time.Millisecond, map[string]uint8{"alice": 20, "bob": 60}, nil},
+			},
+			recent: []string{"alice"},
+		},
+		{
+			name:      "smoothing",
+			smoothing: 0.5,
+			intervals: []interval{
+				{0, map[string]uint8{"alice": 0}, nil}, // 63
+				{200 * time.Millisecond, map[string]uint8{"alice": 0}, []string{"alice active", "alice speaking"}}, // 31
+				{400 * time.Millisecond, map[string]uint8{"alice": 127}, nil},                                      // 79, held
+			},
+			recent: []string{"alice"},
+		},
+		{
+			name:      "hysteresis and hold",
+			smoothing: 1,
+			intervals: []interval{
+				{0, map[string]uint8{"alice": 40}, []string{"alice active", "alice speaking"}},
+				{200 * time.Millisecond, map[string]uint8{"alice": 60}, nil},  // within the hysteresis
+				{400 * time.Millisecond, map[string]uint8{"alice": 40}, nil},  // loud again
+				{600 * time.Millisecond, map[string]uint8{"alice": 61}, nil},  // held
+				{1200 * time.Millisecond, map[string]uint8{"alice": 61}, nil}, // held since 400ms
+				{1400 * time.Millisecond, map[string]uint8{"alice": 61}, []string{"alice quiet"}},
+				{1600 * time.Millisecond, map[string]uint8{"alice": 55}, nil}, // not loud enough to start
+			},
+			recent: []string{"alice"},
+		},
+		{
+			name:      "louder speaker waits for the hold",
+			smoothing: 1,
+			intervals: []interval{
+				{0, map[string]uint8{"alice": 30}, []string{"alice active", "alice speaking"}},
+				{200 * time.Millisecond, map[string]uint8{"alice": 30, "bob": 20}, []string{"bob speaking"}},
+				{800 * time.Millisecond, map[string]uint8{"alice": 30, "bob": 20}, nil},
+				{time.Second, map[string]uint8{"alice": 30, "bob": 20}, []string{"bob active"}},
+				{1200 * time.Millisecond, map[string]uint8{"alice": 10, "bob": 20}, nil},
+			},
+			recent: []string{"bob", "alice"},
+		},
+		{
+			name:      "quiet speaker hands over",
+			smoothing: 1,
+			intervals: []interval{
+				{0, map[string]uint8{"alice": 30}, []string{"alice active", "alice speaking"}},
+				{200 * time.Millisecond, map[string]uint8{"bob": 40}, []string{"bob speaking"}},
+				{time.Second, map[string]uint8{"bob": 40}, []string{"alice quiet", "bob active"}},
+			},
+			recent: []string{"bob", "alice"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*speakerSmoothing = tc.smoothing
+			d := newSpeakerDetector()
+			start := time.Now()
+			for _, iv := range tc.intervals {
+				for username, level := range iv.levels {
+					d.observe(username, level)
+				}
+				var events []string
+				for _, e := range d.update(start.Add(iv.at)) {
+					username := e.Data["username"].(string)
+					switch {
+					case e.Type == "active_speaker":
+						events = append(events, username+" active")
+					case e.Data["speaking"] == true:
+						events = append(events, username+" speaking")
+					default:
+						events = append(events, username+" quiet")
+					}
+				}
+				sort.Strings(events)
+				if !slices.Equal(events, iv.events) {
+					t.Fatalf("at %v: events %q, want %q", iv.at, events, iv.events)
+				}
+			}
+			if recent := d.recentSpeakers(); !slices.Equal(recent, tc.recent) {
+				t.Errorf("recent speakers %q, want %q", recent, tc.recent)
+			}
+		})
+	}
+}
+
+// TestSpeakerRemove forgets a speaker that left.
+func TestSpeakerRemove(t *testing.T) {
+	defer func(smoothing float64) { *speakerSmoothing = smoothing }(*speakerSmoothing)
+	*speakerSmoothing = 1
+
+	d := newSpeakerDetector()
+	now := time.Now()
+	d.observe("alice", 10)
+	d.observe("bob", 20)
+	d.update(now)
+	d.remove("alice")
+	if active, recent := d.activeSpeaker(), d.recentSpeakers(); active != "" || !slices.Equal(recent, []string{"bob"}) {
+		t.Fatalf("after alice left: active %q, recent %q", active, recent)
+	}
+	// With the active speaker gone, the next one takes over at once.
+	d.observe("bob", 20)
+	events := d.update(now.Add(speakerInterval))
+	if len(events) != 1 || fmt.Sprint(events[0].Type, " ", events[0].Data["username"]) != "active_speaker bob" {
+		t.Errorf("events after alice left: %v", events)
+	}
+}
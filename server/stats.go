@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+type roomStats struct {
+	Name   string       `json:"name"`
+	Peers  []peerStats  `json:"peers"`
+	Tracks []trackStats `json:"tracks"`
+
+	MixListeners int            `json:"mixListeners,omitempty"`
+	Remote       []remoteStats  `json:"remote,omitempty"`
+	Cascades     []cascadeStats `json:"cascades,omitempty"`
+}
+
+// remoteStats is a member connected to another node.
+type remoteStats struct {
+	Username string `json:"username"`
+	Node     string `json:"node"`
+}
+
+// cascadeStats is one direction of a link between this node and another.
+type cascadeStats struct {
+	Node      string `json:"node"`
+	Direction string `json:"direction"` // out: local tracks sent, in: remote tracks received
+	State     string `json:"state"`
+	Tracks    int    `json:"tracks"`
+}
+
+type peerStats struct {
+	Username  string                 `json:"username"`
+	SFU       bool                   `json:"sfu"`
+	Bandwidth *bandwidthState        `json:"bandwidth,omitempty"`
+	BWE       map[string]interface{} `json:"bwe,omitempty"`
+
+	Compress    bool             `json:"compress"` // the server deflates large messages to this peer
+	Compression compressionStats `json:"compression"`
+
+	SDP    *sdpSummary `json:"sdp,omitempty"`    // last description sent to the room
+	SFUSDP *sdpSummary `json:"sfuSdp,omitempty"` // last description sent to the SFU
+
+	Candidates candidateStats `json:"candidates"`
+}
+
+type trackStats struct {
+	ID          string       `json:"id"`
+	Owner       string       `json:"owner"`
+	Kind        string       `json:"kind"`
+	Codec       string       `json:"codec"`
+	Layers      []layerStats `json:"layers"`
+	Subscribers int          `json:"subscribers"`
+	Origin      string       `json:"origin,omitempty"` // node of a cascaded track's publisher
+}
+
+type layerStats struct {
+	RID     string `json:"rid"`
+	Bitrate int    `json:"bitrate"`
+}
+
+// handleStats reports the media state of every room as JSON.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	list := snapshotRooms()
+	stats := make([]roomStats, 0, len(list))
+	for _, room := range list {
+		room.mu.Lock()
+		rs := roomStats{Name: room.name}
+		if room.mixer != nil {
+			rs.MixListeners = room.mixer.Listeners()
+		}
+		for _, p := range room.peers {
+			ps := peerStats{
+				Username:    p.username,
+				SFU:         p.sfu,
+				Compress:    p.compress,
+				Compression: p.counters.stats(),
+				SDP:         p.sdp,
+				SFUSDP:      p.sfuSDP,
+				Candidates:  p.candidates,
+			}
+			if p.sfu {
+				state := p.bandwidthState()
+				ps.Bandwidth = &state
+				if p.bwe != nil {
+					ps.BWE = p.bwe.GetStats()
+				}
+			}
+			rs.Peers = append(rs.Peers, ps)
+		}
+		for _, t := range room.tracks {
+			t.mu.RLock()
+			ts := trackStats{
+				ID:          t.id,
+				Owner:       t.owner.username,
+				Kind:        t.kind.String(),
+				Codec:       t.codec.MimeType,
+				Subscribers: len(t.downTracks),
+				Origin:      t.owner.origin,
+			}
+			for _, l := range t.sortedLayers() {
+				ts.Layers = append(ts.Layers, layerStats{RID: l.rid, Bitrate: l.bitrate.bitrate()})
+			}
+			t.mu.RUnlock()
+			rs.Tracks = append(rs.Tracks, ts)
+		}
+		for username, r := range room.remote {
+			rs.Remote = append(rs.Remote, remoteStats{Username: username, Node: r.node})
+		}
+		for node, link := range room.cascadesOut {
+			rs.Cascades = append(rs.Cascades, cascadeStats{
+				Node:      node,
+				Direction: "out",
+				State:     link.pc.ConnectionState().String(),
+				Tracks:    len(link.downTracks),
+			})
+		}
+		for node, in := range room.cascadesIn {
+			cs := cascadeStats{Node: node, Direction: "in", State: in.link.pc.ConnectionState().String()}
+			for _, t := range room.tracks {
+				if t.owner.origin == node {
+					cs.Tracks++
+				}
+			}
+			rs.Cascades = append(rs.Cascades, cs)
+		}
+		sort.Slice(rs.Remote, func(i, j int) bool { return rs.Remote[i].Username < rs.Remote[j].Username })
+		sort.Slice(rs.Cascades, func(i, j int) bool {
+			if rs.Cascades[i].Node != rs.Cascades[j].Node {
+				return rs.Cascades[i].Node < rs.Cascades[j].Node
+			}
+			return rs.Cascades[i].Direction < rs.Cascades[j].Direction
+		})
+		sort.Slice(rs.Peers, func(i, j int) bool { return rs.Peers[i].Username < rs.Peers[j].Username })
+		sort.Slice(rs.Tracks, func(i, j int) bool { return rs.Tracks[i].ID < rs.Tracks[j].ID })
+		room.mu.Unlock()
+		stats = append(stats, rs)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node":  *nodeID,
+		"nodes": ring.Nodes(),
+		"rooms": stats,
+
+		"compression": signalingCounters.stats(),
+	})
+}
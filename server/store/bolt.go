@@ -0,0 +1,283 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt is a RoomStore kept in a single bbolt database file. Every room has
+// a bucket holding one nested bucket per kind of state.
+type Bolt struct {
+	db *bolt.DB
+}
+
+var (
+	settingsKey      = []byte("settings")
+	bansBucket       = []byte("bans")
+	chatBucket       = []byte("chat") // key: big-endian sequence, so cursor order is append order
+	recordingsBucket = []byte("recordings")
+)
+
+// OpenBolt opens or creates the database at path.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+// roomBucket returns the nested bucket name of room, creating it in a
+// writable transaction. In a read-only one it returns nil when missing.
+func roomBucket(tx *bolt.Tx, room, name []byte) (*bolt.Bucket, error) {
+	if !tx.Writable() {
+		r := tx.Bucket(room)
+		if r == nil {
+			return nil, nil
+		}
+		return r.Bucket(name), nil
+	}
+	r, err := tx.CreateBucketIfNotExists(room)
+	if err != nil {
+		return nil, err
+	}
+	return r.CreateBucketIfNotExists(name)
+}
+
+// roomKey names the bucket of room. The prefix makes the empty room name,
+// which bbolt refuses as a key, usable.
+func roomKey(room string) []byte {
+	return []byte("room:" + room)
+}
+
+func (s *Bolt) Settings(room string) (settings RoomSettings, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		r := tx.Bucket(roomKey(room))
+		if r == nil {
+			return nil
+		}
+		v := r.Get(settingsKey)
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &settings)
+	})
+	return settings, ok, err
+}
+
+func (s *Bolt) SaveSettings(room string, settings RoomSettings) error {
+	v, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateBucketIfNotExists(roomKey(room))
+		if err != nil {
+			return err
+		}
+		return r.Put(settingsKey, v)
+	})
+}
+
+func (s *Bolt) Ban(room string, b Ban) error {
+	v, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bans, err := roomBucket(tx, roomKey(room), bansBucket)
+		if err != nil {
+			return err
+		}
+		return bans.Put([]byte(b.Username), v)
+	})
+}
+
+func (s *Bolt) Unban(room, username string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		r := tx.Bucket(roomKey(room))
+		if r == nil || r.Bucket(bansBucket) == nil {
+			return nil
+		}
+		return r.Bucket(bansBucket).Delete([]byte(username))
+	})
+}
+
+func (s *Bolt) Bans(room string) ([]Ban, error) {
+	bans := []Ban{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, _ := roomBucket(tx, roomKey(room), bansBucket)
+		if b == nil {
+			return nil
+		}
+		// Keys are usernames, so the cursor already yields them in order.
+		return b.ForEach(func(_, v []byte) error {
+			var ban Ban
+			if err := json.Unmarshal(v, &ban); err != nil {
+				return err
+			}
+			bans = append(bans, ban)
+			return nil
+		})
+	})
+	return bans, err
+}
+
+// AppendChat and UpdateChat run once per chat message and acknowledgement,
+// from many rooms at a time. They are batched, so concurrent writes share
+// one transaction and one sync to disk instead of queuing for the
+// database's writer in turn. A batched function may run more than once.
+
+func (s *Bolt) AppendChat(room string, m ChatMessage, limit int) error {
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		chat, err := roomBucket(tx, roomKey(room), chatBucket)
+		if err != nil {
+			return err
+		}
+		seq, err := chat.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := chat.Put(sequenceKey(seq), v); err != nil {
+			return err
+		}
+		if limit <= 0 {
+			return nil
+		}
+		n := 0
+		c := chat.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			n++
+		}
+		for k, _ := c.First(); k != nil && n > limit; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+}
+
+func (s *Bolt) UpdateChat(room string, m ChatMessage) error {
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		r := tx.Bucket(roomKey(room))
+		if r == nil || r.Bucket(chatBucket) == nil {
+			return ErrNotFound
+		}
+		chat := r.Bucket(chatBucket)
+		c := chat.Cursor()
+		// History is short, so a scan is cheaper than keeping an index.
+		for k, old := c.Last(); k != nil; k, old = c.Prev() {
+			var existing struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(old, &existing); err != nil {
+				return err
+			}
+			if existing.ID == m.ID {
+				return chat.Put(k, v)
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+func (s *Bolt) ChatHistory(room string) ([]ChatMessage, error) {
+	history := []ChatMessage{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		chat, _ := roomBucket(tx, roomKey(room), chatBucket)
+		if chat == nil {
+			return nil
+		}
+		return chat.ForEach(func(_, v []byte) error {
+			var m ChatMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			history = append(history, m)
+			return nil
+		})
+	})
+	return history, err
+}
+
+func (s *Bolt) ClearChat(room string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		r := tx.Bucket(roomKey(room))
+		if r == nil {
+			return nil
+		}
+		err := r.DeleteBucket(chatBucket)
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *Bolt) SaveRecording(rec Recording) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		recordings, err := roomBucket(tx, roomKey(rec.Room), recordingsBucket)
+		if err != nil {
+			return err
+		}
+		return recordings.Put([]byte(rec.ID), v)
+	})
+}
+
+func (s *Bolt) Recordings(room string) ([]Recording, error) {
+	recordings := []Recording{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, _ := roomBucket(tx, roomKey(room), recordingsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var rec Recording
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			recordings = append(recordings, rec)
+			return nil
+		})
+	})
+	sortRecordings(recordings)
+	return recordings, err
+}
+
+func (s *Bolt) DeleteRoom(room string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(roomKey(room))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
+
+func sequenceKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
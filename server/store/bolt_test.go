@@ -0,0 +1,113 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"server/store"
+	"server/store/storetest"
+)
+
+func openBolt(t *testing.T, path string) *store.Bolt {
+	t.Helper()
+	s, err := store.OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBolt(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.RoomStore {
+		return openBolt(t, filepath.Join(t.TempDir(), "rooms.db"))
+	})
+}
+
+func TestBoltSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+
+	s := openBolt(t, path)
+	settings := store.RoomSettings{LastN: 3, MaxPresenters: 1, PresenterLock: true}
+	if err := s.SaveSettings("lobby", settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ban("lobby", store.Ban{Username: "mallory"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendChat("lobby", store.ChatMessage{ID: "a", From: "alice", Text: "hi"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openBolt(t, path)
+	defer s.Close()
+	if got, ok, err := s.Settings("lobby"); err != nil || !ok || got != settings {
+		t.Fatalf("Settings after reopen = %+v, %v, %v", got, ok, err)
+	}
+	if bans, err := s.Bans("lobby"); err != nil || len(bans) != 1 {
+		t.Fatalf("Bans after reopen = %+v, %v", bans, err)
+	}
+	if history, err := s.ChatHistory("lobby"); err != nil || len(history) != 1 || history[0].Text != "hi" {
+		t.Fatalf("ChatHistory after reopen = %+v, %v", history, err)
+	}
+	// Sequence numbers continue, so new messages still sort last.
+	if err := s.AppendChat("lobby", store.ChatMessage{ID: "b", From: "bob", Text: "hello"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := s.ChatHistory("lobby"); len(history) != 2 || history[1].ID != "b" {
+		t.Fatalf("ChatHistory after append = %+v", history)
+	}
+}
+
+// TestBoltConcurrentChat appends to the chat of several rooms at once, so
+// the appends are batched, with a failing update among them.
+func TestBoltConcurrentChat(t *testing.T) {
+	s := openBolt(t, filepath.Join(t.TempDir(), "rooms.db"))
+	defer s.Close()
+
+	const rooms, messages = 8, 20
+	var wg sync.WaitGroup
+	for r := 0; r < rooms; r++ {
+		wg.Add(1)
+		go func(room string) {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				m := store.ChatMessage{ID: fmt.Sprint(i), From: "alice", Text: "hi"}
+				if err := s.AppendChat(room, m, messages/2); err != nil {
+					t.Error(err)
+					return
+				}
+				m.ReadBy = []string{"bob"}
+				if err := s.UpdateChat(room, m); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.UpdateChat(room, store.ChatMessage{ID: "missing"}); !errors.Is(err, store.ErrNotFound) {
+					t.Errorf("UpdateChat of a missing message = %v; want ErrNotFound", err)
+					return
+				}
+			}
+		}(fmt.Sprint("room-", r))
+	}
+	wg.Wait()
+
+	for r := 0; r < rooms; r++ {
+		history, err := s.ChatHistory(fmt.Sprint("room-", r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != messages/2 {
+			t.Fatalf("room %d keeps %d messages, want %d", r, len(history), messages/2)
+		}
+		for i, m := range history {
+			if want := fmt.Sprint(messages/2 + i); m.ID != want || len(m.ReadBy) != 1 {
+				t.Fatalf("room %d message %d is %+v, want ID %s read by bob", r, i, m, want)
+			}
+		}
+	}
+}
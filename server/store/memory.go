@@ -0,0 +1,194 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// Memory is a RoomStore that forgets everything on restart.
+type Memory struct {
+	mu    sync.Mutex
+	rooms map[string]*memoryRoom
+}
+
+type memoryRoom struct {
+	settings   *RoomSettings
+	bans       map[string]Ban
+	chat       []ChatMessage
+	recordings map[string]Recording
+}
+
+// NewMemory returns an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{rooms: make(map[string]*memoryRoom)}
+}
+
+// room returns the state of name, creating it. Caller must hold s.mu.
+func (s *Memory) room(name string) *memoryRoom {
+	r, ok := s.rooms[name]
+	if !ok {
+		r = &memoryRoom{
+			bans:       make(map[string]Ban),
+			recordings: make(map[string]Recording),
+		}
+		s.rooms[name] = r
+	}
+	return r
+}
+
+func (s *Memory) Settings(room string) (RoomSettings, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[room]
+	if !ok || r.settings == nil {
+		return RoomSettings{}, false, nil
+	}
+	return *r.settings, true, nil
+}
+
+func (s *Memory) SaveSettings(room string, settings RoomSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.room(room).settings = &settings
+	return nil
+}
+
+func (s *Memory) Ban(room string, b Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.room(room).bans[b.Username] = b
+	return nil
+}
+
+func (s *Memory) Unban(room, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.rooms[room]; ok {
+		delete(r.bans, username)
+	}
+	return nil
+}
+
+func (s *Memory) Bans(room string) ([]Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bans := []Ban{}
+	if r, ok := s.rooms[room]; ok {
+		for _, b := range r.bans {
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Username < bans[j].Username })
+	return bans, nil
+}
+
+func (s *Memory) AppendChat(room string, m ChatMessage, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.room(room)
+	r.chat = append(r.chat, cloneChat(m))
+	if over := len(r.chat) - limit; limit > 0 && over > 0 {
+		r.chat = append([]ChatMessage(nil), r.chat[over:]...)
+	}
+	return nil
+}
+
+func (s *Memory) UpdateChat(room string, m ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.rooms[room]; ok {
+		for i := range r.chat {
+			if r.chat[i].ID == m.ID {
+				r.chat[i] = cloneChat(m)
+				return nil
+			}
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *Memory) ChatHistory(room string) ([]ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := []ChatMessage{}
+	if r, ok := s.rooms[room]; ok {
+		for _, m := range r.chat {
+			history = append(history, cloneChat(m))
+		}
+	}
+	return history, nil
+}
+
+func (s *Memory) ClearChat(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[room]
+	if !ok {
+		return nil
+	}
+	r.chat = nil
+	if r.settings == nil && len(r.bans) == 0 && len(r.recordings) == 0 {
+		delete(s.rooms, room)
+	}
+	return nil
+}
+
+func (s *Memory) SaveRecording(rec Recording) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec.Participants = append([]string(nil), rec.Participants...)
+	s.room(rec.Room).recordings[rec.ID] = rec
+	return nil
+}
+
+func (s *Memory) Recordings(room string) ([]Recording, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recordings := []Recording{}
+	if r, ok := s.rooms[room]; ok {
+		for _, rec := range r.recordings {
+			rec.Participants = append([]string(nil), rec.Participants...)
+			recordings = append(recordings, rec)
+		}
+	}
+	sortRecordings(recordings)
+	return recordings, nil
+}
+
+func (s *Memory) DeleteRoom(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rooms, room)
+	return nil
+}
+
+func (s *Memory) Close() error {
+	return nil
+}
+
+func cloneChat(m ChatMessage) ChatMessage {
+	m.DeliveredTo = append([]string(nil), m.DeliveredTo...)
+	m.ReadBy = append([]string(nil), m.ReadBy...)
+	return m
+}
+
+func sortRecordings(recordings []Recording) {
+	sort.Slice(recordings, func(i, j int) bool {
+		if recordings[i].StartedAt != recordings[j].StartedAt {
+			return recordings[i].StartedAt < recordings[j].StartedAt
+		}
+		return recordings[i].ID < recordings[j].ID
+	})
+}
@@ -0,0 +1,14 @@
+package store_test
+
+import (
+	"testing"
+
+	"server/store"
+	"server/store/storetest"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.RoomStore {
+		return store.NewMemory()
+	})
+}
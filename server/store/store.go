@@ -0,0 +1,111 @@
+// Package store keeps the state of rooms that must survive a restart:
+// settings, bans, chat history and recording metadata. Live state such as
+// connections and media stays in the server's memory.
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned when a chat message or recording to update does
+// not exist.
+var ErrNotFound = errors.New("store: not found")
+
+// RoomSettings are the options a room owner may change.
+type RoomSettings struct {
+	LastN         int   `json:"lastN"`
+	MaxPresenters int   `json:"maxPresenters"`
+	PresenterLock bool  `json:"presenterLock"`
+	RelayOnly     *bool `json:"relayOnly,omitempty"` // only relay candidates reach other participants; nil keeps the server's default
+}
+
+// Ban keeps a username out of a room until Until (unix milliseconds, 0 for
+// ever).
+type Ban struct {
+	Username  string `json:"username"`
+	By        string `json:"by"`
+	Reason    string `json:"reason,omitempty"`
+	Timestamp int64  `json:"ts"`
+	Until     int64  `json:"until,omitempty"`
+}
+
+// Active reports whether b still applies at now (unix milliseconds).
+func (b Ban) Active(now int64) bool {
+	return b.Until == 0 || now < b.Until
+}
+
+// ChatMessage is one message of a room's chat.
+type ChatMessage struct {
+	ID          string   `json:"id"`
+	ClientID    string   `json:"clientId,omitempty"` // lets the author match the echo to its pending message
+	From        string   `json:"from"`
+	Text        string   `json:"text"`
+	Timestamp   int64    `json:"ts"`               // unix milliseconds
+	Edited      int64    `json:"edited,omitempty"` // unix milliseconds of the last edit
+	Deleted     bool     `json:"deleted,omitempty"`
+	DeliveredTo []string `json:"deliveredTo,omitempty"`
+	ReadBy      []string `json:"readBy,omitempty"`
+}
+
+// Recording describes a recording of a room; the media itself lives
+// elsewhere.
+type Recording struct {
+	ID           string   `json:"id"`
+	Room         string   `json:"room"`
+	StartedAt    int64    `json:"startedAt"`         // unix milliseconds
+	EndedAt      int64    `json:"endedAt,omitempty"` // 0 while recording
+	Location     string   `json:"location"`          // file path or URL of the media
+	Size         int64    `json:"size,omitempty"`
+	Participants []string `json:"participants,omitempty"`
+}
+
+// RoomStore persists room state. Implementations are safe for concurrent
+// use. Slices returned are copies the caller may keep.
+type RoomStore interface {
+	// Settings returns the saved settings of room; ok is false if none were saved.
+	Settings(room string) (s RoomSettings, ok bool, err error)
+	SaveSettings(room string, s RoomSettings) error
+
+	// Ban adds or replaces the ban of b.Username in room.
+	Ban(room string, b Ban) error
+	// Unban lifts a ban; lifting a missing ban is not an error.
+	Unban(room, username string) error
+	// Bans lists the bans of room ordered by username.
+	Bans(room string) ([]Ban, error)
+
+	// AppendChat adds m to the chat of room, keeping only the newest limit
+	// messages (all of them when limit <= 0).
+	AppendChat(room string, m ChatMessage, limit int) error
+	// UpdateChat replaces the message with m.ID, or returns ErrNotFound.
+	UpdateChat(room string, m ChatMessage) error
+	// ChatHistory returns the chat of room, oldest first.
+	ChatHistory(room string) ([]ChatMessage, error)
+	// ClearChat forgets the chat of room.
+	ClearChat(room string) error
+
+	// SaveRecording adds or replaces a recording, keyed by r.Room and r.ID.
+	// Nothing in the server records yet; this is for recorders to come.
+	SaveRecording(r Recording) error
+	// Recordings lists the recordings of room ordered by start time.
+	Recordings(room string) ([]Recording, error)
+
+	// DeleteRoom forgets everything about room. The server never calls it:
+	// bans and settings outlive the members of a room. It is for tools
+	// administering a store.
+	DeleteRoom(room string) error
+
+	Close() error
+}
+
+// Open returns the store of the given kind: "memory", or "bolt" with the
+// database file at path.
+func Open(kind, path string) (RoomStore, error) {
+	switch kind {
+	case "memory":
+		return NewMemory(), nil
+	case "bolt":
+		return OpenBolt(path)
+	}
+	return nil, fmt.Errorf("store: unknown kind %q", kind)
+}
@@ -0,0 +1,277 @@
+// Package storetest is a conformance suite every store.RoomStore
+// implementation must pass.
+package storetest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"server/store"
+)
+
+// Run runs the suite against stores created by open, one per subtest.
+func Run(t *testing.T, open func(t *testing.T) store.RoomStore) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, store.RoomStore)
+	}{
+		{"Settings", testSettings},
+		{"Bans", testBans},
+		{"ChatHistory", testChatHistory},
+		{"ChatLimit", testChatLimit},
+		{"UpdateChat", testUpdateChat},
+		{"ClearChat", testClearChat},
+		{"Recordings", testRecordings},
+		{"RoomsAreIsolated", testRoomsAreIsolated},
+		{"DeleteRoom", testDeleteRoom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := open(t)
+			t.Cleanup(func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close: %v", err)
+				}
+			})
+			tt.fn(t, s)
+		})
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testSettings(t *testing.T, s store.RoomStore) {
+	if _, ok, err := s.Settings("lobby"); err != nil || ok {
+		t.Fatalf("Settings of a new room = ok %v, err %v; want nothing", ok, err)
+	}
+	relayOnly := true
+	want := store.RoomSettings{LastN: 4, MaxPresenters: 2, PresenterLock: true, RelayOnly: &relayOnly}
+	must(t, s.SaveSettings("lobby", want))
+	got, ok, err := s.Settings("lobby")
+	must(t, err)
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Settings = %+v, %v; want %+v", got, ok, want)
+	}
+
+	// A setting left unset stays unset.
+	want.LastN = 0
+	want.RelayOnly = nil
+	must(t, s.SaveSettings("lobby", want))
+	if got, _, _ := s.Settings("lobby"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Settings after overwrite = %+v; want %+v", got, want)
+	}
+}
+
+func testBans(t *testing.T, s store.RoomStore) {
+	bans, err := s.Bans("lobby")
+	must(t, err)
+	if len(bans) != 0 {
+		t.Fatalf("Bans of a new room = %v", bans)
+	}
+
+	must(t, s.Ban("lobby", store.Ban{Username: "mallory", By: "alice", Reason: "spam", Timestamp: 1}))
+	must(t, s.Ban("lobby", store.Ban{Username: "eve", By: "alice", Timestamp: 2, Until: 100}))
+	must(t, s.Ban("lobby", store.Ban{Username: "mallory", By: "bob", Timestamp: 3}))
+
+	bans, err = s.Bans("lobby")
+	must(t, err)
+	want := []store.Ban{
+		{Username: "eve", By: "alice", Timestamp: 2, Until: 100},
+		{Username: "mallory", By: "bob", Timestamp: 3},
+	}
+	if !reflect.DeepEqual(bans, want) {
+		t.Fatalf("Bans = %+v; want %+v", bans, want)
+	}
+
+	must(t, s.Unban("lobby", "eve"))
+	must(t, s.Unban("lobby", "nobody"))
+	must(t, s.Unban("elsewhere", "nobody"))
+	bans, err = s.Bans("lobby")
+	must(t, err)
+	if len(bans) != 1 || bans[0].Username != "mallory" {
+		t.Fatalf("Bans after Unban = %+v", bans)
+	}
+}
+
+func chat(id, text string) store.ChatMessage {
+	return store.ChatMessage{ID: id, From: "alice", Text: text, Timestamp: int64(len(id))}
+}
+
+func ids(history []store.ChatMessage) []string {
+	out := make([]string, len(history))
+	for i, m := range history {
+		out[i] = m.ID
+	}
+	return out
+}
+
+func testChatHistory(t *testing.T, s store.RoomStore) {
+	history, err := s.ChatHistory("lobby")
+	must(t, err)
+	if len(history) != 0 {
+		t.Fatalf("ChatHistory of a new room = %v", history)
+	}
+
+	msgs := []store.ChatMessage{chat("a", "one"), chat("b", "two"), chat("c", "three")}
+	msgs[1].ClientID = "tmp-1"
+	msgs[1].DeliveredTo = []string{"bob"}
+	for _, m := range msgs {
+		must(t, s.AppendChat("lobby", m, 0))
+	}
+	history, err = s.ChatHistory("lobby")
+	must(t, err)
+	if !reflect.DeepEqual(history, msgs) {
+		t.Fatalf("ChatHistory = %+v; want %+v", history, msgs)
+	}
+
+	// The returned history belongs to the caller.
+	history[1].DeliveredTo[0] = "changed"
+	again, err := s.ChatHistory("lobby")
+	must(t, err)
+	if again[1].DeliveredTo[0] != "bob" {
+		t.Fatal("ChatHistory shares memory with the store")
+	}
+}
+
+func testChatLimit(t *testing.T, s store.RoomStore) {
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		must(t, s.AppendChat("lobby", chat(id, id), 3))
+	}
+	history, err := s.ChatHistory("lobby")
+	must(t, err)
+	if got, want := ids(history), []string{"c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ChatHistory = %v; want %v", got, want)
+	}
+
+	must(t, s.AppendChat("lobby", chat("f", "f"), 1))
+	history, err = s.ChatHistory("lobby")
+	must(t, err)
+	if got, want := ids(history), []string{"f"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ChatHistory after shrinking the limit = %v; want %v", got, want)
+	}
+}
+
+func testUpdateChat(t *testing.T, s store.RoomStore) {
+	for _, id := range []string{"a", "b", "c"} {
+		must(t, s.AppendChat("lobby", chat(id, id), 0))
+	}
+	edited := chat("b", "edited")
+	edited.Edited = 42
+	edited.ReadBy = []string{"bob", "carol"}
+	must(t, s.UpdateChat("lobby", edited))
+
+	history, err := s.ChatHistory("lobby")
+	must(t, err)
+	if got, want := ids(history), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("UpdateChat reordered history: %v", got)
+	}
+	if !reflect.DeepEqual(history[1], edited) {
+		t.Fatalf("updated message = %+v; want %+v", history[1], edited)
+	}
+
+	if err := s.UpdateChat("lobby", chat("zzz", "x")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("UpdateChat of a missing message = %v; want ErrNotFound", err)
+	}
+	if err := s.UpdateChat("elsewhere", chat("a", "x")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("UpdateChat in a missing room = %v; want ErrNotFound", err)
+	}
+}
+
+func testClearChat(t *testing.T, s store.RoomStore) {
+	must(t, s.SaveSettings("lobby", store.RoomSettings{LastN: 1}))
+	must(t, s.AppendChat("lobby", chat("a", "hi"), 0))
+	must(t, s.AppendChat("other", chat("b", "hi"), 0))
+
+	must(t, s.ClearChat("lobby"))
+	must(t, s.ClearChat("lobby"))
+	must(t, s.ClearChat("never-existed"))
+	if history, _ := s.ChatHistory("lobby"); len(history) != 0 {
+		t.Errorf("chat survived ClearChat: %+v", history)
+	}
+	if _, ok, _ := s.Settings("lobby"); !ok {
+		t.Error("ClearChat removed settings")
+	}
+	if history, _ := s.ChatHistory("other"); len(history) != 1 {
+		t.Error("ClearChat removed another room's chat")
+	}
+
+	// The chat starts over.
+	must(t, s.AppendChat("lobby", chat("c", "again"), 0))
+	if history, _ := s.ChatHistory("lobby"); !reflect.DeepEqual(ids(history), []string{"c"}) {
+		t.Errorf("ChatHistory after ClearChat = %v", ids(history))
+	}
+}
+
+func testRecordings(t *testing.T, s store.RoomStore) {
+	late := store.Recording{ID: "r2", Room: "lobby", StartedAt: 200, Location: "/rec/r2.webm"}
+	early := store.Recording{ID: "r1", Room: "lobby", StartedAt: 100, Location: "/rec/r1.webm", Participants: []string{"alice"}}
+	must(t, s.SaveRecording(late))
+	must(t, s.SaveRecording(early))
+
+	early.EndedAt = 150
+	early.Size = 1 << 20
+	must(t, s.SaveRecording(early))
+
+	recordings, err := s.Recordings("lobby")
+	must(t, err)
+	if want := []store.Recording{early, late}; !reflect.DeepEqual(recordings, want) {
+		t.Fatalf("Recordings = %+v; want %+v", recordings, want)
+	}
+}
+
+func testRoomsAreIsolated(t *testing.T, s store.RoomStore) {
+	must(t, s.SaveSettings("a", store.RoomSettings{LastN: 1}))
+	must(t, s.Ban("a", store.Ban{Username: "mallory"}))
+	must(t, s.AppendChat("a", chat("m", "hi"), 0))
+	must(t, s.SaveRecording(store.Recording{ID: "r", Room: "a"}))
+
+	if _, ok, _ := s.Settings("b"); ok {
+		t.Error("settings leaked into another room")
+	}
+	if bans, _ := s.Bans("b"); len(bans) != 0 {
+		t.Error("bans leaked into another room")
+	}
+	if history, _ := s.ChatHistory("b"); len(history) != 0 {
+		t.Error("chat leaked into another room")
+	}
+	if recordings, _ := s.Recordings("b"); len(recordings) != 0 {
+		t.Error("recordings leaked into another room")
+	}
+	// The empty room name is a room like any other.
+	if history, _ := s.ChatHistory(""); len(history) != 0 {
+		t.Error("chat leaked into the empty room name")
+	}
+}
+
+func testDeleteRoom(t *testing.T, s store.RoomStore) {
+	must(t, s.SaveSettings("a", store.RoomSettings{LastN: 1}))
+	must(t, s.Ban("a", store.Ban{Username: "mallory"}))
+	must(t, s.AppendChat("a", chat("m", "hi"), 0))
+	must(t, s.SaveRecording(store.Recording{ID: "r", Room: "a"}))
+	must(t, s.SaveSettings("b", store.RoomSettings{LastN: 2}))
+
+	must(t, s.DeleteRoom("a"))
+	must(t, s.DeleteRoom("never-existed"))
+
+	if _, ok, _ := s.Settings("a"); ok {
+		t.Error("settings survived DeleteRoom")
+	}
+	if bans, _ := s.Bans("a"); len(bans) != 0 {
+		t.Error("bans survived DeleteRoom")
+	}
+	if history, _ := s.ChatHistory("a"); len(history) != 0 {
+		t.Error("chat survived DeleteRoom")
+	}
+	if recordings, _ := s.Recordings("a"); len(recordings) != 0 {
+		t.Error("recordings survived DeleteRoom")
+	}
+	if _, ok, _ := s.Settings("b"); !ok {
+		t.Error("DeleteRoom removed another room")
+	}
+}